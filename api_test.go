@@ -148,6 +148,15 @@ func TestDeletePayment(t *testing.T) {
 type testResponseWriter struct {
 	http.ResponseWriter
 	result string
+	header http.Header
+	status int
+}
+
+func (w *testResponseWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
 }
 
 func (trw *testResponseWriter) EncodeJson(v interface{}) ([]byte, error) {
@@ -171,17 +180,16 @@ func (trw *testResponseWriter) WriteJson(v interface{}) error {
 }
 
 func (w *testResponseWriter) Write(b []byte) (int, error) {
-	w.result = string(b)
-	return len(w.result), nil
+	w.result += string(b)
+	return len(b), nil
 }
 
 func (w *testResponseWriter) Read() []byte {
 	return []byte(w.result)
 }
 
-func (w *testResponseWriter) WriteHeader(int) {
-	// this method is currently not used for testing, and only exists to implement rest.ResponseWriter
-	return
+func (w *testResponseWriter) WriteHeader(code int) {
+	w.status = code
 }
 
 func createRestRequest(method string, urlStr string, body io.Reader, params map[string]string) *rest.Request {
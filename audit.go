@@ -0,0 +1,369 @@
+package f3api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Kinds of audited changes
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// A change of a single field, which is named by its dotted JSON path (see the CSV column layout)
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// A record of a payment being created, updated or deleted
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Who made the change, see ActorFromContext
+	Actor          string `json:"actor"`
+	RequestID      string `json:"request_id,omitempty"`
+	OrganisationID string `json:"organisation_id"`
+	PaymentID      string `json:"payment_id"`
+	// Versions before and after the change; no old version for creations, no new one for deletions
+	OldVersion *int          `json:"old_version"`
+	NewVersion *int          `json:"new_version"`
+	Changes    []FieldChange `json:"changes"`
+}
+
+// Destination of audit events
+type AuditSink interface {
+	WriteAudit(context.Context, AuditEvent) error
+}
+
+// Writes audit events to an io.Writer as JSON, one event per line
+type JSONAuditSink struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// Creates an audit sink writing JSON lines to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	sink := JSONAuditSink{
+		enc: json.NewEncoder(w),
+	}
+	return &sink
+}
+
+// Creates an audit sink appending JSON lines to the file at path, creating the file if needed
+func OpenAuditFile(path string) (*JSONAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := NewJSONAuditSink(f)
+	sink.closer = f
+	return sink, nil
+}
+
+// Writes an event as a single line of JSON
+func (s *JSONAuditSink) WriteAudit(ctx context.Context, e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(&e)
+}
+
+// Closes the underlying file, if the sink was created by OpenAuditFile
+func (s *JSONAuditSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// Keeps audit events in memory, for tests and demonstrations
+type MemoryAuditSink struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+// Records an event in memory
+func (s *MemoryAuditSink) WriteAudit(ctx context.Context, e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, e)
+	return nil
+}
+
+// Returns a copy of all events recorded so far, oldest first
+func (s *MemoryAuditSink) Events() []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]AuditEvent{}, s.events...)
+}
+
+// Writes audit events as rows of a table, through database/sql
+// The table has a column per field of an AuditEvent, with the changes encoded as JSON. Statements
+// use "?" placeholders, as SQLite (whose "sqlite3" driver this package registers) and MySQL do.
+type SQLAuditSink struct {
+	db     *sql.DB
+	insert string
+}
+
+// Table names accepted by NewSQLAuditSink, which writes them into its statements as they are
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Creates an audit sink inserting events into the given table of db, creating the table if needed
+// The database is left to the caller to close.
+func NewSQLAuditSink(ctx context.Context, db *sql.DB, table string) (*SQLAuditSink, error) {
+	if !sqlIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("audit: invalid table name %q", table)
+	}
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+table+` (
+		time            TIMESTAMP    NOT NULL,
+		action          VARCHAR(16)  NOT NULL,
+		actor           VARCHAR(255) NOT NULL,
+		request_id      VARCHAR(255) NOT NULL,
+		organisation_id VARCHAR(255) NOT NULL,
+		payment_id      VARCHAR(255) NOT NULL,
+		old_version     INTEGER,
+		new_version     INTEGER,
+		changes         TEXT         NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("audit: creating table %s: %w", table, err)
+	}
+
+	sink := SQLAuditSink{
+		db: db,
+		insert: `INSERT INTO ` + table + ` (time, action, actor, request_id, organisation_id, payment_id, old_version, new_version, changes)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	}
+	return &sink, nil
+}
+
+// Inserts an event as a row
+// The row is inserted even if ctx is done, as the change it records has been made by then.
+func (s *SQLAuditSink) WriteAudit(ctx context.Context, e AuditEvent) error {
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(context.WithoutCancel(ctx), s.insert, e.Time.UTC(), e.Action, e.Actor, e.RequestID,
+		e.OrganisationID, e.PaymentID, e.OldVersion, e.NewVersion, string(changes))
+	return err
+}
+
+// Lists the fields which differ between two payments, in the order of the CSV column layout
+// A nil payment stands for one that doesn't exist, and has no fields at all.
+func diffPayments(old, new *Payment) []FieldChange {
+	senderCharges := 0
+	for _, p := range []*Payment{old, new} {
+		if p != nil && len(p.Attributes.ChargesInformation.SenderCharges) > senderCharges {
+			senderCharges = len(p.Attributes.ChargesInformation.SenderCharges)
+		}
+	}
+
+	changes := []FieldChange{}
+	for _, c := range paymentCSVColumns(senderCharges) {
+		var change FieldChange
+		if old != nil {
+			change.Old, _ = c.get(old)
+		}
+		if new != nil {
+			change.New, _ = c.get(new)
+		}
+		if change.Old != change.New {
+			change.Field = c.name
+			changes = append(changes, change)
+		}
+	}
+
+	return changes
+}
+
+// Builds the audit event of a change from old to new (either of which may be nil)
+func newAuditEvent(ctx context.Context, action string, old, new *Payment) AuditEvent {
+	e := AuditEvent{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Actor:     ActorFromContext(ctx),
+		RequestID: RequestIDFromContext(ctx),
+		Changes:   diffPayments(old, new),
+	}
+
+	for _, p := range []*Payment{old, new} {
+		if p != nil {
+			e.OrganisationID = p.OrganisationID
+			e.PaymentID = p.ID
+		}
+	}
+	if old != nil {
+		e.OldVersion = &old.Version
+	}
+	if new != nil {
+		e.NewVersion = &new.Version
+	}
+
+	return e
+}
+
+// ContextStore decorator recording every successful write in an audit sink
+type auditedStore struct {
+	storeDecorator
+	sink AuditSink
+}
+
+// Wraps a store to record every payment it creates, updates or deletes in sink, with the actor and
+// request ID taken from the context of the call. The previous state of a payment is read in the same
+// transaction as its change, to compute the field-level diff. Failures to write to the sink don't fail the
+// (already applied) change, but are logged through slog.
+// The returned store implements both ApiStore and ContextStore.
+func AuditStore(store ApiStore, sink AuditSink) ApiStore {
+	return ApiStoreOf(&auditedStore{storeDecorator{ContextStoreOf(store)}, sink})
+}
+
+// Records a change in the sink
+func (s *auditedStore) audit(ctx context.Context, action string, old, new *Payment) {
+	e := newAuditEvent(ctx, action, old, new)
+	if err := s.sink.WriteAudit(ctx, e); err != nil {
+		slog.ErrorContext(ctx, "audit event lost", "error", err, "action", action, "payment_id", e.PaymentID)
+	}
+}
+
+func (s *auditedStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	if err := s.store.AddPaymentContext(ctx, p); err != nil {
+		return err
+	}
+	s.audit(ctx, AuditCreate, nil, &p)
+	return nil
+}
+
+func (s *auditedStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	return s.write(ctx, BatchOp{BatchUpdate, p})
+}
+
+func (s *auditedStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	return s.write(ctx, BatchOp{BatchStore, p})
+}
+
+func (s *auditedStore) DeletePaymentContext(ctx context.Context, id string) error {
+	return s.write(ctx, BatchOp{BatchDelete, Payment{ID: id}})
+}
+
+// How many times a write is attempted while the payment keeps changing under it, see write
+const auditWriteAttempts = 3
+
+// Makes a write replacing a payment through an auditedTx, so that the previous state the change
+// is audited against is read in the same transaction as the write
+// The write doesn't depend on the previous state, so it is attempted again if the store reports that
+// the payment changed in between.
+func (s *auditedStore) write(ctx context.Context, op BatchOp) error {
+	for attempt := 1; ; attempt++ {
+		tx, err := s.BeginContext(ctx)
+		if err != nil {
+			return err
+		}
+		if err := stageOn(tx, op); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if errors.Is(err, ErrTxConflict) && attempt < auditWriteAttempts {
+			continue
+		}
+		// a failed precondition of the only write is reported as such, like a plain write would
+		var berr *BatchError
+		if errors.As(err, &berr) {
+			return berr.Err
+		}
+		return err
+	}
+}
+
+func (s *auditedStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &auditedTx{Tx: tx, ctx: ctx, store: s}, nil
+}
+
+// A change staged in an auditedTx
+type stagedChange struct {
+	action   string
+	old, new *Payment
+}
+
+// Transaction of an auditedStore, recording its changes once they are committed
+type auditedTx struct {
+	Tx
+	ctx     context.Context
+	store   *auditedStore
+	changes []stagedChange
+}
+
+// Stages a write through the wrapped transaction, remembering the change it makes
+func (tx *auditedTx) stage(id string, new *Payment, write func() error) error {
+	var old *Payment
+	if p, err := tx.Tx.GetPayment(id); err == nil {
+		old = &p
+	} else if !errors.Is(err, ErrPaymentNotFound) {
+		return err
+	}
+
+	if err := write(); err != nil {
+		return err
+	}
+
+	action := AuditUpdate
+	switch {
+	case old == nil:
+		action = AuditCreate
+	case new == nil:
+		action = AuditDelete
+	}
+	tx.changes = append(tx.changes, stagedChange{action, old, new})
+	return nil
+}
+
+func (tx *auditedTx) AddPayment(p Payment) error {
+	return tx.stage(p.ID, &p, func() error { return tx.Tx.AddPayment(p) })
+}
+
+func (tx *auditedTx) UpdatePayment(p Payment) error {
+	return tx.stage(p.ID, &p, func() error { return tx.Tx.UpdatePayment(p) })
+}
+
+func (tx *auditedTx) StorePayment(p Payment) error {
+	return tx.stage(p.ID, &p, func() error { return tx.Tx.StorePayment(p) })
+}
+
+func (tx *auditedTx) DeletePayment(id string) error {
+	return tx.stage(id, nil, func() error { return tx.Tx.DeletePayment(id) })
+}
+
+func (tx *auditedTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	for _, c := range tx.changes {
+		tx.store.audit(tx.ctx, c.action, c.old, c.new)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package f3api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Tests the events recorded for creating, updating and deleting a payment
+func TestAuditStore(t *testing.T) {
+	sink := &MemoryAuditSink{}
+	store := ContextStoreOf(AuditStore(NewInMemStore(), sink))
+	ctx := WithActor(context.Background(), "operator")
+
+	p := defaultPayment()
+	if err := store.AddPaymentContext(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	updated := p
+	updated.Version = 1
+	updated.Attributes.Reference = "Payment for Em's violin lessons"
+	if err := store.StorePaymentContext(ctx, updated); err != nil {
+		t.Fatal(err)
+	}
+
+	// failed writes are not audited
+	if err := store.AddPaymentContext(ctx, p); err == nil {
+		t.Fatal("Expected adding an existing payment to fail")
+	}
+
+	if err := store.DeletePaymentContext(ctx, p.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.Events()
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 audit events, got %+v", events)
+	}
+
+	for i, action := range []string{AuditCreate, AuditUpdate, AuditDelete} {
+		e := events[i]
+		if e.Action != action || e.Actor != "operator" || e.PaymentID != p.ID || e.OrganisationID != p.OrganisationID {
+			t.Fatalf("Unexpected %s event %+v", action, e)
+		}
+	}
+
+	if events[0].OldVersion != nil || *events[0].NewVersion != 0 {
+		t.Fatalf("Unexpected versions for a creation: %v %v", events[0].OldVersion, events[0].NewVersion)
+	}
+	if *events[1].OldVersion != 0 || *events[1].NewVersion != 1 {
+		t.Fatalf("Unexpected versions for an update: %v %v", *events[1].OldVersion, *events[1].NewVersion)
+	}
+	if *events[2].OldVersion != 1 || events[2].NewVersion != nil {
+		t.Fatalf("Unexpected versions for a deletion: %v %v", events[2].OldVersion, events[2].NewVersion)
+	}
+
+	expected := []FieldChange{
+		{"version", "0", "1"},
+		{"attributes.reference", p.Attributes.Reference, updated.Attributes.Reference},
+	}
+	if !reflect.DeepEqual(events[1].Changes, expected) {
+		t.Fatalf("Unexpected diff %+v", events[1].Changes)
+	}
+}
+
+// Tests that changes made in a transaction are only audited once committed
+func TestAuditStoreTx(t *testing.T) {
+	sink := &MemoryAuditSink{}
+	store := AuditStore(NewInMemStore(), sink)
+
+	p := defaultPayment()
+	if err := ApplyBatch(store, []BatchOp{{BatchAdd, p}, {BatchAdd, p}}); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if len(sink.Events()) != 0 {
+		t.Fatalf("Failed batch was audited: %+v", sink.Events())
+	}
+
+	if err := ApplyBatch(store, []BatchOp{{BatchAdd, p}, {BatchDelete, p}}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.Events()
+	if len(events) != 2 || events[0].Action != AuditCreate || events[1].Action != AuditDelete {
+		t.Fatalf("Unexpected audit events %+v", events)
+	}
+}
+
+// Store changing a payment behind the back of the first transaction reading it
+type racingStore struct {
+	*InMemStore
+	raced bool
+}
+
+func (s *racingStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.InMemStore.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &racingTx{tx, s}, nil
+}
+
+type racingTx struct {
+	Tx
+	store *racingStore
+}
+
+func (tx *racingTx) GetPayment(id string) (Payment, error) {
+	p, err := tx.Tx.GetPayment(id)
+	if err == nil && !tx.store.raced {
+		tx.store.raced = true
+		changed := p
+		changed.Version = 7
+		tx.store.UpdatePayment(changed)
+	}
+	return p, err
+}
+
+// Tests that a change is audited against the payment it actually replaced, if another write gets in
+// between reading it and writing the change
+func TestAuditStoreRace(t *testing.T) {
+	backend := &racingStore{InMemStore: NewInMemStore()}
+	p := defaultPayment()
+	backend.AddPayment(p)
+
+	sink := &MemoryAuditSink{}
+	store := AuditStore(backend, sink)
+	updated := p
+	updated.Version = 8
+	if err := store.UpdatePayment(updated); err != nil {
+		t.Fatal(err)
+	}
+
+	events := sink.Events()
+	if len(events) != 1 || *events[0].OldVersion != 7 || *events[0].NewVersion != 8 {
+		t.Fatalf("Unexpected audit events %+v", events)
+	}
+	if stored, _ := backend.GetPayment(p.ID); stored.Version != 8 {
+		t.Fatalf("Expected version 8 to be stored, got %d", stored.Version)
+	}
+}
+
+// Tests that the table sink inserts a row per event, with the diff as JSON
+func TestSQLAuditSink(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := NewSQLAuditSink(t.Context(), db, "audit; DROP TABLE payments"); err == nil {
+		t.Fatal("Expected an invalid table name to be refused")
+	}
+	sink, err := NewSQLAuditSink(t.Context(), db, "audit_events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := ContextStoreOf(AuditStore(NewInMemStore(), sink))
+	ctx := WithActor(context.Background(), "operator")
+
+	p := defaultPayment()
+	if err := store.AddPaymentContext(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	p.Version = 1
+	if err := store.UpdatePaymentContext(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("SELECT action, actor, payment_id, old_version, new_version, changes FROM audit_events ORDER BY rowid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		var (
+			e       AuditEvent
+			changes string
+		)
+		if err := rows.Scan(&e.Action, &e.Actor, &e.PaymentID, &e.OldVersion, &e.NewVersion, &changes); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(changes), &e.Changes); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Action != AuditCreate || events[0].Actor != "operator" || events[0].OldVersion != nil ||
+		events[1].PaymentID != p.ID || *events[1].OldVersion != 0 || *events[1].NewVersion != 1 ||
+		!reflect.DeepEqual(events[1].Changes, []FieldChange{{"version", "0", "1"}}) {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+}
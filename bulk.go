@@ -0,0 +1,186 @@
+package f3api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// Media type of newline delimited JSON request bodies, one payment per line
+const ndjsonMediaType = "application/x-ndjson"
+
+// The outcome of a single item of a bulk request
+type BulkItemResult struct {
+	ID     string `json:"id,omitempty"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Path of the payment a rejected duplicate duplicates, see DuplicateError
+	Original string `json:"original,omitempty"`
+}
+
+// The result of an item which failed with err
+func failedItem(id string, err error) BulkItemResult {
+	result := BulkItemResult{ID: id, Status: errorStatus(err), Error: err.Error()}
+	var derr *DuplicateError
+	if errors.As(err, &derr) {
+		result.Original = paymentPath(derr.OriginalID)
+	}
+	return result
+}
+
+// Reads the raw items of a bulk request body: a JSON array (possibly enveloped, see decodeData), or
+// NDJSON if the Content-Type says so
+func decodeBulkPayload(r *rest.Request) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+
+	if isEnveloped(r) {
+		err := decodeData(r, &items)
+		return items, err
+	}
+
+	defer r.Body.Close()
+	dec := json.NewDecoder(r.Body)
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != ndjsonMediaType {
+		if err := dec.Decode(&items); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+
+	for {
+		var item json.RawMessage
+		err := dec.Decode(&item)
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+}
+
+// Creates many payment resources in one request, or with "upsert=true", creates or updates them.
+// The body is either a JSON array of payments, or NDJSON with the application/x-ndjson Content-Type.
+//
+// Without "atomic=true" every item is stored on its own, and the response lists the outcome of each
+// item in request order: 201 (created), 200 (updated), 409 (already exists) or 422 (invalid).
+// With "atomic=true" the items are stored all or nothing through ApplyBatchContext. If any item
+// fails, nothing is stored, the response takes the status of the failing item, and the items that
+// would otherwise have been stored are marked 424.
+func (api *GenericApi) BulkPayments(w rest.ResponseWriter, r *rest.Request) {
+	query := r.URL.Query()
+	atomic := query.Get("atomic") == "true"
+	upsert := query.Get("upsert") == "true"
+
+	items, err := decodeBulkPayload(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BulkItemResult, len(items))
+	payments := make([]*Payment, len(items))
+	for i, item := range items {
+		payment := Payment{}
+		err := json.Unmarshal(item, &payment)
+		if err == nil {
+			err = ValidatePayment(payment)
+		}
+		if err != nil {
+			results[i] = BulkItemResult{ID: payment.ID, Status: http.StatusUnprocessableEntity, Error: err.Error()}
+			continue
+		}
+		results[i].ID = payment.ID
+		payments[i] = &payment
+	}
+
+	if atomic {
+		api.bulkAtomic(w, r, payments, results, upsert)
+		return
+	}
+
+	for i, payment := range payments {
+		if payment == nil {
+			continue
+		}
+
+		results[i].Status = http.StatusCreated
+		err := api.store.AddPaymentContext(r.Context(), *payment)
+		if upsert && errors.Is(err, ErrPaymentExists) {
+			results[i].Status = http.StatusOK
+			err = api.store.UpdatePaymentContext(r.Context(), *payment)
+		}
+		if err != nil {
+			results[i] = failedItem(payment.ID, err)
+		}
+	}
+
+	writeData(w, r, http.StatusOK, results, EnvelopeLinks{Self: r.URL.RequestURI()})
+}
+
+// The all or nothing part of BulkPayments, for the payments that passed validation
+func (api *GenericApi) bulkAtomic(w rest.ResponseWriter, r *rest.Request, payments []*Payment, results []BulkItemResult, upsert bool) {
+	// position of each operation's item in the request
+	var (
+		ops   []BatchOp
+		items []int
+	)
+
+	for i, payment := range payments {
+		if payment == nil {
+			continue
+		}
+
+		op := BatchOp{Kind: BatchAdd, Payment: *payment}
+		results[i].Status = http.StatusCreated
+		if upsert {
+			op.Kind = BatchStore
+			// only used for reporting the outcome, ApplyBatch settles the actual state
+			if _, err := api.store.GetPaymentContext(r.Context(), payment.ID); err == nil {
+				results[i].Status = http.StatusOK
+			}
+		}
+		ops = append(ops, op)
+		items = append(items, i)
+	}
+
+	failed := -1
+	if len(ops) < len(payments) {
+		for i := range results {
+			if payments[i] == nil {
+				failed = i
+				break
+			}
+		}
+	} else {
+		err := ApplyBatchContext(r.Context(), api.store, ops)
+		var berr *BatchError
+		if errors.As(err, &berr) {
+			failed = items[berr.Index]
+			results[failed] = failedItem(payments[failed].ID, berr.Err)
+		} else if err != nil {
+			api.handleError(w, r, err)
+			return
+		}
+	}
+
+	if failed < 0 {
+		writeData(w, r, http.StatusCreated, results, EnvelopeLinks{Self: r.URL.RequestURI()})
+		return
+	}
+
+	for _, i := range items {
+		if i != failed {
+			results[i].Status = http.StatusFailedDependency
+		}
+	}
+
+	writeData(w, r, results[failed].Status, results, EnvelopeLinks{Self: r.URL.RequestURI()})
+}
@@ -0,0 +1,123 @@
+package f3api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Builds a bulk request body holding the given payments as a JSON array
+func bulkBody(t *testing.T, payments ...Payment) string {
+	buf, err := json.Marshal(payments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// Sends a bulk request and decodes the per-item results
+func sendBulkRequest(t *testing.T, api *GenericApi, query string, body string, contentType string) (int, []BulkItemResult) {
+	var results []BulkItemResult
+
+	responseWriter := &testResponseWriter{}
+	request := createRestRequest("POST", "/payments/bulk"+query, strings.NewReader(body), nil)
+	request.Header.Set("Content-Type", contentType)
+	api.BulkPayments(responseWriter, request)
+
+	if err := json.Unmarshal(responseWriter.Read(), &results); err != nil {
+		t.Fatalf("%v: %s", err, responseWriter.result)
+	}
+
+	return responseWriter.status, results
+}
+
+// Tests that a non-atomic bulk request stores what it can and reports every item in order
+func TestBulkPaymentsPerItem(t *testing.T) {
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+
+	existing := defaultPayment()
+	store.AddPayment(existing)
+
+	fresh := defaultPayment()
+	fresh.ID = "fresh"
+	invalid := defaultPayment()
+	invalid.ID = "invalid"
+	invalid.Type = "Refund"
+
+	_, results := sendBulkRequest(t, api, "", bulkBody(t, fresh, existing, invalid), "application/json")
+
+	expected := []int{http.StatusCreated, http.StatusConflict, http.StatusUnprocessableEntity}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %v", len(expected), results)
+	}
+	for i, status := range expected {
+		if results[i].Status != status {
+			t.Fatalf("Item %d: expected status %d, got %+v", i, status, results[i])
+		}
+	}
+
+	if _, err := store.GetPayment(fresh.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that an atomic bulk request stores nothing when a single item fails
+func TestBulkPaymentsAtomic(t *testing.T) {
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+
+	existing := defaultPayment()
+	store.AddPayment(existing)
+
+	fresh := defaultPayment()
+	fresh.ID = "fresh"
+
+	status, results := sendBulkRequest(t, api, "?atomic=true", bulkBody(t, fresh, existing), "application/json")
+	if status != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, status)
+	}
+	if results[0].Status != http.StatusFailedDependency || results[1].Status != http.StatusConflict {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if _, err := store.GetPayment(fresh.ID); err == nil {
+		t.Fatal("Atomic bulk request was partially applied")
+	}
+
+	// the same request, as NDJSON, succeeds when updates are allowed
+	line1, _ := json.Marshal(fresh)
+	line2, _ := json.Marshal(existing)
+	body := string(line1) + "\n" + string(line2) + "\n"
+
+	status, results = sendBulkRequest(t, api, "?atomic=true&upsert=true", body, ndjsonMediaType)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d: %+v", http.StatusCreated, status, results)
+	}
+	if results[0].Status != http.StatusCreated || results[1].Status != http.StatusOK {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	if _, err := store.GetPayment(fresh.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that rejected duplicates are reported as conflicts with their original, not updated instead
+func TestBulkPaymentsUpsertDuplicate(t *testing.T) {
+	store := DetectDuplicates(NewInMemStore(), DuplicateConfig{})
+	api := NewGenericApi(store)
+
+	original := defaultPayment()
+	dup := original
+	dup.ID = "duplicate"
+
+	for _, query := range []string{"?upsert=true", "?upsert=true&atomic=true"} {
+		_, results := sendBulkRequest(t, api, query, bulkBody(t, original, dup), "application/json")
+		if len(results) != 2 || results[1].Status != http.StatusConflict || results[1].Original != paymentPath(original.ID) {
+			t.Fatalf("%s: expected the duplicate to conflict with %s, got %+v", query, original.ID, results)
+		}
+		if _, err := store.GetPayment(dup.ID); err == nil {
+			t.Fatalf("%s: the duplicate was stored", query)
+		}
+	}
+}
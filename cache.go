@@ -0,0 +1,334 @@
+package f3api
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How many payments CacheStore keeps by default
+const defaultCacheSize = 1024
+
+// Configuration of CacheStore
+type CacheConfig struct {
+	// Maximum number of cached payments, the least recently used being evicted first
+	// Defaults to 1024 if not positive.
+	Size int
+
+	// How long a payment stays cached after being read from the store; forever if zero
+	// Writes through the cache invalidate it, so this only bounds how long changes made to the
+	// store by other means can go unnoticed.
+	TTL time.Duration
+
+	// Registry the hit, miss and eviction counts are also exposed in, if any
+	Metrics *Metrics
+}
+
+// Statistics of a CachedStore since it was created
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// number of payments currently cached, expired ones included until they are looked up
+	Entries int
+}
+
+// Read-through cache of payments by ID in front of an ApiStore, see CacheStore
+// Implements both ApiStore and ContextStore.
+type CachedStore struct {
+	backgroundAdapter
+	cache *cachingStore
+}
+
+// Wraps a store to serve GetPayment from a bounded LRU cache, reading through to the store on misses
+//
+// Every write through the returned store, transactions included, invalidates the cached payment.
+// Concurrent misses of the same payment share a single read from the store. Listing and filtering
+// always go to the store. Fails if the cache metrics are already registered in config.Metrics.
+func CacheStore(store ApiStore, config CacheConfig) (*CachedStore, error) {
+	if config.Size <= 0 {
+		config.Size = defaultCacheSize
+	}
+
+	s := cachingStore{
+		storeDecorator: storeDecorator{ContextStoreOf(store)},
+		config:         config,
+		now:            time.Now,
+		lru:            list.New(),
+		entries:        make(map[string]*list.Element),
+		inFlight:       make(map[string]*cacheFill),
+	}
+
+	if m := config.Metrics; m != nil {
+		var err error
+		if s.lookups, err = m.Counter("f3api_cache_lookups_total", "Number of payment cache lookups by result.", "result"); err != nil {
+			return nil, err
+		}
+		if s.evictions, err = m.Counter("f3api_cache_evictions_total", "Number of payments evicted from the cache."); err != nil {
+			return nil, err
+		}
+		err = m.GaugeFunc("f3api_cache_entries", "Number of cached payments.", func() float64 {
+			return float64(s.Stats().Entries)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cs := CachedStore{backgroundAdapter{&s}, &s}
+	return &cs, nil
+}
+
+// Returns the statistics of the cache
+func (s *CachedStore) Stats() CacheStats {
+	return s.cache.Stats()
+}
+
+// ContextStore decorator caching payments by ID
+type cachingStore struct {
+	storeDecorator
+	config CacheConfig
+	now    func() time.Time
+
+	mu sync.Mutex
+	// most recently used first, holding *cacheEntry values
+	lru      *list.List
+	entries  map[string]*list.Element
+	inFlight map[string]*cacheFill
+
+	hits, misses, evicted atomic.Uint64
+	// only set if the statistics are exposed as metrics
+	lookups, evictions *Counter
+}
+
+// A cached payment
+type cacheEntry struct {
+	payment Payment
+	expires time.Time
+}
+
+// A read from the store on behalf of every concurrent miss of a payment
+type cacheFill struct {
+	done    chan struct{}
+	payment Payment
+	err     error
+	// set if the payment was written while being read, so the result must not be cached
+	stale bool
+}
+
+// Returns the statistics of the cache
+func (s *cachingStore) Stats() CacheStats {
+	s.mu.Lock()
+	entries := s.lru.Len()
+	s.mu.Unlock()
+
+	return CacheStats{
+		Hits:      s.hits.Load(),
+		Misses:    s.misses.Load(),
+		Evictions: s.evicted.Load(),
+		Entries:   entries,
+	}
+}
+
+// Counts a lookup as a hit or a miss
+func (s *cachingStore) record(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+	if s.lookups != nil {
+		s.lookups.Inc(result)
+	}
+}
+
+// Looks a payment up in the cache, dropping it if it has expired
+// The caller must hold the lock.
+func (s *cachingStore) cached(id string) (Payment, bool) {
+	elem, ok := s.entries[id]
+	if !ok {
+		return Payment{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if s.config.TTL > 0 && !s.now().Before(entry.expires) {
+		s.lru.Remove(elem)
+		delete(s.entries, id)
+		return Payment{}, false
+	}
+
+	s.lru.MoveToFront(elem)
+	return entry.payment, true
+}
+
+// Caches a payment read from the store, evicting the least recently used ones beyond the size
+// The caller must hold the lock.
+func (s *cachingStore) add(p Payment) {
+	entry := cacheEntry{payment: p, expires: s.now().Add(s.config.TTL)}
+	if elem, ok := s.entries[p.ID]; ok {
+		elem.Value = &entry
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.entries[p.ID] = s.lru.PushFront(&entry)
+
+	for s.lru.Len() > s.config.Size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).payment.ID)
+		s.evicted.Add(1)
+		if s.evictions != nil {
+			s.evictions.Inc()
+		}
+	}
+}
+
+// Drops a payment from the cache, and keeps any read of it in flight from being cached
+func (s *cachingStore) invalidate(ids ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		if elem, ok := s.entries[id]; ok {
+			s.lru.Remove(elem)
+			delete(s.entries, id)
+		}
+		if fill, ok := s.inFlight[id]; ok {
+			fill.stale = true
+			delete(s.inFlight, id)
+		}
+	}
+}
+
+// Reads a payment from the store, caching it, or waits for a read of it already in flight
+// If the read in flight fails because its own context is done, the payment is read again.
+func (s *cachingStore) fill(ctx context.Context, id string) (Payment, error) {
+	for {
+		s.mu.Lock()
+		fill, waiting := s.inFlight[id]
+		if !waiting {
+			fill = &cacheFill{done: make(chan struct{})}
+			s.inFlight[id] = fill
+		}
+		s.mu.Unlock()
+
+		if !waiting {
+			return s.read(ctx, id, fill)
+		}
+
+		select {
+		case <-fill.done:
+		case <-ctx.Done():
+			return Payment{}, ctx.Err()
+		}
+		if isContextError(fill.err) && ctx.Err() == nil {
+			continue
+		}
+		return fill.payment, fill.err
+	}
+}
+
+// Reads a payment from the store on behalf of a fill, caching it unless it was invalidated meanwhile
+func (s *cachingStore) read(ctx context.Context, id string, fill *cacheFill) (Payment, error) {
+	p, err := s.store.GetPaymentContext(ctx, id)
+
+	s.mu.Lock()
+	if !fill.stale {
+		delete(s.inFlight, id)
+		if err == nil {
+			s.add(p)
+		}
+	}
+	fill.payment, fill.err = p, err
+	s.mu.Unlock()
+
+	close(fill.done)
+	return p, err
+}
+
+// Reports whether an error is the error of a done context
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (s *cachingStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	defer s.invalidate(p.ID)
+	return s.store.AddPaymentContext(ctx, p)
+}
+
+func (s *cachingStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	defer s.invalidate(p.ID)
+	return s.store.UpdatePaymentContext(ctx, p)
+}
+
+func (s *cachingStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	defer s.invalidate(p.ID)
+	return s.store.StorePaymentContext(ctx, p)
+}
+
+func (s *cachingStore) DeletePaymentContext(ctx context.Context, id string) error {
+	defer s.invalidate(id)
+	return s.store.DeletePaymentContext(ctx, id)
+}
+
+func (s *cachingStore) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return Payment{}, err
+	}
+
+	s.mu.Lock()
+	p, ok := s.cached(id)
+	s.mu.Unlock()
+
+	s.record(ok)
+	if ok {
+		return p, nil
+	}
+	return s.fill(ctx, id)
+}
+
+func (s *cachingStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingTx{Tx: tx, store: s}, nil
+}
+
+// Transaction of a cachingStore, invalidating the payments it wrote once it is committed
+// Reads within the transaction bypass the cache, as they must see the staged writes.
+type cachingTx struct {
+	Tx
+	store   *cachingStore
+	written []string
+}
+
+func (tx *cachingTx) AddPayment(p Payment) error {
+	tx.written = append(tx.written, p.ID)
+	return tx.Tx.AddPayment(p)
+}
+
+func (tx *cachingTx) UpdatePayment(p Payment) error {
+	tx.written = append(tx.written, p.ID)
+	return tx.Tx.UpdatePayment(p)
+}
+
+func (tx *cachingTx) StorePayment(p Payment) error {
+	tx.written = append(tx.written, p.ID)
+	return tx.Tx.StorePayment(p)
+}
+
+func (tx *cachingTx) DeletePayment(id string) error {
+	tx.written = append(tx.written, id)
+	return tx.Tx.DeletePayment(id)
+}
+
+func (tx *cachingTx) Commit() error {
+	defer tx.store.invalidate(tx.written...)
+	return tx.Tx.Commit()
+}
@@ -0,0 +1,171 @@
+package f3api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Store counting the payments read from it, optionally holding every read back until released
+type countingStore struct {
+	*InMemStore
+	reads   atomic.Int64
+	release chan struct{}
+}
+
+func (s *countingStore) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	p, err := s.InMemStore.GetPaymentContext(ctx, id)
+	s.reads.Add(1)
+	if s.release != nil {
+		<-s.release
+	}
+	return p, err
+}
+
+// Tests hits, misses, invalidation by writes and transactions, eviction and expiry
+func TestCacheStore(t *testing.T) {
+	backend := &countingStore{InMemStore: NewInMemStore()}
+	m := NewMetrics()
+	store, err := CacheStore(backend, CacheConfig{Size: 2, TTL: time.Minute, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	store.cache.now = func() time.Time { return now }
+
+	p := defaultPayment()
+	store.AddPayment(p)
+
+	get := func(id string, reads int64) Payment {
+		t.Helper()
+		got, err := store.GetPayment(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := backend.reads.Load(); n != reads {
+			t.Fatalf("Expected %d reads from the store, got %d", reads, n)
+		}
+		return got
+	}
+
+	get(p.ID, 1)
+	get(p.ID, 1)
+
+	// writes invalidate the cached payment
+	updated := p
+	updated.Version = 1
+	store.UpdatePayment(updated)
+	if got := get(p.ID, 2); got.Version != 1 {
+		t.Fatalf("Expected the updated payment, got version %d", got.Version)
+	}
+
+	tx, _ := store.Begin()
+	updated.Version = 2
+	tx.StorePayment(updated)
+	get(p.ID, 2)
+	tx.Commit()
+	if got := get(p.ID, 3); got.Version != 2 {
+		t.Fatalf("Expected the committed payment, got version %d", got.Version)
+	}
+
+	store.DeletePayment(p.ID)
+	if _, err := store.GetPayment(p.ID); !errors.Is(err, ErrPaymentNotFound) {
+		t.Fatalf("Expected the deleted payment to be gone, got %v", err)
+	}
+
+	// the least recently used payment is evicted
+	for _, id := range []string{"a", "b", "c"} {
+		other := p
+		other.ID = id
+		backend.AddPayment(other)
+	}
+	get("a", 5)
+	get("b", 6)
+	get("a", 6)
+	get("c", 7)
+	get("a", 7)
+	get("b", 8)
+
+	// and payments expire
+	now = now.Add(time.Minute)
+	get("a", 9)
+
+	stats := store.Stats()
+	if stats != (CacheStats{Hits: 4, Misses: 9, Evictions: 2, Entries: 2}) {
+		t.Fatalf("Unexpected statistics %+v", stats)
+	}
+
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`f3api_cache_lookups_total{result="hit"} 4`, `f3api_cache_evictions_total 2`, `f3api_cache_entries 2`} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("Expected %q in the metrics:\n%s", line, buf.String())
+		}
+	}
+}
+
+// Tests that concurrent misses of a payment share a single read from the store
+func TestCacheStoreSingleflight(t *testing.T) {
+	backend := &countingStore{InMemStore: NewInMemStore(), release: make(chan struct{})}
+	store, _ := CacheStore(backend, CacheConfig{})
+	p := defaultPayment()
+	backend.AddPayment(p)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.GetPayment(p.ID); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// let every lookup miss before the read completes
+	for store.Stats().Misses < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	close(backend.release)
+	wg.Wait()
+
+	if n := backend.reads.Load(); n != 1 {
+		t.Fatalf("Expected a single read from the store, got %d", n)
+	}
+}
+
+// Tests that a payment written while being read isn't cached in its old state
+func TestCacheStoreWriteDuringRead(t *testing.T) {
+	backend := &countingStore{InMemStore: NewInMemStore(), release: make(chan struct{})}
+	store, _ := CacheStore(backend, CacheConfig{})
+	p := defaultPayment()
+	backend.AddPayment(p)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		store.GetPayment(p.ID)
+	}()
+	for backend.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	updated := p
+	updated.Version = 1
+	backend.StorePayment(updated)
+	store.cache.invalidate(p.ID)
+	close(backend.release)
+	<-done
+
+	// the read in flight returned the old payment, but didn't cache it
+	if got, _ := store.GetPayment(p.ID); got.Version != 1 {
+		t.Fatalf("Expected the updated payment, got version %d", got.Version)
+	}
+}
@@ -0,0 +1,391 @@
+package f3api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Holidays and weekend days of a payment scheme or currency, on which payments aren't settled
+type HolidayCalendar struct {
+	holidays map[string]bool
+	weekend  [7]bool
+}
+
+// Creates a calendar of the given holidays, with weekends on Saturday and Sunday
+func NewHolidayCalendar(holidays []time.Time) *HolidayCalendar {
+	c := HolidayCalendar{holidays: make(map[string]bool)}
+	c.weekend[time.Saturday], c.weekend[time.Sunday] = true, true
+	for _, day := range holidays {
+		c.holidays[day.Format(timeFmt)] = true
+	}
+	return &c
+}
+
+// Reads a holiday calendar, one holiday per line as a date in the timeFmt format, optionally
+// followed by its name. Lines starting with "#" are comments. Weekends are on Saturday and Sunday,
+// unless a "weekend" line lists other days, such as "weekend fri sat", or none at all.
+func ReadHolidayCalendar(r io.Reader) (*HolidayCalendar, error) {
+	c := NewHolidayCalendar(nil)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "weekend" {
+			c.weekend = [7]bool{}
+			for _, name := range fields[1:] {
+				day, ok := parseWeekday(name)
+				if !ok {
+					return nil, fmt.Errorf("line %d: unknown day %q", line, name)
+				}
+				c.weekend[day] = true
+			}
+			continue
+		}
+
+		day, err := time.Parse(timeFmt, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		c.holidays[day.Format(timeFmt)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Parses the English name of a day of the week, or its first three letters, regardless of case
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(name)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, true
+		}
+	}
+	return 0, false
+}
+
+// Reports whether payments are settled on a day
+func (c *HolidayCalendar) IsBusinessDay(day time.Time) bool {
+	return !c.weekend[day.Weekday()] && !c.holidays[day.Format(timeFmt)]
+}
+
+// What to do with a processing date which isn't a business day
+type RollConvention string
+
+const (
+	// Refuse the payment; the default
+	RollNone RollConvention = "none"
+	// Move the date to the next business day
+	RollFollowing RollConvention = "following"
+	// Move the date to the next business day, unless that is in the next month, in which case it is
+	// moved to the previous business day instead
+	RollModifiedFollowing RollConvention = "modified_following"
+)
+
+// Calendar used when none is known for the scheme or currency of a payment: weekends only
+var weekendCalendar = NewHolidayCalendar(nil)
+
+// How far a processing date is rolled at most, in days, before giving up
+const maxRollDays = 31
+
+// The business days of payments, by payment scheme and currency, and the processing dates accepted
+//
+// A day is a business day for a payment if it is one by the calendar of its scheme and by the
+// calendar of its currency. Schemes and currencies without a calendar of their own only skip
+// weekends. Dates are days in UTC.
+type BusinessCalendar struct {
+	// Calendars by payment scheme, such as "FPS"
+	Schemes map[string]*HolidayCalendar
+	// Calendars by ISO 4217 currency code
+	Currencies map[string]*HolidayCalendar
+	// What to do with processing dates which aren't business days; RollNone if empty
+	Roll RollConvention
+	// How many days ahead of today a payment may be processed at most; no limit if zero
+	HorizonDays int
+}
+
+// Reports whether a day is a business day for a payment
+func (c *BusinessCalendar) IsBusinessDay(p Payment, day time.Time) bool {
+	calendars := []*HolidayCalendar{c.Schemes[p.Attributes.PaymentScheme], c.Currencies[p.Attributes.Currency]}
+	if calendars[0] == nil && calendars[1] == nil {
+		return weekendCalendar.IsBusinessDay(day)
+	}
+	for _, cal := range calendars {
+		if cal != nil && !cal.IsBusinessDay(day) {
+			return false
+		}
+	}
+	return true
+}
+
+// The processing date of a payment on a given day, rolled to a business day as configured
+// Returns a ValidationError if the payment has no processing date, if it isn't a business day and
+// can't be rolled to one, or if it is before today or beyond the horizon.
+func (c *BusinessCalendar) ProcessingDate(p Payment, today time.Time) (time.Time, error) {
+	const field = "attributes.processing_date"
+
+	date := p.Attributes.ProcessingDate.Time
+	if date.IsZero() {
+		return date, ValidationError{field, "must be set"}
+	}
+	date = startOfDay(date)
+
+	if !c.IsBusinessDay(p, date) {
+		rolled, ok := c.roll(p, date)
+		if !ok {
+			return date, ValidationError{field, fmt.Sprintf("%s is not a business day for %s payments in %s", date.Format(timeFmt), p.Attributes.PaymentScheme, p.Attributes.Currency)}
+		}
+		date = rolled
+	}
+
+	today = startOfDay(today)
+	if date.Before(today) {
+		return date, ValidationError{field, fmt.Sprintf("%s is in the past", date.Format(timeFmt))}
+	}
+	if c.HorizonDays > 0 && date.After(today.AddDate(0, 0, c.HorizonDays)) {
+		return date, ValidationError{field, fmt.Sprintf("%s is more than %d days ahead", date.Format(timeFmt), c.HorizonDays)}
+	}
+	return date, nil
+}
+
+// Rolls a date which isn't a business day by the convention of the calendar
+func (c *BusinessCalendar) roll(p Payment, date time.Time) (time.Time, bool) {
+	next := func(step int) (time.Time, bool) {
+		for i := 1; i <= maxRollDays; i++ {
+			if day := date.AddDate(0, 0, i*step); c.IsBusinessDay(p, day) {
+				return day, true
+			}
+		}
+		return date, false
+	}
+
+	switch c.Roll {
+	case RollFollowing:
+		return next(1)
+	case RollModifiedFollowing:
+		if day, ok := next(1); ok && day.Month() == date.Month() {
+			return day, true
+		}
+		return next(-1)
+	}
+	return date, false
+}
+
+// Midnight of the day of t, in UTC
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Loads a BusinessCalendar from a JSON file naming the holiday calendar file of each scheme and
+// currency, see ReadHolidayCalendar. Relative paths are relative to the directory of the file:
+//
+//	{
+//	  "roll": "modified_following",
+//	  "horizon_days": 365,
+//	  "schemes": {"FPS": "fps.txt"},
+//	  "currencies": {"GBP": "gbp.txt", "USD": "usd.txt"}
+//	}
+func LoadBusinessCalendar(path string) (*BusinessCalendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file struct {
+		Roll        RollConvention    `json:"roll"`
+		HorizonDays int               `json:"horizon_days"`
+		Schemes     map[string]string `json:"schemes"`
+		Currencies  map[string]string `json:"currencies"`
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	switch file.Roll {
+	case "", RollNone, RollFollowing, RollModifiedFollowing:
+	default:
+		return nil, fmt.Errorf("%s: unknown roll convention %q", path, file.Roll)
+	}
+	if file.HorizonDays < 0 {
+		return nil, fmt.Errorf("%s: negative horizon", path)
+	}
+
+	read := func(names map[string]string) (map[string]*HolidayCalendar, error) {
+		calendars := make(map[string]*HolidayCalendar)
+		for name, calPath := range names {
+			if !filepath.IsAbs(calPath) {
+				calPath = filepath.Join(filepath.Dir(path), calPath)
+			}
+			cal, err := readHolidayFile(calPath)
+			if err != nil {
+				return nil, err
+			}
+			calendars[name] = cal
+		}
+		return calendars, nil
+	}
+
+	c := BusinessCalendar{Roll: file.Roll, HorizonDays: file.HorizonDays}
+	if c.Schemes, err = read(file.Schemes); err != nil {
+		return nil, err
+	}
+	if c.Currencies, err = read(file.Currencies); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Reads a holiday calendar from a file
+func readHolidayFile(path string) (*HolidayCalendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cal, err := ReadHolidayCalendar(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cal, nil
+}
+
+// ContextStore decorator checking the processing dates of payments against a business calendar
+type businessDayStore struct {
+	storeDecorator
+	calendar *BusinessCalendar
+	now      func() time.Time
+}
+
+// Wraps a store to check the processing date of every payment created or updated through it,
+// transactions included, with BusinessCalendar.ProcessingDate. Payments are written with their
+// processing date rolled as configured, and refused with a ValidationError if it can't be.
+// Updates keeping the processing date of the payment aren't checked, so that payments already
+// processed can still be edited, or restored from a backup; adding a payment which already exists is
+// refused with ErrPaymentExists rather than for its date, for the same reason.
+// The returned store implements both ApiStore and ContextStore.
+func BusinessDayStore(store ApiStore, calendar *BusinessCalendar) ApiStore {
+	return ApiStoreOf(&businessDayStore{storeDecorator{ContextStoreOf(store)}, calendar, time.Now})
+}
+
+// Rolls the processing date of a payment, or explains why it can't be accepted
+func (s *businessDayStore) check(p *Payment) error {
+	date, err := s.calendar.ProcessingDate(*p, s.now())
+	if err != nil {
+		return err
+	}
+	p.Attributes.ProcessingDate = Date{date}
+	return nil
+}
+
+// Checks a payment about to be added, which get looks up
+// A payment which already exists is refused with ErrPaymentExists whatever its date, so that restoring
+// a backup can fall back to updating it. It is only looked up if the date is refused, as adding a
+// payment which exists is refused by the store in any case.
+func (s *businessDayStore) checkAdd(p *Payment, get func(string) (Payment, error)) error {
+	err := s.check(p)
+	if err == nil {
+		return nil
+	}
+	switch _, getErr := get(p.ID); {
+	case getErr == nil:
+		return ErrPaymentExists
+	case !errors.Is(getErr, ErrPaymentNotFound):
+		return getErr
+	}
+	return err
+}
+
+// Checks a payment about to replace the one read with err, unless it keeps its processing date
+func (s *businessDayStore) checkChange(p *Payment, previous Payment, err error) error {
+	switch {
+	case errors.Is(err, ErrPaymentNotFound):
+		return s.check(p)
+	case err != nil:
+		return err
+	case startOfDay(previous.Attributes.ProcessingDate.Time).Equal(startOfDay(p.Attributes.ProcessingDate.Time)):
+		return nil
+	}
+	return s.check(p)
+}
+
+func (s *businessDayStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	get := func(id string) (Payment, error) { return s.store.GetPaymentContext(ctx, id) }
+	if err := s.checkAdd(&p, get); err != nil {
+		return err
+	}
+	setWritten(ctx, p)
+	return s.store.AddPaymentContext(ctx, p)
+}
+
+func (s *businessDayStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	previous, err := s.store.GetPaymentContext(ctx, p.ID)
+	if err := s.checkChange(&p, previous, err); err != nil {
+		return err
+	}
+	setWritten(ctx, p)
+	return s.store.UpdatePaymentContext(ctx, p)
+}
+
+func (s *businessDayStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	previous, err := s.store.GetPaymentContext(ctx, p.ID)
+	if err := s.checkChange(&p, previous, err); err != nil {
+		return err
+	}
+	setWritten(ctx, p)
+	return s.store.StorePaymentContext(ctx, p)
+}
+
+func (s *businessDayStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &businessDayTx{tx, s}, nil
+}
+
+// Transaction of a businessDayStore, checking processing dates as payments are staged
+type businessDayTx struct {
+	Tx
+	store *businessDayStore
+}
+
+func (tx *businessDayTx) AddPayment(p Payment) error {
+	if err := tx.store.checkAdd(&p, tx.Tx.GetPayment); err != nil {
+		return err
+	}
+	return tx.Tx.AddPayment(p)
+}
+
+func (tx *businessDayTx) UpdatePayment(p Payment) error {
+	previous, err := tx.Tx.GetPayment(p.ID)
+	if err := tx.store.checkChange(&p, previous, err); err != nil {
+		return err
+	}
+	return tx.Tx.UpdatePayment(p)
+}
+
+func (tx *businessDayTx) StorePayment(p Payment) error {
+	previous, err := tx.Tx.GetPayment(p.ID)
+	if err := tx.store.checkChange(&p, previous, err); err != nil {
+		return err
+	}
+	return tx.Tx.StorePayment(p)
+}
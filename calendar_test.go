@@ -0,0 +1,186 @@
+package f3api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parses a date in the timeFmt format, or fails the test
+func mustDate(t *testing.T, s string) time.Time {
+	t.Helper()
+	day, err := time.Parse(timeFmt, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return day
+}
+
+// Tests validating and rolling processing dates, by the calendars of the scheme and currency
+func TestBusinessCalendar(t *testing.T) {
+	fps, err := ReadHolidayCalendar(strings.NewReader(`# UK bank holidays
+2026-12-25 Christmas Day
+2026-12-28 Boxing Day (substitute)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aed, err := ReadHolidayCalendar(strings.NewReader("weekend sat Sunday\n2026-12-29\n2026-12-31\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calendar := &BusinessCalendar{
+		Schemes:     map[string]*HolidayCalendar{"FPS": fps},
+		Currencies:  map[string]*HolidayCalendar{"AED": aed},
+		HorizonDays: 30,
+	}
+	today := mustDate(t, "2026-12-21")
+
+	p := defaultPayment()
+	for _, c := range []struct {
+		date, currency string
+		roll           RollConvention
+		expected       string
+	}{
+		{"2026-12-24", "GBP", "", "2026-12-24"},
+		{"2026-12-25", "GBP", "", ""},
+		{"2026-12-25", "GBP", RollFollowing, "2026-12-29"},
+		{"2026-12-25", "AED", RollFollowing, "2026-12-30"},
+		{"2026-12-31", "AED", RollFollowing, "2027-01-01"},
+		{"2026-12-31", "AED", RollModifiedFollowing, "2026-12-30"},
+		{"2026-12-18", "GBP", RollFollowing, ""},
+		{"2026-12-20", "GBP", RollFollowing, "2026-12-21"},
+		{"2027-01-20", "GBP", "", "2027-01-20"},
+		{"2027-01-21", "GBP", "", ""},
+	} {
+		calendar.Roll = c.roll
+		p.Attributes.ProcessingDate = Date{mustDate(t, c.date)}
+		p.Attributes.Currency = c.currency
+
+		date, err := calendar.ProcessingDate(p, today)
+		if c.expected == "" {
+			var verr ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("%s in %s (%s): expected a validation error, got %v", c.date, c.currency, c.roll, err)
+			}
+			continue
+		}
+		if err != nil || date.Format(timeFmt) != c.expected {
+			t.Fatalf("%s in %s (%s): expected %s, got %v (%v)", c.date, c.currency, c.roll, c.expected, date, err)
+		}
+	}
+
+	// schemes and currencies without calendars only skip weekends
+	p.Attributes.PaymentScheme, p.Attributes.Currency = "SEPA", "EUR"
+	if !calendar.IsBusinessDay(p, mustDate(t, "2026-12-25")) || calendar.IsBusinessDay(p, mustDate(t, "2026-12-26")) {
+		t.Fatal("Expected only weekends to be skipped")
+	}
+
+	if _, err := ReadHolidayCalendar(strings.NewReader("weekend caturday\n")); err == nil {
+		t.Fatal("Expected an unknown day to be refused")
+	}
+	if _, err := ReadHolidayCalendar(strings.NewReader("25/12/2026\n")); err == nil {
+		t.Fatal("Expected a malformed date to be refused")
+	}
+}
+
+// Tests loading the calendars named by a configuration file
+func TestLoadBusinessCalendar(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"calendar.json": `{"roll": "following", "horizon_days": 90, "schemes": {"FPS": "fps.txt"}}`,
+		"fps.txt":       "2026-12-25\n",
+		"bad.json":      `{"roll": "preceding"}`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	calendar, err := LoadBusinessCalendar(filepath.Join(dir, "calendar.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calendar.Roll != RollFollowing || calendar.HorizonDays != 90 || calendar.Schemes["FPS"].IsBusinessDay(mustDate(t, "2026-12-25")) {
+		t.Fatalf("Unexpected calendar %+v", calendar)
+	}
+
+	if _, err := LoadBusinessCalendar(filepath.Join(dir, "bad.json")); err == nil {
+		t.Fatal("Expected an unknown roll convention to be refused")
+	}
+}
+
+// Tests that payments are written with their rolled processing date, and refused if it can't be
+func TestBusinessDayStore(t *testing.T) {
+	backend := &countingStore{InMemStore: NewInMemStore()}
+	store := BusinessDayStore(backend, &BusinessCalendar{Roll: RollFollowing})
+	store.(backgroundAdapter).ContextStore.(*businessDayStore).now = func() time.Time {
+		return mustDate(t, "2026-12-21").Add(15 * time.Hour)
+	}
+	api := NewGenericApi(store)
+
+	p := defaultPayment()
+	p.Attributes.ProcessingDate = Date{mustDate(t, "2026-12-26")}
+	body, _ := json.Marshal(p)
+	responseWriter := &testResponseWriter{}
+	api.PostPayment(responseWriter, createRestRequest("POST", "/payments", strings.NewReader(string(body)), nil))
+
+	var written Payment
+	if err := json.Unmarshal(responseWriter.Read(), &written); err != nil {
+		t.Fatal(err)
+	}
+	if date := written.Attributes.ProcessingDate.Format(timeFmt); date != "2026-12-28" {
+		t.Fatalf("Expected the processing date to be rolled to 2026-12-28, got %s", date)
+	}
+	if n := backend.reads.Load(); n != 0 {
+		t.Fatalf("Expected the rolled payment to be handed back without reading it, got %d reads", n)
+	}
+
+	// today is still acceptable, earlier days aren't
+	p.Attributes.ProcessingDate = Date{mustDate(t, "2026-12-21")}
+	if err := store.UpdatePayment(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Attributes.ProcessingDate = Date{mustDate(t, "2026-12-18")}
+	responseWriter = &testResponseWriter{}
+	body, _ = json.Marshal(p)
+	api.PutPayment(responseWriter, createRestRequest("PUT", "/payments/"+p.ID, strings.NewReader(string(body)), map[string]string{"id": p.ID}))
+	if responseWriter.status != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnprocessableEntity, responseWriter.status)
+	}
+
+	var verr ValidationError
+	if err := ApplyBatch(store, []BatchOp{{BatchStore, p}}); !errors.As(err, &verr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+
+	// payments already processed can be edited, or restored, as long as they keep their date
+	store.(backgroundAdapter).ContextStore.(*businessDayStore).now = func() time.Time {
+		return mustDate(t, "2027-01-04")
+	}
+	p.Attributes.ProcessingDate = Date{mustDate(t, "2026-12-21")}
+	p.Attributes.Reference = "Edited"
+	if err := store.UpdatePayment(p); err != nil {
+		t.Fatalf("Expected the processed payment to be updated, got %v", err)
+	}
+	if err := ApplyBatch(store, []BatchOp{{BatchStore, p}}); err != nil {
+		t.Fatalf("Expected the processed payment to be restored, got %v", err)
+	}
+	if err := store.AddPayment(p); !errors.Is(err, ErrPaymentExists) {
+		t.Fatalf("Expected re-adding the processed payment to find it existing, got %v", err)
+	}
+	if err := ApplyBatch(store, []BatchOp{{BatchAdd, p}}); !errors.Is(err, ErrPaymentExists) {
+		t.Fatalf("Expected re-adding the processed payment in a batch to find it existing, got %v", err)
+	}
+	p.Attributes.ProcessingDate = Date{mustDate(t, "2026-12-22")}
+	if err := store.StorePayment(p); !errors.As(err, &verr) {
+		t.Fatalf("Expected moving the payment into the past to be refused, got %v", err)
+	}
+}
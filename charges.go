@@ -0,0 +1,348 @@
+package f3api
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// Who bears the charges of a payment, as given by ChargeInformation.BearerCode
+const (
+	// Shared: the debtor bears the sender's charges, the beneficiary the receiver's
+	BearerShared = "SHAR"
+	// The debtor bears all charges, the beneficiary receives the full amount
+	BearerDebtor = "DEBT"
+	// The beneficiary bears all charges, which are deducted from the amount
+	BearerCreditor = "CRED"
+)
+
+// Checks the charges information of a payment
+// Any charge requires a bearer code, SHAR, DEBT or CRED, and DEBT payments can't have receiver
+// charges. Charges must have an ISO 4217 currency and must not be negative. Payments without any
+// charges information aren't checked.
+func ValidateCharges(p Payment) error {
+	const field = "attributes.charges_information."
+	c := p.Attributes.ChargesInformation
+
+	for i, charge := range c.SenderCharges {
+		switch {
+		case !isCurrencyCode(charge.Currency):
+			return ValidationError{fmt.Sprintf("%ssender_charges.%d.currency", field, i), fmt.Sprintf("%q is not an ISO 4217 currency code", charge.Currency)}
+		case charge.Amount < 0:
+			return ValidationError{fmt.Sprintf("%ssender_charges.%d.amount", field, i), "must not be negative"}
+		}
+	}
+	switch {
+	case c.ReceiverChargesAmount < 0:
+		return ValidationError{field + "receiver_charges_amount", "must not be negative"}
+	case c.ReceiverChargesAmount > 0 && !isCurrencyCode(c.ReceiverChargesCurrency):
+		return ValidationError{field + "receiver_charges_currency", fmt.Sprintf("%q is not an ISO 4217 currency code", c.ReceiverChargesCurrency)}
+	}
+
+	switch c.BearerCode {
+	case BearerShared, BearerCreditor:
+	case BearerDebtor:
+		if c.ReceiverChargesAmount > 0 {
+			return ValidationError{field + "receiver_charges_amount", "must be zero, as the debtor bears all charges"}
+		}
+	case "":
+		if len(c.SenderCharges) > 0 || c.ReceiverChargesAmount > 0 {
+			return ValidationError{field + "bearer_code", "must be set when there are charges"}
+		}
+	default:
+		return ValidationError{field + "bearer_code", fmt.Sprintf("expected SHAR, DEBT or CRED, got %q", c.BearerCode)}
+	}
+	return nil
+}
+
+// The charges of a payment, and what the beneficiary is credited, see ComputeCharges
+type Charges struct {
+	PaymentID  string           `json:"payment_id"`
+	BearerCode string           `json:"bearer_code"`
+	Amount     FractionalAmount `json:"amount"`
+	Currency   string           `json:"currency"`
+	// Totals of the sender charges by currency
+	SenderCharges map[string]FractionalAmount `json:"sender_charges"`
+	// The receiver charges by currency, if any
+	ReceiverCharges map[string]FractionalAmount `json:"receiver_charges"`
+	// Charges deducted from the amount, in the currency of the payment
+	Deducted FractionalAmount `json:"deducted"`
+	// What the beneficiary is credited: the amount less the deducted charges
+	NetAmount FractionalAmount `json:"net_amount"`
+}
+
+// Converts a charge into the currency of a payment: at the exchange rate of the payment if it is in
+// the original currency, and at the rate of the table effective on the processing date otherwise
+func chargeInPaymentCurrency(p Payment, amount FractionalAmount, currency string, rates *RateTable) (float64, bool) {
+	a := p.Attributes
+	switch {
+	case currency == a.Currency:
+		return float64(amount), true
+	case currency == a.Fx.OriginalCurrency && a.Fx.ExchangeRate > 0:
+		return float64(amount) / float64(a.Fx.ExchangeRate), true
+	case rates != nil:
+		rate, _, ok := rates.Rate(currency, a.Currency, a.ProcessingDate.Time)
+		return float64(amount) * rate, ok
+	}
+	return 0, false
+}
+
+// Totals the charges of a payment, and works out what the beneficiary is credited
+//
+// The beneficiary bears the receiver charges of SHAR payments, and all charges of CRED payments,
+// which are deducted from the amount. Charges in other currencies than the payment's are converted
+// as chargeInPaymentCurrency does, with rates if not nil. Returns a ValidationError if the charges
+// are invalid (see ValidateCharges), can't be converted, or exceed the amount.
+func ComputeCharges(p Payment, rates *RateTable) (Charges, error) {
+	a := p.Attributes
+	c := a.ChargesInformation
+	charges := Charges{
+		PaymentID:       p.ID,
+		BearerCode:      c.BearerCode,
+		Amount:          a.Amount,
+		Currency:        a.Currency,
+		SenderCharges:   map[string]FractionalAmount{},
+		ReceiverCharges: map[string]FractionalAmount{},
+	}
+	if err := ValidateCharges(p); err != nil {
+		return charges, err
+	}
+
+	for _, charge := range c.SenderCharges {
+		charges.SenderCharges[charge.Currency] += charge.Amount
+	}
+	if c.ReceiverChargesAmount > 0 {
+		charges.ReceiverCharges[c.ReceiverChargesCurrency] = c.ReceiverChargesAmount
+	}
+
+	var deducted map[string]FractionalAmount
+	switch c.BearerCode {
+	case BearerShared:
+		deducted = charges.ReceiverCharges
+	case BearerCreditor:
+		deducted = addAmounts(map[string]FractionalAmount{}, charges.SenderCharges, charges.ReceiverCharges)
+	}
+
+	total := 0.0
+	for _, currency := range slices.Sorted(maps.Keys(deducted)) {
+		converted, ok := chargeInPaymentCurrency(p, deducted[currency], currency, rates)
+		if !ok {
+			return charges, ValidationError{"attributes.charges_information", fmt.Sprintf("no rate to convert charges in %s to %s", currency, a.Currency)}
+		}
+		total += converted
+	}
+
+	for _, totals := range []map[string]FractionalAmount{charges.SenderCharges, charges.ReceiverCharges} {
+		for currency, amount := range totals {
+			totals[currency] = FractionalAmount(roundAmount(float64(amount), currency))
+		}
+	}
+	charges.Deducted = FractionalAmount(roundAmount(total, a.Currency))
+	charges.NetAmount = FractionalAmount(roundAmount(float64(a.Amount)-total, a.Currency))
+	if charges.NetAmount < 0 {
+		return charges, ValidationError{"attributes.charges_information", fmt.Sprintf("the charges deducted, %.2f %s, exceed the amount", charges.Deducted, a.Currency)}
+	}
+	return charges, nil
+}
+
+// Adds amounts by currency into totals, and returns it
+func addAmounts(totals map[string]FractionalAmount, amounts ...map[string]FractionalAmount) map[string]FractionalAmount {
+	for _, m := range amounts {
+		for currency, amount := range m {
+			totals[currency] += amount
+		}
+	}
+	return totals
+}
+
+// The charges of the payments of an organisation over a range of processing dates, see SummarizeFees
+type FeeSummary struct {
+	OrganisationID string `json:"organisation_id"`
+	Payments       int    `json:"payments"`
+	// Payments whose charges couldn't be computed, left out of the totals
+	Invalid int `json:"invalid"`
+	// Number of payments by bearer code
+	BearerCodes map[string]int `json:"bearer_codes"`
+	// Totals of the sender charges by currency
+	SenderCharges map[string]FractionalAmount `json:"sender_charges"`
+	// Totals of the receiver charges by currency
+	ReceiverCharges map[string]FractionalAmount `json:"receiver_charges"`
+	// Totals of the charges deducted from the amounts credited, by currency of the payments
+	Deducted map[string]FractionalAmount `json:"deducted"`
+}
+
+// Summarizes the charges of payments by organisation, ordered by organisation ID
+// Charges are computed by ComputeCharges, with rates if not nil.
+func SummarizeFees(payments []Payment, rates *RateTable) []FeeSummary {
+	byOrganisation := make(map[string]*FeeSummary)
+	for _, p := range payments {
+		s, ok := byOrganisation[p.OrganisationID]
+		if !ok {
+			s = &FeeSummary{
+				OrganisationID:  p.OrganisationID,
+				BearerCodes:     map[string]int{},
+				SenderCharges:   map[string]FractionalAmount{},
+				ReceiverCharges: map[string]FractionalAmount{},
+				Deducted:        map[string]FractionalAmount{},
+			}
+			byOrganisation[p.OrganisationID] = s
+		}
+
+		s.Payments++
+		charges, err := ComputeCharges(p, rates)
+		if err != nil {
+			s.Invalid++
+			continue
+		}
+		if charges.BearerCode != "" {
+			s.BearerCodes[charges.BearerCode]++
+		}
+		addAmounts(s.SenderCharges, charges.SenderCharges)
+		addAmounts(s.ReceiverCharges, charges.ReceiverCharges)
+		if charges.Deducted > 0 {
+			s.Deducted[charges.Currency] += charges.Deducted
+		}
+	}
+
+	summaries := make([]FeeSummary, 0, len(byOrganisation))
+	for _, s := range byOrganisation {
+		for _, totals := range []map[string]FractionalAmount{s.SenderCharges, s.ReceiverCharges, s.Deducted} {
+			for currency, amount := range totals {
+				totals[currency] = FractionalAmount(roundAmount(float64(amount), currency))
+			}
+		}
+		summaries = append(summaries, *s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].OrganisationID < summaries[j].OrganisationID })
+	return summaries
+}
+
+// ContextStore decorator checking the charges information of payments
+type chargesStore struct {
+	storeDecorator
+}
+
+// Wraps a store to check the charges information of every payment created or updated through it,
+// transactions included, with ValidateCharges
+// The returned store implements both ApiStore and ContextStore.
+func ChargesStore(store ApiStore) ApiStore {
+	return ApiStoreOf(&chargesStore{storeDecorator{ContextStoreOf(store)}})
+}
+
+func (s *chargesStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	if err := ValidateCharges(p); err != nil {
+		return err
+	}
+	return s.store.AddPaymentContext(ctx, p)
+}
+
+func (s *chargesStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	if err := ValidateCharges(p); err != nil {
+		return err
+	}
+	return s.store.UpdatePaymentContext(ctx, p)
+}
+
+func (s *chargesStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	if err := ValidateCharges(p); err != nil {
+		return err
+	}
+	return s.store.StorePaymentContext(ctx, p)
+}
+
+func (s *chargesStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &chargesTx{tx}, nil
+}
+
+// Transaction of a chargesStore, checking charges as payments are staged
+type chargesTx struct {
+	Tx
+}
+
+func (tx *chargesTx) AddPayment(p Payment) error {
+	if err := ValidateCharges(p); err != nil {
+		return err
+	}
+	return tx.Tx.AddPayment(p)
+}
+
+func (tx *chargesTx) UpdatePayment(p Payment) error {
+	if err := ValidateCharges(p); err != nil {
+		return err
+	}
+	return tx.Tx.UpdatePayment(p)
+}
+
+func (tx *chargesTx) StorePayment(p Payment) error {
+	if err := ValidateCharges(p); err != nil {
+		return err
+	}
+	return tx.Tx.StorePayment(p)
+}
+
+// Computes the charges of a payment and what its beneficiary is credited, requires an "id" parameter
+// Charges are converted at the rates served at /fx/quote, if any, see ComputeCharges.
+func (api *GenericApi) GetPaymentCharges(w rest.ResponseWriter, r *rest.Request) {
+	id := r.PathParam("id")
+	payment, err := api.store.GetPaymentContext(r.Context(), id)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+
+	charges, err := ComputeCharges(payment, api.rates)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, charges, EnvelopeLinks{Self: paymentPath(id) + "/charges"})
+}
+
+// Summarizes the charges of the payments processed between the "from" and "until" query parameters,
+// both days included, by organisation; only of the "organisation_id" query parameter if given
+func (api *GenericApi) GetFeeSummaries(w rest.ResponseWriter, r *rest.Request) {
+	query := r.URL.Query()
+	from, err := time.Parse(timeFmt, query.Get("from"))
+	if err != nil {
+		rest.Error(w, "The from parameter must be a day such as 2017-01-18", http.StatusBadRequest)
+		return
+	}
+	until, err := time.Parse(timeFmt, query.Get("until"))
+	if err != nil || until.Before(from) {
+		rest.Error(w, "The until parameter must be a day such as 2017-01-18, not before from", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := ParseFilter(fmt.Sprintf("processing_date >= %s AND processing_date <= %s", from.Format(timeFmt), until.Format(timeFmt)))
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	payments, err := FindPayments(r.Context(), api.store, filter)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+
+	if org, ok := query["organisation_id"]; ok {
+		var kept []Payment
+		for _, p := range payments {
+			if p.OrganisationID == org[0] {
+				kept = append(kept, p)
+			}
+		}
+		payments = kept
+	}
+
+	writeData(w, r, http.StatusOK, SummarizeFees(payments, api.rates), EnvelopeLinks{Self: r.URL.RequestURI()})
+}
@@ -0,0 +1,155 @@
+package f3api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Tests checking bearer codes against the charges
+func TestValidateCharges(t *testing.T) {
+	if err := ValidateCharges(defaultPayment()); err != nil {
+		t.Fatal(err)
+	}
+
+	for field, change := range map[string]func(*ChargeInformation){
+		"bearer_code":               func(c *ChargeInformation) { c.BearerCode = "OUR" },
+		"receiver_charges_amount":   func(c *ChargeInformation) { c.BearerCode = BearerDebtor },
+		"sender_charges.1.currency": func(c *ChargeInformation) { c.SenderCharges[1].Currency = "" },
+		"sender_charges.0.amount":   func(c *ChargeInformation) { c.SenderCharges[0].Amount = -1 },
+		"receiver_charges_currency": func(c *ChargeInformation) { c.ReceiverChargesCurrency = "dollars" },
+		"bearer_code ":              func(c *ChargeInformation) { c.BearerCode = "" },
+		"receiver_charges_amount ":  func(c *ChargeInformation) { c.ReceiverChargesAmount = -1 },
+	} {
+		p := defaultPayment()
+		p.Attributes.ChargesInformation.SenderCharges = append([]SenderCharge{}, p.Attributes.ChargesInformation.SenderCharges...)
+		change(&p.Attributes.ChargesInformation)
+
+		var verr ValidationError
+		if err := ValidateCharges(p); !errors.As(err, &verr) || verr.Field != "attributes.charges_information."+strings.TrimSpace(field) {
+			t.Fatalf("Expected %s to be refused, got %v", field, err)
+		}
+	}
+
+	p := defaultPayment()
+	p.Attributes.ChargesInformation = ChargeInformation{}
+	if err := ValidateCharges(p); err != nil {
+		t.Fatalf("Expected a payment without charges to be valid, got %v", err)
+	}
+}
+
+// Tests totalling charges, and deducting the ones the beneficiary bears
+func TestComputeCharges(t *testing.T) {
+	rates, err := ReadRateTable(strings.NewReader("EUR,GBP,0.5,2017-01-01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		bearer   string
+		deducted FractionalAmount
+	}{
+		// 1 USD at 2 USD to the pound
+		{BearerShared, 0.5},
+		{BearerDebtor, 0},
+		// 5 GBP, and 11 USD at 2 USD to the pound
+		{BearerCreditor, 10.5},
+	} {
+		p := defaultPayment()
+		p.Attributes.ChargesInformation.BearerCode = c.bearer
+		if c.bearer == BearerDebtor {
+			p.Attributes.ChargesInformation.ReceiverChargesAmount = 0
+		}
+
+		charges, err := ComputeCharges(p, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.bearer, err)
+		}
+		if charges.Deducted != c.deducted || charges.NetAmount != p.Attributes.Amount-c.deducted {
+			t.Fatalf("%s: expected %.2f deducted, got %+v", c.bearer, c.deducted, charges)
+		}
+		if charges.SenderCharges["GBP"] != 5 || charges.SenderCharges["USD"] != 10 {
+			t.Fatalf("%s: unexpected sender charges %+v", c.bearer, charges.SenderCharges)
+		}
+	}
+
+	// charges in a third currency need a rate
+	p := defaultPayment()
+	p.Attributes.ChargesInformation.ReceiverChargesCurrency = "EUR"
+	var verr ValidationError
+	if _, err := ComputeCharges(p, nil); !errors.As(err, &verr) {
+		t.Fatalf("Expected a validation error without rates, got %v", err)
+	}
+	if charges, err := ComputeCharges(p, rates); err != nil || charges.NetAmount != 99.71 {
+		t.Fatalf("Expected 1 EUR to be deducted at 0.5 GBP, got %+v (%v)", charges, err)
+	}
+
+	p.Attributes.ChargesInformation.BearerCode = BearerCreditor
+	p.Attributes.Amount = 5
+	if _, err := ComputeCharges(p, rates); !errors.As(err, &verr) {
+		t.Fatalf("Expected charges exceeding the amount to be refused, got %v", err)
+	}
+}
+
+// Tests summarizing charges by organisation, over a range of processing dates
+func TestFeeSummaries(t *testing.T) {
+	store := ChargesStore(NewInMemStore())
+	handler, err := MakeHandler(NewGenericApi(store), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := defaultPayment()
+	invalid := p
+	invalid.Attributes.ChargesInformation.BearerCode = "OUR"
+	var verr ValidationError
+	if err := store.AddPayment(invalid); !errors.As(err, &verr) {
+		t.Fatalf("Expected the invalid bearer code to be refused, got %v", err)
+	}
+
+	for i, change := range []func(*Payment){
+		func(p *Payment) {},
+		func(p *Payment) { p.Attributes.ChargesInformation.BearerCode = BearerCreditor },
+		func(p *Payment) { p.OrganisationID = "other" },
+		func(p *Payment) { p.Attributes.ProcessingDate.Time = p.Attributes.ProcessingDate.AddDate(0, 1, 0) },
+	} {
+		p := defaultPayment()
+		p.ID = string(rune('a' + i))
+		change(&p)
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := sendWithMediaTypes(handler, "GET", "/charges/summary?from=2017-01-01&until=2017-01-31", "", "", "")
+	var summaries []FeeSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(summaries) != 2 || summaries[1].OrganisationID != "other" {
+		t.Fatalf("Unexpected summaries %+v", summaries)
+	}
+	s := summaries[0]
+	if s.Payments != 2 || s.BearerCodes[BearerShared] != 1 || s.BearerCodes[BearerCreditor] != 1 ||
+		s.SenderCharges["GBP"] != 10 || s.ReceiverCharges["USD"] != 2 || s.Deducted["GBP"] != 11 {
+		t.Fatalf("Unexpected summary %+v", s)
+	}
+
+	w = sendWithMediaTypes(handler, "GET", "/charges/summary?from=2017-01-01&until=2017-02-28&organisation_id="+p.OrganisationID, "", "", "")
+	summaries = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &summaries); err != nil || len(summaries) != 1 || summaries[0].Payments != 3 {
+		t.Fatalf("Unexpected summaries %s", w.Body)
+	}
+
+	if w := sendWithMediaTypes(handler, "GET", "/charges/summary?from=2017-01-31&until=2017-01-01", "", "", ""); w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = sendWithMediaTypes(handler, "GET", "/payments/a/charges", "", "", "")
+	var charges Charges
+	if err := json.Unmarshal(w.Body.Bytes(), &charges); err != nil || charges.NetAmount != 99.71 {
+		t.Fatalf("Unexpected charges %s", w.Body)
+	}
+}
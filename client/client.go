@@ -0,0 +1,391 @@
+// Go client of the payments API served by f3api.RunServer
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThrosturX/f3api"
+)
+
+// Settings of a Client; the zero value is ready to use
+type Config struct {
+	// Client making the requests; http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	// How many times idempotent requests (GET, PUT and DELETE) are retried after a network error or
+	// a 429, 502, 503 or 504 response; 3 if zero, no retries if negative
+	MaxRetries int
+
+	// Delay before the first retry, doubled for each one after it; 100 milliseconds if zero
+	RetryBackoff time.Duration
+
+	// Number of payments fetched per request by ListPayments; 100 if zero
+	PageSize int
+}
+
+// Client of the payments API
+// Safe for concurrent use.
+type Client struct {
+	baseURL *url.URL
+	config  Config
+}
+
+// Creates a client for the payments API served at baseURL, e.g. "http://localhost:8080"
+func NewClient(baseURL string, config Config) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("client: base URL %q must be absolute", baseURL)
+	}
+
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 3
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = 100 * time.Millisecond
+	}
+	if config.PageSize == 0 {
+		config.PageSize = 100
+	}
+
+	c := Client{
+		baseURL: u,
+		config:  config,
+	}
+	return &c, nil
+}
+
+// Returned (as an Error) when the server holds a payment for review rather than writing it
+var ErrHeld = errors.New("payment held for review")
+
+// Returned (as an Error) when the server refuses a payment duplicating a recent one, see
+// f3api.DuplicateError; unlike f3api.ErrPaymentExists, the payment can't be updated instead
+var ErrDuplicate = errors.New("payment duplicates a recent one")
+
+// Error response of the server
+// Matches f3api.ErrPaymentNotFound with errors.Is for 404 responses, and for 409 responses
+// ErrDuplicate, f3api.ErrTxConflict or otherwise f3api.ErrPaymentExists, depending on the conflict.
+// Matches ErrHeld for 202 responses to writes.
+type Error struct {
+	StatusCode int
+	// The error message of the server, or the response status if it didn't send one
+	Message string `json:"Error"`
+	// The path of the payment duplicated by the refused one, for ErrDuplicate
+	Original string `json:"original,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("payments API: %d %s", e.StatusCode, e.Message)
+}
+
+// Makes errors.Is match the errors of the store which the server reports with the same status
+func (e *Error) Is(target error) bool {
+	switch target {
+	case f3api.ErrPaymentNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case f3api.ErrPaymentExists:
+		return e.StatusCode == http.StatusConflict && e.Original == "" && e.Message != f3api.ErrTxConflict.Error()
+	case f3api.ErrTxConflict:
+		return e.StatusCode == http.StatusConflict && e.Message == f3api.ErrTxConflict.Error()
+	case ErrDuplicate:
+		return e.StatusCode == http.StatusConflict && e.Original != ""
+	case ErrHeld:
+		return e.StatusCode == http.StatusAccepted
+	}
+	return false
+}
+
+// Decodes the error body of a failed response
+func readError(resp *http.Response) error {
+	e := Error{StatusCode: resp.StatusCode}
+	buf, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		e.Message = ErrHeld.Error()
+	case json.Unmarshal(buf, &e) != nil || e.Message == "":
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return &e
+}
+
+// Reports whether a request can safely be sent again
+func idempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodPut || method == http.MethodDelete
+}
+
+// Reports whether a response status is worth retrying
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// A request body which is sent as it is, rather than encoded as JSON
+type rawBody struct {
+	contentType string
+	data        []byte
+}
+
+// Sends a request to path (relative to the base URL, possibly with a query), retrying idempotent
+// requests as configured, and decodes the JSON response into out unless it is nil
+// Returns the final response, with its body already consumed.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) (*http.Response, error) {
+	var body []byte
+	contentType := "application/json"
+	if raw, ok := in.(rawBody); ok {
+		body, contentType = raw.data, raw.contentType
+	} else if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+
+	u, err := c.baseURL.Parse(c.baseURL.Path + path)
+	if err != nil {
+		return nil, err
+	}
+
+	retries := 0
+	if idempotent(method) && c.config.MaxRetries > 0 {
+		retries = c.config.MaxRetries
+	}
+	backoff := c.config.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, u.String(), contentType, body)
+		// payments held for review by screening aren't written, see f3api.ScreenStore
+		if err == nil && resp.StatusCode < 300 && resp.StatusCode != http.StatusAccepted {
+			defer resp.Body.Close()
+			if out != nil {
+				if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+					return resp, err
+				}
+			}
+			return resp, nil
+		}
+
+		if err == nil {
+			err = readError(resp)
+			resp.Body.Close()
+			// an earlier attempt may well have deleted the payment before failing
+			if method == http.MethodDelete && attempt > 0 && resp.StatusCode == http.StatusNotFound {
+				return resp, nil
+			}
+			if !retryable(resp.StatusCode) {
+				return resp, err
+			}
+		}
+		// the context's error is final, whatever the transport made of it
+		if ctx.Err() != nil {
+			return resp, ctx.Err()
+		}
+		if attempt >= retries {
+			return resp, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// Sends a single request
+func (c *Client) send(ctx context.Context, method, url, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.config.HTTPClient.Do(req)
+}
+
+// Fetches a payment
+func (c *Client) GetPayment(ctx context.Context, id string) (f3api.Payment, error) {
+	var p f3api.Payment
+	_, err := c.do(ctx, http.MethodGet, "/payments/"+url.PathEscape(id), nil, &p)
+	return p, err
+}
+
+// Creates a payment, which must have an ID and must not exist yet (see f3api.ErrPaymentExists)
+// Not retried, as a retry could fail with a conflict after the first attempt succeeded.
+func (c *Client) CreatePayment(ctx context.Context, p f3api.Payment) (f3api.Payment, error) {
+	var created f3api.Payment
+	_, err := c.do(ctx, http.MethodPost, "/payments", p, &created)
+	return created, err
+}
+
+// Creates or replaces the payment with the ID of p
+func (c *Client) PutPayment(ctx context.Context, p f3api.Payment) (f3api.Payment, error) {
+	var stored f3api.Payment
+	_, err := c.do(ctx, http.MethodPut, "/payments/"+url.PathEscape(p.ID), p, &stored)
+	return stored, err
+}
+
+// Deletes a payment
+// If the request is retried, a payment found missing counts as deleted, as it may have been by an
+// attempt whose response was lost.
+func (c *Client) DeletePayment(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/payments/"+url.PathEscape(id), nil, nil)
+	return err
+}
+
+// Creates many payments in a single request, or with upsert, creates or updates them
+// Each payment is stored on its own; the outcome of each is reported in the same order, see
+// f3api.BulkItemResult. Not retried, see CreatePayment.
+func (c *Client) ImportPayments(ctx context.Context, payments []f3api.Payment, upsert bool) ([]f3api.BulkItemResult, error) {
+	path := "/payments/bulk"
+	if upsert {
+		path += "?upsert=true"
+	}
+	if payments == nil {
+		payments = []f3api.Payment{}
+	}
+
+	var results []f3api.BulkItemResult
+	_, err := c.do(ctx, http.MethodPost, path, payments, &results)
+	return results, err
+}
+
+// Creates the payments of a CSV file, in the layout of f3api.NewPaymentCSVReader
+// Not retried, see CreatePayment.
+func (c *Client) ImportCSV(ctx context.Context, r io.Reader) (f3api.ImportResult, error) {
+	var result f3api.ImportResult
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return result, err
+	}
+	_, err = c.do(ctx, http.MethodPost, "/payments/import", rawBody{"text/csv", data}, &result)
+	return result, err
+}
+
+// Changes a payment by fetching it, applying update to it and storing the result
+// The server has no partial updates, so this is a read-modify-write which doesn't guard against
+// concurrent changes made between the read and the write. An error returned by update aborts the
+// change and is returned as it is.
+func (c *Client) Patch(ctx context.Context, id string, update func(*f3api.Payment) error) (f3api.Payment, error) {
+	p, err := c.GetPayment(ctx, id)
+	if err != nil {
+		return f3api.Payment{}, err
+	}
+	if err := update(&p); err != nil {
+		return f3api.Payment{}, err
+	}
+	p.ID = id
+	return c.PutPayment(ctx, p)
+}
+
+// Iterates over all payments, ordered by ID, fetching them a page at a time
+//
+//	it := c.ListPayments(ctx)
+//	for it.Next() {
+//		p := it.Payment()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+func (c *Client) ListPayments(ctx context.Context) *PaymentIterator {
+	query := url.Values{"limit": {strconv.Itoa(c.config.PageSize)}}
+	it := PaymentIterator{
+		ctx:    ctx,
+		client: c,
+		next:   "/payments?" + query.Encode(),
+	}
+	return &it
+}
+
+// Iterator over a list of payments, see ListPayments
+type PaymentIterator struct {
+	ctx     context.Context
+	client  *Client
+	page    []f3api.Payment
+	current f3api.Payment
+	// path of the next page, "" once the last page has been fetched
+	next string
+	err  error
+}
+
+// Advances to the next payment, fetching the next page if needed
+// Returns false at the end of the list or on error, see Err.
+func (it *PaymentIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.next == "" || it.err != nil {
+			return false
+		}
+		it.err = it.fetch()
+	}
+
+	it.current, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Fetches the next page, and finds where the one after it is
+func (it *PaymentIterator) fetch() error {
+	var page []f3api.Payment
+	resp, err := it.client.do(it.ctx, http.MethodGet, it.next, nil, &page)
+	if err != nil {
+		return err
+	}
+
+	it.page = page
+	it.next = ""
+	if link := nextLink(resp.Header.Get("Link")); link != "" {
+		u, err := url.Parse(link)
+		if err != nil {
+			return err
+		}
+		it.next = "/payments?" + u.RawQuery
+	}
+	return nil
+}
+
+// The payment Next advanced to
+func (it *PaymentIterator) Payment() f3api.Payment {
+	return it.current
+}
+
+// The error which ended the iteration, if any
+func (it *PaymentIterator) Err() error {
+	return it.err
+}
+
+// Finds the target of the rel="next" link in a Link header
+func nextLink(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			if strings.ReplaceAll(strings.TrimSpace(param), " ", "") == `rel="next"` {
+				return strings.Trim(target, "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThrosturX/f3api"
+	"github.com/ThrosturX/f3api/storetest"
+)
+
+// Starts a payments server backed by an in-memory store, and a client for it
+func newTestClient(t *testing.T, config Config) *Client {
+	t.Helper()
+
+	handler, err := f3api.MakeHandler(f3api.NewGenericApi(f3api.NewInMemStore()), f3api.ServerConfig{Metrics: f3api.NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c, err := NewClient(server.URL, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Tests creating, fetching, changing and deleting a payment
+func TestClientCRUD(t *testing.T) {
+	c := newTestClient(t, Config{})
+	ctx := t.Context()
+	p := storetest.NewPayment("4ee3a8d8-ca7b-4290-a52c-dd5b6165ec43")
+
+	if _, err := c.CreatePayment(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreatePayment(ctx, p); !errors.Is(err, f3api.ErrPaymentExists) {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+
+	found, err := c.GetPayment(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.ID != p.ID || found.Attributes.Amount != p.Attributes.Amount {
+		t.Fatalf("Unexpected payment %+v", found)
+	}
+
+	patched, err := c.Patch(ctx, p.ID, func(p *f3api.Payment) error {
+		p.Version++
+		p.Attributes.Reference = "Patched"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err = c.GetPayment(ctx, p.ID); err != nil || found.Attributes.Reference != "Patched" || found.Version != patched.Version {
+		t.Fatalf("Patch was not stored: %+v %v", found, err)
+	}
+
+	if err := c.DeletePayment(ctx, p.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.GetPayment(ctx, p.ID)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+	if apiErr.Message == "" {
+		t.Fatal("Expected the error message of the server")
+	}
+}
+
+// Tests iterating over several pages of payments
+func TestClientListPayments(t *testing.T) {
+	c := newTestClient(t, Config{PageSize: 2})
+	ctx := t.Context()
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.CreatePayment(ctx, storetest.NewPayment(fmt.Sprintf("payment-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []string
+	it := c.ListPayments(ctx)
+	for it.Next() {
+		ids = append(ids, it.Payment().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(ids) != "[payment-0 payment-1 payment-2 payment-3 payment-4]" {
+		t.Fatalf("Unexpected listing %v", ids)
+	}
+}
+
+// Tests that idempotent requests are retried when the server is unavailable, and others aren't
+func TestClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, `{"Error":"try again"}`, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id":"retried"}`))
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, Config{RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := c.GetPayment(t.Context(), "retried")
+	if err != nil || p.ID != "retried" || calls.Load() != 3 {
+		t.Fatalf("Expected success on the third attempt, got %v after %d calls", err, calls.Load())
+	}
+
+	calls.Store(0)
+	_, err = c.CreatePayment(t.Context(), storetest.NewPayment("retried"))
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Fatalf("Expected a single failed POST, got %v after %d calls", err, calls.Load())
+	}
+}
+
+// Tests that a retried DELETE finding the payment gone succeeds, unlike a first attempt doing so
+func TestClientRetriedDelete(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt deletes the payment, but its response is lost
+		if calls.Add(1) == 1 {
+			http.Error(w, `{"Error":"timeout"}`, http.StatusGatewayTimeout)
+			return
+		}
+		http.Error(w, `{"Error":"not found"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL, Config{RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.DeletePayment(t.Context(), "deleted"); err != nil || calls.Load() != 2 {
+		t.Fatalf("Expected the retried delete to succeed, got %v after %d calls", err, calls.Load())
+	}
+	if err := c.DeletePayment(t.Context(), "deleted"); !errors.Is(err, f3api.ErrPaymentNotFound) || calls.Load() != 3 {
+		t.Fatalf("Expected ErrPaymentNotFound, got %v after %d calls", err, calls.Load())
+	}
+}
+
+// Tests that a cancelled context stops the client, retries included
+func TestClientContext(t *testing.T) {
+	c := newTestClient(t, Config{})
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	if _, err := c.GetPayment(ctx, "any"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancelled request, got %v", err)
+	}
+}
+
+// Tests creating payments in bulk and from CSV
+func TestClientImport(t *testing.T) {
+	c := newTestClient(t, Config{})
+	ctx := t.Context()
+	payments := []f3api.Payment{storetest.NewPayment("payment-0"), storetest.NewPayment("payment-1")}
+
+	results, err := c.ImportPayments(ctx, payments, false)
+	if err != nil || len(results) != 2 || results[0].Status != http.StatusCreated {
+		t.Fatalf("Unexpected bulk results %+v %v", results, err)
+	}
+
+	var csv strings.Builder
+	if err := f3api.WritePaymentsCSV(&csv, []f3api.Payment{storetest.NewPayment("payment-2"), payments[0]}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.ImportCSV(ctx, strings.NewReader(csv.String()))
+	if err != nil || result.Imported != 1 || len(result.Errors) != 1 || result.Errors[0].ID != payments[0].ID {
+		t.Fatalf("Unexpected import result %+v %v", result, err)
+	}
+}
+
+// Tests that payments held for review aren't mistaken for written ones
+func TestClientHeld(t *testing.T) {
+	list := f3api.NewWatchList([]f3api.WatchListEntry{{Name: "Wilfred Jeremiah Owens"}})
+	store := f3api.ScreenStore(f3api.NewInMemStore(), f3api.NewListScreener(list))
+	handler, err := f3api.MakeHandler(f3api.NewGenericApi(store), f3api.ServerConfig{Metrics: f3api.NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c, err := NewClient(server.URL, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreatePayment(t.Context(), storetest.NewPayment("held")); !errors.Is(err, ErrHeld) {
+		t.Fatalf("Expected the payment to be held, got %v", err)
+	}
+}
+
+// Tests that payments refused as duplicates aren't mistaken for existing ones
+func TestClientDuplicate(t *testing.T) {
+	store := f3api.DetectDuplicates(f3api.NewInMemStore(), f3api.DuplicateConfig{})
+	handler, err := f3api.MakeHandler(f3api.NewGenericApi(store), f3api.ServerConfig{Metrics: f3api.NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	c, err := NewClient(server.URL, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.CreatePayment(t.Context(), storetest.NewPayment("original")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.CreatePayment(t.Context(), storetest.NewPayment("original"))
+	if !errors.Is(err, f3api.ErrPaymentExists) || errors.Is(err, ErrDuplicate) {
+		t.Fatalf("Expected the payment to exist, got %v", err)
+	}
+
+	_, err = c.CreatePayment(t.Context(), storetest.NewPayment("duplicate"))
+	var cerr *Error
+	if !errors.Is(err, ErrDuplicate) || errors.Is(err, f3api.ErrPaymentExists) || !errors.As(err, &cerr) || cerr.Original != "/payments/original" {
+		t.Fatalf("Expected the payment to be refused as a duplicate, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ThrosturX/f3api"
+)
+
+// Formats of payment files
+const (
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+)
+
+// Picks the format of a payment file: the one given with -format, or else the one its extension
+// suggests, or else JSON
+func fileFormat(flagValue, path string) (string, error) {
+	switch flagValue {
+	case formatJSON, formatCSV, formatNDJSON:
+		return flagValue, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown format %q, expected json, csv or ndjson", flagValue)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return formatCSV, nil
+	case ".ndjson", ".jsonl":
+		return formatNDJSON, nil
+	}
+	return formatJSON, nil
+}
+
+// Opens a file for reading, or stdin if path is "" or "-"
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// Creates a file for writing, or returns stdout if path is "" or "-"
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+// Writer with a Close method which does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// A payment read from a file, or the reason it couldn't be read
+type fileItem struct {
+	// Position of the payment in the file: "line N" for CSV and NDJSON, "item N" for JSON arrays
+	where   string
+	payment f3api.Payment
+	err     error
+}
+
+// Reads every payment of a file
+// Errors confined to a single payment are reported in its item, and reading carries on with the next
+// one; errors which make the rest of the file unreadable are returned.
+func readPayments(r io.Reader, format string) ([]fileItem, error) {
+	var items []fileItem
+
+	switch format {
+	case formatCSV:
+		reader, err := f3api.NewPaymentCSVReader(r)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			p, err := reader.Read()
+			if err == io.EOF {
+				return items, nil
+			}
+			if rowErr, ok := err.(*f3api.CSVRowError); ok {
+				items = append(items, fileItem{where: fmt.Sprintf("line %d", rowErr.Line), err: rowErr.Err})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, fileItem{where: fmt.Sprintf("line %d", reader.Line()), payment: p})
+		}
+
+	case formatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			item := fileItem{where: fmt.Sprintf("line %d", line)}
+			item.err = json.Unmarshal(scanner.Bytes(), &item.payment)
+			items = append(items, item)
+		}
+		return items, scanner.Err()
+	}
+
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	for i, msg := range raw {
+		item := fileItem{where: fmt.Sprintf("item %d", i+1)}
+		item.err = json.Unmarshal(msg, &item.payment)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Writes payments to a file in the given format
+func writePayments(w io.Writer, format string, payments []f3api.Payment) error {
+	switch format {
+	case formatCSV:
+		return f3api.WritePaymentsCSV(w, payments)
+
+	case formatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, p := range payments {
+			if err := enc.Encode(&p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if payments == nil {
+		payments = []f3api.Payment{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(payments)
+}
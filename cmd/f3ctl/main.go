@@ -0,0 +1,123 @@
+// Command-line tool for running and operating the payments service
+//
+// Usage:
+//
+//	f3ctl <command> [flags] [arguments]
+//
+// Run "f3ctl help" for the list of commands, and "f3ctl <command> -h" for the flags of a command.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// A subcommand of f3ctl
+type command struct {
+	// Arguments of the command, shown in its usage line
+	args string
+	// One line description, shown in the command list
+	summary string
+	// Runs the command with its own arguments (without the command name)
+	run func(args []string) error
+}
+
+// All subcommands, by name
+// Filled in by init, as the commands refer back to it for their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":    {"[flags]", "Run the payments API server", runServe},
+		"get":      {"[flags] <id>...", "Show payments", runGet},
+		"list":     {"[flags]", "List all payments", runList},
+		"create":   {"[flags] [file]", "Create a payment from a JSON file, or from stdin", runCreate},
+		"delete":   {"[flags] <id>...", "Delete payments", runDelete},
+		"import":   {"[flags] [file]", "Create (or update) the payments of a JSON, CSV or NDJSON file", runImport},
+		"export":   {"[flags] [file]", "Write all payments to a JSON, CSV or NDJSON file", runExport},
+		"validate": {"[flags] <file>...", "Check payment files offline, without a server", runValidate},
+		"backup":   {"[flags] <file>", "Write a snapshot of every payment of a server to a file", runBackup},
+		"restore":  {"[flags] <file>", "Restore a snapshot written by backup, replacing payments with the same IDs", runRestore},
+		"migrate":  {"[flags]", "Bring the schema of a persistent store up to date", runMigrate},
+	}
+}
+
+// Error which only calls for the usage of a command to be shown
+var errUsage = errors.New("usage")
+
+// Error of a command which has already reported what went wrong
+var errFailed = errors.New("failed")
+
+// Error of a command which has already reported the payments held for review by the server
+var errHeld = errors.New("held for review")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// Runs the command named by args[0], returning the exit status: 0 on success, 1 on failure,
+// 2 on misuse and 3 if payments were held for review (but none failed)
+func run(args []string, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(stderr)
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "f3ctl: unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+
+	err := cmd.run(args[1:])
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(stderr, "usage: f3ctl %s %s\n", args[0], cmd.args)
+		return 2
+	case errors.Is(err, errFailed):
+		return 1
+	case errors.Is(err, errHeld):
+		return 3
+	}
+
+	fmt.Fprintf(stderr, "f3ctl %s: %v\n", args[0], err)
+	return 1
+}
+
+// Lists the commands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: f3ctl <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-9s %s\n", name, commands[name].summary)
+	}
+}
+
+// Creates the flag set of a command, reporting errors rather than exiting
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("f3ctl "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: f3ctl %s %s\n", name, commands[name].args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThrosturX/f3api"
+	"github.com/ThrosturX/f3api/storetest"
+)
+
+// Starts a payments server, returning the store behind it and the -server flag pointing at it
+func startServer(t *testing.T) (*f3api.InMemStore, string) {
+	t.Helper()
+
+	store := f3api.NewInMemStore()
+	handler, err := f3api.MakeHandler(f3api.NewGenericApi(store), f3api.ServerConfig{Metrics: f3api.NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return store, "-server=" + server.URL
+}
+
+// Runs f3ctl, failing the test unless it exits with the expected status
+func runCommand(t *testing.T, status int, args ...string) {
+	t.Helper()
+
+	if got := run(args, io.Discard); got != status {
+		t.Fatalf("f3ctl %v exited with %d, expected %d", args, got, status)
+	}
+}
+
+// Tests moving payments between servers in every file format, and through a backup
+func TestImportExport(t *testing.T) {
+	dir := t.TempDir()
+	source, server := startServer(t)
+	for i := 0; i < 3; i++ {
+		if err := source.AddPayment(storetest.NewPayment(fmt.Sprintf("payment-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"payments.json", "payments.csv", "payments.ndjson", "backup"} {
+		path := filepath.Join(dir, name)
+		target, targetServer := startServer(t)
+
+		if name == "backup" {
+			runCommand(t, 0, "backup", server, path)
+			runCommand(t, 0, "restore", targetServer, path)
+		} else {
+			runCommand(t, 0, "export", server, path)
+			runCommand(t, 0, "validate", path)
+			runCommand(t, 0, "import", targetServer, path)
+			// importing again conflicts, unless updating
+			runCommand(t, 1, "import", targetServer, path)
+			runCommand(t, 0, "import", targetServer, "-upsert", path)
+		}
+
+		payments, err := target.GetAllPayments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payments) != 3 {
+			t.Fatalf("%s: expected 3 payments, got %d", name, len(payments))
+		}
+	}
+}
+
+// Tests that validate reports invalid and duplicate payments
+func TestValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payments.ndjson")
+	p := storetest.NewPayment("payment")
+	invalid := p
+	invalid.ID = "invalid"
+	invalid.Attributes.Currency = "pounds"
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePayments(f, formatNDJSON, []f3api.Payment{p, invalid}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	runCommand(t, 1, "validate", "-o=json", path)
+
+	if err := os.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	runCommand(t, 1, "validate", path)
+
+	runCommand(t, 2, "validate")
+	runCommand(t, 2, "frobnicate")
+}
+
+// Tests that migrating the memory store does nothing, and that unknown stores are refused
+func TestMigrate(t *testing.T) {
+	runCommand(t, 0, "migrate", "-store=memory")
+	runCommand(t, 1, "migrate", "-store=postgres")
+	runCommand(t, 2, "migrate", "extra")
+}
+
+// Tests fetching and deleting payments by ID
+func TestGetDelete(t *testing.T) {
+	store, server := startServer(t)
+	if err := store.AddPayment(storetest.NewPayment("payment")); err != nil {
+		t.Fatal(err)
+	}
+
+	runCommand(t, 0, "get", server, "-o=json", "payment")
+	runCommand(t, 0, "list", server)
+	runCommand(t, 0, "delete", server, "payment")
+	runCommand(t, 1, "get", server, "payment")
+	runCommand(t, 1, "delete", server, "payment")
+}
+
+// Tests that payments held for review are neither imported nor failures
+func TestImportHeld(t *testing.T) {
+	list := f3api.NewWatchList([]f3api.WatchListEntry{{Name: "Ivan Petrovich Sidorov"}})
+	store := f3api.ScreenStore(f3api.NewInMemStore(), f3api.NewListScreener(list))
+	handler, err := f3api.MakeHandler(f3api.NewGenericApi(store), f3api.ServerConfig{Metrics: f3api.NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	held := storetest.NewPayment("held")
+	held.Attributes.BeneficiaryParty.Name = "Ivan Petrovich Sidorov"
+	path := filepath.Join(t.TempDir(), "payments.ndjson")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePayments(f, formatNDJSON, []f3api.Payment{storetest.NewPayment("stored"), held}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	runCommand(t, 3, "import", "-server="+server.URL, path)
+	if _, err := store.GetPayment("stored"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPayment("held"); err == nil {
+		t.Fatal("Expected the held payment not to be stored")
+	}
+
+	// failures take precedence
+	runCommand(t, 1, "import", "-server="+server.URL, path)
+}
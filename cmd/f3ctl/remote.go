@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ThrosturX/f3api"
+	"github.com/ThrosturX/f3api/client"
+)
+
+// Output modes of the commands which show payments
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// Flags shared by the commands which talk to a running server
+type remoteFlags struct {
+	server  *string
+	timeout *time.Duration
+}
+
+// Adds the server flags to a flag set
+func addRemoteFlags(fs *flag.FlagSet) remoteFlags {
+	return remoteFlags{
+		server:  fs.String("server", envOr("F3API_SERVER", "http://localhost:8080"), "base URL of the payments API"),
+		timeout: fs.Duration("timeout", time.Minute, "how long the whole command may take"),
+	}
+}
+
+// Creates a client for the server, and the context bounding the command
+func (f remoteFlags) connect() (*client.Client, context.Context, context.CancelFunc, error) {
+	c, err := client.NewClient(*f.server, client.Config{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *f.timeout)
+	return c, ctx, cancel, nil
+}
+
+// Adds the output mode flag to a flag set
+func addOutputFlag(fs *flag.FlagSet) *string {
+	return fs.String("o", outputTable, "output mode: table or json")
+}
+
+// Shows payments on stdout, as a table or as JSON
+func printPayments(w io.Writer, output string, payments []f3api.Payment) error {
+	switch output {
+	case outputJSON:
+		if payments == nil {
+			payments = []f3api.Payment{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(payments)
+
+	case outputTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tVERSION\tORGANISATION\tAMOUNT\tCURRENCY\tSCHEME\tPROCESSING DATE\tREFERENCE")
+		for _, p := range payments {
+			a := p.Attributes
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", p.ID, p.Version, p.OrganisationID,
+				strconv.FormatFloat(float64(a.Amount), 'f', 2, 64), a.Currency, a.PaymentScheme,
+				a.ProcessingDate.Format("2006-01-02"), a.Reference)
+		}
+		return tw.Flush()
+	}
+
+	return fmt.Errorf("unknown output mode %q, expected table or json", output)
+}
+
+// Shows payments by ID
+func runGet(args []string) error {
+	fs := newFlagSet("get")
+	remote := addRemoteFlags(fs)
+	output := addOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	var payments []f3api.Payment
+	for _, id := range fs.Args() {
+		p, err := c.GetPayment(ctx, id)
+		if err != nil {
+			return fmt.Errorf("%s: %w", id, err)
+		}
+		payments = append(payments, p)
+	}
+
+	return printPayments(os.Stdout, *output, payments)
+}
+
+// Lists every payment
+func runList(args []string) error {
+	fs := newFlagSet("list")
+	remote := addRemoteFlags(fs)
+	output := addOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	payments, err := listPayments(ctx, c)
+	if err != nil {
+		return err
+	}
+	return printPayments(os.Stdout, *output, payments)
+}
+
+// Fetches every payment of the server, page by page
+func listPayments(ctx context.Context, c *client.Client) ([]f3api.Payment, error) {
+	var payments []f3api.Payment
+
+	it := c.ListPayments(ctx)
+	for it.Next() {
+		payments = append(payments, it.Payment())
+	}
+	return payments, it.Err()
+}
+
+// Creates a single payment from a JSON document
+func runCreate(args []string) error {
+	fs := newFlagSet("create")
+	remote := addRemoteFlags(fs)
+	output := addOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var p f3api.Payment
+	if err := json.NewDecoder(in).Decode(&p); err != nil {
+		return err
+	}
+	if err := f3api.ValidatePayment(p); err != nil {
+		return err
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	created, err := c.CreatePayment(ctx, p)
+	if errors.Is(err, client.ErrHeld) {
+		fmt.Fprintf(os.Stderr, "%s: held for review\n", p.ID)
+		return errHeld
+	}
+	if err != nil {
+		return err
+	}
+	return printPayments(os.Stdout, *output, []f3api.Payment{created})
+}
+
+// Deletes payments by ID
+// Every ID is tried, even after a failure; payments which don't exist count as failures.
+func runDelete(args []string) error {
+	fs := newFlagSet("delete")
+	remote := addRemoteFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	failed := false
+	for _, id := range fs.Args() {
+		if err := c.DeletePayment(ctx, id); err != nil {
+			fmt.Fprintf(os.Stderr, "f3ctl delete: %s: %v\n", id, err)
+			failed = true
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+		}
+	}
+
+	if failed {
+		return errFailed
+	}
+	return nil
+}
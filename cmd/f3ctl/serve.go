@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ThrosturX/f3api"
+)
+
+// Returns the value of an environment variable, or def if it is unset
+func envOr(name, def string) string {
+	if val, ok := os.LookupEnv(name); ok {
+		return val
+	}
+	return def
+}
+
+// Creates the store named by the -store flag
+// Only the in-memory store exists for now; it keeps nothing across restarts.
+func openStore(name string) (f3api.ApiStore, error) {
+	switch name {
+	case "memory":
+		return f3api.NewInMemStore(), nil
+	}
+	return nil, fmt.Errorf("unknown store %q, the only store is \"memory\"", name)
+}
+
+// Opens the audit sink given by -audit-log: stdout if empty, the audit_events table of an SQLite
+// database for "sqlite:<path>", or else a file of JSON lines
+// The returned function closes the file or database.
+func openAuditSink(spec string) (f3api.AuditSink, func() error, error) {
+	if spec == "" {
+		return f3api.NewJSONAuditSink(os.Stdout), func() error { return nil }, nil
+	}
+
+	path, ok := strings.CutPrefix(spec, "sqlite:")
+	if !ok {
+		sink, err := f3api.OpenAuditFile(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		return sink, sink.Close, nil
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sink, err := f3api.NewSQLAuditSink(context.Background(), db, "audit_events")
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return sink, db.Close, nil
+}
+
+// Reads the duplicate payment policies from a file
+func readDuplicateConfig(path string) (f3api.DuplicateConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return f3api.DuplicateConfig{}, err
+	}
+	defer f.Close()
+
+	config, err := f3api.ReadDuplicateConfig(f)
+	if err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Reads a watch list from a file
+func readWatchList(path string) (*f3api.WatchList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list, err := f3api.ReadWatchList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return list, nil
+}
+
+// Reads an exchange rate table from a file
+func readRateTable(path string) (*f3api.RateTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	table, err := f3api.ReadRateTable(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return table, nil
+}
+
+// Runs the payments API server, like cmd/main.go but configured through flags
+// The flags default to the environment variables read by cmd/main.go.
+func runServe(args []string) error {
+	fs := newFlagSet("serve")
+	addr := fs.String("addr", envOr("F3API_ADDR", ":8080"), "TCP address to listen on")
+	storeName := fs.String("store", envOr("F3API_STORE", "memory"), "payment store")
+	traces := fs.String("trace-exporter", os.Getenv("F3API_TRACE_EXPORTER"), `where to export traces: "none", "stdout" or "file:<path>" (OTLP/JSON, see f3api.NewTracerProvider)`)
+	auditLog := fs.String("audit-log", os.Getenv("F3API_AUDIT_LOG"), `file the audit log is appended to, or "sqlite:<path>" for the audit_events table of an SQLite database; stdout if empty`)
+	watchList := fs.String("watch-list", os.Getenv("F3API_WATCH_LIST"), "CSV file of the names and addresses payments are screened against, see f3api.ReadWatchList; no screening if empty")
+	fxRates := fs.String("fx-rates", os.Getenv("F3API_FX_RATES"), "CSV file of the exchange rates filling in the FX of payments without a contract and served at /fx/quote, see f3api.ReadRateTable")
+	calendar := fs.String("calendar", os.Getenv("F3API_CALENDAR"), "JSON file of the business day calendars processing dates are checked against, see f3api.LoadBusinessCalendar; no checks if empty")
+	duplicates := fs.String("duplicate-policy", os.Getenv("F3API_DUPLICATE_POLICY"), "JSON file of the duplicate payment policies, see f3api.ReadDuplicateConfig; no detection if empty")
+	scheduleInterval := fs.Duration("schedule-interval", time.Minute, "how often the payments of schedules falling due are made")
+	shutdownDelay := fs.Duration("shutdown-delay", 0, "how long readiness fails before the server stops on SIGTERM")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "how long requests in flight may take to finish on SIGTERM (default 30s)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	store, err := openStore(*storeName)
+	if err != nil {
+		return err
+	}
+
+	tp, shutdown, err := f3api.NewTracerProvider(*traces)
+	if err != nil {
+		return err
+	}
+
+	audit, closeAudit, err := openAuditSink(*auditLog)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	if store, err = f3api.InstrumentStore(store, f3api.DefaultMetrics); err != nil {
+		return err
+	}
+	store = f3api.TraceStore(store)
+	store = f3api.AuditStore(store, audit)
+	var detector *f3api.DuplicateDetector
+	if *duplicates != "" {
+		config, err := readDuplicateConfig(*duplicates)
+		if err != nil {
+			return err
+		}
+		detector = f3api.DetectDuplicates(store, config)
+		store = detector
+	}
+	var rates *f3api.RateTable
+	if *fxRates != "" {
+		if rates, err = readRateTable(*fxRates); err != nil {
+			return err
+		}
+	}
+	store = f3api.ChargesStore(f3api.FXStore(store, rates))
+	if *calendar != "" {
+		// rolled before the rate of the processing date is looked up, and duplicates are fingerprinted
+		cal, err := f3api.LoadBusinessCalendar(*calendar)
+		if err != nil {
+			return err
+		}
+		store = f3api.BusinessDayStore(store, cal)
+	}
+	if *watchList != "" {
+		list, err := readWatchList(*watchList)
+		if err != nil {
+			return err
+		}
+		store = f3api.ScreenStore(store, f3api.NewListScreener(list))
+	}
+	api := f3api.NewGenericApi(store)
+
+	// schedules go through every decorator, like any other payment
+	scheduler := f3api.NewScheduler(store, nil)
+	api.ServeSchedules(scheduler)
+	if rates != nil {
+		api.ServeRates(rates)
+	}
+	if detector != nil {
+		api.ServeDuplicateFlags(detector)
+	}
+	ctx, stopScheduler := context.WithCancel(context.Background())
+	defer stopScheduler()
+	go scheduler.Run(ctx, *scheduleInterval)
+
+	f3api.RunServerConfig(api, f3api.ServerConfig{
+		Addr:            *addr,
+		TracerProvider:  tp,
+		Logger:          slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+		ShutdownDelay:   *shutdownDelay,
+		ShutdownTimeout: *shutdownTimeout,
+	})
+
+	return shutdown(context.Background())
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/ThrosturX/f3api"
+	"github.com/ThrosturX/f3api/client"
+)
+
+// Number of payments sent per bulk request by import and restore
+const importBatchSize = 500
+
+// Outcome of sendPayments
+type sendResult struct {
+	stored int
+	// payments the server held for review rather than storing them, see f3api.ScreenStore
+	held   int
+	failed bool
+}
+
+// Describes the outcome, e.g. "imported 2 of 3 payments, 1 held for review"
+func (r sendResult) report(verb string, total int) string {
+	s := fmt.Sprintf("%s %d of %d payments", verb, r.stored, total)
+	if r.held > 0 {
+		s += fmt.Sprintf(", %d held for review", r.held)
+	}
+	return s
+}
+
+// The error of a command which sent payments, if they weren't all stored: errFailed if any failed,
+// and otherwise errHeld if any were held for review
+func (r sendResult) err() error {
+	switch {
+	case r.failed:
+		return errFailed
+	case r.held > 0:
+		return errHeld
+	}
+	return nil
+}
+
+// Sends payments to the server in batches, reporting each payment which failed or was held on stderr
+func sendPayments(ctx context.Context, c *client.Client, payments []f3api.Payment, upsert bool) (sendResult, error) {
+	var result sendResult
+
+	for start := 0; start < len(payments); start += importBatchSize {
+		end := min(start+importBatchSize, len(payments))
+		results, err := c.ImportPayments(ctx, payments[start:end], upsert)
+		if err != nil {
+			result.failed = true
+			return result, err
+		}
+		for _, r := range results {
+			switch {
+			case r.Status == http.StatusAccepted:
+				fmt.Fprintf(os.Stderr, "%s: held for review\n", r.ID)
+				result.held++
+			case r.Status >= 300:
+				fmt.Fprintf(os.Stderr, "%s: %d %s\n", r.ID, r.Status, r.Error)
+				result.failed = true
+			default:
+				result.stored++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Creates the payments of a file, or with -upsert, creates or updates them
+func runImport(args []string) error {
+	fs := newFlagSet("import")
+	remote := addRemoteFlags(fs)
+	formatFlag := fs.String("format", "", "file format: json, csv or ndjson (default from the file extension, else json)")
+	upsert := fs.Bool("upsert", false, "update payments which already exist instead of failing them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	format, err := fileFormat(*formatFlag, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	in, err := openInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	items, err := readPayments(in, format)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	var payments []f3api.Payment
+	for _, item := range items {
+		if item.err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", item.where, item.err)
+			failed = true
+			continue
+		}
+		payments = append(payments, item.payment)
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	result, err := sendPayments(ctx, c, payments, *upsert)
+	fmt.Println(result.report("imported", len(items)))
+	if err != nil {
+		return err
+	}
+	result.failed = result.failed || failed
+	return result.err()
+}
+
+// Writes every payment of the server to a file
+func runExport(args []string) error {
+	fs := newFlagSet("export")
+	remote := addRemoteFlags(fs)
+	formatFlag := fs.String("format", "", "file format: json, csv or ndjson (default from the file extension, else json)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errUsage
+	}
+
+	format, err := fileFormat(*formatFlag, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	payments, err := listPayments(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	out, err := createOutput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if err := writePayments(out, format, payments); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// A problem found by validate
+type validationProblem struct {
+	File  string `json:"file"`
+	Where string `json:"where"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// Checks that every payment of the given files can be read and passes f3api.ValidatePayment, and
+// that no ID appears twice
+func runValidate(args []string) error {
+	fs := newFlagSet("validate")
+	formatFlag := fs.String("format", "", "file format: json, csv or ndjson (default from the file extension, else json)")
+	output := addOutputFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+	if *output != outputTable && *output != outputJSON {
+		return fmt.Errorf("unknown output mode %q, expected table or json", *output)
+	}
+
+	problems := []validationProblem{}
+	checked := 0
+	seen := make(map[string]string)
+	for _, path := range fs.Args() {
+		format, err := fileFormat(*formatFlag, path)
+		if err != nil {
+			return err
+		}
+		items, err := readFile(path, format)
+		if err != nil {
+			problems = append(problems, validationProblem{File: path, Error: err.Error()})
+			continue
+		}
+
+		for _, item := range items {
+			checked++
+			p := item.payment
+			err := item.err
+			if err == nil {
+				err = f3api.ValidatePayment(p)
+			}
+			if err == nil && seen[p.ID] != "" {
+				err = fmt.Errorf("duplicate ID, first seen at %s", seen[p.ID])
+			}
+			if err != nil {
+				problems = append(problems, validationProblem{File: path, Where: item.where, ID: p.ID, Error: err.Error()})
+				continue
+			}
+			seen[p.ID] = path + " " + item.where
+		}
+	}
+
+	if *output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			where := p.File
+			if p.Where != "" {
+				where += ": " + p.Where
+			}
+			fmt.Printf("%s: %s\n", where, p.Error)
+		}
+		fmt.Printf("%d payments checked, %d problems\n", checked, len(problems))
+	}
+
+	if len(problems) > 0 {
+		return errFailed
+	}
+	return nil
+}
+
+// Reads every payment of the file at path
+func readFile(path, format string) ([]fileItem, error) {
+	in, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	return readPayments(in, format)
+}
+
+// Writes every payment of a server to an NDJSON snapshot
+// The snapshot is written to a temporary file first, so an interrupted backup never leaves a
+// truncated snapshot in place of a good one.
+func runBackup(args []string) error {
+	fs := newFlagSet("backup")
+	remote := addRemoteFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	path := fs.Arg(0)
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	payments, err := listPayments(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := writePayments(tmp, formatNDJSON, payments); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	fmt.Printf("backed up %d payments to %s\n", len(payments), path)
+	return nil
+}
+
+// Stores every payment of a snapshot written by backup, replacing any payment with the same ID
+// Payments which aren't in the snapshot are left alone.
+//
+// Payments are restored through the API, like any other write, so the server applies its checks to
+// the ones it doesn't hold yet: those dated before today, duplicating a recent payment, or naming a
+// watch-listed party may be refused or held for review, and are reported as such. Restoring them
+// faithfully takes a server started without -calendar, -duplicate-policy and -watch-list.
+func runRestore(args []string) error {
+	fs := newFlagSet("restore")
+	remote := addRemoteFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	items, err := readFile(fs.Arg(0), formatNDJSON)
+	if err != nil {
+		return err
+	}
+	payments := make([]f3api.Payment, 0, len(items))
+	for _, item := range items {
+		if item.err != nil {
+			return fmt.Errorf("%s: %s: %w", fs.Arg(0), item.where, item.err)
+		}
+		payments = append(payments, item.payment)
+	}
+
+	c, ctx, cancel, err := remote.connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	result, err := sendPayments(ctx, c, payments, true)
+	fmt.Println(result.report("restored", len(payments)))
+	if err != nil {
+		return err
+	}
+	return result.err()
+}
+
+// Brings the schema of a persistent store up to date
+// There is no persistent store yet: the memory store has no schema, so there is nothing to migrate.
+func runMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	storeName := fs.String("store", envOr("F3API_STORE", "memory"), "payment store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	if _, err := openStore(*storeName); err != nil {
+		return err
+	}
+	fmt.Printf("store %q has no schema, nothing to migrate\n", *storeName)
+	return nil
+}
@@ -1,12 +1,38 @@
 package main
 
-import "github.com/ThrosturX/f3api"
+import (
+    "log"
+    "log/slog"
+    "os"
+
+    "github.com/ThrosturX/f3api"
+)
 
 // Example API server, for demonstration purposes
 // Uses In-Memory storage as opposed to long-term stable storage
+// Traces are exported as configured by F3API_TRACE_EXPORTER, see f3api.NewTracerProvider
+// Requests are logged as JSON to stderr, and changes to payments are audited to F3API_AUDIT_LOG (or stdout)
 func main() {
-    store := f3api.NewInMemStore()
-    api := f3api.NewGenericApi(store)
+    tp, _, err := f3api.NewTracerProvider(os.Getenv("F3API_TRACE_EXPORTER"))
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    audit := f3api.NewJSONAuditSink(os.Stdout)
+    if path := os.Getenv("F3API_AUDIT_LOG"); path != "" {
+        if audit, err = f3api.OpenAuditFile(path); err != nil {
+            log.Fatal(err)
+        }
+    }
+
+    store, err := f3api.InstrumentStore(f3api.NewInMemStore(), f3api.DefaultMetrics)
+    if err != nil {
+        log.Fatal(err)
+    }
+    api := f3api.NewGenericApi(f3api.AuditStore(f3api.TraceStore(store), audit))
 
-    f3api.RunServer(api)
+    f3api.RunServerConfig(api, f3api.ServerConfig{
+        TracerProvider: tp,
+        Logger:         slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+    })
 }
@@ -0,0 +1,252 @@
+package f3api
+
+import (
+	"context"
+)
+
+// Context aware variant of ApiStore
+//
+// Every method takes the context of the call, so that deadlines and cancellation (such as a client
+// disconnecting) can stop slow store operations, and so that request scoped values (trace IDs, the
+// identity of the caller) reach the storage layer. Implementations should give up and return the
+// context's error once the context is done. The method names follow the database/sql convention,
+// which lets a single type implement both ApiStore and ContextStore.
+type ContextStore interface {
+	// Add a payment to the stable storage
+	// Precondition: The payment must not exist
+	AddPaymentContext(context.Context, Payment) error
+
+	// Update an existing payment in the stable storage
+	// Precondition: The payment must already exist
+	UpdatePaymentContext(context.Context, Payment) error
+
+	// Creates or updates a payment in the stable storage
+	StorePaymentContext(context.Context, Payment) error
+
+	// Delete a payment from the stable storage
+	// Precondition: A payment with the resource ID already exist
+	DeletePaymentContext(ctx context.Context, id string) error
+
+	// Fetch a specific payment from the stable storage
+	// Precondition: A payment with the resource ID already exist
+	GetPaymentContext(ctx context.Context, id string) (Payment, error)
+
+	// Fetch a list of all payments from the stable storage
+	GetAllPaymentsContext(context.Context) ([]Payment, error)
+
+	// Begin a transaction, bound to the context for its whole lifetime
+	BeginContext(context.Context) (Tx, error)
+}
+
+// Makes a ContextStore out of an ApiStore
+// Stores which already implement ContextStore are returned as they are, any other store is wrapped
+// in an adapter which checks the context before each call (but can't interrupt the call itself).
+func ContextStoreOf(store ApiStore) ContextStore {
+	if cs, ok := store.(ContextStore); ok {
+		return cs
+	}
+	return contextAdapter{store}
+}
+
+// Adapts a plain ApiStore to the ContextStore interface
+type contextAdapter struct {
+	store ApiStore
+}
+
+func (a contextAdapter) AddPaymentContext(ctx context.Context, p Payment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.store.AddPayment(p)
+}
+
+func (a contextAdapter) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.store.UpdatePayment(p)
+}
+
+func (a contextAdapter) StorePaymentContext(ctx context.Context, p Payment) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.store.StorePayment(p)
+}
+
+func (a contextAdapter) DeletePaymentContext(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.store.DeletePayment(id)
+}
+
+func (a contextAdapter) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return Payment{}, err
+	}
+	return a.store.GetPayment(id)
+}
+
+func (a contextAdapter) GetAllPaymentsContext(ctx context.Context) ([]Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.store.GetAllPayments()
+}
+
+func (a contextAdapter) FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// not through FindPayments, which would find the adapter itself to be a FilterStore
+	payments, err := a.store.GetAllPayments()
+	if err != nil {
+		return nil, err
+	}
+	return f.Apply(payments), nil
+}
+
+func (a contextAdapter) PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// not through PagePayments, which would find the adapter itself to be a PageStore
+	payments, err := a.store.GetAllPayments()
+	if err != nil {
+		return nil, err
+	}
+	return pageOf(payments, after, limit), nil
+}
+
+func (a contextAdapter) CheckHealth(ctx context.Context) error {
+	return CheckStoreHealth(ctx, a.store)
+}
+
+func (a contextAdapter) BeginContext(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.store.Begin()
+}
+
+// Passes every call on to the store it wraps
+// Decorators embed it, and only implement the calls they change. Besides ContextStore, it implements
+// FilterStore, PageStore and HealthChecker, through the wrapped store if it does.
+type storeDecorator struct {
+	store ContextStore
+}
+
+func (d storeDecorator) AddPaymentContext(ctx context.Context, p Payment) error {
+	return d.store.AddPaymentContext(ctx, p)
+}
+
+func (d storeDecorator) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	return d.store.UpdatePaymentContext(ctx, p)
+}
+
+func (d storeDecorator) StorePaymentContext(ctx context.Context, p Payment) error {
+	return d.store.StorePaymentContext(ctx, p)
+}
+
+func (d storeDecorator) DeletePaymentContext(ctx context.Context, id string) error {
+	return d.store.DeletePaymentContext(ctx, id)
+}
+
+func (d storeDecorator) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	return d.store.GetPaymentContext(ctx, id)
+}
+
+func (d storeDecorator) GetAllPaymentsContext(ctx context.Context) ([]Payment, error) {
+	return d.store.GetAllPaymentsContext(ctx)
+}
+
+func (d storeDecorator) FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error) {
+	return FindPayments(ctx, d.store, f)
+}
+
+func (d storeDecorator) PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error) {
+	return PagePayments(ctx, d.store, after, limit)
+}
+
+func (d storeDecorator) CheckHealth(ctx context.Context) error {
+	return CheckStoreHealth(ctx, d.store)
+}
+
+func (d storeDecorator) BeginContext(ctx context.Context) (Tx, error) {
+	return d.store.BeginContext(ctx)
+}
+
+// Makes an ApiStore out of a ContextStore, the reverse of ContextStoreOf
+// Stores which already implement ApiStore are returned as they are, any other store is wrapped in
+// an adapter which makes every call with context.Background(). Mostly useful for decorators, which
+// only need to implement ContextStore.
+func ApiStoreOf(store ContextStore) ApiStore {
+	if s, ok := store.(ApiStore); ok {
+		return s
+	}
+	return backgroundAdapter{store}
+}
+
+// Adapts a ContextStore to the ApiStore interface, while still implementing ContextStore
+type backgroundAdapter struct {
+	ContextStore
+}
+
+func (a backgroundAdapter) AddPayment(p Payment) error {
+	return a.AddPaymentContext(context.Background(), p)
+}
+
+func (a backgroundAdapter) UpdatePayment(p Payment) error {
+	return a.UpdatePaymentContext(context.Background(), p)
+}
+
+func (a backgroundAdapter) StorePayment(p Payment) error {
+	return a.StorePaymentContext(context.Background(), p)
+}
+
+func (a backgroundAdapter) DeletePayment(id string) error {
+	return a.DeletePaymentContext(context.Background(), id)
+}
+
+func (a backgroundAdapter) GetPayment(id string) (Payment, error) {
+	return a.GetPaymentContext(context.Background(), id)
+}
+
+func (a backgroundAdapter) GetAllPayments() ([]Payment, error) {
+	return a.GetAllPaymentsContext(context.Background())
+}
+
+func (a backgroundAdapter) Begin() (Tx, error) {
+	return a.BeginContext(context.Background())
+}
+
+func (a backgroundAdapter) CheckHealth(ctx context.Context) error {
+	return CheckStoreHealth(ctx, a.ContextStore)
+}
+
+func (a backgroundAdapter) FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error) {
+	return FindPayments(ctx, a.ContextStore, f)
+}
+
+func (a backgroundAdapter) PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error) {
+	return PagePayments(ctx, a.ContextStore, after, limit)
+}
+
+// Key of the payment written with a context, see withWritten
+type writtenKey struct{}
+
+// Returns a copy of ctx through which decorators adjusting a payment before writing it (such as
+// BusinessDayStore and FXStore) hand back the payment they pass on, and where it ends up
+// The returned payment is p until a decorator adjusts it; the innermost one has the last word.
+func withWritten(ctx context.Context, p Payment) (context.Context, *Payment) {
+	written := p
+	return context.WithValue(ctx, writtenKey{}, &written), &written
+}
+
+// Hands back the adjusted payment a decorator passes on, if the context asks for it, see withWritten
+func setWritten(ctx context.Context, p Payment) {
+	if written, ok := ctx.Value(writtenKey{}).(*Payment); ok {
+		*written = p
+	}
+}
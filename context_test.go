@@ -0,0 +1,98 @@
+package f3api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// An ApiStore which doesn't implement ContextStore, to exercise the adapter
+type plainStore struct {
+	ApiStore
+}
+
+// Tests that the adapter for plain ApiStores refuses calls once the context is done
+func TestContextStoreOf(t *testing.T) {
+	inMem := NewInMemStore()
+	if ContextStoreOf(inMem) != ContextStore(inMem) {
+		t.Fatal("InMemStore should be used as a ContextStore directly")
+	}
+
+	cs := ContextStoreOf(plainStore{inMem})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := defaultPayment()
+	if err := cs.AddPaymentContext(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if _, err := cs.GetPaymentContext(ctx, p.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+}
+
+// Tests that payments can be found through the adapter for plain ApiStores
+func TestContextAdapterFindPayments(t *testing.T) {
+	store := NewInMemStore()
+	for i, amount := range []FractionalAmount{10, 20, 30} {
+		p := defaultPayment()
+		p.ID = strconv.Itoa(i)
+		p.Attributes.Amount = amount
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := ParseFilter("amount >= 20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := FindPayments(context.Background(), ContextStoreOf(plainStore{store}), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 {
+		t.Fatalf("Expected 2 payments, got %d", len(payments))
+	}
+}
+
+// Tests that payments can be paged through the adapter for plain ApiStores
+func TestContextAdapterPagePayments(t *testing.T) {
+	store := NewInMemStore()
+	for i := 0; i < 5; i++ {
+		p := defaultPayment()
+		p.ID = strconv.Itoa(i)
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payments, err := PagePayments(context.Background(), ContextStoreOf(plainStore{store}), "1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].ID != "2" || payments[1].ID != "3" {
+		t.Fatalf("Expected payments 2 and 3, got %v", payments)
+	}
+}
+
+// Tests that the handlers pass the request context on to the store
+func TestGenericApiRequestContext(t *testing.T) {
+	api := NewGenericApi(NewInMemStore())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	responseWriter := &testResponseWriter{}
+	request := createRestRequest("GET", "/payments", strings.NewReader(""), nil)
+	request.Request = request.Request.WithContext(ctx)
+	api.GetAllPayments(responseWriter, request)
+
+	if responseWriter.status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d for a cancelled request, got %d", http.StatusServiceUnavailable, responseWriter.status)
+	}
+}
@@ -0,0 +1,402 @@
+package f3api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// CSV codec for the Payment resource.
+//
+// Every payment is flattened into a single row, with one column per field. Columns are named after
+// the dotted JSON path of the field they hold, in the order the fields are declared:
+//
+//	type, id, version, organisation_id,
+//	attributes.amount,
+//	attributes.beneficiary_party.account_number, attributes.beneficiary_party.bank_id,
+//	attributes.beneficiary_party.bank_id_code, attributes.beneficiary_party.account_name,
+//	attributes.beneficiary_party.account_number_code, attributes.beneficiary_party.address,
+//	attributes.beneficiary_party.name, attributes.beneficiary_party.account_type,
+//	attributes.charges_information.bearer_code,
+//	attributes.charges_information.sender_charges.0.amount,
+//	attributes.charges_information.sender_charges.0.currency,
+//	(... one amount/currency pair per sender charge ...)
+//	attributes.charges_information.receiver_charges_amount,
+//	attributes.charges_information.receiver_charges_currency,
+//	attributes.currency,
+//	attributes.debtor_party.account_number, attributes.debtor_party.bank_id,
+//	attributes.debtor_party.bank_id_code, attributes.debtor_party.account_name,
+//	attributes.debtor_party.account_number_code, attributes.debtor_party.address,
+//	attributes.debtor_party.name,
+//	attributes.end_to_end_reference,
+//	attributes.fx.contract_reference, attributes.fx.exchange_rate,
+//	attributes.fx.original_amount, attributes.fx.original_currency,
+//	attributes.numeric_reference, attributes.payment_id, attributes.payment_purpose,
+//	attributes.payment_scheme, attributes.payment_type, attributes.processing_date,
+//	attributes.reference, attributes.scheme_payment_sub_type, attributes.scheme_payment_type,
+//	attributes.sponsor_party.account_number, attributes.sponsor_party.bank_id,
+//	attributes.sponsor_party.bank_id_code
+//
+// Values are written in the same textual format as their JSON counterparts (amounts with two
+// decimal places, exchange rates with five, ISO 8601 dates). When reading, the header row decides
+// which columns are present and in which order; missing columns and empty cells are left as zero values.
+
+// A single CSV column, addressing a leaf field of the Payment type
+type csvColumn struct {
+	name string
+	// Index path of the field within Payment (see reflect.Value.FieldByIndex)
+	index []int
+	// For columns within a repeated group: the path of the group, the element number, and the index
+	// path within the element
+	group     string
+	elem      int
+	elemIndex []int
+}
+
+// A leaf field of the Payment type. Slices of structs are leaves with their own element fields.
+type csvField struct {
+	path  string
+	index []int
+	elem  []csvField
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+	// The flattened fields of the Payment type, in declaration order
+	paymentCSVFields = flattenCSVFields(reflect.TypeOf(Payment{}), "", nil)
+)
+
+// Walks the fields of a struct type, flattening nested and embedded structs into dotted JSON paths
+func flattenCSVFields(t reflect.Type, prefix string, index []int) []csvField {
+	var fields []csvField
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		if sf.Anonymous {
+			// embedded structs are inlined by encoding/json, so we do the same
+			fields = append(fields, flattenCSVFields(sf.Type, prefix, fieldIndex)...)
+			continue
+		}
+
+		path := prefix + strings.Split(sf.Tag.Get("json"), ",")[0]
+		switch {
+		case sf.Type.Kind() == reflect.Slice:
+			fields = append(fields, csvField{path, fieldIndex, flattenCSVFields(sf.Type.Elem(), "", nil)})
+		case sf.Type.Kind() == reflect.Struct && !sf.Type.Implements(jsonMarshalerType):
+			fields = append(fields, flattenCSVFields(sf.Type, path+".", fieldIndex)...)
+		default:
+			fields = append(fields, csvField{path: path, index: fieldIndex})
+		}
+	}
+
+	return fields
+}
+
+// Most elements of a repeated group a CSV header may have columns for, such as sender charges
+// Element numbers come from the uploaded header, and payments are grown to hold every element.
+const maxCSVElements = 32
+
+// Lays out the columns for a header with room for the given number of repeated group elements
+func paymentCSVColumns(repeat int) []csvColumn {
+	var columns []csvColumn
+
+	for _, f := range paymentCSVFields {
+		if f.elem == nil {
+			columns = append(columns, csvColumn{name: f.path, index: f.index, elem: -1})
+			continue
+		}
+		for n := 0; n < repeat; n++ {
+			for _, ef := range f.elem {
+				name := fmt.Sprintf("%s.%d.%s", f.path, n, ef.path)
+				columns = append(columns, csvColumn{name: name, index: f.index, group: f.path, elem: n, elemIndex: ef.index})
+			}
+		}
+	}
+
+	return columns
+}
+
+// Finds the column with the given header name
+func parseCSVColumn(name string) (csvColumn, error) {
+	for _, f := range paymentCSVFields {
+		if f.elem == nil {
+			if f.path == name {
+				return csvColumn{name: name, index: f.index, elem: -1}, nil
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(name, f.path+".") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(name, f.path+"."), ".", 2)
+		n, err := strconv.Atoi(parts[0])
+		if err != nil || n < 0 || len(parts) != 2 {
+			break
+		}
+		if n >= maxCSVElements {
+			return csvColumn{}, fmt.Errorf("CSV column %q: at most %d elements are supported", name, maxCSVElements)
+		}
+		for _, ef := range f.elem {
+			if ef.path == parts[1] {
+				return csvColumn{name: name, index: f.index, group: f.path, elem: n, elemIndex: ef.index}, nil
+			}
+		}
+	}
+
+	return csvColumn{}, fmt.Errorf("Unknown CSV column %q", name)
+}
+
+// Checks that the elements of each repeated group in a header are numbered from 0 without gaps
+func checkCSVElements(columns []csvColumn) error {
+	elems := make(map[string][]bool)
+	for _, c := range columns {
+		if c.elem < 0 {
+			continue
+		}
+		for len(elems[c.group]) <= c.elem {
+			elems[c.group] = append(elems[c.group], false)
+		}
+		elems[c.group][c.elem] = true
+	}
+
+	for group, present := range elems {
+		for n, ok := range present {
+			if !ok {
+				return fmt.Errorf("CSV columns of %s.%d are missing, elements must be numbered from 0", group, n)
+			}
+		}
+	}
+	return nil
+}
+
+// Fetches the value of the column from the payment, formatted for CSV
+func (c csvColumn) get(p *Payment) (string, error) {
+	v := reflect.ValueOf(p).Elem().FieldByIndex(c.index)
+	if c.elem >= 0 {
+		if c.elem >= v.Len() {
+			return "", nil
+		}
+		v = v.Index(c.elem).FieldByIndex(c.elemIndex)
+	}
+
+	if m, ok := v.Interface().(json.Marshaler); ok {
+		buf, err := m.MarshalJSON()
+		if err != nil {
+			return "", err
+		}
+		return strings.Trim(string(buf), "\""), nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	}
+
+	return "", fmt.Errorf("Unsupported type %v for CSV column %s", v.Type(), c.name)
+}
+
+// Parses a CSV value into the column's field of the payment; empty values are skipped
+func (c csvColumn) set(p *Payment, s string) error {
+	if s == "" {
+		return nil
+	}
+
+	v := reflect.ValueOf(p).Elem().FieldByIndex(c.index)
+	if c.elem >= 0 {
+		if c.elem >= v.Len() {
+			grown := reflect.MakeSlice(v.Type(), c.elem+1, c.elem+1)
+			reflect.Copy(grown, v)
+			v.Set(grown)
+		}
+		v = v.Index(c.elem).FieldByIndex(c.elemIndex)
+	}
+
+	if v.Addr().Type().Implements(jsonUnmarshalerType) {
+		return v.Addr().Interface().(json.Unmarshaler).UnmarshalJSON([]byte("\"" + s + "\""))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported type %v for CSV column %s", v.Type(), c.name)
+}
+
+// Writes payments as CSV rows, preceded by a header row
+type PaymentCSVWriter struct {
+	w           *csv.Writer
+	columns     []csvColumn
+	wroteHeader bool
+}
+
+// Creates a new CSV writer with room for the given number of sender charges per payment
+func NewPaymentCSVWriter(w io.Writer, senderCharges int) *PaymentCSVWriter {
+	pw := PaymentCSVWriter{
+		w:       csv.NewWriter(w),
+		columns: paymentCSVColumns(senderCharges),
+	}
+	return &pw
+}
+
+// Writes a single payment as a CSV row, writing the header first if needed
+func (pw *PaymentCSVWriter) Write(p Payment) error {
+	if !pw.wroteHeader {
+		header := make([]string, len(pw.columns))
+		for i, c := range pw.columns {
+			header[i] = c.name
+		}
+		if err := pw.w.Write(header); err != nil {
+			return err
+		}
+		pw.wroteHeader = true
+	}
+
+	record := make([]string, len(pw.columns))
+	written := 0
+	for i, c := range pw.columns {
+		val, err := c.get(&p)
+		if err != nil {
+			return err
+		}
+		record[i] = val
+		if c.elem >= 0 && c.elem+1 > written {
+			written = c.elem + 1
+		}
+	}
+
+	if n := len(p.Attributes.ChargesInformation.SenderCharges); n > written {
+		return fmt.Errorf("Payment %s has %d sender charges, only %d fit in the CSV layout", p.ID, n, written)
+	}
+
+	return pw.w.Write(record)
+}
+
+// Flushes any buffered rows to the underlying writer
+func (pw *PaymentCSVWriter) Flush() error {
+	pw.w.Flush()
+	return pw.w.Error()
+}
+
+// Writes a list of payments as CSV, sizing the sender charges columns to fit all of them
+func WritePaymentsCSV(w io.Writer, payments []Payment) error {
+	senderCharges := 0
+	for _, p := range payments {
+		if n := len(p.Attributes.ChargesInformation.SenderCharges); n > senderCharges {
+			senderCharges = n
+		}
+	}
+
+	pw := NewPaymentCSVWriter(w, senderCharges)
+	for _, p := range payments {
+		if err := pw.Write(p); err != nil {
+			return err
+		}
+	}
+
+	return pw.Flush()
+}
+
+// An error confined to a single CSV row; reading may continue with the next row
+type CSVRowError struct {
+	Line int
+	Err  error
+}
+
+// Formats the row error with its line number
+func (e *CSVRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Reads payments from CSV rows, as laid out by the header row
+type PaymentCSVReader struct {
+	r       *csv.Reader
+	columns []csvColumn
+	line    int
+}
+
+// Creates a new CSV reader, reading and checking the header row immediately
+func NewPaymentCSVReader(r io.Reader) (*PaymentCSVReader, error) {
+	cr := csv.NewReader(r)
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV payload is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	columns := make([]csvColumn, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			return nil, fmt.Errorf("Duplicate CSV column %q", name)
+		}
+		seen[name] = true
+
+		if columns[i], err = parseCSVColumn(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkCSVElements(columns); err != nil {
+		return nil, err
+	}
+
+	pr := PaymentCSVReader{
+		r:       cr,
+		columns: columns,
+		line:    1,
+	}
+	return &pr, nil
+}
+
+// Reads the next payment. Returns io.EOF when there are no more rows, and a *CSVRowError
+// for rows that could not be parsed, after which reading may continue.
+func (pr *PaymentCSVReader) Read() (Payment, error) {
+	var p Payment
+
+	record, err := pr.r.Read()
+	if err != nil {
+		if perr, ok := err.(*csv.ParseError); ok {
+			pr.line = perr.StartLine
+			return p, &CSVRowError{perr.StartLine, perr.Err}
+		}
+		return p, err
+	}
+	pr.line, _ = pr.r.FieldPos(0)
+
+	for i, c := range pr.columns {
+		if err := c.set(&p, record[i]); err != nil {
+			return p, &CSVRowError{pr.line, fmt.Errorf("%s: %v", c.name, err)}
+		}
+	}
+
+	return p, nil
+}
+
+// The line number of the most recently read row
+func (pr *PaymentCSVReader) Line() int {
+	return pr.line
+}
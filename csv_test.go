@@ -0,0 +1,171 @@
+package f3api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Tests that a payment survives a round trip through the CSV codec unchanged
+func TestPaymentCSVRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+
+	payment := defaultPayment()
+	if err := WritePaymentsCSV(&buf, []Payment{payment}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := strings.SplitN(buf.String(), "\n", 2)[0]
+	for _, column := range []string{
+		"attributes.debtor_party.account_number",
+		"attributes.charges_information.sender_charges.0.amount",
+		"attributes.charges_information.sender_charges.1.currency",
+	} {
+		if !strings.Contains(header, column) {
+			t.Fatalf("Header is missing column %s: %s", column, header)
+		}
+	}
+
+	reader, err := NewPaymentCSVReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := reader.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(payment, found) {
+		t.Fatalf("Mismatched payments after CSV round trip:\n%+v\n%+v", payment, found)
+	}
+}
+
+// Tests that the header row is checked for unknown columns
+func TestPaymentCSVUnknownColumn(t *testing.T) {
+	_, err := NewPaymentCSVReader(strings.NewReader("id,attributes.no_such_field\n"))
+	if err == nil {
+		t.Fatal("Expected an error for an unknown column")
+	}
+}
+
+// Tests that the elements of repeated groups are bounded, and numbered without gaps
+func TestPaymentCSVElements(t *testing.T) {
+	const charges = "attributes.charges_information.sender_charges."
+	for _, header := range []string{
+		"id," + charges + "999999999.amount",
+		"id," + charges + "0.amount," + charges + "2.amount",
+		"id," + charges + "1.currency",
+	} {
+		if _, err := NewPaymentCSVReader(strings.NewReader(header + "\n")); err == nil {
+			t.Fatalf("Expected header %q to be refused", header)
+		}
+	}
+
+	if _, err := NewPaymentCSVReader(strings.NewReader("id," + charges + "0.amount," + charges + "1.currency\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that a CSV import reports broken rows without aborting the rest of the batch
+func TestImportPayments(t *testing.T) {
+	var (
+		buf    bytes.Buffer
+		result ImportResult
+	)
+
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+
+	good := defaultPayment()
+	invalid := defaultPayment()
+	invalid.ID = "invalid"
+	invalid.Attributes.Currency = "pounds"
+	if err := WritePaymentsCSV(&buf, []Payment{good, invalid, good}); err != nil {
+		t.Fatal(err)
+	}
+
+	// lines 2, 3 and 4 hold the payments, add a malformed 5th
+	body := buf.String() + "not,enough,fields\n"
+
+	responseWriter := &testResponseWriter{}
+	request := createRestRequest("POST", "/payments/import", strings.NewReader(body), nil)
+	api.ImportPayments(responseWriter, request)
+
+	if err := json.Unmarshal(responseWriter.Read(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Imported != 1 {
+		t.Fatalf("Expected 1 imported payment, got %d", result.Imported)
+	}
+
+	lines := []int{}
+	for _, e := range result.Errors {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{3, 4, 5}) {
+		t.Fatalf("Expected errors on lines 3, 4 and 5, got %v", result.Errors)
+	}
+
+	if _, err := store.GetPayment(good.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tests that an import breaking off reports the rows imported until then
+func TestImportPaymentsInterrupted(t *testing.T) {
+	var buf bytes.Buffer
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+
+	if err := WritePaymentsCSV(&buf, []Payment{defaultPayment()}); err != nil {
+		t.Fatal(err)
+	}
+	body := io.MultiReader(&buf, iotest.ErrReader(errors.New("connection reset")))
+
+	responseWriter := &testResponseWriter{}
+	api.ImportPayments(responseWriter, createRestRequest("POST", "/payments/import", body, nil))
+
+	var result ImportResult
+	if err := json.Unmarshal(responseWriter.Read(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if responseWriter.status != http.StatusInternalServerError || result.Imported != 1 || result.Error != "connection reset" {
+		t.Fatalf("Expected the imported payment and the error, got %d %+v", responseWriter.status, result)
+	}
+}
+
+// Tests the CSV output of the GetAllPayments endpoint
+func TestGetAllPaymentsCSV(t *testing.T) {
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+	store.AddPayment(defaultPayment())
+
+	responseWriter := &testResponseWriter{}
+	api.GetAllPayments(responseWriter, createRestRequest("GET", "/payments?format=csv", strings.NewReader(""), nil))
+
+	if ct := responseWriter.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Unexpected Content-Type %q", ct)
+	}
+
+	reader, err := NewPaymentCSVReader(strings.NewReader(responseWriter.result))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := reader.Read(); err != nil || p.ID != defaultPayment().ID {
+		t.Fatalf("Unexpected CSV export: %v %q", err, responseWriter.result)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.GetAllPayments(responseWriter, createRestRequest("GET", "/payments?format=xml", strings.NewReader(""), nil))
+	if responseWriter.status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for an unknown format, got %d", http.StatusBadRequest, responseWriter.status)
+	}
+}
@@ -0,0 +1,580 @@
+package f3api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// What to do with a payment duplicating one created shortly before
+type DuplicateAction string
+
+const (
+	// Refuse the duplicate with a DuplicateError; the default
+	DuplicateReject DuplicateAction = "reject"
+	// Create the duplicate, but flag it for review
+	DuplicateFlag DuplicateAction = "flag"
+	// Create the duplicate as any other payment
+	DuplicateAllow DuplicateAction = "allow"
+)
+
+// How long after a payment is created its duplicates are detected, unless configured otherwise
+const defaultDuplicateWindow = 24 * time.Hour
+
+// Most payments flagged for review kept at once; the oldest flags are dropped beyond that
+const maxDuplicateFlags = 1000
+
+// Returned when dismissing a flag which doesn't exist
+var ErrFlagNotFound = errors.New("no duplicate payment is flagged under this ID")
+
+// How duplicates of the payments of an organisation are handled
+type DuplicatePolicy struct {
+	// DuplicateReject if empty
+	Action DuplicateAction
+	// How long after a payment is created its duplicates are detected; 24 hours if zero
+	Window time.Duration
+}
+
+// Configuration of DetectDuplicates
+type DuplicateConfig struct {
+	// Policy of the organisations without one of their own
+	Default DuplicatePolicy
+	// Policies by organisation ID
+	Organisations map[string]DuplicatePolicy
+}
+
+// Returned when creating a payment duplicating a recent one, under the DuplicateReject policy
+// Reported as a conflict, but doesn't match ErrPaymentExists: the payment itself doesn't exist, so
+// it can't be updated instead.
+type DuplicateError struct {
+	ID         string
+	OriginalID string
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("Payment %v duplicates payment %v", e.ID, e.OriginalID)
+}
+
+// A payment created despite duplicating a recent one, under the DuplicateFlag policy
+type FlaggedDuplicate struct {
+	Time           time.Time `json:"time"`
+	OrganisationID string    `json:"organisation_id"`
+	PaymentID      string    `json:"payment_id"`
+	OriginalID     string    `json:"original_id"`
+	Fingerprint    string    `json:"fingerprint"`
+}
+
+// Reads a DuplicateConfig from JSON, with windows in the time.ParseDuration format:
+//
+//	{
+//	  "default": {"action": "reject", "window": "24h"},
+//	  "organisations": {"743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb": {"action": "flag", "window": "72h"}}
+//	}
+func ReadDuplicateConfig(r io.Reader) (DuplicateConfig, error) {
+	type policy struct {
+		Action DuplicateAction `json:"action"`
+		Window string          `json:"window"`
+	}
+	var file struct {
+		Default       policy            `json:"default"`
+		Organisations map[string]policy `json:"organisations"`
+	}
+	var config DuplicateConfig
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return config, err
+	}
+
+	convert := func(name string, p policy) (DuplicatePolicy, error) {
+		converted := DuplicatePolicy{Action: p.Action}
+		switch p.Action {
+		case "", DuplicateReject, DuplicateFlag, DuplicateAllow:
+		default:
+			return converted, fmt.Errorf("%s: unknown action %q", name, p.Action)
+		}
+		if p.Window != "" {
+			window, err := time.ParseDuration(p.Window)
+			if err != nil {
+				return converted, fmt.Errorf("%s: %w", name, err)
+			}
+			converted.Window = window
+		}
+		return converted, nil
+	}
+
+	var err error
+	if config.Default, err = convert("default", file.Default); err != nil {
+		return config, err
+	}
+	config.Organisations = make(map[string]DuplicatePolicy)
+	for id, p := range file.Organisations {
+		if config.Organisations[id], err = convert("organisation "+id, p); err != nil {
+			return config, err
+		}
+	}
+	return config, nil
+}
+
+// Fingerprints the fields which make two payments the same payment, whatever their IDs: the debtor
+// and beneficiary accounts, the amount and currency, the reference and the processing date
+// The reference is compared regardless of case and surrounding space. Payments of different
+// organisations are never the same payment.
+func PaymentFingerprint(p Payment) string {
+	a := p.Attributes
+	fields := []string{
+		p.OrganisationID,
+		a.DebtorParty.BankID, a.DebtorParty.AccountNumber,
+		a.BeneficiaryParty.BankID, a.BeneficiaryParty.AccountNumber,
+		strconv.FormatFloat(float64(a.Amount), 'f', -1, 64), a.Currency,
+		strings.ToLower(strings.TrimSpace(a.Reference)),
+		a.ProcessingDate.Format(timeFmt),
+	}
+
+	h := sha256.New()
+	for _, field := range fields {
+		// length prefixed, so that no two lists of fields hash the same input
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// A payment seen by a duplicateStore
+type seenPayment struct {
+	fingerprint string
+	created     time.Time
+}
+
+// A payment in the order of creation of a duplicateStore
+// Stale once the payment is forgotten or remembered again, as told by its time of creation.
+type createdPayment struct {
+	id      string
+	created time.Time
+}
+
+// ContextStore decorator detecting payments created twice under different IDs
+type duplicateStore struct {
+	storeDecorator
+	config DuplicateConfig
+	now    func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]seenPayment
+	// IDs of the seen payments by fingerprint
+	byFingerprint map[string]idSet
+	// seen payments in order of creation, for forgetting them once out of every window, along with
+	// stale entries which are skipped
+	created   []createdPayment
+	maxWindow time.Duration
+	flags     []FlaggedDuplicate
+}
+
+// Detector of duplicate payments, see DetectDuplicates
+// Implements both ApiStore and ContextStore.
+type DuplicateDetector struct {
+	backgroundAdapter
+	detector *duplicateStore
+}
+
+// Wraps a store to detect payments duplicating one created through it shortly before, as told by
+// PaymentFingerprint, and to reject or flag them as configured for their organisation
+//
+// Payments are checked when they are created, whether added or stored under a new ID, transactions
+// included. Only the payments created through the detector since it was started are known to it.
+func DetectDuplicates(store ApiStore, config DuplicateConfig) *DuplicateDetector {
+	s := duplicateStore{
+		storeDecorator: storeDecorator{ContextStoreOf(store)},
+		config:         config,
+		now:            time.Now,
+		seen:           make(map[string]seenPayment),
+		byFingerprint:  make(map[string]idSet),
+	}
+
+	s.maxWindow = s.policy("").Window
+	for id := range config.Organisations {
+		s.maxWindow = max(s.maxWindow, s.policy(id).Window)
+	}
+
+	d := DuplicateDetector{backgroundAdapter{&s}, &s}
+	return &d
+}
+
+// Lists the payments flagged for review and not dismissed yet, in the order they were created
+// Only the latest flags are kept, see maxDuplicateFlags.
+func (d *DuplicateDetector) Flags() []FlaggedDuplicate {
+	d.detector.mu.Lock()
+	defer d.detector.mu.Unlock()
+
+	return append([]FlaggedDuplicate{}, d.detector.flags...)
+}
+
+// Dismisses the flag of a payment once reviewed, and returns it
+func (d *DuplicateDetector) DismissFlag(id string) (FlaggedDuplicate, error) {
+	d.detector.mu.Lock()
+	defer d.detector.mu.Unlock()
+
+	for i, flag := range d.detector.flags {
+		if flag.PaymentID == id {
+			d.detector.flags = append(d.detector.flags[:i:i], d.detector.flags[i+1:]...)
+			return flag, nil
+		}
+	}
+	return FlaggedDuplicate{}, ErrFlagNotFound
+}
+
+// The policy of an organisation, with the defaults filled in
+func (s *duplicateStore) policy(organisationID string) DuplicatePolicy {
+	p, ok := s.config.Organisations[organisationID]
+	if !ok {
+		p = s.config.Default
+	}
+	if p.Action == "" {
+		p.Action = DuplicateReject
+	}
+	if p.Window <= 0 {
+		p.Window = defaultDuplicateWindow
+	}
+	return p
+}
+
+// Forgets the payments created before every window
+// The caller must hold the lock.
+func (s *duplicateStore) expire(now time.Time) {
+	for len(s.created) > 0 {
+		c := s.created[0]
+		if seen, ok := s.seen[c.id]; ok && seen.created.Equal(c.created) {
+			if now.Sub(c.created) < s.maxWindow {
+				return
+			}
+			s.forget(c.id)
+		}
+		s.created = s.created[1:]
+	}
+}
+
+// Forgets a payment
+// The caller must hold the lock.
+func (s *duplicateStore) forget(id string) {
+	if seen, ok := s.seen[id]; ok {
+		removeFromIndex(s.byFingerprint, seen.fingerprint, id)
+		delete(s.seen, id)
+	}
+}
+
+// Remembers a payment created at the given time
+// The caller must hold the lock.
+func (s *duplicateStore) remember(id, fingerprint string, created time.Time) {
+	s.forget(id)
+	s.seen[id] = seenPayment{fingerprint, created}
+	addToIndex(s.byFingerprint, fingerprint, id)
+	s.created = append(s.created, createdPayment{id, created})
+}
+
+// Finds the earliest payment with a fingerprint created within a window, other than the given one
+// The caller must hold the lock.
+func (s *duplicateStore) original(id, fingerprint string, now time.Time, window time.Duration) (string, bool) {
+	var (
+		found   string
+		created time.Time
+	)
+	for other := range s.byFingerprint[fingerprint] {
+		seen := s.seen[other]
+		if other == id || now.Sub(seen.created) >= window {
+			continue
+		}
+		if found == "" || seen.created.Before(created) || seen.created.Equal(created) && other < found {
+			found, created = other, seen.created
+		}
+	}
+	return found, found != ""
+}
+
+// Checks a payment about to be created against the recent ones, and remembers it unless rejected
+// Returns a function undoing the check, for when the payment turns out not to be created after all,
+// and the flag to record if it is.
+func (s *duplicateStore) check(ctx context.Context, p *Payment) (undo func(), flag *FlaggedDuplicate, err error) {
+	now := s.now()
+	fingerprinted := *p
+	// scheduled payments made late all get today's processing date, so they are told apart by the
+	// day they were due
+	if due, ok := dueDateFromContext(ctx); ok {
+		fingerprinted.Attributes.ProcessingDate = Date{due}
+	}
+	fingerprint := PaymentFingerprint(fingerprinted)
+	policy := s.policy(p.OrganisationID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+	if policy.Action != DuplicateAllow {
+		if original, ok := s.original(p.ID, fingerprint, now, policy.Window); ok {
+			if policy.Action == DuplicateReject {
+				return nil, nil, &DuplicateError{p.ID, original}
+			}
+			flag = &FlaggedDuplicate{now, p.OrganisationID, p.ID, original, fingerprint}
+		}
+	}
+
+	previous, existed := s.seen[p.ID]
+	s.remember(p.ID, fingerprint, now)
+	undo = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.forget(p.ID)
+		if existed {
+			s.seen[p.ID] = previous
+			addToIndex(s.byFingerprint, previous.fingerprint, p.ID)
+		}
+	}
+	return undo, flag, nil
+}
+
+// Records the flag of a created payment, if any
+func (s *duplicateStore) raise(ctx context.Context, flag *FlaggedDuplicate) {
+	if flag == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.flags = append(s.flags, *flag)
+	if dropped := len(s.flags) - maxDuplicateFlags; dropped > 0 {
+		slog.WarnContext(ctx, "too many duplicate payments flagged, dropping the oldest", "payment_id", s.flags[0].PaymentID)
+		s.flags = append([]FlaggedDuplicate{}, s.flags[dropped:]...)
+	}
+	s.mu.Unlock()
+
+	slog.WarnContext(ctx, "duplicate payment flagged for review", "payment_id", flag.PaymentID, "original_id", flag.OriginalID, "organisation_id", flag.OrganisationID)
+}
+
+// Creates a payment through write, once checked for duplicates
+func (s *duplicateStore) create(ctx context.Context, p Payment, write func() error) error {
+	undo, flag, err := s.check(ctx, &p)
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		undo()
+		return err
+	}
+	s.raise(ctx, flag)
+	return nil
+}
+
+// Keeps track of the fingerprint of an updated payment, which stays known for as long as it would have
+func (s *duplicateStore) updated(p *Payment) {
+	fingerprint := PaymentFingerprint(*p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seen, ok := s.seen[p.ID]; ok && seen.fingerprint != fingerprint {
+		removeFromIndex(s.byFingerprint, seen.fingerprint, p.ID)
+		s.seen[p.ID] = seenPayment{fingerprint, seen.created}
+		addToIndex(s.byFingerprint, fingerprint, p.ID)
+	}
+}
+
+// Reports whether a payment exists in the store
+func (s *duplicateStore) exists(ctx context.Context, id string) (bool, error) {
+	_, err := s.store.GetPaymentContext(ctx, id)
+	if errors.Is(err, ErrPaymentNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *duplicateStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	return s.create(ctx, p, func() error { return s.store.AddPaymentContext(ctx, p) })
+}
+
+func (s *duplicateStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	if err := s.store.UpdatePaymentContext(ctx, p); err != nil {
+		return err
+	}
+	s.updated(&p)
+	return nil
+}
+
+func (s *duplicateStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	exists, err := s.exists(ctx, p.ID)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return s.create(ctx, p, func() error { return s.store.StorePaymentContext(ctx, p) })
+	}
+
+	if err := s.store.StorePaymentContext(ctx, p); err != nil {
+		return err
+	}
+	s.updated(&p)
+	return nil
+}
+
+func (s *duplicateStore) DeletePaymentContext(ctx context.Context, id string) error {
+	if err := s.store.DeletePaymentContext(ctx, id); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.forget(id)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *duplicateStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &duplicateTx{Tx: tx, ctx: ctx, store: s}, nil
+}
+
+// Transaction of a duplicateStore
+// Payments are checked as they are staged, against each other too, and forgotten again unless the
+// transaction is committed.
+type duplicateTx struct {
+	Tx
+	ctx     context.Context
+	store   *duplicateStore
+	undo    []func()
+	flags   []*FlaggedDuplicate
+	updated []Payment
+	deleted []string
+}
+
+// Stages the creation of a payment through write, once checked for duplicates
+func (tx *duplicateTx) create(p Payment, write func() error) error {
+	undo, flag, err := tx.store.check(tx.ctx, &p)
+	if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		undo()
+		return err
+	}
+	tx.undo = append(tx.undo, undo)
+	tx.flags = append(tx.flags, flag)
+	return nil
+}
+
+// Forgets the payments staged for creation, in reverse order
+func (tx *duplicateTx) forget() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+}
+
+func (tx *duplicateTx) AddPayment(p Payment) error {
+	return tx.create(p, func() error { return tx.Tx.AddPayment(p) })
+}
+
+func (tx *duplicateTx) UpdatePayment(p Payment) error {
+	if err := tx.Tx.UpdatePayment(p); err != nil {
+		return err
+	}
+	tx.updated = append(tx.updated, p)
+	return nil
+}
+
+func (tx *duplicateTx) StorePayment(p Payment) error {
+	_, err := tx.Tx.GetPayment(p.ID)
+	if errors.Is(err, ErrPaymentNotFound) {
+		return tx.create(p, func() error { return tx.Tx.StorePayment(p) })
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Tx.StorePayment(p); err != nil {
+		return err
+	}
+	tx.updated = append(tx.updated, p)
+	return nil
+}
+
+func (tx *duplicateTx) DeletePayment(id string) error {
+	if err := tx.Tx.DeletePayment(id); err != nil {
+		return err
+	}
+	tx.deleted = append(tx.deleted, id)
+	return nil
+}
+
+func (tx *duplicateTx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		tx.forget()
+		return err
+	}
+	for _, p := range tx.updated {
+		tx.store.updated(&p)
+	}
+	tx.store.mu.Lock()
+	for _, id := range tx.deleted {
+		tx.store.forget(id)
+	}
+	tx.store.mu.Unlock()
+	for _, flag := range tx.flags {
+		tx.store.raise(tx.ctx, flag)
+	}
+	return nil
+}
+
+func (tx *duplicateTx) Rollback() error {
+	tx.forget()
+	return tx.Tx.Rollback()
+}
+
+// Serves the payments flagged for review by a detector under /duplicates
+// Without a detector, /duplicates responds with 404.
+func (api *GenericApi) ServeDuplicateFlags(detector *DuplicateDetector) {
+	api.duplicates = detector
+}
+
+// The duplicate detector of the API, if it has one
+func (api *GenericApi) duplicateDetector(w rest.ResponseWriter) (*DuplicateDetector, bool) {
+	if api.duplicates == nil {
+		rest.Error(w, "Duplicate payments are not detected", http.StatusNotFound)
+	}
+	return api.duplicates, api.duplicates != nil
+}
+
+// Lists the payments flagged for review as duplicates, oldest first
+func (api *GenericApi) GetFlaggedDuplicates(w rest.ResponseWriter, r *rest.Request) {
+	detector, ok := api.duplicateDetector(w)
+	if !ok {
+		return
+	}
+	writeData(w, r, http.StatusOK, detector.Flags(), EnvelopeLinks{Self: "/duplicates"})
+}
+
+// Dismisses the flag of a payment once reviewed, requires an "id" parameter
+func (api *GenericApi) DismissFlaggedDuplicate(w rest.ResponseWriter, r *rest.Request) {
+	detector, ok := api.duplicateDetector(w)
+	if !ok {
+		return
+	}
+
+	flag, err := detector.DismissFlag(r.PathParam("id"))
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, flag, EnvelopeLinks{Self: "/duplicates"})
+}
@@ -0,0 +1,237 @@
+package f3api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests rejecting, flagging and allowing duplicates by organisation, within their windows
+func TestDetectDuplicates(t *testing.T) {
+	store := DetectDuplicates(NewInMemStore(), DuplicateConfig{
+		Default: DuplicatePolicy{Window: time.Hour},
+		Organisations: map[string]DuplicatePolicy{
+			"flagged": {Action: DuplicateFlag},
+			"allowed": {Action: DuplicateAllow},
+		},
+	})
+	now := time.Now()
+	store.detector.now = func() time.Time { return now }
+
+	p := defaultPayment()
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+
+	dup := p
+	dup.ID = "duplicate"
+	dup.Attributes.Reference = " " + strings.ToUpper(p.Attributes.Reference)
+	err := store.AddPayment(dup)
+	var derr *DuplicateError
+	if !errors.As(err, &derr) || derr.OriginalID != p.ID || errors.Is(err, ErrPaymentExists) {
+		t.Fatalf("Expected the duplicate to be rejected, got %v", err)
+	}
+	if err := store.StorePayment(dup); !errors.As(err, &derr) {
+		t.Fatalf("Expected the duplicate to be rejected when stored, got %v", err)
+	}
+
+	// other amounts aren't duplicates, and updates aren't checked
+	other := dup
+	other.Attributes.Amount++
+	if err := store.AddPayment(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.StorePayment(p); err != nil {
+		t.Fatal(err)
+	}
+
+	// the window is over
+	now = now.Add(time.Hour)
+	if err := store.StorePayment(dup); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, org := range []string{"flagged", "allowed"} {
+		original := p
+		original.ID, original.OrganisationID = org+"-original", org
+		dup := original
+		dup.ID = org + "-duplicate"
+		if err := store.AddPayment(original); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.AddPayment(dup); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	flags := store.Flags()
+	if len(flags) != 1 || flags[0].PaymentID != "flagged-duplicate" || flags[0].OriginalID != "flagged-original" {
+		t.Fatalf("Unexpected flags %+v", flags)
+	}
+
+	// deleted payments aren't duplicated any more
+	if err := store.DeletePayment("flagged-original"); err != nil {
+		t.Fatal(err)
+	}
+	again := p
+	again.ID, again.OrganisationID = "flagged-again", "flagged"
+	store.AddPayment(again)
+	if flags := store.Flags(); len(flags) != 2 || flags[1].OriginalID != "flagged-duplicate" {
+		t.Fatalf("Unexpected flags %+v", flags)
+	}
+
+	// flags are served until dismissed
+	api := NewGenericApi(store)
+	responseWriter := &testResponseWriter{}
+	api.GetFlaggedDuplicates(responseWriter, createRestRequest("GET", "/duplicates", strings.NewReader(""), nil))
+	if responseWriter.status != http.StatusNotFound {
+		t.Fatalf("Expected status %d without a detector, got %d", http.StatusNotFound, responseWriter.status)
+	}
+	api.ServeDuplicateFlags(store)
+
+	responseWriter = &testResponseWriter{}
+	api.DismissFlaggedDuplicate(responseWriter, createRestRequest("POST", "/duplicates/flagged-duplicate/dismiss", strings.NewReader(""), map[string]string{"id": "flagged-duplicate"}))
+	responseWriter = &testResponseWriter{}
+	api.GetFlaggedDuplicates(responseWriter, createRestRequest("GET", "/duplicates", strings.NewReader(""), nil))
+	var served []FlaggedDuplicate
+	if err := json.Unmarshal(responseWriter.Read(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if len(served) != 1 || served[0].PaymentID != "flagged-again" {
+		t.Fatalf("Unexpected flags %+v", served)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.DismissFlaggedDuplicate(responseWriter, createRestRequest("POST", "/duplicates/flagged-duplicate/dismiss", strings.NewReader(""), map[string]string{"id": "flagged-duplicate"}))
+	if responseWriter.status != http.StatusNotFound {
+		t.Fatalf("Expected status %d dismissing twice, got %d", http.StatusNotFound, responseWriter.status)
+	}
+}
+
+// Tests that only the latest flags are kept
+func TestDuplicateFlagsBounded(t *testing.T) {
+	store := DetectDuplicates(NewInMemStore(), DuplicateConfig{Default: DuplicatePolicy{Action: DuplicateFlag}})
+	for i := 0; i <= maxDuplicateFlags+1; i++ {
+		p := defaultPayment()
+		p.ID = strconv.Itoa(i)
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if flags := store.Flags(); len(flags) != maxDuplicateFlags || flags[0].PaymentID != "2" {
+		t.Fatalf("Expected the latest %d flags, got %d starting with %+v", maxDuplicateFlags, len(flags), flags[0])
+	}
+}
+
+// Tests that payments are forgotten once out of the window, even behind one created again since
+func TestDuplicateExpiry(t *testing.T) {
+	store := DetectDuplicates(NewInMemStore(), DuplicateConfig{Default: DuplicatePolicy{Window: time.Hour}})
+	now := time.Now()
+	store.detector.now = func() time.Time { return now }
+
+	payment := func(id, reference string) Payment {
+		p := defaultPayment()
+		p.ID = id
+		p.Attributes.Reference = reference
+		return p
+	}
+	for _, p := range []Payment{payment("again", "a"), payment("expired", "b"), payment("deleted", "c")} {
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeletePayment("deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	// created again under the same ID, after the others
+	now = now.Add(30 * time.Minute)
+	if err := store.DeletePayment("again"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddPayment(payment("again", "a")); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(45 * time.Minute)
+	if err := store.AddPayment(payment("latest", "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	d := store.detector
+	if _, ok := d.seen["expired"]; ok {
+		t.Fatal("Expected the payment out of the window to be forgotten")
+	}
+	if _, ok := d.seen["again"]; !ok {
+		t.Fatal("Expected the payment created again to be remembered")
+	}
+	if len(d.created) != 2 || d.created[0].id != "again" || d.created[1].id != "latest" {
+		t.Fatalf("Expected only the payments in the window to be queued, got %+v", d.created)
+	}
+}
+
+// Tests that duplicates within an atomic batch are refused, and that a refused batch is forgotten
+func TestDetectDuplicatesBatch(t *testing.T) {
+	store := DetectDuplicates(NewInMemStore(), DuplicateConfig{})
+
+	p := defaultPayment()
+	dup := p
+	dup.ID = "duplicate"
+	err := ApplyBatch(store, []BatchOp{{BatchAdd, p}, {BatchStore, dup}})
+	var (
+		berr *BatchError
+		derr *DuplicateError
+	)
+	if !errors.As(err, &berr) || berr.Index != 1 || !errors.As(err, &derr) {
+		t.Fatalf("Expected the second payment to be rejected, got %v", err)
+	}
+
+	if err := store.AddPayment(dup); err != nil {
+		t.Fatalf("Expected the payment of the rolled back batch to be forgotten, got %v", err)
+	}
+}
+
+// Tests the response to a rejected duplicate
+func TestPostDuplicatePayment(t *testing.T) {
+	api := NewGenericApi(DetectDuplicates(NewInMemStore(), DuplicateConfig{}))
+	p := defaultPayment()
+	api.store.AddPaymentContext(t.Context(), p)
+
+	dup := p
+	dup.ID = "duplicate"
+	body, _ := json.Marshal(dup)
+	responseWriter := &testResponseWriter{}
+	api.PostPayment(responseWriter, createRestRequest("POST", "/payments", strings.NewReader(string(body)), nil))
+
+	if responseWriter.status != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, responseWriter.status)
+	}
+	if link := responseWriter.Header().Get("Link"); link != `</payments/`+p.ID+`>; rel="duplicate-of"` {
+		t.Fatalf("Unexpected link %q", link)
+	}
+	var response duplicateErrorResponse
+	if err := json.Unmarshal(responseWriter.Read(), &response); err != nil || response.Original != "/payments/"+p.ID {
+		t.Fatalf("Unexpected response %s", responseWriter.result)
+	}
+}
+
+// Tests reading the policies from JSON
+func TestReadDuplicateConfig(t *testing.T) {
+	config, err := ReadDuplicateConfig(strings.NewReader(`{"default": {"window": "2h"}, "organisations": {"org": {"action": "flag"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Default.Window != 2*time.Hour || config.Organisations["org"].Action != DuplicateFlag {
+		t.Fatalf("Unexpected config %+v", config)
+	}
+
+	for _, bad := range []string{`{"default": {"action": "ignore"}}`, `{"default": {"window": "soon"}}`, `{"defaults": {}}`} {
+		if _, err := ReadDuplicateConfig(strings.NewReader(bad)); err == nil {
+			t.Fatalf("Expected %s to be refused", bad)
+		}
+	}
+}
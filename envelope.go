@@ -0,0 +1,112 @@
+package f3api
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// Media type of JSON:API documents, selecting enveloped requests and responses
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// A JSON:API style document, wrapping the data of a response
+type Envelope struct {
+	Data  interface{}   `json:"data"`
+	Links EnvelopeLinks `json:"links"`
+	Meta  *EnvelopeMeta `json:"meta,omitempty"`
+}
+
+// Links of an enveloped response
+type EnvelopeLinks struct {
+	// The resource or collection in the response
+	Self string `json:"self"`
+	// The next page of a paginated collection, if there is one
+	Next string `json:"next,omitempty"`
+}
+
+// Metadata of an enveloped collection
+type EnvelopeMeta struct {
+	// Number of items in the response (in this page, for paginated collections)
+	Count int `json:"count"`
+}
+
+// Reports whether an Accept header explicitly asks for mediaType (with a non-zero quality)
+// Wildcards don't count, so that clients which accept anything keep getting bare JSON.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil || mt != mediaType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// Reports whether the client asked for enveloped responses
+func wantsEnvelope(r *rest.Request) bool {
+	return acceptsMediaType(r.Header.Get("Accept"), jsonAPIMediaType)
+}
+
+// Reports whether the request body is enveloped
+func isEnveloped(r *rest.Request) bool {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediatype == jsonAPIMediaType
+}
+
+// Writes the JSON body of a response with the given status, wrapped in an Envelope if the client asked
+// for it through the Accept header (see wantsEnvelope); collections are counted in the envelope's meta
+func writeData(w rest.ResponseWriter, r *rest.Request, status int, data interface{}, links EnvelopeLinks) {
+	w.Header().Add("Vary", "Accept")
+	if !wantsEnvelope(r) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+		}
+		w.WriteJson(data)
+		return
+	}
+
+	env := Envelope{Data: data, Links: links}
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice {
+		env.Meta = &EnvelopeMeta{Count: v.Len()}
+		// empty collections are [] rather than null
+		if v.IsNil() {
+			env.Data = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+		}
+	}
+
+	w.Header().Set("Content-Type", jsonAPIMediaType)
+	w.WriteHeader(status)
+	w.WriteJson(&env)
+}
+
+// Decodes the JSON payload of a request into v, unwrapping it from its envelope if the Content-Type
+// says it is enveloped
+func decodeData(r *rest.Request, v interface{}) error {
+	if !isEnveloped(r) {
+		return r.DecodeJsonPayload(v)
+	}
+
+	env := struct {
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := r.DecodeJsonPayload(&env); err != nil {
+		return err
+	}
+	if len(env.Data) == 0 {
+		return errMissingData
+	}
+	return json.Unmarshal(env.Data, v)
+}
+
+// Error of an enveloped request body without data
+var errMissingData = errors.New("Enveloped request body has no data")
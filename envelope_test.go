@@ -0,0 +1,85 @@
+package f3api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Sends a request to handler with the given Accept and Content-Type headers
+func sendWithMediaTypes(handler http.Handler, method, path, accept, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// Tests enveloped requests and responses, and that bare JSON remains the default
+func TestEnvelope(t *testing.T) {
+	handler, err := MakeHandler(NewGenericApi(NewInMemStore()), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := defaultPayment()
+
+	// enveloped request body, enveloped response
+	w := sendWithMediaTypes(handler, "POST", "/payments", jsonAPIMediaType, jsonAPIMediaType, `{"data":`+DEFAULT_PAYMENT+`}`)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != jsonAPIMediaType {
+		t.Fatalf("Unexpected response %d %s: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	var single struct {
+		Data  Payment
+		Links EnvelopeLinks
+		Meta  *EnvelopeMeta
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &single); err != nil {
+		t.Fatal(err)
+	}
+	if single.Data.ID != p.ID || single.Links.Self != "/payments/"+p.ID || single.Meta != nil {
+		t.Fatalf("Unexpected envelope %+v", single)
+	}
+
+	// paginated collection
+	w = sendWithMediaTypes(handler, "GET", "/payments?limit=1", "application/json;q=0.5, "+jsonAPIMediaType, "", "")
+	var list struct {
+		Data  []Payment
+		Links EnvelopeLinks
+		Meta  EnvelopeMeta
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Data) != 1 || list.Meta.Count != 1 || list.Links.Self != "/payments?limit=1" || list.Links.Next != "" {
+		t.Fatalf("Unexpected envelope %+v", list)
+	}
+
+	// bare JSON for clients which don't ask for envelopes, or refuse them
+	for _, accept := range []string{"", "*/*", "application/json", jsonAPIMediaType + ";q=0"} {
+		w = sendWithMediaTypes(handler, "GET", "/payments/"+p.ID, accept, "", "")
+		var bare Payment
+		if err := json.Unmarshal(w.Body.Bytes(), &bare); err != nil || bare.ID != p.ID {
+			t.Fatalf("Accept %q: expected a bare payment, got %s", accept, w.Body.String())
+		}
+	}
+
+	// empty collections are enveloped as []
+	w = sendWithMediaTypes(handler, "GET", "/payments?limit=1&after="+p.ID, jsonAPIMediaType, "", "")
+	var empty struct{ Data json.RawMessage }
+	if err := json.Unmarshal(w.Body.Bytes(), &empty); err != nil || string(empty.Data) != "[]" {
+		t.Fatalf("Expected an empty data array, got %s", w.Body.String())
+	}
+
+	// enveloped bodies must have data
+	w = sendWithMediaTypes(handler, "PUT", "/payments/"+p.ID, "", jsonAPIMediaType, `{"links":{}}`)
+	if w.Code == http.StatusOK {
+		t.Fatal("Expected an envelope without data to be refused")
+	}
+}
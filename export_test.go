@@ -0,0 +1,8 @@
+package f3api
+
+import "time"
+
+// Like BusinessDayStore, as of now, for the conformance tests in package f3api_test
+func BusinessDayStoreAt(store ApiStore, calendar *BusinessCalendar, now time.Time) ApiStore {
+	return ApiStoreOf(&businessDayStore{storeDecorator{ContextStoreOf(store)}, calendar, func() time.Time { return now }})
+}
@@ -0,0 +1,583 @@
+package f3api
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter expressions over payments, as given to GET /payments?filter=
+//
+//	expr       = term { "OR" term }
+//	term       = factor { "AND" factor }
+//	factor     = "NOT" factor | "(" expr ")" | comparison
+//	comparison = field operator value
+//	operator   = "=" | "!=" | "<" | "<=" | ">" | ">=" | "contains" | "prefix"
+//
+// Fields are the dotted JSON paths of the CSV column layout; paths which don't name a top-level field
+// are taken to be within "attributes", so "amount" stands for "attributes.amount". Values are bare
+// words or quoted strings ('...' or "..."), and are checked against the type of their field:
+//
+//   - text fields take any value, and "contains" and "prefix" (both case sensitive)
+//   - numeric fields (amounts, exchange rates, versions, string-encoded integers) take numbers
+//   - dates take a day (2017-01-18), a month (2017-01) or a year (2017), each standing for the range
+//     of days it covers: "processing_date = 2017-01" matches any day of January, and
+//     "processing_date > 2017-01" any day from February on
+//
+// Keywords are case insensitive. For example:
+//
+//	currency = GBP AND amount > 10000 AND beneficiary_party.bank_id = 403000
+//	AND processing_date = 2017-01 AND reference contains 'piano'
+
+// A parsed and type-checked filter expression, see ParseFilter
+type Filter struct {
+	src  string
+	expr filterExpr
+}
+
+// An error in a filter expression, at a byte offset of the expression
+type FilterError struct {
+	Pos int
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("Invalid filter at position %d: %s", e.Pos, e.Msg)
+}
+
+// Node of a filter expression
+type filterExpr interface {
+	match(p *Payment) bool
+	// Appends the SQL condition of the node to b, and its parameters to args
+	sql(b *strings.Builder, column func(field string) string, args *[]interface{})
+}
+
+// Kinds of values fields hold, which decide the operators and values they take
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	numberField
+	dateField
+)
+
+// A field a filter can test
+type filterField struct {
+	path  string
+	index []int
+	kind  fieldKind
+}
+
+var (
+	dateType = reflect.TypeOf(Date{})
+
+	// The filterable fields of a payment by path; the repeated sender charges aren't filterable
+	paymentFilterFields = func() map[string]filterField {
+		fields := make(map[string]filterField)
+		paymentType := reflect.TypeOf(Payment{})
+		for _, f := range paymentCSVFields {
+			if f.elem != nil {
+				continue
+			}
+			t := paymentType.FieldByIndex(f.index).Type
+			kind := textField
+			switch {
+			case t == dateType:
+				kind = dateField
+			case t.Kind() != reflect.String:
+				kind = numberField
+			}
+			fields[f.path] = filterField{f.path, f.index, kind}
+		}
+		return fields
+	}()
+)
+
+// Finds a field by the name used in a filter
+func lookupFilterField(name string) (filterField, bool) {
+	if f, ok := paymentFilterFields[name]; ok {
+		return f, true
+	}
+	f, ok := paymentFilterFields["attributes."+name]
+	return f, ok
+}
+
+// The value of the field in a payment: a string, a float64 or a time.Time
+func (f filterField) value(p *Payment) interface{} {
+	v := reflect.ValueOf(p).Elem().FieldByIndex(f.index)
+	switch f.kind {
+	case dateField:
+		return v.Interface().(Date).Time
+	case numberField:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			return v.Float()
+		}
+		return float64(v.Int())
+	}
+	return v.String()
+}
+
+// Parses and type-checks a filter expression, see the grammar above
+func ParseFilter(src string) (*Filter, error) {
+	p := filterParser{lexer: filterLexer{src: src}}
+	p.next()
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+
+	f := Filter{src: src, expr: expr}
+	return &f, nil
+}
+
+// The expression the filter was parsed from
+func (f *Filter) String() string {
+	return f.src
+}
+
+// Reports whether a payment matches the filter
+func (f *Filter) Match(p *Payment) bool {
+	return f.expr.match(p)
+}
+
+// Translates the filter into the condition of an SQL WHERE clause, with "?" placeholders for its
+// parameters, for stores keeping payments in SQL databases
+// column maps the path of a field (e.g. "attributes.amount") to its column. Dates are passed as
+// "2006-01-02" strings, numbers as float64.
+func (f *Filter) SQLWhere(column func(field string) string) (string, []interface{}) {
+	var (
+		b    strings.Builder
+		args []interface{}
+	)
+	f.expr.sql(&b, column, &args)
+	return b.String(), args
+}
+
+// Keeps the payments matching the filter
+func (f *Filter) Apply(payments []Payment) []Payment {
+	var matched []Payment
+	for i := range payments {
+		if f.Match(&payments[i]) {
+			matched = append(matched, payments[i])
+		}
+	}
+	return matched
+}
+
+// Implemented by stores which can search payments without listing them all
+type FilterStore interface {
+	FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error)
+}
+
+// Fetches the payments of a store which match a filter, searching the store itself if it implements
+// FilterStore, and filtering the list of all its payments otherwise
+func FindPayments(ctx context.Context, store ContextStore, f *Filter) ([]Payment, error) {
+	if fs, ok := store.(FilterStore); ok {
+		return fs.FindPaymentsContext(ctx, f)
+	}
+
+	payments, err := store.GetAllPaymentsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f.Apply(payments), nil
+}
+
+type andExpr struct {
+	left, right filterExpr
+}
+
+func (e andExpr) match(p *Payment) bool {
+	return e.left.match(p) && e.right.match(p)
+}
+
+func (e andExpr) sql(b *strings.Builder, column func(string) string, args *[]interface{}) {
+	b.WriteString("(")
+	e.left.sql(b, column, args)
+	b.WriteString(" AND ")
+	e.right.sql(b, column, args)
+	b.WriteString(")")
+}
+
+type orExpr struct {
+	left, right filterExpr
+}
+
+func (e orExpr) match(p *Payment) bool {
+	return e.left.match(p) || e.right.match(p)
+}
+
+func (e orExpr) sql(b *strings.Builder, column func(string) string, args *[]interface{}) {
+	b.WriteString("(")
+	e.left.sql(b, column, args)
+	b.WriteString(" OR ")
+	e.right.sql(b, column, args)
+	b.WriteString(")")
+}
+
+type notExpr struct {
+	expr filterExpr
+}
+
+func (e notExpr) match(p *Payment) bool {
+	return !e.expr.match(p)
+}
+
+func (e notExpr) sql(b *strings.Builder, column func(string) string, args *[]interface{}) {
+	b.WriteString("NOT ")
+	e.expr.sql(b, column, args)
+}
+
+// A comparison of a field with a value of the field's kind
+type comparison struct {
+	field filterField
+	op    string
+	text  string
+	num   float64
+	// dates stand for the range of days [from, until)
+	from, until time.Time
+}
+
+func (c comparison) match(p *Payment) bool {
+	switch v := c.field.value(p).(type) {
+	case string:
+		switch c.op {
+		case "=":
+			return v == c.text
+		case "!=":
+			return v != c.text
+		case "contains":
+			return strings.Contains(v, c.text)
+		case "prefix":
+			return strings.HasPrefix(v, c.text)
+		}
+	case float64:
+		switch c.op {
+		case "=":
+			return v == c.num
+		case "!=":
+			return v != c.num
+		case "<":
+			return v < c.num
+		case "<=":
+			return v <= c.num
+		case ">":
+			return v > c.num
+		case ">=":
+			return v >= c.num
+		}
+	case time.Time:
+		within := !v.Before(c.from) && v.Before(c.until)
+		switch c.op {
+		case "=":
+			return within
+		case "!=":
+			return !within
+		case "<":
+			return v.Before(c.from)
+		case "<=":
+			return v.Before(c.until)
+		case ">":
+			return !v.Before(c.until)
+		case ">=":
+			return !v.Before(c.from)
+		}
+	}
+	return false
+}
+
+// Escapes the wildcards of a LIKE pattern, with \ as the escape character
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (c comparison) sql(b *strings.Builder, column func(string) string, args *[]interface{}) {
+	col := column(c.field.path)
+
+	switch c.field.kind {
+	case textField:
+		switch c.op {
+		case "contains":
+			fmt.Fprintf(b, `%s LIKE ? ESCAPE '\'`, col)
+			*args = append(*args, "%"+likeEscaper.Replace(c.text)+"%")
+		case "prefix":
+			fmt.Fprintf(b, `%s LIKE ? ESCAPE '\'`, col)
+			*args = append(*args, likeEscaper.Replace(c.text)+"%")
+		default:
+			fmt.Fprintf(b, "%s %s ?", col, sqlOperator(c.op))
+			*args = append(*args, c.text)
+		}
+
+	case numberField:
+		fmt.Fprintf(b, "%s %s ?", col, sqlOperator(c.op))
+		*args = append(*args, c.num)
+
+	case dateField:
+		from, until := c.from.Format(timeFmt), c.until.Format(timeFmt)
+		switch c.op {
+		case "=":
+			fmt.Fprintf(b, "(%s >= ? AND %s < ?)", col, col)
+			*args = append(*args, from, until)
+		case "!=":
+			fmt.Fprintf(b, "(%s < ? OR %s >= ?)", col, col)
+			*args = append(*args, from, until)
+		case "<":
+			fmt.Fprintf(b, "%s < ?", col)
+			*args = append(*args, from)
+		case "<=":
+			fmt.Fprintf(b, "%s < ?", col)
+			*args = append(*args, until)
+		case ">":
+			fmt.Fprintf(b, "%s >= ?", col)
+			*args = append(*args, until)
+		case ">=":
+			fmt.Fprintf(b, "%s >= ?", col)
+			*args = append(*args, from)
+		}
+	}
+}
+
+// The SQL spelling of a comparison operator
+func sqlOperator(op string) string {
+	if op == "!=" {
+		return "<>"
+	}
+	return op
+}
+
+// Kinds of filter tokens
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	// a bare word: field, keyword or unquoted value
+	tokWord
+	tokString
+	tokOperator
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Splits a filter expression into tokens
+type filterLexer struct {
+	src string
+	pos int
+}
+
+// Characters of bare words, which include those of dotted paths, numbers and dates
+func isWordChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("._-:+", c)
+}
+
+func (l *filterLexer) next() (filterToken, error) {
+	for l.pos < len(l.src) && unicode.IsSpace(rune(l.src[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return filterToken{tokEOF, "", start}, nil
+	}
+
+	switch c := l.src[l.pos]; c {
+	case '(':
+		l.pos++
+		return filterToken{tokLParen, "(", start}, nil
+	case ')':
+		l.pos++
+		return filterToken{tokRParen, ")", start}, nil
+	case '=':
+		l.pos++
+		return filterToken{tokOperator, "=", start}, nil
+	case '!', '<', '>':
+		l.pos++
+		if l.pos < len(l.src) && l.src[l.pos] == '=' {
+			l.pos++
+		} else if c == '!' {
+			return filterToken{}, &FilterError{start, `expected "!="`}
+		}
+		return filterToken{tokOperator, l.src[start:l.pos], start}, nil
+	case '\'', '"':
+		end := strings.IndexByte(l.src[l.pos+1:], c)
+		if end < 0 {
+			return filterToken{}, &FilterError{start, "unterminated string"}
+		}
+		l.pos += end + 2
+		return filterToken{tokString, l.src[start+1 : l.pos-1], start}, nil
+	}
+
+	for _, c := range l.src[l.pos:] {
+		if !isWordChar(c) {
+			break
+		}
+		l.pos += len(string(c))
+	}
+	if l.pos == start {
+		return filterToken{}, &FilterError{start, fmt.Sprintf("unexpected character %q", l.src[start])}
+	}
+	return filterToken{tokWord, l.src[start:l.pos], start}, nil
+}
+
+// Recursive descent parser of filter expressions
+type filterParser struct {
+	lexer filterLexer
+	tok   filterToken
+	err   error
+}
+
+// Advances to the next token; lexing errors are reported by the next parse step
+func (p *filterParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lexer.next()
+	if p.err != nil {
+		p.tok = filterToken{kind: tokEOF, pos: p.lexer.pos}
+	}
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return &FilterError{p.tok.pos, fmt.Sprintf(format, args...)}
+}
+
+// Reports whether the current token is the given keyword
+func (p *filterParser) isKeyword(keyword string) bool {
+	return p.tok.kind == tokWord && strings.EqualFold(p.tok.text, keyword)
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseFactor() (filterExpr, error) {
+	switch {
+	case p.isKeyword("NOT"):
+		p.next()
+		expr, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+
+	case p.tok.kind == tokLParen:
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf(`expected ")"`)
+		}
+		p.next()
+		return expr, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	if p.tok.kind != tokWord {
+		return nil, p.errorf("expected a field")
+	}
+	field, ok := lookupFilterField(p.tok.text)
+	if !ok {
+		return nil, p.errorf("unknown field %q", p.tok.text)
+	}
+	p.next()
+
+	op := p.tok.text
+	switch {
+	case p.tok.kind == tokOperator:
+	case p.isKeyword("contains"), p.isKeyword("prefix"):
+		op = strings.ToLower(op)
+		if field.kind != textField {
+			return nil, p.errorf("%s only applies to text fields, not %s", op, field.path)
+		}
+	default:
+		return nil, p.errorf("expected an operator")
+	}
+	if field.kind == textField && op != "=" && op != "!=" && op != "contains" && op != "prefix" {
+		return nil, p.errorf("%s doesn't apply to the text field %s", op, field.path)
+	}
+	p.next()
+
+	if p.tok.kind != tokWord && p.tok.kind != tokString {
+		return nil, p.errorf("expected a value")
+	}
+	c := comparison{field: field, op: op, text: p.tok.text}
+
+	var err error
+	switch field.kind {
+	case numberField:
+		if c.num, err = strconv.ParseFloat(c.text, 64); err != nil {
+			return nil, p.errorf("%s is a number, not %q", field.path, c.text)
+		}
+	case dateField:
+		if c.from, c.until, err = parseDateRange(c.text); err != nil {
+			return nil, p.errorf("%s is a date, not %q", field.path, c.text)
+		}
+	}
+	p.next()
+
+	return c, nil
+}
+
+// Parses a day, month or year into the range of days it covers
+func parseDateRange(s string) (from, until time.Time, err error) {
+	if from, err = time.Parse(timeFmt, s); err == nil {
+		return from, from.AddDate(0, 0, 1), nil
+	}
+	if from, err = time.Parse("2006-01", s); err == nil {
+		return from, from.AddDate(0, 1, 0), nil
+	}
+	if from, err = time.Parse("2006", s); err == nil {
+		return from, from.AddDate(1, 0, 0), nil
+	}
+	return time.Time{}, time.Time{}, err
+}
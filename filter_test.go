@@ -0,0 +1,127 @@
+package f3api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests matching filters against the default payment
+func TestFilterMatch(t *testing.T) {
+	p := defaultPayment()
+
+	for _, c := range []struct {
+		filter string
+		match  bool
+	}{
+		{"currency = GBP", true},
+		{"currency != GBP", false},
+		{"attributes.currency = 'GBP'", true},
+		{"amount > 100", true},
+		{"amount > 100.21", false},
+		{"amount >= 100.21 AND amount <= 100.21", true},
+		{"version = 0", true},
+		{"numeric_reference = 1002001", true},
+		{"fx.exchange_rate < 2.5", true},
+		{"beneficiary_party.bank_id = 403000", true},
+		{"beneficiary_party.account_type = 0", true},
+		{"reference contains 'piano'", true},
+		{"reference contains 'Piano'", false},
+		{"reference prefix \"Payment for\"", true},
+		{"processing_date = 2017-01-18", true},
+		{"processing_date = 2017-01", true},
+		{"processing_date = 2017", true},
+		{"processing_date != 2017-01", false},
+		{"processing_date < 2017-01", false},
+		{"processing_date <= 2017-01", true},
+		{"processing_date > 2017-01-17", true},
+		{"processing_date > 2017-01", false},
+		{"processing_date >= 2017-01-18", true},
+		{"currency = USD OR amount > 100", true},
+		{"currency = USD OR amount > 1000", false},
+		{"NOT currency = USD", true},
+		{"not (currency = GBP and amount > 1000)", true},
+		{"currency = GBP AND amount > 10000 AND beneficiary_party.bank_id = 403000 AND processing_date = 2017-01 AND reference contains 'piano'", false},
+		{"currency = GBP AND amount > 100 AND beneficiary_party.bank_id = 403000 AND processing_date = 2017-01 AND reference contains 'piano'", true},
+	} {
+		f, err := ParseFilter(c.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.filter, err)
+		}
+		if f.Match(&p) != c.match {
+			t.Fatalf("%s: expected match to be %v", c.filter, c.match)
+		}
+	}
+}
+
+// Tests that malformed and ill-typed filters are refused
+func TestFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		"colour = red",
+		"amount > lots",
+		"amount contains 1",
+		"currency < GBP",
+		"processing_date = yesterday",
+		"currency = GBP AND",
+		"(currency = GBP",
+		"currency = 'GBP",
+		"currency ! GBP",
+		"currency = GBP extra",
+		"charges_information.sender_charges = 1",
+		"amount > 10,000",
+	} {
+		if _, err := ParseFilter(filter); err == nil {
+			t.Fatalf("Expected filter %q to be refused", filter)
+		}
+	}
+}
+
+// Tests the SQL translation of a filter
+func TestFilterSQLWhere(t *testing.T) {
+	f, err := ParseFilter("currency = GBP AND (amount > 10000 OR reference contains '50%') AND processing_date = 2017-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	where, args := f.SQLWhere(func(field string) string {
+		return strings.ReplaceAll(strings.TrimPrefix(field, "attributes."), ".", "_")
+	})
+	expected := `((currency = ? AND (amount > ? OR reference LIKE ? ESCAPE '\')) AND (processing_date >= ? AND processing_date < ?))`
+	if where != expected {
+		t.Fatalf("Unexpected condition %s", where)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"GBP", 10000.0, `%50\%%`, "2017-01-01", "2017-02-01"}) {
+		t.Fatalf("Unexpected parameters %v", args)
+	}
+}
+
+// Tests the filter query parameter of GetAllPayments, through store decorators
+func TestGetAllPaymentsFilter(t *testing.T) {
+	instrumented, err := InstrumentStore(NewInMemStore(), NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := TraceStore(instrumented)
+	api := NewGenericApi(store)
+
+	p := defaultPayment()
+	store.AddPayment(p)
+	other := p
+	other.ID = "other"
+	other.Attributes.Currency = "EUR"
+	store.AddPayment(other)
+
+	responseWriter := &testResponseWriter{}
+	api.GetAllPayments(responseWriter, createRestRequest("GET", "/payments?filter=currency+%3D+EUR", strings.NewReader(""), nil))
+	if !strings.Contains(responseWriter.result, `"id":"other"`) || strings.Contains(responseWriter.result, p.ID) {
+		t.Fatalf("Unexpected listing %s", responseWriter.result)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.GetAllPayments(responseWriter, createRestRequest("GET", "/payments?filter=currency+%3C+EUR", strings.NewReader(""), nil))
+	if responseWriter.status != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for an invalid filter, got %d", http.StatusBadRequest, responseWriter.status)
+	}
+}
@@ -0,0 +1,332 @@
+package f3api
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// Number of decimal places of the ISO 4217 currencies without two of them
+var minorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// Number of decimal places amounts in a currency are rounded to
+// Amounts are written with two decimal places, so currencies with more of them are rounded to two.
+func currencyDecimals(currency string) int {
+	if d, ok := minorUnits[currency]; ok {
+		return min(d, 2)
+	}
+	return 2
+}
+
+// Rounds an amount to the decimal places of a currency
+func roundAmount(amount float64, currency string) float64 {
+	scale := math.Pow10(currencyDecimals(currency))
+	return math.Round(amount*scale) / scale
+}
+
+// Rounds an exchange rate to the five decimal places it is written with
+func roundRate(rate float64) float64 {
+	return math.Round(rate*1e5) / 1e5
+}
+
+// Checks the foreign exchange of a payment, if it has any
+//
+// The exchange rate is the amount of the original currency a unit of the currency of the payment
+// is worth, so that the amount times the rate is the original amount. It must be positive, the
+// currencies must differ, and the original amount may only be off by the rounding of both amounts
+// to their currencies' decimal places and of the rate to five decimal places. Payments without any
+// FX field set are domestic, and not checked.
+func ValidateFX(p Payment) error {
+	a := p.Attributes
+	fx := a.Fx
+	if fx == (FX{}) {
+		return nil
+	}
+
+	switch {
+	case !isCurrencyCode(fx.OriginalCurrency):
+		return ValidationError{"attributes.fx.original_currency", fmt.Sprintf("%q is not an ISO 4217 currency code", fx.OriginalCurrency)}
+	case fx.OriginalCurrency == a.Currency:
+		return ValidationError{"attributes.fx.original_currency", "must differ from the currency of the payment"}
+	case fx.ExchangeRate <= 0:
+		return ValidationError{"attributes.fx.exchange_rate", "must be positive"}
+	case fx.OriginalAmount < 0:
+		return ValidationError{"attributes.fx.original_amount", "must not be negative"}
+	}
+
+	expected := float64(a.Amount) * float64(fx.ExchangeRate)
+	tolerance := 0.5*math.Pow10(-currencyDecimals(fx.OriginalCurrency)) +
+		0.5*math.Pow10(-currencyDecimals(a.Currency))*float64(fx.ExchangeRate) +
+		0.5e-5*float64(a.Amount)
+	if math.Abs(float64(fx.OriginalAmount)-expected) > tolerance {
+		return ValidationError{"attributes.fx.original_amount", fmt.Sprintf(
+			"%.2f %s at %.5f is %.2f %s, not %.2f", a.Amount, a.Currency, fx.ExchangeRate, expected, fx.OriginalCurrency, fx.OriginalAmount)}
+	}
+	return nil
+}
+
+// A rate of a RateTable, from its effective date until the next rate of the same currencies
+type rateEntry struct {
+	effective time.Time
+	rate      float64
+}
+
+// Exchange rates between currencies, with the dates they are effective from
+type RateTable struct {
+	// rates by "FROM/TO", ordered by effective date
+	rates map[string][]rateEntry
+}
+
+// Reads a rate table from a CSV file without header, with a line per rate: the currency converted
+// from, the currency converted to, the amount of the latter a unit of the former is worth, and the
+// date the rate is effective from, such as "GBP,USD,1.27000,2026-10-01". Lines starting with "#" are
+// comments. Rates are used both ways, unless the reverse rate is given too.
+func ReadRateTable(r io.Reader) (*RateTable, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 4
+	reader.TrimLeadingSpace = true
+
+	t := RateTable{rates: make(map[string][]rateEntry)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		from, to := strings.TrimSpace(record[0]), strings.TrimSpace(record[1])
+		if !isCurrencyCode(from) || !isCurrencyCode(to) || from == to {
+			return nil, fmt.Errorf("line %d: expected two different currency codes, got %q and %q", line, from, to)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, record[2])
+		}
+		effective, err := time.Parse(timeFmt, strings.TrimSpace(record[3]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		pair := from + "/" + to
+		t.rates[pair] = append(t.rates[pair], rateEntry{effective, rate})
+	}
+
+	for _, entries := range t.rates {
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].effective.Before(entries[j].effective) })
+	}
+	return &t, nil
+}
+
+// The rate of a pair of currencies effective on a day, and the day it is effective from
+func (t *RateTable) lookup(pair string, day time.Time) (rateEntry, bool) {
+	entries := t.rates[pair]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].effective.After(day) })
+	if i == 0 {
+		return rateEntry{}, false
+	}
+	return entries[i-1], true
+}
+
+// The amount of a currency a unit of another is worth on a day, the day the rate is effective from,
+// and whether the table has such a rate
+func (t *RateTable) Rate(from, to string, day time.Time) (float64, time.Time, bool) {
+	day = startOfDay(day)
+	if e, ok := t.lookup(from+"/"+to, day); ok {
+		return e.rate, e.effective, true
+	}
+	if e, ok := t.lookup(to+"/"+from, day); ok {
+		return 1 / e.rate, e.effective, true
+	}
+	return 0, time.Time{}, false
+}
+
+// Request to convert an amount of money at the rate effective on a day
+type FXQuoteRequest struct {
+	From   string           `json:"from"`
+	To     string           `json:"to"`
+	Amount FractionalAmount `json:"amount"`
+	// Today if not given to GenericApi.QuoteFX
+	Date Date `json:"date"`
+}
+
+// The conversion of an amount of money, see RateTable.Quote
+type FXQuote struct {
+	FXQuoteRequest
+	Rate      ExchangeRate     `json:"rate"`
+	Converted FractionalAmount `json:"converted"`
+	// Day the rate is effective from
+	Effective Date `json:"effective"`
+}
+
+// Converts an amount at the rate effective on the day of the request, rounded to five decimal
+// places, and rounds the result to the decimal places of the currency converted to
+func (t *RateTable) Quote(req FXQuoteRequest) (FXQuote, error) {
+	q := FXQuote{FXQuoteRequest: req}
+	switch {
+	case !isCurrencyCode(req.From):
+		return q, ValidationError{"from", fmt.Sprintf("%q is not an ISO 4217 currency code", req.From)}
+	case !isCurrencyCode(req.To):
+		return q, ValidationError{"to", fmt.Sprintf("%q is not an ISO 4217 currency code", req.To)}
+	case req.Amount < 0:
+		return q, ValidationError{"amount", "must not be negative"}
+	case req.Date.IsZero():
+		return q, ValidationError{"date", "must be set"}
+	}
+
+	rate, effective, ok := 1.0, req.Date.Time, true
+	if req.From != req.To {
+		if rate, effective, ok = t.Rate(req.From, req.To, req.Date.Time); !ok {
+			return q, ValidationError{"to", fmt.Sprintf("no rate from %s to %s on %s", req.From, req.To, req.Date.Format(timeFmt))}
+		}
+	}
+
+	rate = roundRate(rate)
+	q.Rate, q.Effective = ExchangeRate(rate), Date{effective}
+	q.Converted = FractionalAmount(roundAmount(float64(req.Amount)*rate, req.To))
+	return q, nil
+}
+
+// ContextStore decorator checking the foreign exchange of payments, and filling it in from a rate
+// table when there is no FX contract
+type fxStore struct {
+	storeDecorator
+	rates *RateTable
+	now   func() time.Time
+}
+
+// Wraps a store to check the foreign exchange of every payment created or updated through it,
+// transactions included, with ValidateFX
+//
+// Payments with an original currency but no contract reference get the rate of the table effective
+// on their processing date (today if they have none), and the original amount it makes, before
+// being checked. Without a table, payments are only checked.
+// The returned store implements both ApiStore and ContextStore.
+func FXStore(store ApiStore, rates *RateTable) ApiStore {
+	return ApiStoreOf(&fxStore{storeDecorator{ContextStoreOf(store)}, rates, time.Now})
+}
+
+// Fills in the foreign exchange of a payment if needed, and checks it
+func (s *fxStore) check(p *Payment) error {
+	a := &p.Attributes
+	if s.rates != nil && a.Fx.ContractReference == "" && a.Fx.OriginalCurrency != "" && a.Fx.OriginalCurrency != a.Currency {
+		day := a.ProcessingDate.Time
+		if day.IsZero() {
+			day = s.now()
+		}
+
+		rate, _, ok := s.rates.Rate(a.Currency, a.Fx.OriginalCurrency, day)
+		if !ok {
+			return ValidationError{"attributes.fx.exchange_rate", fmt.Sprintf("no rate from %s to %s on %s", a.Currency, a.Fx.OriginalCurrency, day.Format(timeFmt))}
+		}
+		rate = roundRate(rate)
+		a.Fx.ExchangeRate = ExchangeRate(rate)
+		a.Fx.OriginalAmount = FractionalAmount(roundAmount(float64(a.Amount)*rate, a.Fx.OriginalCurrency))
+	}
+	return ValidateFX(*p)
+}
+
+func (s *fxStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	if err := s.check(&p); err != nil {
+		return err
+	}
+	setWritten(ctx, p)
+	return s.store.AddPaymentContext(ctx, p)
+}
+
+func (s *fxStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	if err := s.check(&p); err != nil {
+		return err
+	}
+	setWritten(ctx, p)
+	return s.store.UpdatePaymentContext(ctx, p)
+}
+
+func (s *fxStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	if err := s.check(&p); err != nil {
+		return err
+	}
+	setWritten(ctx, p)
+	return s.store.StorePaymentContext(ctx, p)
+}
+
+func (s *fxStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &fxTx{tx, s}, nil
+}
+
+// Transaction of an fxStore, checking foreign exchange as payments are staged
+type fxTx struct {
+	Tx
+	store *fxStore
+}
+
+func (tx *fxTx) AddPayment(p Payment) error {
+	if err := tx.store.check(&p); err != nil {
+		return err
+	}
+	return tx.Tx.AddPayment(p)
+}
+
+func (tx *fxTx) UpdatePayment(p Payment) error {
+	if err := tx.store.check(&p); err != nil {
+		return err
+	}
+	return tx.Tx.UpdatePayment(p)
+}
+
+func (tx *fxTx) StorePayment(p Payment) error {
+	if err := tx.store.check(&p); err != nil {
+		return err
+	}
+	return tx.Tx.StorePayment(p)
+}
+
+// Serves quotes at the rates of a table under /fx/quote
+// Without a table, /fx/quote responds with 404.
+func (api *GenericApi) ServeRates(rates *RateTable) {
+	api.rates = rates
+}
+
+// Converts an amount of money at the rate effective on a day, today if not given
+func (api *GenericApi) QuoteFX(w rest.ResponseWriter, r *rest.Request) {
+	if api.rates == nil {
+		rest.Error(w, "No exchange rates are known", http.StatusNotFound)
+		return
+	}
+
+	req := FXQuoteRequest{}
+	if err := decodeData(r, &req); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Date.IsZero() {
+		req.Date = Date{startOfDay(time.Now())}
+	}
+
+	quote, err := api.rates.Quote(req)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, quote, EnvelopeLinks{Self: r.URL.RequestURI()})
+}
@@ -0,0 +1,169 @@
+package f3api
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests the relationship between the amounts and the rate, within the rounding of each currency
+func TestValidateFX(t *testing.T) {
+	if err := ValidateFX(defaultPayment()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		amount, original float64
+		currency, orig   string
+		rate             float64
+		field            string
+	}{
+		{100, 127.01, "GBP", "USD", 1.27, ""},
+		{100, 127.02, "GBP", "USD", 1.27, "attributes.fx.original_amount"},
+		{100, 15235, "GBP", "JPY", 152.345, ""},
+		{100, 15233, "GBP", "JPY", 152.345, "attributes.fx.original_amount"},
+		{15235, 100, "JPY", "GBP", 0.00656, ""},
+		{100, 100, "GBP", "GBP", 1, "attributes.fx.original_currency"},
+		{100, 100, "GBP", "USD", 0, "attributes.fx.exchange_rate"},
+		{100, 100, "GBP", "usd", 1, "attributes.fx.original_currency"},
+	} {
+		p := defaultPayment()
+		p.Attributes.Amount, p.Attributes.Currency = FractionalAmount(c.amount), c.currency
+		p.Attributes.Fx = FX{"", ExchangeRate(c.rate), FractionalAmount(c.original), c.orig}
+
+		err := ValidateFX(p)
+		var verr ValidationError
+		if c.field == "" && err != nil || c.field != "" && (!errors.As(err, &verr) || verr.Field != c.field) {
+			t.Fatalf("%.2f %s at %.5f to %.2f %s: expected error of %q, got %v", c.amount, c.currency, c.rate, c.original, c.orig, c.field, err)
+		}
+	}
+
+	p := defaultPayment()
+	p.Attributes.Fx = FX{}
+	if err := ValidateFX(p); err != nil {
+		t.Fatalf("Expected a domestic payment to be valid, got %v", err)
+	}
+}
+
+// Tests looking up rates by effective date, both ways
+func TestRateTable(t *testing.T) {
+	table, err := ReadRateTable(strings.NewReader(`# from, to, rate, effective
+GBP,USD,1.25,2026-10-01
+GBP,USD,1.30,2026-10-15
+USD,EUR,0.90,2026-01-01
+EUR,USD,1.20,2026-01-01
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		from, to, day string
+		rate          float64
+		effective     string
+	}{
+		{"GBP", "USD", "2026-10-14", 1.25, "2026-10-01"},
+		{"GBP", "USD", "2026-10-15", 1.30, "2026-10-15"},
+		{"USD", "GBP", "2026-12-01", 1 / 1.30, "2026-10-15"},
+		{"EUR", "USD", "2026-06-01", 1.20, "2026-01-01"},
+		{"GBP", "USD", "2026-09-30", 0, ""},
+		{"GBP", "EUR", "2026-10-15", 0, ""},
+	} {
+		rate, effective, ok := table.Rate(c.from, c.to, mustDate(t, c.day))
+		if ok != (c.effective != "") || ok && (math.Abs(rate-c.rate) > 1e-12 || effective.Format(timeFmt) != c.effective) {
+			t.Fatalf("%s to %s on %s: expected %v from %s, got %v from %v (%v)", c.from, c.to, c.day, c.rate, c.effective, rate, effective, ok)
+		}
+	}
+
+	for _, bad := range []string{"GBP,GBP,1,2026-01-01\n", "GBP,USD,-1,2026-01-01\n", "GBP,USD,1\n", "GBP,USD,1,01/01/2026\n"} {
+		if _, err := ReadRateTable(strings.NewReader(bad)); err == nil {
+			t.Fatalf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+// Tests filling in the foreign exchange of payments without a contract, and checking the others
+func TestFXStore(t *testing.T) {
+	table, err := ReadRateTable(strings.NewReader("GBP,USD,1.27,2017-01-01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := FXStore(NewInMemStore(), table)
+
+	p := defaultPayment()
+	p.Attributes.Fx.ContractReference = ""
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := store.GetPayment(p.ID)
+	if fx := stored.Attributes.Fx; fx.ExchangeRate != 1.27 || fx.OriginalAmount != 127.27 {
+		t.Fatalf("Expected the FX to be filled in from the table, got %+v", fx)
+	}
+
+	// and the API responds with the payment filled in
+	body, _ := json.Marshal(p)
+	responseWriter := &testResponseWriter{}
+	NewGenericApi(store).PutPayment(responseWriter, createRestRequest("PUT", "/payments/"+p.ID, strings.NewReader(string(body)), map[string]string{"id": p.ID}))
+	var written Payment
+	if err := json.Unmarshal(responseWriter.Read(), &written); err != nil {
+		t.Fatal(err)
+	}
+	if fx := written.Attributes.Fx; fx.ExchangeRate != 1.27 || fx.OriginalAmount != 127.27 {
+		t.Fatalf("Expected the filled in FX in the response, got %+v", fx)
+	}
+
+	// contracts have rates of their own
+	p.Attributes.Fx.ContractReference = "FX123"
+	if err := store.UpdatePayment(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Attributes.Fx.OriginalAmount = 300
+	var verr ValidationError
+	if err := store.UpdatePayment(p); !errors.As(err, &verr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+	if err := ApplyBatch(store, []BatchOp{{BatchStore, p}}); !errors.As(err, &verr) {
+		t.Fatalf("Expected a validation error, got %v", err)
+	}
+
+	p.Attributes.Fx = FX{OriginalCurrency: "EUR"}
+	if err := store.UpdatePayment(p); !errors.As(err, &verr) || verr.Field != "attributes.fx.exchange_rate" {
+		t.Fatalf("Expected the missing rate to be reported, got %v", err)
+	}
+}
+
+// Tests quoting conversions through the API
+func TestQuoteFX(t *testing.T) {
+	api := NewGenericApi(NewInMemStore())
+	quote := func(body string) *testResponseWriter {
+		responseWriter := &testResponseWriter{}
+		api.QuoteFX(responseWriter, createRestRequest("POST", "/fx/quote", strings.NewReader(body), nil))
+		return responseWriter
+	}
+
+	if responseWriter := quote(`{"from": "USD", "to": "JPY", "amount": "10"}`); responseWriter.status != http.StatusNotFound {
+		t.Fatalf("Expected status %d without rates, got %d", http.StatusNotFound, responseWriter.status)
+	}
+
+	table, err := ReadRateTable(strings.NewReader("USD,JPY,152.345,2026-01-01\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.ServeRates(table)
+
+	var q FXQuote
+	if err := json.Unmarshal(quote(`{"from": "USD", "to": "JPY", "amount": "10.01"}`).Read(), &q); err != nil {
+		t.Fatal(err)
+	}
+	if q.Converted != 1525 || q.Rate != 152.345 || q.Effective.Format(timeFmt) != "2026-01-01" || q.Date.Format(timeFmt) != time.Now().UTC().Format(timeFmt) {
+		t.Fatalf("Unexpected quote %+v", q)
+	}
+
+	if responseWriter := quote(`{"from": "JPY", "to": "USD", "amount": "1000", "date": "2025-12-31"}`); responseWriter.status != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status %d before the rate is effective, got %d", http.StatusUnprocessableEntity, responseWriter.status)
+	}
+}
@@ -0,0 +1,111 @@
+package f3api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version of the service, reported by /version
+// Set at build time with -ldflags "-X github.com/ThrosturX/f3api.Version=1.2.3"; if left empty, the
+// version of the main module from the build info is reported instead.
+var Version = ""
+
+// How long /readyz waits for the store to answer before reporting it as unusable
+const readinessTimeout = 2 * time.Second
+
+// Optionally implemented by stores (and RestApi implementations) which can tell whether they are usable
+// A store which doesn't implement it is assumed to always be usable.
+type HealthChecker interface {
+	// Returns nil if the store can serve requests, the reason it can't otherwise
+	CheckHealth(context.Context) error
+}
+
+// Checks the health of a store, which is healthy unless it implements HealthChecker and says otherwise
+func CheckStoreHealth(ctx context.Context, store interface{}) error {
+	if hc, ok := store.(HealthChecker); ok {
+		return hc.CheckHealth(ctx)
+	}
+	return nil
+}
+
+// Status reported by the health endpoints
+type healthStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Build information reported by /version
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// Writes v as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Liveness: the process is up and serving requests
+func (s *Server) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// Readiness: the server isn't shutting down, and the store is usable
+func (s *Server) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+	if err := CheckStoreHealth(ctx, s.health); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, healthStatus{Status: "unavailable", Error: err.Error()})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// Build information of the running binary
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, readVersionInfo())
+}
+
+// Collects the build information of the running binary
+func readVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Revision = setting.Value
+			case "vcs.time":
+				info.Time = setting.Value
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+
+	return info
+}
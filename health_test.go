@@ -0,0 +1,92 @@
+package f3api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Store which reports itself as unusable
+type unhealthyStore struct {
+	*InMemStore
+}
+
+func (s unhealthyStore) CheckHealth(ctx context.Context) error {
+	return errors.New("disk on fire")
+}
+
+// Issues a GET request against handler, returning the status and decoded JSON body
+func getJSON(t *testing.T, handler http.Handler, path string) (int, map[string]interface{}) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: %v: %s", path, err, w.Body.String())
+	}
+	return w.Code, body
+}
+
+// Tests the liveness and readiness endpoints, including readiness failing once shutdown starts
+func TestHealthEndpoints(t *testing.T) {
+	store, err := InstrumentStore(NewInMemStore(), NewMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(NewGenericApi(TraceStore(store)), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if status, body := getJSON(t, server, path); status != http.StatusOK || body["status"] != "ok" {
+			t.Fatalf("%s: unexpected response %d %v", path, status, body)
+		}
+	}
+
+	// the server was never started, so shutting it down only flips readiness
+	if err := server.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := getJSON(t, server, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected readiness to fail while shutting down, got %d", status)
+	}
+	if status, _ := getJSON(t, server, "/healthz"); status != http.StatusOK {
+		t.Fatalf("Expected liveness to hold while shutting down, got %d", status)
+	}
+}
+
+// Tests that readiness fails when the store reports itself as unusable, through any decorators
+func TestReadyzUnhealthyStore(t *testing.T) {
+	store := AuditStore(TraceStore(unhealthyStore{NewInMemStore()}), &MemoryAuditSink{})
+	server, err := NewServer(NewGenericApi(store), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := getJSON(t, server, "/readyz")
+	if status != http.StatusServiceUnavailable || body["error"] != "disk on fire" {
+		t.Fatalf("Unexpected response %d %v", status, body)
+	}
+}
+
+// Tests that the version endpoint reports the overridden version
+func TestVersion(t *testing.T) {
+	defer func(v string) { Version = v }(Version)
+	Version = "1.2.3"
+
+	handler, err := MakeHandler(NewGenericApi(NewInMemStore()), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, body := getJSON(t, handler, "/version")
+	if status != http.StatusOK || body["version"] != "1.2.3" || body["go_version"] == "" {
+		t.Fatalf("Unexpected response %d %v", status, body)
+	}
+}
@@ -0,0 +1,291 @@
+package f3api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// A write held for review by screening
+type HeldPayment struct {
+	Payment Payment `json:"payment"`
+	// The write held: "add", "update" or "store"
+	Operation string          `json:"operation"`
+	Time      time.Time       `json:"time"`
+	Result    ScreeningResult `json:"screening"`
+}
+
+// Optional interface of stores holding payments for review, such as ScreeningStore
+type HoldStore interface {
+	// Lists the writes held for review, oldest first
+	HeldPayments(ctx context.Context) ([]HeldPayment, error)
+
+	// Applies the held write of a payment after all, and stops holding it
+	ReleasePayment(ctx context.Context, id string) (HeldPayment, error)
+
+	// Drops the held write of a payment
+	RejectPayment(ctx context.Context, id string) (HeldPayment, error)
+}
+
+// Store screening payments before they are written, see ScreenStore
+// Implements ApiStore, ContextStore and HoldStore.
+type ScreeningStore struct {
+	backgroundAdapter
+	screening *screeningStore
+}
+
+// ContextStore decorator screening payments before they are written
+type screeningStore struct {
+	storeDecorator
+	screener Screener
+	now      func() time.Time
+
+	mu   sync.Mutex
+	held map[string]HeldPayment
+}
+
+// Wraps a store to screen every payment created or updated through it, refusing the ones screened
+// for rejection with a ScreeningError, and holding the ones screened for review with a HeldError
+//
+// Held writes are kept in memory until released, which applies them to the store unscreened, or
+// rejected. Holding a payment again replaces its held write. As a transaction is all or nothing,
+// payments which would be held make their transaction fail with a ScreeningError instead.
+// GenericApi serves the held payments only if the screening store wraps the others.
+func ScreenStore(store ApiStore, screener Screener) *ScreeningStore {
+	s := screeningStore{
+		storeDecorator: storeDecorator{ContextStoreOf(store)},
+		screener:       screener,
+		now:            time.Now,
+		held:           make(map[string]HeldPayment),
+	}
+	ss := ScreeningStore{backgroundAdapter{&s}, &s}
+	return &ss
+}
+
+func (s *ScreeningStore) HeldPayments(ctx context.Context) ([]HeldPayment, error) {
+	return s.screening.HeldPayments(ctx)
+}
+
+func (s *ScreeningStore) ReleasePayment(ctx context.Context, id string) (HeldPayment, error) {
+	return s.screening.ReleasePayment(ctx, id)
+}
+
+func (s *ScreeningStore) RejectPayment(ctx context.Context, id string) (HeldPayment, error) {
+	return s.screening.RejectPayment(ctx, id)
+}
+
+// Screens a payment, returning an error unless it is clear to be written
+// Payments to be held are held for the given operation, unless it is empty.
+func (s *screeningStore) screen(ctx context.Context, p Payment, operation string) error {
+	result, err := s.screener.Screen(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case result.Outcome == ScreeningClear:
+		return nil
+	case result.Outcome == ScreeningHold && operation != "":
+		hold := HeldPayment{p, operation, s.now(), result}
+		s.mu.Lock()
+		s.held[p.ID] = hold
+		s.mu.Unlock()
+
+		slog.WarnContext(ctx, "payment held for review", "payment_id", p.ID, "operation", operation, "matches", len(result.Matches))
+		return &HeldError{hold}
+	}
+
+	return &ScreeningError{p.ID, result}
+}
+
+func (s *screeningStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	if err := s.screen(ctx, p, "add"); err != nil {
+		return err
+	}
+	return s.store.AddPaymentContext(ctx, p)
+}
+
+func (s *screeningStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	if err := s.screen(ctx, p, "update"); err != nil {
+		return err
+	}
+	return s.store.UpdatePaymentContext(ctx, p)
+}
+
+func (s *screeningStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	if err := s.screen(ctx, p, "store"); err != nil {
+		return err
+	}
+	return s.store.StorePaymentContext(ctx, p)
+}
+
+func (s *screeningStore) BeginContext(ctx context.Context) (Tx, error) {
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &screeningTx{Tx: tx, ctx: ctx, store: s}, nil
+}
+
+func (s *screeningStore) HeldPayments(ctx context.Context) ([]HeldPayment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	held := make([]HeldPayment, 0, len(s.held))
+	for _, hold := range s.held {
+		held = append(held, hold)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(held, func(i, j int) bool {
+		if !held[i].Time.Equal(held[j].Time) {
+			return held[i].Time.Before(held[j].Time)
+		}
+		return held[i].Payment.ID < held[j].Payment.ID
+	})
+	return held, nil
+}
+
+// Stops holding a payment
+func (s *screeningStore) take(id string) (HeldPayment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hold, ok := s.held[id]
+	if !ok {
+		return hold, fmt.Errorf("No payment %v held for review: %w", id, ErrPaymentNotFound)
+	}
+	delete(s.held, id)
+	return hold, nil
+}
+
+func (s *screeningStore) ReleasePayment(ctx context.Context, id string) (HeldPayment, error) {
+	hold, err := s.take(id)
+	if err != nil {
+		return hold, err
+	}
+
+	switch hold.Operation {
+	case "add":
+		err = s.store.AddPaymentContext(ctx, hold.Payment)
+	case "update":
+		err = s.store.UpdatePaymentContext(ctx, hold.Payment)
+	default:
+		err = s.store.StorePaymentContext(ctx, hold.Payment)
+	}
+	if err != nil {
+		// keep it held, unless held again meanwhile
+		s.mu.Lock()
+		if _, ok := s.held[id]; !ok {
+			s.held[id] = hold
+		}
+		s.mu.Unlock()
+		return hold, err
+	}
+
+	slog.InfoContext(ctx, "held payment released", "payment_id", id, "actor", ActorFromContext(ctx))
+	return hold, nil
+}
+
+func (s *screeningStore) RejectPayment(ctx context.Context, id string) (HeldPayment, error) {
+	if err := ctx.Err(); err != nil {
+		return HeldPayment{}, err
+	}
+	hold, err := s.take(id)
+	if err != nil {
+		return hold, err
+	}
+
+	slog.InfoContext(ctx, "held payment rejected", "payment_id", id, "actor", ActorFromContext(ctx))
+	return hold, nil
+}
+
+// Transaction of a screeningStore, screening payments as they are staged
+type screeningTx struct {
+	Tx
+	ctx   context.Context
+	store *screeningStore
+}
+
+func (tx *screeningTx) AddPayment(p Payment) error {
+	if err := tx.store.screen(tx.ctx, p, ""); err != nil {
+		return err
+	}
+	return tx.Tx.AddPayment(p)
+}
+
+func (tx *screeningTx) UpdatePayment(p Payment) error {
+	if err := tx.store.screen(tx.ctx, p, ""); err != nil {
+		return err
+	}
+	return tx.Tx.UpdatePayment(p)
+}
+
+func (tx *screeningTx) StorePayment(p Payment) error {
+	if err := tx.store.screen(tx.ctx, p, ""); err != nil {
+		return err
+	}
+	return tx.Tx.StorePayment(p)
+}
+
+// The HoldStore of the API's store, if it holds payments
+func (api *GenericApi) holds(w rest.ResponseWriter) (HoldStore, bool) {
+	holds, ok := api.store.(HoldStore)
+	if !ok {
+		rest.Error(w, "Payments are not screened", http.StatusNotFound)
+	}
+	return holds, ok
+}
+
+// Lists the payments held for review by screening, oldest first
+func (api *GenericApi) GetHeldPayments(w rest.ResponseWriter, r *rest.Request) {
+	holds, ok := api.holds(w)
+	if !ok {
+		return
+	}
+
+	held, err := holds.HeldPayments(r.Context())
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, held, EnvelopeLinks{Self: "/holds"})
+}
+
+// Writes a payment held for review after all
+func (api *GenericApi) ReleaseHeldPayment(w rest.ResponseWriter, r *rest.Request) {
+	holds, ok := api.holds(w)
+	if !ok {
+		return
+	}
+
+	hold, err := holds.ReleasePayment(r.Context(), r.PathParam("id"))
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, hold.Payment, EnvelopeLinks{Self: paymentPath(hold.Payment.ID)})
+}
+
+// Drops a payment held for review
+func (api *GenericApi) RejectHeldPayment(w rest.ResponseWriter, r *rest.Request) {
+	holds, ok := api.holds(w)
+	if !ok {
+		return
+	}
+
+	hold, err := holds.RejectPayment(r.Context(), r.PathParam("id"))
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, hold, EnvelopeLinks{Self: r.URL.RequestURI()})
+}
@@ -0,0 +1,252 @@
+package f3api
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Secondary indexes of a shard of an InMemStore, maintained under the shard's lock on every write
+//
+// Each index maps a value of the indexed field to the set of IDs of the payments holding it. The
+// processing dates are also kept in order, so ranges of dates can be looked up without a scan.
+type paymentIndexes struct {
+	byOrganisation map[string]idSet
+	byEndToEnd     map[string]idSet
+	byBeneficiary  map[beneficiaryAccount]idSet
+	byDate         map[string]idSet
+	// the keys of byDate ("2006-01-02" dates, which sort chronologically), in order
+	dates []string
+}
+
+// A set of payment IDs
+type idSet map[string]struct{}
+
+// Key of the beneficiary account index
+type beneficiaryAccount struct {
+	bankID, accountNumber string
+}
+
+// Creates empty indexes
+func newPaymentIndexes() paymentIndexes {
+	return paymentIndexes{
+		byOrganisation: make(map[string]idSet),
+		byEndToEnd:     make(map[string]idSet),
+		byBeneficiary:  make(map[beneficiaryAccount]idSet),
+		byDate:         make(map[string]idSet),
+	}
+}
+
+// Key of a payment in the processing date index
+func dateKey(p *Payment) string {
+	return p.Attributes.ProcessingDate.Format(timeFmt)
+}
+
+// Key of a payment in the beneficiary account index
+func beneficiaryKey(p *Payment) beneficiaryAccount {
+	party := p.Attributes.BeneficiaryParty
+	return beneficiaryAccount{party.BankID, party.AccountNumber}
+}
+
+// Adds an ID to the set of key, creating the set if needed
+func addToIndex[K comparable](index map[K]idSet, key K, id string) bool {
+	ids, ok := index[key]
+	if !ok {
+		ids = make(idSet)
+		index[key] = ids
+	}
+	ids[id] = struct{}{}
+	return !ok
+}
+
+// Removes an ID from the set of key, dropping the set once empty
+func removeFromIndex[K comparable](index map[K]idSet, key K, id string) bool {
+	ids := index[key]
+	delete(ids, id)
+	if len(ids) > 0 {
+		return false
+	}
+	delete(index, key)
+	return true
+}
+
+// Indexes a payment
+func (ix *paymentIndexes) add(p *Payment) {
+	addToIndex(ix.byOrganisation, p.OrganisationID, p.ID)
+	addToIndex(ix.byEndToEnd, p.Attributes.EndToEndReference, p.ID)
+	addToIndex(ix.byBeneficiary, beneficiaryKey(p), p.ID)
+
+	key := dateKey(p)
+	if addToIndex(ix.byDate, key, p.ID) {
+		i := sort.SearchStrings(ix.dates, key)
+		ix.dates = append(ix.dates, "")
+		copy(ix.dates[i+1:], ix.dates[i:])
+		ix.dates[i] = key
+	}
+}
+
+// Drops a payment from the indexes
+func (ix *paymentIndexes) remove(p *Payment) {
+	removeFromIndex(ix.byOrganisation, p.OrganisationID, p.ID)
+	removeFromIndex(ix.byEndToEnd, p.Attributes.EndToEndReference, p.ID)
+	removeFromIndex(ix.byBeneficiary, beneficiaryKey(p), p.ID)
+
+	key := dateKey(p)
+	if removeFromIndex(ix.byDate, key, p.ID) {
+		i := sort.SearchStrings(ix.dates, key)
+		ix.dates = append(ix.dates[:i], ix.dates[i+1:]...)
+	}
+}
+
+// Collects the IDs of the payments processed in [from, until)
+func (ix *paymentIndexes) dateRange(from, until time.Time) idSet {
+	ids := make(idSet)
+
+	start := sort.SearchStrings(ix.dates, from.Format(timeFmt))
+	end := sort.SearchStrings(ix.dates, until.Format(timeFmt))
+	for _, key := range ix.dates[start:end] {
+		for id := range ix.byDate[key] {
+			ids[id] = struct{}{}
+		}
+	}
+	return ids
+}
+
+// Makes sure the shard's tree of payments doesn't change nodes shared with a snapshot
+// The caller must hold the write lock.
+func (sh *inMemShard) own() {
+	if sh.shared.Load() {
+		sh.payments.share()
+		sh.shared.Store(false)
+	}
+}
+
+// Stores a payment, replacing any payment with the same ID, and indexes it
+// The caller must hold the write lock.
+func (sh *inMemShard) put(p Payment) {
+	sh.own()
+	if old, ok := sh.payments.put(p); ok {
+		sh.indexes.remove(old)
+	}
+	sh.indexes.add(&p)
+}
+
+// Deletes a payment along with its index entries, if it exists
+// The caller must hold the write lock.
+func (sh *inMemShard) remove(id string) {
+	sh.own()
+	if old, ok := sh.payments.delete(id); ok {
+		sh.indexes.remove(old)
+	}
+}
+
+// Copies the payments with the IDs found in the indexes of every shard, under all read locks, and
+// sorts them by ID
+func (s *InMemStore) lookup(ctx context.Context, ids func(*paymentIndexes) idSet) ([]Payment, error) {
+	if err := s.rLockAll(ctx); err != nil {
+		return nil, err
+	}
+	defer s.rUnlockAll()
+
+	var ps []Payment
+	for i := range s.shards {
+		sh := &s.shards[i]
+		for id := range ids(&sh.indexes) {
+			p, _ := sh.payments.get(id)
+			ps = append(ps, *p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+	return ps, nil
+}
+
+// Fetches the payments of an organisation, ordered by ID, through the organisation index
+func (s *InMemStore) PaymentsByOrganisation(ctx context.Context, organisationID string) ([]Payment, error) {
+	return s.lookup(ctx, func(ix *paymentIndexes) idSet {
+		return ix.byOrganisation[organisationID]
+	})
+}
+
+// Fetches the payments with an end to end reference, ordered by ID, through the reference index
+func (s *InMemStore) PaymentsByEndToEndReference(ctx context.Context, reference string) ([]Payment, error) {
+	return s.lookup(ctx, func(ix *paymentIndexes) idSet {
+		return ix.byEndToEnd[reference]
+	})
+}
+
+// Fetches the payments to a beneficiary account, ordered by ID, through the account index
+func (s *InMemStore) PaymentsByBeneficiaryAccount(ctx context.Context, bankID, accountNumber string) ([]Payment, error) {
+	return s.lookup(ctx, func(ix *paymentIndexes) idSet {
+		return ix.byBeneficiary[beneficiaryAccount{bankID, accountNumber}]
+	})
+}
+
+// Fetches the payments processed on the days in [from, until), ordered by date and then ID, through
+// the ordered processing date index
+func (s *InMemStore) PaymentsByProcessingDate(ctx context.Context, from, until time.Time) ([]Payment, error) {
+	ps, err := s.lookup(ctx, func(ix *paymentIndexes) idSet {
+		return ix.dateRange(from, until)
+	})
+	// stable, keeping the payments of a day ordered by ID
+	sort.SliceStable(ps, func(i, j int) bool { return dateKey(&ps[i]) < dateKey(&ps[j]) })
+	return ps, err
+}
+
+// Narrows down the payments which may match a filter expression through the indexes, for
+// FindPaymentsContext; ok is false if the indexes can't help, and a full scan is needed
+// Equality on the organisation and end to end reference, and any date comparison, are looked up;
+// conjunctions use the smaller side which can be looked up, and disjunctions need both sides.
+func (ix *paymentIndexes) candidates(expr filterExpr) (ids idSet, ok bool) {
+	switch e := expr.(type) {
+	case comparison:
+		switch {
+		case e.op == "=" && e.field.path == "organisation_id":
+			return ix.byOrganisation[e.text], true
+		case e.op == "=" && e.field.path == "attributes.end_to_end_reference":
+			return ix.byEndToEnd[e.text], true
+		case e.field.path == "attributes.processing_date" && e.op != "!=":
+			from, until := time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+			switch e.op {
+			case "=":
+				from, until = e.from, e.until
+			case "<":
+				until = e.from
+			case "<=":
+				until = e.until
+			case ">":
+				from = e.until
+			case ">=":
+				from = e.from
+			}
+			return ix.dateRange(from, until), true
+		}
+
+	case andExpr:
+		left, lok := ix.candidates(e.left)
+		right, rok := ix.candidates(e.right)
+		switch {
+		case lok && rok && len(right) < len(left):
+			return right, true
+		case lok:
+			return left, true
+		case rok:
+			return right, true
+		}
+
+	case orExpr:
+		left, lok := ix.candidates(e.left)
+		right, rok := ix.candidates(e.right)
+		if lok && rok {
+			union := make(idSet, len(left)+len(right))
+			for id := range left {
+				union[id] = struct{}{}
+			}
+			for id := range right {
+				union[id] = struct{}{}
+			}
+			return union, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,225 @@
+package f3api
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Lists the IDs of payments
+func paymentIDs(payments []Payment) []string {
+	ids := []string{}
+	for _, p := range payments {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// Creates the n-th payment of an index test: spread over 100 organisations, 1000 references,
+// 10 beneficiary banks and the days of 2017
+func indexedPayment(n int) Payment {
+	p := defaultPayment()
+	p.ID = fmt.Sprintf("payment-%07d", n)
+	p.OrganisationID = fmt.Sprintf("org-%d", n%100)
+	p.Attributes.EndToEndReference = fmt.Sprintf("ref-%d", n%1000)
+	p.Attributes.BeneficiaryParty.BankID = fmt.Sprintf("bank-%d", n%10)
+	p.Attributes.ProcessingDate = Date{time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, n%365)}
+	return p
+}
+
+// Tests that the indexes follow every kind of write
+func TestInMemStoreIndexes(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemStore()
+
+	p := defaultPayment()
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+	day := p.Attributes.ProcessingDate.Time
+	party := p.Attributes.BeneficiaryParty
+
+	check := func(expected ...string) {
+		t.Helper()
+		for name, lookup := range map[string]func() ([]Payment, error){
+			"organisation": func() ([]Payment, error) { return store.PaymentsByOrganisation(ctx, p.OrganisationID) },
+			"reference": func() ([]Payment, error) {
+				return store.PaymentsByEndToEndReference(ctx, p.Attributes.EndToEndReference)
+			},
+			"beneficiary": func() ([]Payment, error) {
+				return store.PaymentsByBeneficiaryAccount(ctx, party.BankID, party.AccountNumber)
+			},
+			"date": func() ([]Payment, error) { return store.PaymentsByProcessingDate(ctx, day, day.AddDate(0, 0, 1)) },
+		} {
+			ps, err := lookup()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := paymentIDs(ps); !reflect.DeepEqual(ids, append([]string{}, expected...)) {
+				t.Fatalf("%s index: expected %v, got %v", name, expected, ids)
+			}
+		}
+	}
+	check(p.ID)
+
+	// an update moves the payment to other index entries
+	moved := p
+	moved.OrganisationID = "elsewhere"
+	moved.Attributes.EndToEndReference = "elsewhere"
+	moved.Attributes.BeneficiaryParty.BankID = "elsewhere"
+	moved.Attributes.ProcessingDate = Date{day.AddDate(0, 1, 0)}
+	if err := store.UpdatePayment(moved); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	if err := ApplyBatch(store, []BatchOp{{BatchStore, p}, {BatchAdd, indexedPayment(1)}}); err != nil {
+		t.Fatal(err)
+	}
+	check(p.ID)
+
+	if err := store.DeletePayment(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	dates := 0
+	for i := range store.shards {
+		dates += len(store.shards[i].indexes.dates)
+	}
+	if dates != 1 {
+		t.Fatalf("Expected the emptied date to be dropped, got %d dates", dates)
+	}
+}
+
+// Tests that filtering through the indexes finds the same payments as a full scan
+func TestInMemStoreIndexedFilter(t *testing.T) {
+	store := NewInMemStore()
+	var all []Payment
+	for n := 0; n < 2000; n++ {
+		p := indexedPayment(n)
+		all = append(all, p)
+		store.AddPayment(p)
+	}
+
+	for _, filter := range []string{
+		"organisation_id = org-7",
+		"organisation_id = org-7 AND processing_date = 2017-03",
+		"end_to_end_reference = ref-12 OR end_to_end_reference = ref-13",
+		"processing_date >= 2017-12-01 AND amount > 100",
+		"processing_date < 2017-01-03",
+		"organisation_id = org-7 OR amount > 100",
+		"processing_date != 2017-01",
+	} {
+		f, err := ParseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := store.FindPaymentsContext(context.Background(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := paymentIDs(f.Apply(all))
+		if ids := paymentIDs(found); len(ids) != len(expected) {
+			t.Fatalf("%s: expected %d payments, got %d", filter, len(expected), len(ids))
+		}
+	}
+}
+
+var (
+	benchStores   = make(map[int]*InMemStore)
+	benchStoresMu sync.Mutex
+)
+
+// Returns a store of n indexed payments, shared between benchmarks as it is slow to fill
+func benchStore(b *testing.B, n int) *InMemStore {
+	b.Helper()
+	if n > 100000 && testing.Short() {
+		b.Skip("skipping the largest store in short mode")
+	}
+
+	benchStoresMu.Lock()
+	defer benchStoresMu.Unlock()
+
+	if store, ok := benchStores[n]; ok {
+		return store
+	}
+	store := NewInMemStore()
+	for i := 0; i < n; i++ {
+		store.AddPayment(indexedPayment(i))
+	}
+	benchStores[n] = store
+	return store
+}
+
+// Compares looking payments up through the indexes with scanning every payment
+func BenchmarkInMemStoreLookup(b *testing.B) {
+	ctx := context.Background()
+
+	for _, n := range []int{10000, 1000000} {
+		filter, err := ParseFilter("organisation_id = org-7 AND processing_date = 2017-03-05")
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("n=%d/organisation/index", n), func(b *testing.B) {
+			store := benchStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.PaymentsByOrganisation(ctx, "org-7")
+			}
+		})
+		b.Run(fmt.Sprintf("n=%d/organisation/scan", n), func(b *testing.B) {
+			store := benchStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.rLockAll(ctx)
+				var ps []Payment
+				for j := range store.shards {
+					it := store.shards[j].payments.iter("")
+					for p, ok := it.next(); ok; p, ok = it.next() {
+						if p.OrganisationID == "org-7" {
+							ps = append(ps, *p)
+						}
+					}
+				}
+				store.rUnlockAll()
+			}
+		})
+		b.Run(fmt.Sprintf("n=%d/filter/index", n), func(b *testing.B) {
+			store := benchStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.FindPaymentsContext(ctx, filter)
+			}
+		})
+		b.Run(fmt.Sprintf("n=%d/filter/scan", n), func(b *testing.B) {
+			store := benchStore(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.rLockAll(ctx)
+				var ps []Payment
+				for j := range store.shards {
+					it := store.shards[j].payments.iter("")
+					for p, ok := it.next(); ok; p, ok = it.next() {
+						if filter.Match(p) {
+							ps = append(ps, *p)
+						}
+					}
+				}
+				store.rUnlockAll()
+			}
+		})
+	}
+}
+
+// Measures the cost of maintaining the indexes on writes
+func BenchmarkInMemStoreStore(b *testing.B) {
+	store := NewInMemStore()
+	for i := 0; i < b.N; i++ {
+		store.StorePayment(indexedPayment(i % 100000))
+	}
+}
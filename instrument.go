@@ -0,0 +1,279 @@
+package f3api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Wraps the handler of every route to record request counts, status codes and latencies in m,
+// labelled by method and by the route's path expression (so "/payments/:id" rather than every ID).
+// The request span started by TracingMiddleware is also renamed after the route.
+// Requests which don't match any route never reach these handlers, and are not recorded.
+// Fails if the request metrics are already registered in m.
+func InstrumentRoutes(m *Metrics, routes ...*rest.Route) ([]*rest.Route, error) {
+	requests, err := m.Counter("f3api_http_requests_total", "Number of HTTP requests by method, route and status code.", "method", "route", "code")
+	if err != nil {
+		return nil, err
+	}
+	duration, err := m.Histogram("f3api_http_request_duration_seconds", "Latency of HTTP requests by method and route.", DefaultLatencyBuckets, "method", "route")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		method, path, handler := route.HttpMethod, route.PathExp, route.Func
+		route.Func = func(w rest.ResponseWriter, r *rest.Request) {
+			// the request span (if any) was started before routing, now we know the route
+			trace.SpanFromContext(r.Context()).SetName(method + " " + path)
+
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+			handler(sw, r)
+
+			requests.Inc(method, path, strconv.Itoa(sw.status))
+			duration.Observe(time.Since(start).Seconds(), method, path)
+		}
+	}
+
+	return routes, nil
+}
+
+// Remembers the status code written through a rest.ResponseWriter
+type statusWriter struct {
+	rest.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Provided in order to keep implementing http.ResponseWriter
+func (w *statusWriter) Write(b []byte) (int, error) {
+	return w.ResponseWriter.(http.ResponseWriter).Write(b)
+}
+
+// Provided in order to keep implementing http.Flusher
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ContextStore decorator recording the count, latency and errors of every store operation
+type instrumentedStore struct {
+	storeDecorator
+	ops      *Counter
+	errors   *Counter
+	duration *Histogram
+	payments *Gauge
+
+	mu sync.Mutex
+	// currency and scheme of every stored payment, by ID, so that writes can move it between counts
+	labels map[string][2]string
+}
+
+// Wraps a store to record the count, latency and errors of every operation in m, labelled by ApiStore
+// method, and to expose the number of stored payments by currency and payment scheme.
+// The payment counts are taken from GetAllPayments once, and kept up to date by the writes made
+// through the returned store. Fails if the store metrics are already registered in m.
+func InstrumentStore(store ApiStore, m *Metrics) (ApiStore, error) {
+	s := instrumentedStore{
+		storeDecorator: storeDecorator{ContextStoreOf(store)},
+		labels:         make(map[string][2]string),
+	}
+
+	var err error
+	if s.ops, err = m.Counter("f3api_store_operations_total", "Number of store operations by method.", "operation"); err != nil {
+		return nil, err
+	}
+	if s.errors, err = m.Counter("f3api_store_operation_errors_total", "Number of failed store operations by method.", "operation"); err != nil {
+		return nil, err
+	}
+	if s.duration, err = m.Histogram("f3api_store_operation_duration_seconds", "Latency of store operations by method.", DefaultLatencyBuckets, "operation"); err != nil {
+		return nil, err
+	}
+	if s.payments, err = m.Gauge("f3api_payments", "Number of stored payments by currency and payment scheme.", "currency", "scheme"); err != nil {
+		return nil, err
+	}
+
+	payments, err := s.store.GetAllPaymentsContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	for i := range payments {
+		s.count(payments[i].ID, &payments[i])
+	}
+
+	return ApiStoreOf(&s), nil
+}
+
+// Records a finished store operation
+func (s *instrumentedStore) observe(op string, start time.Time, err error) {
+	s.ops.Inc(op)
+	s.duration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		s.errors.Inc(op)
+	}
+}
+
+// Moves a stored payment to the count of its currency and scheme, or out of the counts if p is nil
+// Concurrent writes of the same payment may be counted in another order than the store applied
+// them, which only matters if they change its currency or scheme.
+func (s *instrumentedStore) count(id string, p *Payment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.labels[id]; ok {
+		s.payments.Add(-1, old[:]...)
+		delete(s.labels, id)
+	}
+	if p != nil {
+		labels := [2]string{p.Attributes.Currency, p.Attributes.PaymentScheme}
+		s.payments.Add(1, labels[:]...)
+		s.labels[id] = labels
+	}
+}
+
+func (s *instrumentedStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	start := time.Now()
+	err := s.store.AddPaymentContext(ctx, p)
+	s.observe("AddPayment", start, err)
+	if err == nil {
+		s.count(p.ID, &p)
+	}
+	return err
+}
+
+func (s *instrumentedStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	start := time.Now()
+	err := s.store.UpdatePaymentContext(ctx, p)
+	s.observe("UpdatePayment", start, err)
+	if err == nil {
+		s.count(p.ID, &p)
+	}
+	return err
+}
+
+func (s *instrumentedStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	start := time.Now()
+	err := s.store.StorePaymentContext(ctx, p)
+	s.observe("StorePayment", start, err)
+	if err == nil {
+		s.count(p.ID, &p)
+	}
+	return err
+}
+
+func (s *instrumentedStore) DeletePaymentContext(ctx context.Context, id string) error {
+	start := time.Now()
+	err := s.store.DeletePaymentContext(ctx, id)
+	s.observe("DeletePayment", start, err)
+	if err == nil {
+		s.count(id, nil)
+	}
+	return err
+}
+
+func (s *instrumentedStore) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	start := time.Now()
+	p, err := s.store.GetPaymentContext(ctx, id)
+	s.observe("GetPayment", start, err)
+	return p, err
+}
+
+func (s *instrumentedStore) GetAllPaymentsContext(ctx context.Context) ([]Payment, error) {
+	start := time.Now()
+	ps, err := s.store.GetAllPaymentsContext(ctx)
+	s.observe("GetAllPayments", start, err)
+	return ps, err
+}
+
+func (s *instrumentedStore) FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error) {
+	start := time.Now()
+	ps, err := FindPayments(ctx, s.store, f)
+	s.observe("FindPayments", start, err)
+	return ps, err
+}
+
+func (s *instrumentedStore) PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error) {
+	start := time.Now()
+	ps, err := PagePayments(ctx, s.store, after, limit)
+	s.observe("PagePayments", start, err)
+	return ps, err
+}
+
+func (s *instrumentedStore) BeginContext(ctx context.Context) (Tx, error) {
+	start := time.Now()
+	tx, err := s.store.BeginContext(ctx)
+	s.observe("Begin", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedTx{Tx: tx, store: s}, nil
+}
+
+// Transaction of an instrumentedStore, recording commits and rollbacks as store operations
+// The staged writes are counted once they are committed.
+type instrumentedTx struct {
+	Tx
+	store  *instrumentedStore
+	staged []BatchOp
+}
+
+// Remembers a write the transaction accepted, for counting it on commit
+func (tx *instrumentedTx) stage(kind BatchOpKind, p Payment, err error) error {
+	if err == nil {
+		tx.staged = append(tx.staged, BatchOp{Kind: kind, Payment: p})
+	}
+	return err
+}
+
+func (tx *instrumentedTx) AddPayment(p Payment) error {
+	return tx.stage(BatchAdd, p, tx.Tx.AddPayment(p))
+}
+
+func (tx *instrumentedTx) UpdatePayment(p Payment) error {
+	return tx.stage(BatchUpdate, p, tx.Tx.UpdatePayment(p))
+}
+
+func (tx *instrumentedTx) StorePayment(p Payment) error {
+	return tx.stage(BatchStore, p, tx.Tx.StorePayment(p))
+}
+
+func (tx *instrumentedTx) DeletePayment(id string) error {
+	return tx.stage(BatchDelete, Payment{ID: id}, tx.Tx.DeletePayment(id))
+}
+
+func (tx *instrumentedTx) Commit() error {
+	start := time.Now()
+	err := tx.Tx.Commit()
+	tx.store.observe("Commit", start, err)
+	if err == nil {
+		for i, op := range tx.staged {
+			if op.Kind == BatchDelete {
+				tx.store.count(op.Payment.ID, nil)
+			} else {
+				tx.store.count(op.Payment.ID, &tx.staged[i].Payment)
+			}
+		}
+	}
+	tx.staged = nil
+	return err
+}
+
+func (tx *instrumentedTx) Rollback() error {
+	start := time.Now()
+	err := tx.Tx.Rollback()
+	tx.store.observe("Rollback", start, err)
+	tx.staged = nil
+	return err
+}
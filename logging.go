@@ -0,0 +1,130 @@
+package f3api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carrying the request ID, both in requests and responses
+const requestIDHeader = "X-Request-Id"
+
+// Key of the per-request information in a context
+type requestInfoKey struct{}
+
+// Key of an explicitly set actor in a context
+type actorKey struct{}
+
+// What we know about the request a context belongs to
+type requestInfo struct {
+	id  string
+	env map[string]interface{}
+}
+
+// Returns the ID of the request the context belongs to, or "" outside of a request
+func RequestIDFromContext(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// Returns a copy of ctx in which actor is responsible for what is done with the context
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// Returns who is responsible for what is done with the context: the actor set with WithActor, or
+// else the user authenticated by the middleware (the REMOTE_USER set by rest.AuthBasicMiddleware),
+// or else "anonymous"
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok {
+		return actor
+	}
+	// the env is looked up now rather than when the request started, as authentication middleware
+	// may well run after ours
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		if user, ok := info.env["REMOTE_USER"].(string); ok && user != "" {
+			return user
+		}
+	}
+	return "anonymous"
+}
+
+// Creates a random request ID
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Reports whether a request ID sent by a client is fit for use (and for our logs)
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Assigns an ID to every request, and logs every request as a structured record once it is done
+// Replaces rest.AccessLogApacheMiddleware. The request ID is taken from the X-Request-Id header if
+// the client sent one, generated otherwise, and returned in the X-Request-Id response header. It is
+// also available to handlers and stores, through RequestIDFromContext on the request context.
+type AccessLogMiddleware struct {
+	// Destination of the request records; slog.Default() if nil
+	Logger *slog.Logger
+}
+
+// Makes AccessLogMiddleware implement the rest.Middleware interface
+func (mw *AccessLogMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	logger := mw.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r.Request = r.Request.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id, r.Env}))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.RequestURI()),
+			slog.Int("status", sw.status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("actor", ActorFromContext(r.Context())),
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+		}
+
+		level := slog.LevelInfo
+		if sw.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	}
+}
@@ -0,0 +1,69 @@
+package f3api
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests that requests are logged as JSON records carrying the request ID, and that the request ID
+// reaches the audit log
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+
+	sink := &MemoryAuditSink{}
+	api := NewGenericApi(AuditStore(NewInMemStore(), sink))
+	handler, err := MakeHandler(api, ServerConfig{
+		Metrics: NewMetrics(),
+		Logger:  slog.New(slog.NewJSONHandler(&buf, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	request, err := http.NewRequest("POST", server.URL+"/payments", strings.NewReader(DEFAULT_PAYMENT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(requestIDHeader, "req-1234")
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if id := resp.Header.Get(requestIDHeader); id != "req-1234" {
+		t.Fatalf("Expected the request ID to be echoed, got %q", id)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	if record["request_id"] != "req-1234" || record["method"] != "POST" || record["status"] != float64(200) {
+		t.Fatalf("Unexpected request record %v", record)
+	}
+
+	events := sink.Events()
+	if len(events) != 1 || events[0].RequestID != "req-1234" || events[0].Actor != "anonymous" {
+		t.Fatalf("Unexpected audit events %+v", events)
+	}
+
+	// requests without an ID are given one
+	resp, err = http.Get(server.URL + "/payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !validRequestID(resp.Header.Get(requestIDHeader)) {
+		t.Fatal("Expected a generated request ID")
+	}
+}
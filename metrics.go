@@ -0,0 +1,137 @@
+package f3api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Default histogram buckets for latencies, in seconds
+var DefaultLatencyBuckets = prometheus.DefBuckets
+
+// The registry used by RunServer and, unless told otherwise, by the instrumentation in this package
+var DefaultMetrics = NewMetrics()
+
+// A registry of metrics, exposed in the Prometheus text format
+// A thin layer over a prometheus.Registry, which keeps the instrumentation in this package from
+// depending on the client library directly.
+type Metrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+}
+
+// Creates a new, empty registry
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+	m := Metrics{
+		registry: registry,
+		handler:  promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	}
+	return &m
+}
+
+// Registers a collector, failing if another one is already registered under the same name
+func (m *Metrics) register(name string, c prometheus.Collector) error {
+	if err := m.registry.Register(c); err != nil {
+		return fmt.Errorf("metrics: registering %s: %w", name, err)
+	}
+	return nil
+}
+
+// Registers a counter with the given label names
+func (m *Metrics) Counter(name, help string, labels ...string) (*Counter, error) {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	if err := m.register(name, vec); err != nil {
+		return nil, err
+	}
+	return &Counter{vec}, nil
+}
+
+// Registers a histogram with the given (ascending) buckets and label names
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) (*Histogram, error) {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	if err := m.register(name, vec); err != nil {
+		return nil, err
+	}
+	return &Histogram{vec}, nil
+}
+
+// Registers a gauge with the given label names
+func (m *Metrics) Gauge(name, help string, labels ...string) (*Gauge, error) {
+	vec := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	if err := m.register(name, vec); err != nil {
+		return nil, err
+	}
+	return &Gauge{vec}, nil
+}
+
+// Registers an unlabelled gauge whose value is computed by collect every time the metrics are scraped
+// collect must be cheap, as it is called on every scrape.
+func (m *Metrics) GaugeFunc(name, help string, collect func() float64) error {
+	return m.register(name, prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, collect))
+}
+
+// Writes all metrics in the Prometheus text format, ordered by name
+func (m *Metrics) WriteText(w io.Writer) error {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serves the metrics in the Prometheus text format, for scraping
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
+
+// A labelled, monotonically increasing counter
+type Counter struct {
+	vec *prometheus.CounterVec
+}
+
+// Increments the counter of the series with the given label values
+func (c *Counter) Inc(values ...string) {
+	c.vec.WithLabelValues(values...).Inc()
+}
+
+// Adds v (which must not be negative) to the counter of the series with the given label values
+func (c *Counter) Add(v float64, values ...string) {
+	c.vec.WithLabelValues(values...).Add(v)
+}
+
+// A labelled histogram of observations, such as latencies
+type Histogram struct {
+	vec *prometheus.HistogramVec
+}
+
+// Records an observation in the series with the given label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.vec.WithLabelValues(values...).Observe(v)
+}
+
+// A labelled value which can go up and down
+type Gauge struct {
+	vec *prometheus.GaugeVec
+}
+
+// Adds v (which may be negative) to the gauge of the series with the given label values
+func (g *Gauge) Add(v float64, values ...string) {
+	g.vec.WithLabelValues(values...).Add(v)
+}
+
+// Sets the gauge of the series with the given label values
+func (g *Gauge) Set(v float64, values ...string) {
+	g.vec.WithLabelValues(values...).Set(v)
+}
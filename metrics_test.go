@@ -0,0 +1,185 @@
+package f3api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Tests the text format of every metric type
+func TestMetricsFormat(t *testing.T) {
+	var buf bytes.Buffer
+
+	m := NewMetrics()
+	requests, err := m.Counter("requests_total", "Requests.", "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests.Inc("200")
+	requests.Add(2, "500")
+	latency, err := m.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	latency.Observe(0.5)
+	things, err := m.Gauge("things", "Things by \"kind\".", "kind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	things.Add(4, "a\"b")
+	things.Add(-1, "a\"b")
+	if err := m.GaugeFunc("answer", "The answer.", func() float64 { return 42 }); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP answer The answer.
+# TYPE answer gauge
+answer 42
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 0
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.5
+latency_seconds_count 1
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 1
+requests_total{code="500"} 2
+# HELP things Things by "kind".
+# TYPE things gauge
+things{kind="a\"b"} 3
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected metrics output:\n%s", buf.String())
+	}
+}
+
+// Tests that registering a metric twice fails, including through the instrumentation
+func TestMetricsDuplicate(t *testing.T) {
+	m := NewMetrics()
+	if _, err := m.Counter("requests_total", "Requests."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Counter("requests_total", "Requests."); err == nil {
+		t.Fatal("Expected registering the counter twice to fail")
+	}
+
+	if _, err := InstrumentStore(NewInMemStore(), m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InstrumentStore(NewInMemStore(), m); err == nil {
+		t.Fatal("Expected instrumenting a second store in the same registry to fail")
+	}
+}
+
+// Tests that the payment counts follow the writes made through the store, transactions included
+func TestInstrumentStoreCounts(t *testing.T) {
+	backend := NewInMemStore()
+	p := defaultPayment()
+	backend.AddPayment(p)
+
+	m := NewMetrics()
+	store, err := InstrumentStore(backend, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eur := p
+	eur.ID = "eur"
+	eur.Attributes.Currency = "EUR"
+	store.AddPayment(eur)
+	moved := p
+	moved.Attributes.Currency = "USD"
+	store.UpdatePayment(moved)
+	if err := store.DeletePayment("missing"); err == nil {
+		t.Fatal("Expected deleting a missing payment to fail")
+	}
+
+	tx, _ := store.Begin()
+	tx.DeletePayment(eur.ID)
+	other := p
+	other.ID = "other"
+	tx.AddPayment(other)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, _ = store.Begin()
+	tx.DeletePayment(other.ID)
+	tx.Rollback()
+
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`f3api_payments{currency="EUR",scheme="FPS"} 0`,
+		`f3api_payments{currency="GBP",scheme="FPS"} 1`,
+		`f3api_payments{currency="USD",scheme="FPS"} 1`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("Expected %q in the metrics:\n%s", line, buf.String())
+		}
+	}
+}
+
+// Tests the request and store metrics of a server, as scraped from /metrics
+func TestServerMetrics(t *testing.T) {
+	m := NewMetrics()
+	store, err := InstrumentStore(NewInMemStore(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddPayment(defaultPayment())
+
+	handler, err := MakeHandler(NewGenericApi(store), ServerConfig{Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, path := range []string{"/payments", "/payments/" + defaultPayment().ID, "/payments/missing"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(buf)
+
+	for _, line := range []string{
+		`f3api_http_requests_total{code="200",method="GET",route="/payments"} 1`,
+		`f3api_http_requests_total{code="200",method="GET",route="/payments/:id"} 1`,
+		`f3api_http_requests_total{code="404",method="GET",route="/payments/:id"} 1`,
+		`f3api_http_request_duration_seconds_count{method="GET",route="/payments/:id"} 2`,
+		`f3api_store_operations_total{operation="GetPayment"} 2`,
+		`f3api_store_operation_errors_total{operation="GetPayment"} 1`,
+		`f3api_store_operation_duration_seconds_count{operation="AddPayment"} 1`,
+		`f3api_payments{currency="GBP",scheme="FPS"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics are missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
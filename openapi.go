@@ -0,0 +1,586 @@
+package f3api
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Version of the OpenAPI specification the document follows
+const openAPIVersion = "3.1.0"
+
+// A JSON object of the OpenAPI document
+type jsonObject = map[string]interface{}
+
+// Schemas of the types which are encoded differently from their Go kind
+// Each of them parses more leniently than it is written: any decimal number is read, but amounts
+// are always written with two decimal places and exchange rates with five.
+var scalarSchemas = map[reflect.Type]jsonObject{
+	reflect.TypeOf(StringedInt(0)): {
+		"type":        "string",
+		"pattern":     `^-?[0-9]+$`,
+		"description": "Integer encoded as a string",
+	},
+	reflect.TypeOf(FractionalAmount(0)): {
+		"type":        "string",
+		"pattern":     `^-?[0-9]+(\.[0-9]+)?$`,
+		"description": "Decimal amount encoded as a string, written with two decimal places",
+		"examples":    []string{"100.21"},
+	},
+	reflect.TypeOf(ExchangeRate(0)): {
+		"type":        "string",
+		"pattern":     `^-?[0-9]+(\.[0-9]+)?$`,
+		"description": "Decimal exchange rate encoded as a string, written with five decimal places",
+		"examples":    []string{"2.00000"},
+	},
+	reflect.TypeOf(Date{}): {
+		"type":        "string",
+		"format":      "date",
+		"description": "ISO 8601 calendar date",
+		"examples":    []string{"2017-01-18"},
+	},
+	reflect.TypeOf(time.Time{}): {
+		"type":   "string",
+		"format": "date-time",
+	},
+}
+
+// Descriptions of the payment types in the document; those of their fields are given by the
+// "description" tags of the fields
+var schemaDescriptions = map[reflect.Type]string{
+	reflect.TypeOf(Payment{}):           "A payment from the debtor party to the beneficiary party, processed through a payment scheme",
+	reflect.TypeOf(PaymentAttributes{}): "Details of a payment",
+	reflect.TypeOf(MinimalParty{}):      "An account at a bank, identified as a payment scheme does",
+	reflect.TypeOf(Party{}):             "The holder of an account, and the account",
+	reflect.TypeOf(TypedParty{}):        "A party with the type of its account",
+	reflect.TypeOf(ChargeInformation{}): "The charges banks take for a payment, and who bears them",
+	reflect.TypeOf(SenderCharge{}):      "A charge of a bank on the debtor's side",
+	reflect.TypeOf(FX{}):                "The conversion of a payment from the currency of the debtor",
+}
+
+// Derives JSON schemas from Go types, collecting named structs as reusable components
+type schemaGenerator struct {
+	components jsonObject
+}
+
+// Returns the schema of values of type t, as encoded by encoding/json
+// Named structs are referred to by name, and added to the components on first use.
+func (g *schemaGenerator) schema(t reflect.Type) jsonObject {
+	if s, ok := scalarSchemas[t]; ok {
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		// unexported types are named like exported ones in the document
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := g.components[name]; !ok {
+			// claimed before recursing, for types which refer to themselves
+			g.components[name] = nil
+			g.components[name] = withDescription(g.object(t), schemaDescriptions[t])
+		}
+		return jsonObject{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		return jsonObject{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return jsonObject{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.String:
+		return jsonObject{"type": "string"}
+	case reflect.Bool:
+		return jsonObject{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObject{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonObject{"type": "number"}
+	}
+
+	// interfaces and anything else encoding/json would make of them
+	return jsonObject{}
+}
+
+// Returns the schema of a struct, with the fields of embedded structs promoted as encoding/json does
+func (g *schemaGenerator) object(t reflect.Type) jsonObject {
+	properties := jsonObject{}
+	g.addFields(t, properties)
+	return jsonObject{"type": "object", "properties": properties}
+}
+
+// Adds the JSON fields of a struct to properties
+func (g *schemaGenerator) addFields(t reflect.Type, properties jsonObject) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct && scalarSchemas[f.Type] == nil {
+			g.addFields(f.Type, properties)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = withDescription(g.schema(f.Type), f.Tag.Get("description"))
+	}
+}
+
+// Returns a copy of a schema with the given description, or the schema itself if it is empty
+// Copied, as the schemas of scalars and references are shared.
+func withDescription(schema jsonObject, description string) jsonObject {
+	if description == "" {
+		return schema
+	}
+	s := jsonObject{"description": description}
+	for k, v := range schema {
+		if k != "description" {
+			s[k] = v
+		}
+	}
+	return s
+}
+
+// A parameter of an operation
+type apiParameter struct {
+	name, in, description string
+	schema                jsonObject
+}
+
+// An operation of the API, as listed in the OpenAPI document
+type apiOperation struct {
+	// Method and path of the route, in the form used by go-json-rest ("/payments/:id")
+	method, path string
+	id, summary  string
+	parameters   []apiParameter
+	// Schemas of the request body by media type, if the operation takes one
+	request map[string]jsonObject
+	// Status codes with their descriptions, and schemas by media type of their bodies, if any
+	responses map[string]apiResponse
+}
+
+// A response of an operation
+type apiResponse struct {
+	description string
+	content     map[string]jsonObject
+	headers     jsonObject
+}
+
+// Describes the operations of the payments API, which must be the routes of paymentRoutes
+func paymentOperations(g *schemaGenerator) []apiOperation {
+	payment := g.schema(reflect.TypeOf(Payment{}))
+	payments := jsonObject{"type": "array", "items": payment}
+	errorBody := map[string]jsonObject{"application/json": g.schema(reflect.TypeOf(errorResponse{}))}
+	idParam := apiParameter{"id", "path", "ID of the payment", jsonObject{"type": "string"}}
+	fieldsParam := apiParameter{"fields", "query",
+		`Comma separated dotted paths of the fields to return, e.g. "id,amount"; paths which aren't top-level fields are within "attributes"`,
+		jsonObject{"type": "string"}}
+
+	// wraps a schema in an Envelope, for requests and responses in the JSON:API media type
+	enveloped := func(data jsonObject) jsonObject {
+		return jsonObject{"type": "object", "properties": jsonObject{
+			"data":  data,
+			"links": g.schema(reflect.TypeOf(EnvelopeLinks{})),
+			"meta":  g.schema(reflect.TypeOf(EnvelopeMeta{})),
+		}}
+	}
+	paymentBody := map[string]jsonObject{"application/json": payment, jsonAPIMediaType: enveloped(payment)}
+
+	errResponse := func(description string) apiResponse {
+		return apiResponse{description: description, content: errorBody}
+	}
+	paymentResponse := apiResponse{description: "The payment", content: paymentBody}
+	// refused duplicates name the payment they duplicate, see handleError
+	conflictResponse := func(description string) apiResponse {
+		return apiResponse{
+			description: description,
+			content:     map[string]jsonObject{"application/json": g.schema(reflect.TypeOf(duplicateErrorResponse{}))},
+			headers: jsonObject{"Link": jsonObject{
+				"description": `Link to the duplicated payment, with rel="duplicate-of", if the payment is a duplicate`,
+				"schema":      jsonObject{"type": "string"},
+			}},
+		}
+	}
+	held := g.schema(reflect.TypeOf(HeldPayment{}))
+	heldList := jsonObject{"type": "array", "items": held}
+	heldBody := map[string]jsonObject{"application/json": held, jsonAPIMediaType: enveloped(held)}
+	schedule := g.schema(reflect.TypeOf(Schedule{}))
+	scheduleList := jsonObject{"type": "array", "items": schedule}
+	scheduleBody := map[string]jsonObject{"application/json": schedule, jsonAPIMediaType: enveloped(schedule)}
+	scheduleID := apiParameter{"id", "path", "ID of the schedule", jsonObject{"type": "string"}}
+	quoteRequest := g.schema(reflect.TypeOf(FXQuoteRequest{}))
+	quote := g.schema(reflect.TypeOf(FXQuote{}))
+	charges := g.schema(reflect.TypeOf(Charges{}))
+	summaries := g.schema(reflect.TypeOf([]FeeSummary{}))
+	report := g.schema(reflect.TypeOf([]ReportRow{}))
+	flag := g.schema(reflect.TypeOf(FlaggedDuplicate{}))
+	flagList := jsonObject{"type": "array", "items": flag}
+	results := g.schema(reflect.TypeOf([]BulkItemResult{}))
+	bulkResults := map[string]jsonObject{"application/json": results, jsonAPIMediaType: enveloped(results)}
+
+	return []apiOperation{
+		{
+			method: http.MethodGet, path: "/payments", id: "listPayments",
+			summary: "Lists all payments, or a page of them when a limit is given",
+			parameters: []apiParameter{
+				{"format", "query", "Format of the response", jsonObject{"type": "string", "enum": []string{"json", "csv"}, "default": "json"}},
+				{"limit", "query", "Size of the page; pages are ordered by payment ID", jsonObject{"type": "integer", "minimum": 1, "maximum": maxPageSize}},
+				{"after", "query", "ID of the last payment of the previous page", jsonObject{"type": "string"}},
+				fieldsParam,
+				{"filter", "query", `Filter expression, e.g. "currency = GBP AND amount > 10000 AND reference contains 'piano'"`, jsonObject{"type": "string"}},
+			},
+			responses: map[string]apiResponse{
+				"200": {
+					description: "The payments",
+					content: map[string]jsonObject{
+						"application/json": payments,
+						jsonAPIMediaType:   enveloped(payments),
+						"text/csv":         {"type": "string", "description": "One payment per row, see NewPaymentCSVReader"},
+					},
+					headers: jsonObject{"Link": jsonObject{
+						"description": `Link to the next page, with rel="next", unless this is the last page`,
+						"schema":      jsonObject{"type": "string"},
+					}},
+				},
+				"400": errResponse("Invalid query parameters"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/payments", id: "createPayment",
+			summary: "Creates a payment, which must have an ID",
+			request: paymentBody,
+			responses: map[string]apiResponse{
+				"200": paymentResponse,
+				"202": {description: "The payment is held for review by screening", content: heldBody},
+				"409": conflictResponse("A payment with the same ID exists, the payment duplicates a recent one, or it was changed concurrently"),
+				"422": errResponse("The payment or its foreign exchange is invalid, it has no business day to be processed on, or it is refused by screening"),
+				"500": errResponse("The payment could not be decoded"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/payments/import", id: "importPayments",
+			summary: "Creates the payments of a CSV file, one payment per row",
+			request: map[string]jsonObject{"text/csv": {"type": "string"}},
+			responses: map[string]apiResponse{
+				"200": {description: "How many payments were created, and why the others weren't", content: map[string]jsonObject{
+					"application/json": g.schema(reflect.TypeOf(ImportResult{})),
+					jsonAPIMediaType:   enveloped(g.schema(reflect.TypeOf(ImportResult{}))),
+				}},
+				"400": errResponse("The CSV header is invalid"),
+				"500": {description: "The file couldn't be read to the end; the payments created until then are reported along with the error", content: map[string]jsonObject{
+					"application/json": g.schema(reflect.TypeOf(ImportResult{})),
+					jsonAPIMediaType:   enveloped(g.schema(reflect.TypeOf(ImportResult{}))),
+				}},
+			},
+		},
+		{
+			method: http.MethodPost, path: "/payments/bulk", id: "bulkPayments",
+			summary: "Creates (or updates) many payments, each on its own or all or nothing",
+			parameters: []apiParameter{
+				{"atomic", "query", "Store all payments or none", jsonObject{"type": "boolean", "default": false}},
+				{"upsert", "query", "Update payments which already exist", jsonObject{"type": "boolean", "default": false}},
+			},
+			request: map[string]jsonObject{
+				"application/json": payments,
+				jsonAPIMediaType:   enveloped(payments),
+				ndjsonMediaType:    {"type": "string", "description": "One payment per line"},
+			},
+			responses: map[string]apiResponse{
+				"200": {description: "The outcome of each payment, in request order", content: bulkResults},
+				"201": {description: "All payments were stored atomically", content: bulkResults},
+				"400": errResponse("The body could not be decoded"),
+				"409": {description: "Atomic request failed, as a payment already exists", content: bulkResults},
+				"422": {description: "Atomic request failed, as a payment is invalid", content: bulkResults},
+			},
+		},
+		{
+			method: http.MethodGet, path: "/payments/:id", id: "getPayment",
+			summary:    "Fetches a payment",
+			parameters: []apiParameter{idParam, fieldsParam},
+			responses: map[string]apiResponse{
+				"200": paymentResponse,
+				"400": errResponse("Unknown fields"),
+				"404": errResponse("No such payment"),
+			},
+		},
+		{
+			method: http.MethodPut, path: "/payments/:id", id: "putPayment",
+			summary:    "Creates or replaces a payment",
+			parameters: []apiParameter{idParam},
+			request:    paymentBody,
+			responses: map[string]apiResponse{
+				"200": paymentResponse,
+				"202": {description: "The payment is held for review by screening", content: heldBody},
+				"409": conflictResponse("The payment duplicates a recent one, or it was changed concurrently"),
+				"422": errResponse("The payment or its foreign exchange is invalid, it has no business day to be processed on, or it is refused by screening"),
+				"500": errResponse("The payment could not be decoded"),
+			},
+		},
+		{
+			method: http.MethodDelete, path: "/payments/:id", id: "deletePayment",
+			summary:    "Deletes a payment",
+			parameters: []apiParameter{idParam},
+			responses: map[string]apiResponse{
+				"200": {description: "The payment was deleted"},
+				"404": errResponse("No such payment"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/payments/:id/charges", id: "getPaymentCharges",
+			summary:    "Computes the charges of a payment, and what its beneficiary is credited",
+			parameters: []apiParameter{idParam},
+			responses: map[string]apiResponse{
+				"200": {description: "The charges", content: map[string]jsonObject{
+					"application/json": charges,
+					jsonAPIMediaType:   enveloped(charges),
+				}},
+				"404": errResponse("No such payment"),
+				"422": errResponse("The charges are invalid, can't be converted, or exceed the amount"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/holds", id: "listHeldPayments",
+			summary: "Lists the payments held for review by screening, oldest first",
+			responses: map[string]apiResponse{
+				"200": {description: "The held payments", content: map[string]jsonObject{
+					"application/json": heldList,
+					jsonAPIMediaType:   enveloped(heldList),
+				}},
+				"404": errResponse("Payments are not screened"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/holds/:id/release", id: "releaseHeldPayment",
+			summary:    "Writes a payment held for review after all",
+			parameters: []apiParameter{idParam},
+			responses: map[string]apiResponse{
+				"200": paymentResponse,
+				"404": errResponse("No such payment held for review"),
+				"409": errResponse("The payment was created meanwhile"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/holds/:id/reject", id: "rejectHeldPayment",
+			summary:    "Drops a payment held for review",
+			parameters: []apiParameter{idParam},
+			responses: map[string]apiResponse{
+				"200": {description: "The payment which was held", content: heldBody},
+				"404": errResponse("No such payment held for review"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/schedules", id: "listSchedules",
+			summary: "Lists the schedules of recurring payments by ID",
+			responses: map[string]apiResponse{
+				"200": {description: "The schedules", content: map[string]jsonObject{
+					"application/json": scheduleList,
+					jsonAPIMediaType:   enveloped(scheduleList),
+				}},
+				"404": errResponse("Payments are not scheduled"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/schedules", id: "createSchedule",
+			summary: "Creates a schedule of recurring payments, which must have an ID",
+			request: scheduleBody,
+			responses: map[string]apiResponse{
+				"201": {description: "The schedule", content: scheduleBody},
+				"400": errResponse("The schedule could not be decoded"),
+				"404": errResponse("Payments are not scheduled"),
+				"409": errResponse("A schedule with the same ID exists"),
+				"422": errResponse("The schedule, its recurrence rule or its payment is invalid"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/schedules/:id", id: "getSchedule",
+			summary:    "Fetches a schedule, with the payments made so far",
+			parameters: []apiParameter{scheduleID},
+			responses: map[string]apiResponse{
+				"200": {description: "The schedule", content: scheduleBody},
+				"404": errResponse("No such schedule"),
+			},
+		},
+		{
+			method: http.MethodDelete, path: "/schedules/:id", id: "deleteSchedule",
+			summary:    "Deletes a schedule; the payments already made are kept",
+			parameters: []apiParameter{scheduleID},
+			responses: map[string]apiResponse{
+				"200": {description: "The schedule was deleted"},
+				"404": errResponse("No such schedule"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/fx/quote", id: "quoteFX",
+			summary: "Converts an amount of money at the exchange rate effective on a day, today if not given",
+			request: map[string]jsonObject{"application/json": quoteRequest, jsonAPIMediaType: enveloped(quoteRequest)},
+			responses: map[string]apiResponse{
+				"200": {description: "The converted amount", content: map[string]jsonObject{
+					"application/json": quote,
+					jsonAPIMediaType:   enveloped(quote),
+				}},
+				"400": errResponse("The request could not be decoded"),
+				"404": errResponse("No exchange rates are known"),
+				"422": errResponse("The currencies are invalid, or no rate between them is known"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/charges/summary", id: "summarizeFees",
+			summary: "Summarizes the charges of the payments processed over a range of days, by organisation",
+			parameters: []apiParameter{
+				{"from", "query", "First processing date", jsonObject{"type": "string", "format": "date"}},
+				{"until", "query", "Last processing date", jsonObject{"type": "string", "format": "date"}},
+				{"organisation_id", "query", "Only summarize the payments of this organisation", jsonObject{"type": "string"}},
+			},
+			responses: map[string]apiResponse{
+				"200": {description: "The summaries, by organisation ID", content: map[string]jsonObject{
+					"application/json": summaries,
+					jsonAPIMediaType:   enveloped(summaries),
+				}},
+				"400": errResponse("Invalid query parameters"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/reports/summary", id: "summarizePayments",
+			summary: "Computes the count, sum, minimum, maximum and average of the amounts of payments, by groups of them",
+			parameters: []apiParameter{
+				{"format", "query", "Format of the response", jsonObject{"type": "string", "enum": []string{"json", "csv"}, "default": "json"}},
+				{"group_by", "query", `Comma separated groups among currency, scheme, type, organisation, day, week and month, e.g. "currency,month"; payments are always grouped by currency, last if it isn't given`,
+					jsonObject{"type": "string"}},
+				{"filter", "query", `Filter expression, e.g. "processing_date >= 2017-01-01 AND processing_date < 2017-02-01"`, jsonObject{"type": "string"}},
+			},
+			responses: map[string]apiResponse{
+				"200": {description: "A row of statistics per group, ordered by the keys of the groups", content: map[string]jsonObject{
+					"application/json": report,
+					jsonAPIMediaType:   enveloped(report),
+					"text/csv":         {"type": "string", "description": "A column per group, followed by count, sum, min, max and average"},
+				}},
+				"400": errResponse("Invalid query parameters"),
+			},
+		},
+		{
+			method: http.MethodGet, path: "/duplicates", id: "listFlaggedDuplicates",
+			summary: "Lists the payments created despite duplicating a recent one, flagged for review, oldest first",
+			responses: map[string]apiResponse{
+				"200": {description: "The flagged payments", content: map[string]jsonObject{
+					"application/json": flagList,
+					jsonAPIMediaType:   enveloped(flagList),
+				}},
+				"404": errResponse("Duplicate payments are not detected"),
+			},
+		},
+		{
+			method: http.MethodPost, path: "/duplicates/:id/dismiss", id: "dismissFlaggedDuplicate",
+			summary:    "Dismisses the flag of a duplicate payment once reviewed",
+			parameters: []apiParameter{idParam},
+			responses: map[string]apiResponse{
+				"200": {description: "The dismissed flag", content: map[string]jsonObject{
+					"application/json": flag,
+					jsonAPIMediaType:   enveloped(flag),
+				}},
+				"404": errResponse("No such payment flagged for review"),
+			},
+		},
+	}
+}
+
+// Body of error responses, as written by rest.Error
+type errorResponse struct {
+	Error string
+}
+
+// Turns a go-json-rest path ("/payments/:id") into an OpenAPI one ("/payments/{id}")
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Wraps schemas by media type in an OpenAPI content object
+func openAPIContent(content map[string]jsonObject) jsonObject {
+	obj := jsonObject{}
+	for mediaType, schema := range content {
+		obj[mediaType] = jsonObject{"schema": schema}
+	}
+	return obj
+}
+
+// Builds the OpenAPI document of the payments API, with the schemas derived from the Go types
+func OpenAPISpec() jsonObject {
+	g := schemaGenerator{components: jsonObject{}}
+
+	paths := jsonObject{}
+	for _, op := range paymentOperations(&g) {
+		operation := jsonObject{
+			"operationId": op.id,
+			"summary":     op.summary,
+		}
+
+		if len(op.parameters) > 0 {
+			var params []jsonObject
+			for _, p := range op.parameters {
+				params = append(params, jsonObject{
+					"name":        p.name,
+					"in":          p.in,
+					"description": p.description,
+					"required":    p.in == "path",
+					"schema":      p.schema,
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if op.request != nil {
+			operation["requestBody"] = jsonObject{"required": true, "content": openAPIContent(op.request)}
+		}
+
+		responses := jsonObject{}
+		for status, r := range op.responses {
+			response := jsonObject{"description": r.description}
+			if r.content != nil {
+				response["content"] = openAPIContent(r.content)
+			}
+			if r.headers != nil {
+				response["headers"] = r.headers
+			}
+			responses[status] = response
+		}
+		operation["responses"] = responses
+
+		path := openAPIPath(op.path)
+		item, ok := paths[path].(jsonObject)
+		if !ok {
+			item = jsonObject{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = operation
+	}
+
+	return jsonObject{
+		"openapi": openAPIVersion,
+		"info": jsonObject{
+			"title":   "Payments API",
+			"version": readVersionInfo().Version,
+		},
+		"paths":      paths,
+		"components": jsonObject{"schemas": g.components},
+	}
+}
+
+// Serves the OpenAPI document
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, OpenAPISpec())
+}
@@ -0,0 +1,137 @@
+package f3api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Fetches the OpenAPI document from a server, decoded as plain JSON
+func fetchOpenAPISpec(t *testing.T) map[string]interface{} {
+	t.Helper()
+
+	handler, err := MakeHandler(NewGenericApi(NewInMemStore()), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", w.Code)
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// Tests that the document describes exactly the routes served by RunServer
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := fetchOpenAPISpec(t)
+
+	var served, documented []string
+	for _, route := range paymentRoutes(NewGenericApi(NewInMemStore())) {
+		served = append(served, route.HttpMethod+" "+openAPIPath(route.PathExp))
+	}
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(served)
+	sort.Strings(documented)
+
+	if strings.Join(served, "\n") != strings.Join(documented, "\n") {
+		t.Fatalf("Routes and OpenAPI document diverge\nserved:\n%s\ndocumented:\n%s",
+			strings.Join(served, "\n"), strings.Join(documented, "\n"))
+	}
+}
+
+// Tests the schemas derived from the payment types
+func TestOpenAPISchemas(t *testing.T) {
+	spec := fetchOpenAPISpec(t)
+	if spec["openapi"] != openAPIVersion {
+		t.Fatalf("Unexpected OpenAPI version %v", spec["openapi"])
+	}
+
+	schemas := spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	property := func(schema, name string) map[string]interface{} {
+		t.Helper()
+		s, ok := schemas[schema].(map[string]interface{})
+		if !ok {
+			t.Fatalf("Missing schema %s", schema)
+		}
+		p, ok := s["properties"].(map[string]interface{})[name].(map[string]interface{})
+		if !ok {
+			t.Fatalf("Missing property %s.%s", schema, name)
+		}
+		return p
+	}
+
+	// string-encoded types
+	for _, c := range []struct{ schema, property, format string }{
+		{"PaymentAttributes", "amount", ""},
+		{"PaymentAttributes", "payment_id", ""},
+		{"PaymentAttributes", "processing_date", "date"},
+		{"FX", "exchange_rate", ""},
+	} {
+		p := property(c.schema, c.property)
+		if p["type"] != "string" || (c.format != "" && p["format"] != c.format) {
+			t.Fatalf("Unexpected schema of %s.%s: %v", c.schema, c.property, p)
+		}
+	}
+
+	// fields of embedded structs are promoted
+	if p := property("TypedParty", "bank_id"); p["type"] != "string" {
+		t.Fatalf("Unexpected schema of TypedParty.bank_id: %v", p)
+	}
+	if p := property("PaymentAttributes", "debtor_party"); p["$ref"] != "#/components/schemas/Party" {
+		t.Fatalf("Unexpected schema of PaymentAttributes.debtor_party: %v", p)
+	}
+
+	// the payment types and all their fields are described
+	for _, name := range []string{"Payment", "PaymentAttributes", "TypedParty", "Party", "MinimalParty", "ChargeInformation", "SenderCharge", "FX"} {
+		s := schemas[name].(map[string]interface{})
+		if s["description"] == nil {
+			t.Fatalf("Schema %s has no description", name)
+		}
+		for field := range s["properties"].(map[string]interface{}) {
+			if property(name, field)["description"] == nil {
+				t.Fatalf("Property %s.%s has no description", name, field)
+			}
+		}
+	}
+	if p := property("PaymentAttributes", "amount"); p["pattern"] == nil || !strings.Contains(p["description"].(string), "beneficiary") {
+		t.Fatalf("Expected the amount to keep its format along with its description, got %v", p)
+	}
+	put := spec["paths"].(map[string]interface{})["/payments/{id}"].(map[string]interface{})["put"].(map[string]interface{})
+	if put["responses"].(map[string]interface{})["409"] == nil {
+		t.Fatal("Expected PUT /payments/{id} to document refused duplicates")
+	}
+
+	// every reference resolves
+	var check func(v interface{})
+	check = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				if _, ok := schemas[strings.TrimPrefix(ref, "#/components/schemas/")]; !ok {
+					t.Fatalf("Dangling reference %s", ref)
+				}
+			}
+			for _, child := range v {
+				check(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				check(child)
+			}
+		}
+	}
+	check(spec)
+}
@@ -0,0 +1,267 @@
+package f3api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Span exporter writing spans in the OTLP/JSON encoding, as the OpenTelemetry file exporter does:
+// every batch of spans is written as an ExportTraceServiceRequest on a line of its own, which the
+// collector's otlpjsonfile receiver can read back
+type otlpJSONExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Creates an exporter writing to w
+func newOTLPJSONExporter(w io.Writer) *otlpJSONExporter {
+	return &otlpJSONExporter{w: w}
+}
+
+// Makes otlpJSONExporter implement sdktrace.SpanExporter
+func (e *otlpJSONExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(otlpRequestOf(spans))
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(buf, '\n'))
+	return err
+}
+
+// Makes otlpJSONExporter implement sdktrace.SpanExporter; the writer is left to its owner
+func (e *otlpJSONExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// The messages of the OTLP trace protocol, as encoded in JSON: fields in lowerCamelCase, IDs in hex,
+// 64 bit integers (timestamps included) as strings and enums as numbers
+type (
+	otlpRequest struct {
+		ResourceSpans []*otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource      `json:"resource"`
+		ScopeSpans []*otlpScopeSpans `json:"scopeSpans"`
+		SchemaURL  string            `json:"schemaUrl,omitempty"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+
+	otlpScopeSpans struct {
+		Scope     otlpScope  `json:"scope"`
+		Spans     []otlpSpan `json:"spans"`
+		SchemaURL string     `json:"schemaUrl,omitempty"`
+	}
+
+	otlpScope struct {
+		Name       string         `json:"name"`
+		Version    string         `json:"version,omitempty"`
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+
+	otlpSpan struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		TraceState   string `json:"traceState,omitempty"`
+		ParentSpanID string `json:"parentSpanId,omitempty"`
+		Flags        uint32 `json:"flags,omitempty"`
+		Name         string `json:"name"`
+		// numbered like trace.SpanKind
+		Kind                   int            `json:"kind"`
+		StartTimeUnixNano      int64          `json:"startTimeUnixNano,string"`
+		EndTimeUnixNano        int64          `json:"endTimeUnixNano,string"`
+		Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+		DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+		Events                 []otlpEvent    `json:"events,omitempty"`
+		DroppedEventsCount     int            `json:"droppedEventsCount,omitempty"`
+		Links                  []otlpLink     `json:"links,omitempty"`
+		DroppedLinksCount      int            `json:"droppedLinksCount,omitempty"`
+		Status                 otlpStatus     `json:"status"`
+	}
+
+	otlpEvent struct {
+		TimeUnixNano           int64          `json:"timeUnixNano,string"`
+		Name                   string         `json:"name"`
+		Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+		DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+	}
+
+	otlpLink struct {
+		TraceID                string         `json:"traceId"`
+		SpanID                 string         `json:"spanId"`
+		TraceState             string         `json:"traceState,omitempty"`
+		Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+		DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+	}
+
+	otlpStatus struct {
+		Message string `json:"message,omitempty"`
+		Code    int    `json:"code,omitempty"`
+	}
+
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+
+	otlpAnyValue struct {
+		StringValue *string         `json:"stringValue,omitempty"`
+		BoolValue   *bool           `json:"boolValue,omitempty"`
+		IntValue    *string         `json:"intValue,omitempty"`
+		DoubleValue *float64        `json:"doubleValue,omitempty"`
+		ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	}
+
+	otlpArrayValue struct {
+		Values []otlpAnyValue `json:"values"`
+	}
+)
+
+// Groups spans by resource and instrumentation scope into an export request
+func otlpRequestOf(spans []sdktrace.ReadOnlySpan) *otlpRequest {
+	type scopeKey struct {
+		resource              *otlpResourceSpans
+		name, version, schema string
+	}
+
+	req := otlpRequest{}
+	resources := make(map[attribute.Distinct]*otlpResourceSpans)
+	scopes := make(map[scopeKey]*otlpScopeSpans)
+	for _, span := range spans {
+		res := span.Resource()
+		rs, ok := resources[res.Equivalent()]
+		if !ok {
+			rs = &otlpResourceSpans{
+				Resource:  otlpResource{Attributes: otlpAttributes(res.Attributes())},
+				SchemaURL: res.SchemaURL(),
+			}
+			resources[res.Equivalent()] = rs
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+
+		scope := span.InstrumentationScope()
+		key := scopeKey{rs, scope.Name, scope.Version, scope.SchemaURL}
+		ss, ok := scopes[key]
+		if !ok {
+			ss = &otlpScopeSpans{
+				Scope:     otlpScope{Name: scope.Name, Version: scope.Version, Attributes: otlpAttributes(scope.Attributes.ToSlice())},
+				SchemaURL: scope.SchemaURL,
+			}
+			scopes[key] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		ss.Spans = append(ss.Spans, otlpSpanOf(span))
+	}
+	return &req
+}
+
+// Converts a span to its OTLP message
+func otlpSpanOf(span sdktrace.ReadOnlySpan) otlpSpan {
+	sc := span.SpanContext()
+	s := otlpSpan{
+		TraceID:                sc.TraceID().String(),
+		SpanID:                 sc.SpanID().String(),
+		TraceState:             sc.TraceState().String(),
+		Flags:                  uint32(sc.TraceFlags()),
+		Name:                   span.Name(),
+		Kind:                   int(span.SpanKind()),
+		StartTimeUnixNano:      span.StartTime().UnixNano(),
+		EndTimeUnixNano:        span.EndTime().UnixNano(),
+		Attributes:             otlpAttributes(span.Attributes()),
+		DroppedAttributesCount: span.DroppedAttributes(),
+		DroppedEventsCount:     span.DroppedEvents(),
+		DroppedLinksCount:      span.DroppedLinks(),
+		Status:                 otlpStatus{Message: span.Status().Description},
+	}
+	if parent := span.Parent(); parent.SpanID().IsValid() {
+		s.ParentSpanID = parent.SpanID().String()
+	}
+
+	// unlike the API, OTLP numbers OK before errors
+	switch span.Status().Code {
+	case codes.Ok:
+		s.Status.Code = 1
+	case codes.Error:
+		s.Status.Code = 2
+	}
+
+	for _, event := range span.Events() {
+		s.Events = append(s.Events, otlpEvent{
+			TimeUnixNano:           event.Time.UnixNano(),
+			Name:                   event.Name,
+			Attributes:             otlpAttributes(event.Attributes),
+			DroppedAttributesCount: event.DroppedAttributeCount,
+		})
+	}
+	for _, link := range span.Links() {
+		s.Links = append(s.Links, otlpLink{
+			TraceID:                link.SpanContext.TraceID().String(),
+			SpanID:                 link.SpanContext.SpanID().String(),
+			TraceState:             link.SpanContext.TraceState().String(),
+			Attributes:             otlpAttributes(link.Attributes),
+			DroppedAttributesCount: link.DroppedAttributeCount,
+		})
+	}
+	return s
+}
+
+// Converts attributes to their OTLP messages
+func otlpAttributes(attrs []attribute.KeyValue) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, attr := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: string(attr.Key), Value: otlpValueOf(attr.Value)})
+	}
+	return kvs
+}
+
+// Converts an attribute value to its OTLP message
+func otlpValueOf(v attribute.Value) otlpAnyValue {
+	array := []otlpAnyValue{}
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpAnyValue{BoolValue: &b}
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &i}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpAnyValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		for _, b := range v.AsBoolSlice() {
+			array = append(array, otlpValueOf(attribute.BoolValue(b)))
+		}
+	case attribute.INT64SLICE:
+		for _, i := range v.AsInt64Slice() {
+			array = append(array, otlpValueOf(attribute.Int64Value(i)))
+		}
+	case attribute.FLOAT64SLICE:
+		for _, f := range v.AsFloat64Slice() {
+			array = append(array, otlpValueOf(attribute.Float64Value(f)))
+		}
+	case attribute.STRINGSLICE:
+		for _, s := range v.AsStringSlice() {
+			array = append(array, otlpValueOf(attribute.StringValue(s)))
+		}
+	default:
+		s := v.Emit()
+		return otlpAnyValue{StringValue: &s}
+	}
+	return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: array}}
+}
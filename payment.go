@@ -1,76 +1,77 @@
 package f3api
 
 // The Payment Type, our main resource payload.
-// Details not disclosed, same goes for other types in this file.
+// A payment of Amount in Currency from the DebtorParty to the BeneficiaryParty, processed through
+// a payment scheme on its ProcessingDate; the other types in this file make up its attributes.
 type Payment struct {
-	Type           string            `json:"type"`
-	ID             string            `json:"id"`
-	Version        int               `json:"version"`
-	OrganisationID string            `json:"organisation_id"`
-	Attributes     PaymentAttributes `json:"attributes"`
+	Type           string            `json:"type" description:"Type of the resource, always \"Payment\""`
+	ID             string            `json:"id" description:"ID of the payment, chosen by the client, usually a UUID"`
+	Version        int               `json:"version" description:"Version of the payment, kept as the client sends it"`
+	OrganisationID string            `json:"organisation_id" description:"ID of the organisation the payment belongs to"`
+	Attributes     PaymentAttributes `json:"attributes" description:"Details of the payment"`
 }
 
-// No documentation exists for this type.
+// Details of a payment
 type PaymentAttributes struct {
-	Amount               FractionalAmount  `json:"amount"`
-	BeneficiaryParty     TypedParty        `json:"beneficiary_party"`
-	ChargesInformation   ChargeInformation `json:"charges_information"`
-	Currency             string            `json:"currency"`
-	DebtorParty          Party             `json:"debtor_party"`
-	EndToEndReference    string            `json:"end_to_end_reference"`
-	Fx                   FX                `json:"fx"`
-	NumericReference     StringedInt       `json:"numeric_reference"`
-	PaymentID            StringedInt       `json:"payment_id"`
-	PaymentPurpose       string            `json:"payment_purpose"`
-	PaymentScheme        string            `json:"payment_scheme"`
-	PaymentType          string            `json:"payment_type"`
-	ProcessingDate       Date              `json:"processing_date"`
-	Reference            string            `json:"reference"`
-	SchemePaymentSubType string            `json:"scheme_payment_sub_type"`
-	SchemePaymentType    string            `json:"scheme_payment_type"`
-	SponsorParty         MinimalParty      `json:"sponsor_party"`
+	Amount               FractionalAmount  `json:"amount" description:"Amount credited to the beneficiary, in currency"`
+	BeneficiaryParty     TypedParty        `json:"beneficiary_party" description:"Party the payment is made to"`
+	ChargesInformation   ChargeInformation `json:"charges_information" description:"Charges of the banks involved, and who bears them"`
+	Currency             string            `json:"currency" description:"ISO 4217 code of the currency of amount"`
+	DebtorParty          Party             `json:"debtor_party" description:"Party the payment is made from"`
+	EndToEndReference    string            `json:"end_to_end_reference" description:"Reference of the debtor, passed on unchanged to the beneficiary"`
+	Fx                   FX                `json:"fx" description:"Foreign exchange, for payments converted from another currency"`
+	NumericReference     StringedInt       `json:"numeric_reference" description:"Numeric reference of the payment, for schemes which need one"`
+	PaymentID            StringedInt       `json:"payment_id" description:"ID of the payment in the system of the debtor"`
+	PaymentPurpose       string            `json:"payment_purpose" description:"What the payment is for"`
+	PaymentScheme        string            `json:"payment_scheme" description:"Payment scheme the payment is processed through, such as FPS"`
+	PaymentType          string            `json:"payment_type" description:"Type of the payment, such as Credit"`
+	ProcessingDate       Date              `json:"processing_date" description:"Date the payment is processed on"`
+	Reference            string            `json:"reference" description:"Reference shown to the beneficiary"`
+	SchemePaymentSubType string            `json:"scheme_payment_sub_type" description:"Subtype of the payment in its scheme, such as InternetBanking"`
+	SchemePaymentType    string            `json:"scheme_payment_type" description:"Type of the payment in its scheme, such as ImmediatePayment"`
+	SponsorParty         MinimalParty      `json:"sponsor_party" description:"Bank sponsoring the debtor's bank in the scheme, if it isn't a member itself"`
 }
 
-// No documentation exists for this type.
+// An account at a bank, identified as a payment scheme does
 type MinimalParty struct {
-	AccountNumber string `json:"account_number"`
-	BankID        string `json:"bank_id"`
-	BankIDCode    string `json:"bank_id_code"`
+	AccountNumber string `json:"account_number" description:"Number of the account at its bank"`
+	BankID        string `json:"bank_id" description:"ID of the bank, such as a sort code"`
+	BankIDCode    string `json:"bank_id_code" description:"Kind of bank_id, such as GBDSC for UK sort codes"`
 }
 
-// No documentation exists for this type.
+// The holder of an account, and the account
 type Party struct {
 	MinimalParty
-	AccountName       string `json:"account_name"`
-	AccountNumberCode string `json:"account_number_code"`
-	Address           string `json:"address"`
-	Name              string `json:"name"`
+	AccountName       string `json:"account_name" description:"Name of the account"`
+	AccountNumberCode string `json:"account_number_code" description:"Format of account_number, BBAN or IBAN"`
+	Address           string `json:"address" description:"Address of the holder of the account"`
+	Name              string `json:"name" description:"Name of the holder of the account"`
 }
 
-// No documentation exists for this type.
+// A Party with the type of its account
 type TypedParty struct {
 	Party
-	AccountType int `json:"account_type"`
+	AccountType int `json:"account_type" description:"Type of the account, as coded by the payment scheme"`
 }
 
-// No documentation exists for this type.
+// The charges banks take for a payment, and who bears them, see ValidateCharges
 type ChargeInformation struct {
-	BearerCode              string           `json:"bearer_code"`
-	SenderCharges           []SenderCharge   `json:"sender_charges"`
-	ReceiverChargesAmount   FractionalAmount `json:"receiver_charges_amount"`
-	ReceiverChargesCurrency string           `json:"receiver_charges_currency"`
+	BearerCode              string           `json:"bearer_code" description:"Who bears the charges: SHAR to share them, DEBT for the debtor or CRED for the beneficiary"`
+	SenderCharges           []SenderCharge   `json:"sender_charges" description:"Charges of the banks on the debtor's side"`
+	ReceiverChargesAmount   FractionalAmount `json:"receiver_charges_amount" description:"Charges of the beneficiary's bank"`
+	ReceiverChargesCurrency string           `json:"receiver_charges_currency" description:"ISO 4217 code of the currency of receiver_charges_amount"`
 }
 
-// No documentation exists for this type.
+// A charge of a bank on the debtor's side
 type SenderCharge struct {
-	Amount   FractionalAmount `json:"amount"`
-	Currency string           `json:"currency"`
+	Amount   FractionalAmount `json:"amount" description:"Amount of the charge"`
+	Currency string           `json:"currency" description:"ISO 4217 code of the currency of amount"`
 }
 
-// No documentation exists for this type.
+// The conversion of a payment from the currency of the debtor, see ValidateFX
 type FX struct {
-	ContractReference string           `json:"contract_reference"`
-	ExchangeRate      ExchangeRate     `json:"exchange_rate"`
-	OriginalAmount    FractionalAmount `json:"original_amount"`
-	OriginalCurrency  string           `json:"original_currency"`
+	ContractReference string           `json:"contract_reference" description:"Reference of the foreign exchange contract"`
+	ExchangeRate      ExchangeRate     `json:"exchange_rate" description:"Units of original_currency per unit of the payment's currency"`
+	OriginalAmount    FractionalAmount `json:"original_amount" description:"Amount debited, in original_currency"`
+	OriginalCurrency  string           `json:"original_currency" description:"ISO 4217 code of the currency the payment was converted from"`
 }
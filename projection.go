@@ -0,0 +1,117 @@
+package f3api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Every field of the JSON encoding of a payment, as nested maps; used to check requested fields
+var paymentFieldTemplate = mustDecodeJSONObject(Payment{})
+
+// Encodes v as JSON, and decodes it back into nested maps, keeping numbers as they were written
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Like toJSONObject, for values which always encode to an object
+func mustDecodeJSONObject(v interface{}) map[string]interface{} {
+	obj, err := toJSONObject(v)
+	if err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+// Looks up a dotted path in nested maps
+func lookupPath(obj map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = obj
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Parses the "fields" query parameter: a comma separated list of dotted JSON paths into a payment
+// Paths which don't name a top-level field are taken to be within "attributes", so that "amount"
+// stands for "attributes.amount". Paths may name objects as a whole ("attributes.debtor_party").
+func parseFields(param string) ([][]string, error) {
+	var paths [][]string
+
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return nil, fmt.Errorf("Empty field in %q", param)
+		}
+
+		path := strings.Split(field, ".")
+		if _, ok := paymentFieldTemplate[path[0]]; !ok {
+			path = append([]string{"attributes"}, path...)
+		}
+		if _, ok := lookupPath(paymentFieldTemplate, path); !ok {
+			return nil, fmt.Errorf("Unknown field %q", field)
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
+
+// Projects a payment down to the given paths, keeping the nesting of the fields
+func projectPayment(p Payment, paths [][]string) (map[string]interface{}, error) {
+	obj, err := toJSONObject(p)
+	if err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]interface{})
+	for _, path := range paths {
+		v, ok := lookupPath(obj, path)
+		if !ok {
+			continue
+		}
+
+		parent := projected
+		for _, name := range path[:len(path)-1] {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = v
+	}
+
+	return projected, nil
+}
+
+// Projects payments down to the given paths, see projectPayment
+func projectPayments(payments []Payment, paths [][]string) ([]map[string]interface{}, error) {
+	projected := make([]map[string]interface{}, len(payments))
+	for i, p := range payments {
+		var err error
+		if projected[i], err = projectPayment(p, paths); err != nil {
+			return nil, err
+		}
+	}
+	return projected, nil
+}
@@ -0,0 +1,74 @@
+package f3api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests projecting single payments and lists down to the requested fields
+func TestFieldsProjection(t *testing.T) {
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+	p := defaultPayment()
+	store.AddPayment(p)
+
+	expected := map[string]interface{}{
+		"id": p.ID,
+		"attributes": map[string]interface{}{
+			"amount":          "100.21",
+			"currency":        p.Attributes.Currency,
+			"processing_date": p.Attributes.ProcessingDate.Format(timeFmt),
+			"debtor_party":    map[string]interface{}{"name": p.Attributes.DebtorParty.Name},
+		},
+	}
+	const fields = "id,amount,currency,attributes.processing_date,debtor_party.name"
+
+	responseWriter := &testResponseWriter{}
+	api.GetPayment(responseWriter, createRestRequest("GET", "/payments/"+p.ID+"?fields="+fields, strings.NewReader(""), map[string]string{"id": p.ID}))
+	var single map[string]interface{}
+	if err := json.Unmarshal(responseWriter.Read(), &single); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(single, expected) {
+		t.Fatalf("Unexpected projection %v", single)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.GetAllPayments(responseWriter, createRestRequest("GET", "/payments?fields="+fields, strings.NewReader(""), nil))
+	var list []map[string]interface{}
+	if err := json.Unmarshal(responseWriter.Read(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || !reflect.DeepEqual(list[0], expected) {
+		t.Fatalf("Unexpected projection %v", list)
+	}
+
+	// whole objects, and numbers as they were
+	paths, err := parseFields("version,attributes.fx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	projected, err := projectPayment(p, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := json.Marshal(projected); !strings.Contains(string(buf), `"version":0`) || !strings.Contains(string(buf), `"exchange_rate":"2.00000"`) {
+		t.Fatalf("Unexpected projection %s", buf)
+	}
+}
+
+// Tests that unknown or empty fields are refused
+func TestFieldsValidation(t *testing.T) {
+	api := NewGenericApi(NewInMemStore())
+
+	for _, query := range []string{"fields=id,colour", "fields=", "fields=id,,amount", "fields=amount.value", "fields=id&format=csv"} {
+		responseWriter := &testResponseWriter{}
+		api.GetAllPayments(responseWriter, createRestRequest("GET", "/payments?"+query, strings.NewReader(""), nil))
+		if responseWriter.status != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusBadRequest, responseWriter.status)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package f3api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often a recurrence repeats
+type Frequency string
+
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+)
+
+// A recurrence rule, the subset of RFC 5545 RRULE payment schedules need
+type Recurrence struct {
+	Frequency Frequency
+	// Number of days, weeks or months between occurrences; 1 if not positive
+	Interval int
+	// Number of occurrences; unlimited if zero
+	Count int
+	// Last day an occurrence may fall on; unlimited if zero
+	Until time.Time
+}
+
+// Parses a recurrence rule such as "FREQ=MONTHLY;INTERVAL=3;COUNT=4" or "FREQ=WEEKLY;UNTIL=20271231"
+// FREQ is DAILY, WEEKLY or MONTHLY, INTERVAL defaults to 1, and either COUNT or UNTIL may end the
+// recurrence. UNTIL is a date, and may be given as a UTC date-time ("20271231T000000Z"). An
+// "RRULE:" prefix is allowed.
+func ParseRecurrence(rule string) (Recurrence, error) {
+	r := Recurrence{Interval: 1}
+	seen := make(map[string]bool)
+
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimSpace(rule), "RRULE:"), ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return r, fmt.Errorf("expected NAME=VALUE, got %q", part)
+		}
+		if seen[name] {
+			return r, fmt.Errorf("%s is given twice", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			r.Frequency = Frequency(value)
+			if r.Frequency != Daily && r.Frequency != Weekly && r.Frequency != Monthly {
+				return r, fmt.Errorf("unsupported FREQ %q, expected DAILY, WEEKLY or MONTHLY", value)
+			}
+		case "INTERVAL":
+			if r.Interval, err = strconv.Atoi(value); err != nil || r.Interval < 1 {
+				return r, fmt.Errorf("INTERVAL must be a positive integer, got %q", value)
+			}
+		case "COUNT":
+			if r.Count, err = strconv.Atoi(value); err != nil || r.Count < 1 {
+				return r, fmt.Errorf("COUNT must be a positive integer, got %q", value)
+			}
+		case "UNTIL":
+			date, _, _ := strings.Cut(value, "T")
+			if r.Until, err = time.Parse("20060102", date); err != nil {
+				return r, fmt.Errorf("UNTIL must be a date such as 20271231, got %q", value)
+			}
+		default:
+			return r, fmt.Errorf("unsupported rule part %s", name)
+		}
+	}
+
+	switch {
+	case r.Frequency == "":
+		return r, fmt.Errorf("FREQ is required")
+	case r.Count > 0 && !r.Until.IsZero():
+		return r, fmt.Errorf("COUNT and UNTIL are mutually exclusive")
+	}
+	return r, nil
+}
+
+// Formats the rule as ParseRecurrence parses it, without the defaults
+func (r Recurrence) String() string {
+	parts := []string{"FREQ=" + string(r.Frequency)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// The day of the n-th occurrence from start, counting from 0, and whether there is one
+// Monthly occurrences fall on the day of the month of start, or on the last day of the shorter
+// months: a rule starting on January 31 recurs on February 28 (or 29) and March 31.
+func (r Recurrence) Occurrence(start time.Time, n int) (time.Time, bool) {
+	if n < 0 || r.Count > 0 && n >= r.Count {
+		return time.Time{}, false
+	}
+
+	start, interval := startOfDay(start), max(r.Interval, 1)
+	var day time.Time
+	switch r.Frequency {
+	case Daily:
+		day = start.AddDate(0, 0, n*interval)
+	case Weekly:
+		day = start.AddDate(0, 0, 7*n*interval)
+	default:
+		// the first of the month first, as AddDate would overflow into the next month
+		month := time.Date(start.Year(), start.Month()+time.Month(n*interval), 1, 0, 0, 0, 0, time.UTC)
+		last := month.AddDate(0, 1, -1).Day()
+		day = month.AddDate(0, 0, min(start.Day(), last)-1)
+	}
+
+	if !r.Until.IsZero() && day.After(startOfDay(r.Until)) {
+		return time.Time{}, false
+	}
+	return day, true
+}
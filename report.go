@@ -0,0 +1,225 @@
+package f3api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+// A property of payments that report rows are grouped by, see ParseReportGroups
+type ReportGroup string
+
+const (
+	GroupCurrency     ReportGroup = "currency"
+	GroupScheme       ReportGroup = "scheme"
+	GroupType         ReportGroup = "type"
+	GroupOrganisation ReportGroup = "organisation"
+	// Processing date, as 2017-01-18
+	GroupDay ReportGroup = "day"
+	// ISO week of the processing date, as 2017-W03
+	GroupWeek ReportGroup = "week"
+	// Month of the processing date, as 2017-01
+	GroupMonth ReportGroup = "month"
+)
+
+// The groups in the order they are documented in
+var reportGroups = []ReportGroup{GroupCurrency, GroupScheme, GroupType, GroupOrganisation, GroupDay, GroupWeek, GroupMonth}
+
+// The key of a payment within a group
+func (g ReportGroup) key(p Payment) string {
+	day := p.Attributes.ProcessingDate.Time
+	switch g {
+	case GroupCurrency:
+		return p.Attributes.Currency
+	case GroupScheme:
+		return p.Attributes.PaymentScheme
+	case GroupType:
+		return p.Attributes.PaymentType
+	case GroupOrganisation:
+		return p.OrganisationID
+	case GroupDay:
+		return day.Format(timeFmt)
+	case GroupWeek:
+		year, week := day.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case GroupMonth:
+		return day.Format("2006-01")
+	}
+	return ""
+}
+
+// Adds the currency to groups which don't have it, last, as amounts in different currencies don't add up
+func withCurrencyGroup(groups []ReportGroup) []ReportGroup {
+	for _, g := range groups {
+		if g == GroupCurrency {
+			return groups
+		}
+	}
+	return append(groups[:len(groups):len(groups)], GroupCurrency)
+}
+
+// Parses a comma separated list of groups, such as "currency,month"
+// The currency is added as the last group if it isn't given, see Summarize, so an empty list
+// groups payments by currency alone.
+func ParseReportGroups(s string) ([]ReportGroup, error) {
+	groups := []ReportGroup{}
+	if s == "" {
+		return withCurrencyGroup(groups), nil
+	}
+
+	seen := map[ReportGroup]bool{}
+	for _, name := range strings.Split(s, ",") {
+		g := ReportGroup(strings.TrimSpace(name))
+		known := false
+		for _, r := range reportGroups {
+			known = known || r == g
+		}
+		switch {
+		case !known:
+			return nil, fmt.Errorf("Unknown group %q", g)
+		case seen[g]:
+			return nil, fmt.Errorf("Group %q is given twice", g)
+		}
+		seen[g] = true
+		groups = append(groups, g)
+	}
+	return withCurrencyGroup(groups), nil
+}
+
+// Statistics of the amounts of a group of payments, all in the same currency, see Summarize
+type ReportRow struct {
+	// Keys of the group, by group name
+	Group   map[ReportGroup]string `json:"group"`
+	Count   int                    `json:"count"`
+	Sum     FractionalAmount       `json:"sum"`
+	Min     FractionalAmount       `json:"min"`
+	Max     FractionalAmount       `json:"max"`
+	Average FractionalAmount       `json:"average"`
+}
+
+// Computes the statistics of the amounts of payments, grouped by groups in turn
+// Payments are always grouped by currency too, last unless it is among groups. Rows are ordered by
+// their keys, in the order of groups. Without payments there are no rows.
+func Summarize(payments []Payment, groups []ReportGroup) []ReportRow {
+	groups = withCurrencyGroup(groups)
+	byKey := make(map[string]*ReportRow)
+	var keys []string
+	for _, p := range payments {
+		values := make([]string, len(groups))
+		for i, g := range groups {
+			values[i] = g.key(p)
+		}
+		// joined with a separator which can't be in keys, so that rows sort by their first key first
+		key := strings.Join(values, "\x00")
+
+		amount := p.Attributes.Amount
+		row, ok := byKey[key]
+		if !ok {
+			row = &ReportRow{Group: make(map[ReportGroup]string, len(groups)), Min: amount, Max: amount}
+			for i, g := range groups {
+				row.Group[g] = values[i]
+			}
+			byKey[key] = row
+			keys = append(keys, key)
+		}
+		row.Count++
+		row.Sum += amount
+		row.Min = min(row.Min, amount)
+		row.Max = max(row.Max, amount)
+	}
+
+	sort.Strings(keys)
+	rows := make([]ReportRow, 0, len(keys))
+	for _, key := range keys {
+		row := byKey[key]
+		currency := row.Group[GroupCurrency]
+		row.Sum = FractionalAmount(roundAmount(float64(row.Sum), currency))
+		row.Average = FractionalAmount(roundAmount(float64(row.Sum)/float64(row.Count), currency))
+		rows = append(rows, *row)
+	}
+	return rows
+}
+
+// Writes report rows as CSV: a column per group, in the order of groups (the currency included, like
+// Summarize), followed by the statistics, with amounts in two decimal places
+func WriteReportCSV(w io.Writer, groups []ReportGroup, rows []ReportRow) error {
+	groups = withCurrencyGroup(groups)
+	cw := csv.NewWriter(w)
+	header := make([]string, 0, len(groups)+5)
+	for _, g := range groups {
+		header = append(header, string(g))
+	}
+	if err := cw.Write(append(header, "count", "sum", "min", "max", "average")); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := make([]string, 0, len(header))
+		for _, g := range groups {
+			record = append(record, row.Group[g])
+		}
+		record = append(record, strconv.Itoa(row.Count))
+		for _, amount := range []FractionalAmount{row.Sum, row.Min, row.Max, row.Average} {
+			record = append(record, strconv.FormatFloat(float64(amount), 'f', 2, 64))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Computes the statistics of the amounts of payments, grouped by the "group_by" query parameter
+// (see ParseReportGroups), of the payments matching the "filter" query parameter if it is given.
+// Responds with CSV instead of JSON when the "format" query parameter is "csv".
+func (api *GenericApi) GetReportSummary(w rest.ResponseWriter, r *rest.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		rest.Error(w, "Unknown format "+format, http.StatusBadRequest)
+		return
+	}
+
+	groups, err := ParseReportGroups(query.Get("group_by"))
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var payments []Payment
+	if query.Get("filter") != "" {
+		var filter *Filter
+		if filter, err = ParseFilter(query.Get("filter")); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payments, err = FindPayments(r.Context(), api.store, filter)
+	} else {
+		payments, err = api.store.GetAllPaymentsContext(r.Context())
+	}
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+
+	rows := Summarize(payments, groups)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		// The status has been sent by now, so all we can do about errors is log them
+		if err := WriteReportCSV(w.(http.ResponseWriter), groups, rows); err != nil {
+			slog.ErrorContext(r.Context(), "writing the report as CSV failed", "error", err)
+		}
+		return
+	}
+	writeData(w, r, http.StatusOK, rows, EnvelopeLinks{Self: r.URL.RequestURI()})
+}
@@ -0,0 +1,136 @@
+package f3api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Tests parsing lists of groups
+func TestParseReportGroups(t *testing.T) {
+	groups, err := ParseReportGroups("currency, month")
+	if err != nil || len(groups) != 2 || groups[0] != GroupCurrency || groups[1] != GroupMonth {
+		t.Fatalf("Unexpected groups %v (%v)", groups, err)
+	}
+	if groups, err := ParseReportGroups(""); err != nil || len(groups) != 1 || groups[0] != GroupCurrency {
+		t.Fatalf("Expected the currency alone, got %v (%v)", groups, err)
+	}
+	if groups, err := ParseReportGroups("month"); err != nil || len(groups) != 2 || groups[1] != GroupCurrency {
+		t.Fatalf("Expected the currency to be added last, got %v (%v)", groups, err)
+	}
+	for _, bad := range []string{"year", "day,day", "currency,"} {
+		if _, err := ParseReportGroups(bad); err == nil {
+			t.Fatalf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+// Payments of the fixture with other amounts, currencies and processing dates
+func reportPayments(t *testing.T) []Payment {
+	var payments []Payment
+	for i, c := range []struct {
+		amount   FractionalAmount
+		currency string
+		day      string
+	}{
+		{10, "GBP", "2017-01-02"},
+		{20, "GBP", "2017-01-08"},
+		{30.01, "GBP", "2017-02-01"},
+		{1000, "JPY", "2017-01-02"},
+	} {
+		p := defaultPayment()
+		p.ID = string(rune('a' + i))
+		p.Attributes.Amount = c.amount
+		p.Attributes.Currency = c.currency
+		p.Attributes.ProcessingDate = Date{mustDate(t, c.day)}
+		payments = append(payments, p)
+	}
+	return payments
+}
+
+// Tests the statistics of groups of payments
+func TestSummarize(t *testing.T) {
+	payments := reportPayments(t)
+
+	// amounts in different currencies are never added up
+	rows := Summarize(payments, nil)
+	if len(rows) != 2 || rows[0].Count != 3 || rows[0].Sum != 60.01 || rows[0].Min != 10 || rows[0].Max != 30.01 ||
+		rows[1].Group[GroupCurrency] != "JPY" || rows[1].Sum != 1000 {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+
+	rows = Summarize(payments, []ReportGroup{GroupCurrency, GroupMonth})
+	if len(rows) != 3 {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+	gbp := rows[0]
+	if gbp.Group[GroupCurrency] != "GBP" || gbp.Group[GroupMonth] != "2017-01" ||
+		gbp.Count != 2 || gbp.Sum != 30 || gbp.Min != 10 || gbp.Max != 20 || gbp.Average != 15 {
+		t.Fatalf("Unexpected row %+v", gbp)
+	}
+	if rows[1].Group[GroupMonth] != "2017-02" || rows[2].Group[GroupCurrency] != "JPY" {
+		t.Fatalf("Expected rows ordered by currency then month, got %+v", rows)
+	}
+
+	// 2017-01-02 is a Monday, and 2017-01-08 the Sunday of the same week
+	rows = Summarize(payments, []ReportGroup{GroupWeek})
+	if len(rows) != 3 || rows[0].Group[GroupWeek] != "2017-W01" || rows[0].Group[GroupCurrency] != "GBP" || rows[0].Count != 2 ||
+		rows[1].Group[GroupCurrency] != "JPY" || rows[2].Group[GroupWeek] != "2017-W05" {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+
+	if rows := Summarize(nil, []ReportGroup{GroupDay}); len(rows) != 0 {
+		t.Fatalf("Expected no rows, got %+v", rows)
+	}
+}
+
+// Tests the report endpoint, in JSON and CSV
+func TestReportSummary(t *testing.T) {
+	store := NewInMemStore()
+	for _, p := range reportPayments(t) {
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler, err := MakeHandler(NewGenericApi(store), ServerConfig{Metrics: NewMetrics()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := sendWithMediaTypes(handler, "GET", "/reports/summary?group_by=currency&filter=processing_date+%3C+2017-02-01", "", "", "")
+	var rows []ReportRow
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(rows) != 2 || rows[0].Group[GroupCurrency] != "GBP" || rows[0].Sum != 30 || rows[1].Average != 1000 {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+
+	w = sendWithMediaTypes(handler, "GET", "/reports/summary?group_by=currency,month&format=csv", "", "", "")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Fatalf("Expected CSV, got %s", ct)
+	}
+	expected := "currency,month,count,sum,min,max,average\n" +
+		"GBP,2017-01,2,30.00,10.00,20.00,15.00\n" +
+		"GBP,2017-02,1,30.01,30.01,30.01,30.01\n" +
+		"JPY,2017-01,1,1000.00,1000.00,1000.00,1000.00\n"
+	if w.Body.String() != expected {
+		t.Fatalf("Unexpected CSV:\n%s", w.Body)
+	}
+
+	w = sendWithMediaTypes(handler, "GET", "/reports/summary?group_by=month&format=csv", "", "", "")
+	expected = "month,currency,count,sum,min,max,average\n" +
+		"2017-01,GBP,2,30.00,10.00,20.00,15.00\n" +
+		"2017-01,JPY,1,1000.00,1000.00,1000.00,1000.00\n" +
+		"2017-02,GBP,1,30.01,30.01,30.01,30.01\n"
+	if w.Body.String() != expected {
+		t.Fatalf("Unexpected CSV:\n%s", w.Body)
+	}
+
+	for _, query := range []string{"group_by=year", "format=xml", "filter=amount"} {
+		if w := sendWithMediaTypes(handler, "GET", "/reports/summary?"+query, "", "", ""); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
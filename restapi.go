@@ -1,7 +1,16 @@
 package f3api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/ant0ine/go-json-rest/rest"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
@@ -25,42 +34,188 @@ type RestApi interface {
 	// -- List "a collection", whatever that means
 	// Without further specification (e.g. about pagination), just list them all:
 	GetAllPayments(rest.ResponseWriter, *rest.Request)
+
+	// Create payment resources in bulk from an uploaded CSV file
+	ImportPayments(rest.ResponseWriter, *rest.Request)
+
+	// Create or update many payment resources in a single request
+	BulkPayments(rest.ResponseWriter, *rest.Request)
+
+	// List the payments held for review by screening
+	GetHeldPayments(rest.ResponseWriter, *rest.Request)
+
+	// Write a payment held for review after all
+	ReleaseHeldPayment(rest.ResponseWriter, *rest.Request)
+
+	// Drop a payment held for review
+	RejectHeldPayment(rest.ResponseWriter, *rest.Request)
+
+	// List the schedules of recurring payments
+	GetAllSchedules(rest.ResponseWriter, *rest.Request)
+
+	// Create a schedule of recurring payments
+	PostSchedule(rest.ResponseWriter, *rest.Request)
+
+	// Fetch a schedule, with the payments made so far
+	GetSchedule(rest.ResponseWriter, *rest.Request)
+
+	// Delete a schedule
+	DeleteSchedule(rest.ResponseWriter, *rest.Request)
+
+	// Convert an amount of money between currencies
+	QuoteFX(rest.ResponseWriter, *rest.Request)
+
+	// Compute the charges of a payment, and what its beneficiary is credited
+	GetPaymentCharges(rest.ResponseWriter, *rest.Request)
+
+	// Summarize the charges of payments by organisation, over a range of processing dates
+	GetFeeSummaries(rest.ResponseWriter, *rest.Request)
+
+	// Compute statistics of the amounts of payments, by groups of them
+	GetReportSummary(rest.ResponseWriter, *rest.Request)
+
+	// List the payments flagged for review as duplicates
+	GetFlaggedDuplicates(rest.ResponseWriter, *rest.Request)
+
+	// Dismiss the flag of a duplicate payment once reviewed
+	DismissFlaggedDuplicate(rest.ResponseWriter, *rest.Request)
 }
 
 // Generic implementation of the API
 type GenericApi struct {
-	store ApiStore
+	store      ContextStore
+	scheduler  *Scheduler
+	rates      *RateTable
+	duplicates *DuplicateDetector
 }
 
 // Creates a new Generic API with the provided ApiStore for stable storage
+// Store calls are made with the context of the request, see ContextStoreOf
 func NewGenericApi(store ApiStore) *GenericApi {
 	ga := GenericApi{
-		store: store,
+		store: ContextStoreOf(store),
 	}
 	return &ga
 }
 
+// Checks the health of the underlying store, see HealthChecker
+func (api *GenericApi) CheckHealth(ctx context.Context) error {
+	return CheckStoreHealth(ctx, api.store)
+}
+
 // Simple wrapper function for future improvements (DRY -- this is a good place for type switches)
+// Duplicates point to the payment they duplicate, in a Link header and in the body. Payments held
+// for review aren't errors as far as the client is concerned, and are described like GetHeldPayments
+// does.
 func (api *GenericApi) handleError(w rest.ResponseWriter, r *rest.Request, err error) {
-	rest.Error(w, err.Error(), http.StatusInternalServerError)
+	var (
+		derr *DuplicateError
+		held *HeldError
+	)
+	if errors.As(err, &held) {
+		writeData(w, r, http.StatusAccepted, held.Hold, EnvelopeLinks{Self: "/holds"})
+		return
+	}
+	if errors.As(err, &derr) {
+		original := paymentPath(derr.OriginalID)
+		w.Header().Set("Link", "<"+original+`>; rel="duplicate-of"`)
+		w.WriteHeader(errorStatus(err))
+		w.WriteJson(duplicateErrorResponse{err.Error(), original})
+		return
+	}
+	rest.Error(w, err.Error(), errorStatus(err))
+}
+
+// Body of the response to a rejected duplicate
+type duplicateErrorResponse struct {
+	Error    string
+	Original string `json:"original,omitempty" description:"Path of the payment duplicated by the refused one"`
+}
+
+// Picks the HTTP status code matching an error from the store or validation
+func errorStatus(err error) int {
+	var (
+		verr ValidationError
+		serr *ScreeningError
+		held *HeldError
+		derr *DuplicateError
+	)
+
+	switch {
+	case errors.Is(err, ErrPaymentNotFound), errors.Is(err, ErrScheduleNotFound), errors.Is(err, ErrFlagNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrPaymentExists), errors.Is(err, ErrScheduleExists), errors.Is(err, ErrTxConflict), errors.As(err, &derr):
+		return http.StatusConflict
+	case errors.As(err, &verr), errors.As(err, &serr):
+		return http.StatusUnprocessableEntity
+	case errors.As(err, &held):
+		return http.StatusAccepted
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Decodes the JSON payload of a request into a payment, traced in a span of its own
+// The payment may be enveloped, see decodeData.
+func decodePayment(r *rest.Request, payment *Payment) error {
+	_, span := startSpan(r.Context(), "DecodePayment")
+	err := decodeData(r, payment)
+	endSpan(span, err)
+	return err
+}
+
+// Path of a payment resource
+func paymentPath(id string) string {
+	return "/payments/" + url.PathEscape(id)
+}
+
+// Reads the "fields" query parameter of a request, see parseFields; nil paths if there is none
+func requestFields(r *rest.Request) ([][]string, error) {
+	param, ok := r.URL.Query()["fields"]
+	if !ok {
+		return nil, nil
+	}
+	return parseFields(strings.Join(param, ","))
 }
 
 // Fetches a payment resource
+// Only the fields listed in the "fields" query parameter are returned, if it is given (see parseFields)
 func (api *GenericApi) GetPayment(w rest.ResponseWriter, r *rest.Request) {
+	fields, err := requestFields(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	id := r.PathParam("id")
-	payment, err := api.store.GetPayment(id)
+	payment, err := api.store.GetPaymentContext(r.Context(), id)
 	if err != nil {
 		api.handleError(w, r, err)
 		return
 	}
 
-	w.WriteJson(payment)
+	links := EnvelopeLinks{Self: paymentPath(id)}
+	if fields == nil {
+		writeData(w, r, http.StatusOK, payment, links)
+		return
+	}
+
+	projected, err := projectPayment(payment, fields)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, projected, links)
 }
 
 // Creates a new payment resource. NOTE: Currently requires the resource to have an ID
 func (api *GenericApi) PostPayment(w rest.ResponseWriter, r *rest.Request) {
 	payment := Payment{}
-	if err := r.DecodeJsonPayload(&payment); err != nil {
+	if err := decodePayment(r, &payment); err != nil {
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -72,13 +227,15 @@ func (api *GenericApi) PostPayment(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	err := api.store.AddPayment(payment)
+	// the decorators of the store may adjust the payment, see withWritten
+	ctx, written := withWritten(r.Context(), payment)
+	err := api.store.AddPaymentContext(ctx, payment)
 	if err != nil {
 		api.handleError(w, r, err)
 		return
 	}
 
-	w.WriteJson(&payment)
+	writeData(w, r, http.StatusOK, *written, EnvelopeLinks{Self: paymentPath(payment.ID)})
 }
 
 // Creates or updates a payment resource, requires an "id" parameter
@@ -90,16 +247,21 @@ func (api *GenericApi) PutPayment(w rest.ResponseWriter, r *rest.Request) {
 	}
 
 	payment := Payment{}
-	if err := r.DecodeJsonPayload(&payment); err != nil {
+	if err := decodePayment(r, &payment); err != nil {
 		rest.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	payment.ID = id
 
-	api.store.StorePayment(payment)
+	ctx, written := withWritten(r.Context(), payment)
+	err := api.store.StorePaymentContext(ctx, payment)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
 
-	w.WriteJson(&payment)
+	writeData(w, r, http.StatusOK, *written, EnvelopeLinks{Self: paymentPath(payment.ID)})
 }
 
 // Deletes a payment resource, requires an "id" parameter
@@ -109,7 +271,7 @@ func (api *GenericApi) DeletePayment(w rest.ResponseWriter, r *rest.Request) {
 	if id == "" {
 		rest.Error(w, "DELETE Request must include ID", http.StatusBadRequest)
 	}
-	err := api.store.DeletePayment(id)
+	err := api.store.DeletePaymentContext(r.Context(), id)
 	if err != nil {
 		api.handleError(w, r, err)
 		return
@@ -118,14 +280,200 @@ func (api *GenericApi) DeletePayment(w rest.ResponseWriter, r *rest.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// Fetches all payments, NOTE: No pagination implemented
+// Largest page of payments served at once
+const maxPageSize = 1000
+
+// Reads the page of payments selected by the "limit" and "after" query parameters
+// Without a limit (zero), all payments are listed in the order of the store. With one, payments are
+// ordered by ID and at most limit of them, with an ID greater than after, are listed.
+func pageQuery(query url.Values) (limit int, after string, err error) {
+	after = query.Get("after")
+	if query.Get("limit") == "" {
+		if after != "" {
+			return 0, "", errors.New("The after parameter requires a limit")
+		}
+		return 0, "", nil
+	}
+
+	limit, err = strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 || limit > maxPageSize {
+		return 0, "", fmt.Errorf("The limit must be a number between 1 and %d", maxPageSize)
+	}
+	return limit, after, nil
+}
+
+// Implemented by stores which can list a page of payments without listing them all
+type PageStore interface {
+	// Fetches up to limit payments with IDs greater than after, in order of their IDs
+	PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error)
+}
+
+// Fetches up to limit payments of a store with IDs greater than after, in order of their IDs, paging
+// through the store itself if it implements PageStore, and sorting the list of all its payments otherwise
+func PagePayments(ctx context.Context, store ContextStore, after string, limit int) ([]Payment, error) {
+	if ps, ok := store.(PageStore); ok {
+		return ps.PagePaymentsContext(ctx, after, limit)
+	}
+
+	payments, err := store.GetAllPaymentsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pageOf(payments, after, limit), nil
+}
+
+// Sorts payments by ID, and returns up to limit of them with IDs greater than after
+func pageOf(payments []Payment, after string, limit int) []Payment {
+	sort.Slice(payments, func(i, j int) bool { return payments[i].ID < payments[j].ID })
+	start := sort.Search(len(payments), func(i int) bool { return payments[i].ID > after })
+
+	page := payments[start:]
+	if len(page) > limit {
+		page = page[:limit]
+	}
+	return page
+}
+
+// Fetches all payments, or a page of them when the "limit" query parameter is given
+// The next page, if there is one, is linked to in the Link header of the response, with the
+// "after" parameter set to the ID of the last payment of this page (see pageQuery).
+// Responds with CSV instead of JSON when the "format" query parameter is "csv"
+// JSON responses are projected down to the "fields" query parameter, like those of GetPayment.
+// Only the payments matching the "filter" query parameter are listed, if it is given (see ParseFilter).
 func (api *GenericApi) GetAllPayments(w rest.ResponseWriter, r *rest.Request) {
-	payments, err := api.store.GetAllPayments()
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		rest.Error(w, "Unknown format "+format, http.StatusBadRequest)
+		return
+	}
+
+	fields, err := requestFields(r)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fields != nil && format == "csv" {
+		rest.Error(w, "The fields parameter is not supported with the CSV format", http.StatusBadRequest)
+		return
+	}
+
+	var filter *Filter
+	if query.Get("filter") != "" {
+		if filter, err = ParseFilter(query.Get("filter")); err != nil {
+			rest.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit, after, err := pageQuery(query)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// one more payment than the page holds tells whether there is a next page
+	var payments []Payment
+	switch {
+	case filter != nil:
+		payments, err = FindPayments(r.Context(), api.store, filter)
+		if err == nil && limit > 0 {
+			payments = pageOf(payments, after, limit+1)
+		}
+	case limit > 0:
+		payments, err = PagePayments(r.Context(), api.store, after, limit+1)
+	default:
+		payments, err = api.store.GetAllPaymentsContext(r.Context())
+	}
 
 	if err != nil {
 		api.handleError(w, r, err)
 		return
 	}
 
-	w.WriteJson(&payments)
+	links := EnvelopeLinks{Self: r.URL.RequestURI()}
+	if limit > 0 && len(payments) > limit {
+		payments = payments[:limit]
+		query.Set("after", payments[limit-1].ID)
+		link := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		links.Next = link.String()
+		w.Header().Set("Link", "<"+links.Next+`>; rel="next"`)
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		// The status has been sent by now, so all we can do about errors is log them
+		if err := WritePaymentsCSV(w.(http.ResponseWriter), payments); err != nil {
+			slog.ErrorContext(r.Context(), "writing payments as CSV failed", "error", err)
+		}
+		return
+	}
+
+	if fields == nil {
+		writeData(w, r, http.StatusOK, payments, links)
+		return
+	}
+
+	projected, err := projectPayments(payments, fields)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, projected, links)
+}
+
+// A CSV row that could not be imported
+type ImportRowError struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// The outcome of a CSV import
+type ImportResult struct {
+	Imported int              `json:"imported"`
+	Errors   []ImportRowError `json:"errors"`
+	// Why the import stopped before the end of the file, if it did, such as the upload breaking off
+	Error string `json:"Error,omitempty"`
+}
+
+// Creates payment resources from an uploaded CSV file, see csv.go for the column layout.
+// Each row is validated and added on its own; failing rows are reported without aborting the rest.
+// If the file can't be read to the end, the rows imported until then are reported along with the
+// error, with the status of the error.
+func (api *GenericApi) ImportPayments(w rest.ResponseWriter, r *rest.Request) {
+	reader, err := NewPaymentCSVReader(r.Body)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := ImportResult{Errors: []ImportRowError{}}
+	for {
+		payment, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if rowErr, ok := err.(*CSVRowError); ok {
+			result.Errors = append(result.Errors, ImportRowError{Line: rowErr.Line, Error: rowErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			writeData(w, r, errorStatus(err), result, EnvelopeLinks{Self: r.URL.RequestURI()})
+			return
+		}
+
+		if err = ValidatePayment(payment); err == nil {
+			err = api.store.AddPaymentContext(r.Context(), payment)
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, ImportRowError{Line: reader.Line(), ID: payment.ID, Error: err.Error()})
+			continue
+		}
+		result.Imported++
+	}
+
+	writeData(w, r, http.StatusOK, result, EnvelopeLinks{Self: r.URL.RequestURI()})
 }
@@ -0,0 +1,396 @@
+package f3api
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+)
+
+var (
+	// Returned when creating a schedule under the ID of another
+	ErrScheduleExists = errors.New("Cannot add an already existing schedule")
+	// Returned when fetching or deleting a schedule which doesn't exist
+	ErrScheduleNotFound = errors.New("schedule does not exist")
+)
+
+// Payments made on a recurring basis out of a template, see Scheduler
+type Schedule struct {
+	ID string `json:"id"`
+	// Template of the payments; each of them gets an ID of its own, see ScheduledPaymentID, and the
+	// day it is made on as processing date
+	Payment Payment `json:"payment"`
+	// Day of the first payment
+	Start Date `json:"start"`
+	// When the payments recur, see ParseRecurrence
+	Rule string `json:"rrule"`
+	// Day of the next payment, if there is one; set by the scheduler
+	Next *Date `json:"next,omitempty"`
+	// The payments made so far, oldest first; set by the scheduler
+	History []ScheduledPayment `json:"history"`
+}
+
+// A payment made, or attempted, by a Scheduler
+type ScheduledPayment struct {
+	ScheduleID string `json:"schedule_id"`
+	// Day the payment was due
+	Date      Date      `json:"date"`
+	PaymentID string    `json:"payment_id"`
+	Time      time.Time `json:"time"`
+	// Why the payment couldn't be made, if it couldn't; such payments aren't attempted again
+	Error string `json:"error,omitempty"`
+}
+
+// ID of the payment of a schedule due on a day
+// Payments are made under this ID only, so that no payment is made twice.
+func ScheduledPaymentID(scheduleID string, day time.Time) string {
+	return scheduleID + "-" + day.Format("20060102")
+}
+
+// Key of the day a scheduled payment was due in a context, see withDueDate
+type dueDateKey struct{}
+
+// Returns a copy of ctx in which a scheduled payment made with it is the one due on day
+// Payments made late get today's processing date, so stores telling payments apart by their
+// processing date, such as DetectDuplicates, go by the due date instead.
+func withDueDate(ctx context.Context, day time.Time) context.Context {
+	return context.WithValue(ctx, dueDateKey{}, day)
+}
+
+// Returns the day the scheduled payment made with the context was due, see withDueDate
+func dueDateFromContext(ctx context.Context) (time.Time, bool) {
+	day, ok := ctx.Value(dueDateKey{}).(time.Time)
+	return day, ok
+}
+
+// A schedule of a Scheduler, with its parsed rule
+type scheduleState struct {
+	Schedule
+	rule Recurrence
+	// position of the next occurrence of the rule
+	next int
+}
+
+// The schedule as served, with a copy of its history
+func (s *scheduleState) view() Schedule {
+	sch := s.Schedule
+	sch.History = append([]ScheduledPayment{}, s.History...)
+	if day, ok := s.rule.Occurrence(s.Start.Time, s.next); ok {
+		sch.Next = &Date{day}
+	}
+	return sch
+}
+
+// Makes the payments of schedules in a store as they fall due
+type Scheduler struct {
+	store ContextStore
+	now   func() time.Time
+
+	// serializes runs
+	run sync.Mutex
+
+	mu        sync.Mutex
+	schedules map[string]*scheduleState
+}
+
+// Creates a scheduler making the payments of its schedules in store, telling the time by clock
+// (time.Now if nil)
+//
+// Schedules are kept in memory only. Payments are made by RunDue, which Run calls periodically.
+func NewScheduler(store ApiStore, clock func() time.Time) *Scheduler {
+	if clock == nil {
+		clock = time.Now
+	}
+	s := Scheduler{
+		store:     ContextStoreOf(store),
+		now:       clock,
+		schedules: make(map[string]*scheduleState),
+	}
+	return &s
+}
+
+// Adds a schedule, whose payments are made from its start on
+// Returns a ValidationError if the schedule or its template is invalid, or starts before today.
+func (s *Scheduler) AddSchedule(ctx context.Context, sch Schedule) (Schedule, error) {
+	if err := ctx.Err(); err != nil {
+		return sch, err
+	}
+
+	switch {
+	case sch.ID == "":
+		return sch, ValidationError{"id", "must not be empty"}
+	case sch.Start.IsZero():
+		return sch, ValidationError{"start", "must be set"}
+	case startOfDay(sch.Start.Time).Before(startOfDay(s.now())):
+		return sch, ValidationError{"start", "must not be in the past"}
+	}
+	rule, err := ParseRecurrence(sch.Rule)
+	if err != nil {
+		return sch, ValidationError{"rrule", err.Error()}
+	}
+	template := sch.Payment
+	template.ID = sch.ID
+	if err := ValidatePayment(template); err != nil {
+		if verr, ok := err.(ValidationError); ok {
+			verr.Field = "payment." + verr.Field
+			err = verr
+		}
+		return sch, err
+	}
+
+	state := scheduleState{Schedule: sch, rule: rule}
+	state.Start = Date{startOfDay(sch.Start.Time)}
+	state.Next, state.History = nil, []ScheduledPayment{}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[sch.ID]; ok {
+		return sch, ErrScheduleExists
+	}
+	s.schedules[sch.ID] = &state
+	return state.view(), nil
+}
+
+// Fetches a schedule, with the payments made so far
+func (s *Scheduler) GetSchedule(ctx context.Context, id string) (Schedule, error) {
+	if err := ctx.Err(); err != nil {
+		return Schedule{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, ErrScheduleNotFound
+	}
+	return state.view(), nil
+}
+
+// Lists the schedules by ID
+func (s *Scheduler) GetAllSchedules(ctx context.Context) ([]Schedule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, state := range s.schedules {
+		schedules = append(schedules, state.view())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+	return schedules, nil
+}
+
+// Deletes a schedule, so that no more payments are made for it
+// The payments already made stay in the store.
+func (s *Scheduler) DeleteSchedule(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[id]; !ok {
+		return ErrScheduleNotFound
+	}
+	delete(s.schedules, id)
+	return nil
+}
+
+// The payment of a schedule due next, if it is due by today, along with the position of its
+// occurrence
+func (s *Scheduler) due(id string, today time.Time) (Payment, ScheduledPayment, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.schedules[id]
+	if !ok {
+		return Payment{}, ScheduledPayment{}, 0, false
+	}
+	day, ok := state.rule.Occurrence(state.Start.Time, state.next)
+	if !ok || day.After(today) {
+		return Payment{}, ScheduledPayment{}, 0, false
+	}
+
+	p := state.Payment
+	p.ID = ScheduledPaymentID(id, day)
+	// payments missed while the scheduler wasn't running are made late rather than backdated
+	p.Attributes.ProcessingDate = Date{day}
+	if day.Before(today) {
+		p.Attributes.ProcessingDate = Date{today}
+	}
+	return p, ScheduledPayment{ScheduleID: id, Date: Date{day}, PaymentID: p.ID}, state.next, true
+}
+
+// Records the outcome of the payment of an occurrence of a schedule, unless the schedule is gone
+func (s *Scheduler) record(made ScheduledPayment, occurrence int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if state, ok := s.schedules[made.ScheduleID]; ok && state.next == occurrence {
+		state.History = append(state.History, made)
+		state.next++
+	}
+}
+
+// Makes the payments due by today, of every schedule, and returns them
+//
+// Each payment is made once: payments the store refuses, or holds for review, are recorded with
+// their error and not attempted again, and payments which turn out to exist already are recorded as
+// made. Other errors, such as the store being unavailable, stop the run and are returned; the
+// payment is attempted again on the next run.
+func (s *Scheduler) RunDue(ctx context.Context) ([]ScheduledPayment, error) {
+	s.run.Lock()
+	defer s.run.Unlock()
+
+	now := s.now()
+	today := startOfDay(now)
+
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.schedules))
+	for id := range s.schedules {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+
+	made := []ScheduledPayment{}
+	for _, id := range ids {
+		for {
+			p, payment, occurrence, ok := s.due(id, today)
+			if !ok {
+				break
+			}
+
+			err := s.store.AddPaymentContext(withDueDate(ctx, payment.Date.Time), p)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrPaymentExists):
+				// made by an earlier run, which failed to record it
+			case errorStatus(err) >= http.StatusInternalServerError:
+				return made, err
+			default:
+				payment.Error = err.Error()
+				slog.WarnContext(ctx, "scheduled payment not made", "schedule_id", id, "payment_id", p.ID, "error", err)
+			}
+
+			payment.Time = now
+			s.record(payment, occurrence)
+			made = append(made, payment)
+		}
+	}
+	return made, nil
+}
+
+// Calls RunDue every interval, and once right away, until the context is done
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.RunDue(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "scheduled payments failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Path of a schedule resource
+func schedulePath(id string) string {
+	return "/schedules/" + url.PathEscape(id)
+}
+
+// Serves the schedules of a scheduler under /schedules
+// Without a scheduler, /schedules responds with 404.
+func (api *GenericApi) ServeSchedules(scheduler *Scheduler) {
+	api.scheduler = scheduler
+}
+
+// The scheduler of the API, if it has one
+func (api *GenericApi) schedules(w rest.ResponseWriter) (*Scheduler, bool) {
+	if api.scheduler == nil {
+		rest.Error(w, "Payments are not scheduled", http.StatusNotFound)
+	}
+	return api.scheduler, api.scheduler != nil
+}
+
+// Lists the schedules by ID
+func (api *GenericApi) GetAllSchedules(w rest.ResponseWriter, r *rest.Request) {
+	scheduler, ok := api.schedules(w)
+	if !ok {
+		return
+	}
+
+	schedules, err := scheduler.GetAllSchedules(r.Context())
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, schedules, EnvelopeLinks{Self: "/schedules"})
+}
+
+// Creates a schedule, which must have an ID
+func (api *GenericApi) PostSchedule(w rest.ResponseWriter, r *rest.Request) {
+	scheduler, ok := api.schedules(w)
+	if !ok {
+		return
+	}
+
+	sch := Schedule{}
+	if err := decodeData(r, &sch); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sch, err := scheduler.AddSchedule(r.Context(), sch)
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusCreated, sch, EnvelopeLinks{Self: schedulePath(sch.ID)})
+}
+
+// Fetches a schedule with the payments made so far, requires an "id" parameter
+func (api *GenericApi) GetSchedule(w rest.ResponseWriter, r *rest.Request) {
+	scheduler, ok := api.schedules(w)
+	if !ok {
+		return
+	}
+
+	sch, err := scheduler.GetSchedule(r.Context(), r.PathParam("id"))
+	if err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusOK, sch, EnvelopeLinks{Self: schedulePath(sch.ID)})
+}
+
+// Deletes a schedule, requires an "id" parameter
+func (api *GenericApi) DeleteSchedule(w rest.ResponseWriter, r *rest.Request) {
+	scheduler, ok := api.schedules(w)
+	if !ok {
+		return
+	}
+
+	if err := scheduler.DeleteSchedule(r.Context(), r.PathParam("id")); err != nil {
+		api.handleError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,235 @@
+package f3api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests parsing recurrence rules, and the days they recur on
+func TestRecurrence(t *testing.T) {
+	start := mustDate(t, "2027-01-31")
+	for _, c := range []struct {
+		rule     string
+		expected []string
+	}{
+		{"FREQ=DAILY;COUNT=3", []string{"2027-01-31", "2027-02-01", "2027-02-02"}},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2;UNTIL=20270314", []string{"2027-01-31", "2027-02-14", "2027-02-28", "2027-03-14"}},
+		{"FREQ=MONTHLY;COUNT=4", []string{"2027-01-31", "2027-02-28", "2027-03-31", "2027-04-30"}},
+		{"FREQ=MONTHLY;INTERVAL=12;UNTIL=20290131T000000Z", []string{"2027-01-31", "2028-01-31", "2029-01-31"}},
+	} {
+		r, err := ParseRecurrence(c.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", c.rule, err)
+		}
+
+		var days []string
+		for n := 0; ; n++ {
+			day, ok := r.Occurrence(start, n)
+			if !ok {
+				break
+			}
+			days = append(days, day.Format(timeFmt))
+		}
+		if strings.Join(days, ",") != strings.Join(c.expected, ",") {
+			t.Fatalf("%s: expected %v, got %v", c.rule, c.expected, days)
+		}
+		if again, err := ParseRecurrence(r.String()); err != nil || again != r {
+			t.Fatalf("%s: formatted as %s, parsed back as %+v (%v)", c.rule, r, again, err)
+		}
+	}
+
+	for _, bad := range []string{"", "COUNT=3", "FREQ=YEARLY", "FREQ=DAILY;COUNT=0", "FREQ=DAILY;COUNT=2;UNTIL=20270101", "FREQ=DAILY;FREQ=WEEKLY", "FREQ=DAILY;BYDAY=MO", "FREQ"} {
+		if _, err := ParseRecurrence(bad); err == nil {
+			t.Fatalf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+// Tests making the payments of a schedule as they fall due, once each
+func TestScheduler(t *testing.T) {
+	store := NewInMemStore()
+	now := mustDate(t, "2027-01-29").Add(9 * time.Hour)
+	scheduler := NewScheduler(store, func() time.Time { return now })
+	ctx := context.Background()
+
+	sch := Schedule{ID: "rent", Payment: defaultPayment(), Start: Date{mustDate(t, "2027-01-31")}, Rule: "FREQ=MONTHLY;COUNT=3"}
+	if _, err := scheduler.AddSchedule(ctx, sch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scheduler.AddSchedule(ctx, sch); !errors.Is(err, ErrScheduleExists) {
+		t.Fatalf("Expected the schedule to exist, got %v", err)
+	}
+
+	if made, err := scheduler.RunDue(ctx); err != nil || len(made) != 0 {
+		t.Fatalf("Expected nothing due yet, got %v (%v)", made, err)
+	}
+
+	// the scheduler was down in February; the payment made by an earlier run isn't made again
+	p := defaultPayment()
+	p.ID = ScheduledPaymentID("rent", mustDate(t, "2027-01-31"))
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+	now = mustDate(t, "2027-03-02")
+	made, err := scheduler.RunDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(made) != 2 || made[0].PaymentID != "rent-20270131" || made[1].PaymentID != "rent-20270228" || made[1].Error != "" {
+		t.Fatalf("Unexpected payments %+v", made)
+	}
+
+	late, err := store.GetPayment("rent-20270228")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if date := late.Attributes.ProcessingDate.Format(timeFmt); date != "2027-03-02" {
+		t.Fatalf("Expected the missed payment to be processed today, got %s", date)
+	}
+
+	if made, _ := scheduler.RunDue(ctx); len(made) != 0 {
+		t.Fatalf("Expected no payment to be made twice, got %+v", made)
+	}
+
+	// the last payment is held for review, and not attempted again
+	now = mustDate(t, "2027-04-30")
+	list := NewWatchList([]WatchListEntry{{Name: "Wilfred Jeremiah Owens"}})
+	scheduler.store = ScreenStore(store, NewListScreener(list))
+	made, err = scheduler.RunDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(made) != 1 || made[0].PaymentID != "rent-20270331" || !strings.Contains(made[0].Error, "held for review") {
+		t.Fatalf("Expected the payment to be held, got %+v", made)
+	}
+
+	sch, err = scheduler.GetSchedule(ctx, "rent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sch.History) != 3 || sch.Next != nil {
+		t.Fatalf("Expected the schedule to be over, got %+v", sch)
+	}
+	if made, _ := scheduler.RunDue(ctx); len(made) != 0 {
+		t.Fatalf("Expected nothing more to be made, got %+v", made)
+	}
+
+	// payments of deleted schedules aren't made
+	sch = Schedule{ID: "daily", Payment: defaultPayment(), Start: Date{now}, Rule: "FREQ=DAILY"}
+	if _, err := scheduler.AddSchedule(ctx, sch); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.DeleteSchedule(ctx, "daily"); err != nil {
+		t.Fatal(err)
+	}
+	if made, _ := scheduler.RunDue(ctx); len(made) != 0 {
+		t.Fatalf("Expected nothing to be made, got %+v", made)
+	}
+}
+
+// Tests that the payments missed while the scheduler was down are all made, although they are made
+// on the same day out of the same template
+func TestSchedulerCatchUp(t *testing.T) {
+	store := DetectDuplicates(NewInMemStore(), DuplicateConfig{})
+	now := mustDate(t, "2027-01-29")
+	scheduler := NewScheduler(store, func() time.Time { return now })
+	ctx := context.Background()
+
+	sch := Schedule{ID: "supplier", Payment: defaultPayment(), Start: Date{now}, Rule: "FREQ=DAILY;COUNT=3"}
+	if _, err := scheduler.AddSchedule(ctx, sch); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.AddDate(0, 0, 2)
+	made, err := scheduler.RunDue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(made) != 3 {
+		t.Fatalf("Expected 3 payments, got %+v", made)
+	}
+	for _, payment := range made {
+		if payment.Error != "" {
+			t.Fatalf("Expected every missed payment to be made, got %+v", made)
+		}
+	}
+
+	// a payment duplicating one of them is still detected
+	dup := defaultPayment()
+	dup.ID = "dup"
+	dup.Attributes.ProcessingDate = Date{mustDate(t, "2027-01-30")}
+	var derr *DuplicateError
+	if err := store.AddPayment(dup); !errors.As(err, &derr) || derr.OriginalID != "supplier-20270130" {
+		t.Fatalf("Expected the duplicate to be rejected, got %v", err)
+	}
+}
+
+// Tests that only valid schedules are added
+func TestSchedulerValidation(t *testing.T) {
+	now := mustDate(t, "2027-01-29")
+	scheduler := NewScheduler(NewInMemStore(), func() time.Time { return now })
+
+	valid := Schedule{ID: "s", Payment: defaultPayment(), Start: Date{now}, Rule: "FREQ=WEEKLY"}
+	for field, change := range map[string]func(*Schedule){
+		"id":                          func(s *Schedule) { s.ID = "" },
+		"start":                       func(s *Schedule) { s.Start = Date{now.AddDate(0, 0, -1)} },
+		"rrule":                       func(s *Schedule) { s.Rule = "FREQ=HOURLY" },
+		"payment.attributes.currency": func(s *Schedule) { s.Payment.Attributes.Currency = "pounds" },
+	} {
+		sch := valid
+		change(&sch)
+		var verr ValidationError
+		if _, err := scheduler.AddSchedule(context.Background(), sch); !errors.As(err, &verr) || verr.Field != field {
+			t.Fatalf("Expected %s to be refused, got %v", field, err)
+		}
+	}
+}
+
+// Tests creating, fetching and deleting schedules through the API
+func TestScheduleApi(t *testing.T) {
+	store := NewInMemStore()
+	api := NewGenericApi(store)
+	responseWriter := &testResponseWriter{}
+	api.GetAllSchedules(responseWriter, createRestRequest("GET", "/schedules", strings.NewReader(""), nil))
+	if responseWriter.status != http.StatusNotFound {
+		t.Fatalf("Expected status %d without a scheduler, got %d", http.StatusNotFound, responseWriter.status)
+	}
+
+	now := time.Now().UTC()
+	api.ServeSchedules(NewScheduler(store, func() time.Time { return now }))
+
+	body, _ := json.Marshal(Schedule{ID: "rent", Payment: defaultPayment(), Start: Date{now}, Rule: "FREQ=MONTHLY"})
+	responseWriter = &testResponseWriter{}
+	api.PostSchedule(responseWriter, createRestRequest("POST", "/schedules", strings.NewReader(string(body)), nil))
+	if responseWriter.status != http.StatusCreated {
+		t.Fatalf("Expected status %d, got %d", http.StatusCreated, responseWriter.status)
+	}
+	responseWriter = &testResponseWriter{}
+	api.PostSchedule(responseWriter, createRestRequest("POST", "/schedules", strings.NewReader(string(body)), nil))
+	if responseWriter.status != http.StatusConflict {
+		t.Fatalf("Expected status %d, got %d", http.StatusConflict, responseWriter.status)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.GetSchedule(responseWriter, createRestRequest("GET", "/schedules/rent", strings.NewReader(""), map[string]string{"id": "rent"}))
+	var sch Schedule
+	if err := json.Unmarshal(responseWriter.Read(), &sch); err != nil {
+		t.Fatal(err)
+	}
+	if sch.Next == nil || sch.Next.Format(timeFmt) != now.Format(timeFmt) || sch.Payment.Attributes.Amount != defaultPayment().Attributes.Amount {
+		t.Fatalf("Unexpected schedule %+v", sch)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.DeleteSchedule(responseWriter, createRestRequest("DELETE", "/schedules/rent", strings.NewReader(""), map[string]string{"id": "rent"}))
+	responseWriter = &testResponseWriter{}
+	api.GetSchedule(responseWriter, createRestRequest("GET", "/schedules/rent", strings.NewReader(""), map[string]string{"id": "rent"}))
+	if responseWriter.status != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, responseWriter.status)
+	}
+}
@@ -0,0 +1,318 @@
+package f3api
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Outcome of screening a payment
+type ScreeningOutcome string
+
+const (
+	// Nothing matched, the payment may be accepted
+	ScreeningClear ScreeningOutcome = "clear"
+	// A party may be listed, the payment must be held until reviewed
+	ScreeningHold ScreeningOutcome = "hold"
+	// A party is listed, the payment must be refused
+	ScreeningReject ScreeningOutcome = "reject"
+)
+
+// A field of a party of a payment resembling an entry of a watch list
+type ScreeningMatch struct {
+	// "debtor_party" or "beneficiary_party"
+	Party string `json:"party"`
+	// "name" or "address"
+	Field string `json:"field"`
+	Value string `json:"value"`
+	// The listed name or address the value resembles
+	Entry string  `json:"entry"`
+	Score float64 `json:"score"`
+}
+
+// What screening a payment found
+type ScreeningResult struct {
+	Outcome ScreeningOutcome `json:"outcome"`
+	Matches []ScreeningMatch `json:"matches"`
+}
+
+// Screens the parties of payments against sanctions and watch lists before they are accepted
+// Implemented by ListScreener, and meant to be implemented for screening vendors as well.
+type Screener interface {
+	Screen(ctx context.Context, p Payment) (ScreeningResult, error)
+}
+
+// An entry of a watch list: a name, and optionally an address
+type WatchListEntry struct {
+	Name    string
+	Address string
+}
+
+// A list of the parties no payment should be made from or to without review
+type WatchList struct {
+	entries []watchListEntry
+}
+
+// An entry of a watch list, tokenized for matching
+type watchListEntry struct {
+	WatchListEntry
+	name, address []string
+}
+
+// Creates a watch list of the given entries
+func NewWatchList(entries []WatchListEntry) *WatchList {
+	list := WatchList{}
+	for _, e := range entries {
+		list.entries = append(list.entries, watchListEntry{e, normalizeTokens(e.Name), normalizeTokens(e.Address)})
+	}
+	return &list
+}
+
+// Reads a watch list from a CSV file without header, with the name in the first column and the
+// address, if known, in the second. Lines starting with "#" are comments.
+func ReadWatchList(r io.Reader) (*WatchList, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var entries []WatchListEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		switch {
+		case len(record) > 2:
+			return nil, fmt.Errorf("line %d: expected a name and an address, got %d fields", line, len(record))
+		case strings.TrimSpace(record[0]) == "":
+			return nil, fmt.Errorf("line %d: empty name", line)
+		}
+
+		entry := WatchListEntry{Name: record[0]}
+		if len(record) == 2 {
+			entry.Address = record[1]
+		}
+		entries = append(entries, entry)
+	}
+	return NewWatchList(entries), nil
+}
+
+// Number of entries of the list
+func (l *WatchList) Len() int {
+	return len(l.entries)
+}
+
+// Default score from which ListScreener holds payments
+const defaultHoldThreshold = 0.9
+
+// Screens payments against a watch list, fuzzily matching the names and addresses of their parties
+//
+// Names and addresses are normalized (case, accents, punctuation) and split into words, and two of
+// them score the average similarity of each word of either to the closest word of the other, by the
+// Jaro-Winkler similarity. Scores range from 0 (nothing in common) to 1 (the same words).
+type ListScreener struct {
+	List *WatchList
+	// Payments are held from this score on; 0.9 if zero
+	HoldThreshold float64
+	// Payments are refused from this score on; never if zero
+	RejectThreshold float64
+}
+
+// Creates a screener holding the payments of parties resembling an entry of the list
+func NewListScreener(list *WatchList) *ListScreener {
+	s := ListScreener{List: list}
+	return &s
+}
+
+// Screens the names and addresses of the debtor and beneficiary parties of a payment
+func (s *ListScreener) Screen(ctx context.Context, p Payment) (ScreeningResult, error) {
+	if err := ctx.Err(); err != nil {
+		return ScreeningResult{}, err
+	}
+
+	hold := s.HoldThreshold
+	if hold <= 0 {
+		hold = defaultHoldThreshold
+	}
+
+	result := ScreeningResult{Outcome: ScreeningClear}
+	parties := []struct {
+		name  string
+		party Party
+	}{
+		{"debtor_party", p.Attributes.DebtorParty},
+		{"beneficiary_party", p.Attributes.BeneficiaryParty.Party},
+	}
+
+	for _, party := range parties {
+		name, address := normalizeTokens(party.party.Name), normalizeTokens(party.party.Address)
+
+		for _, e := range s.List.entries {
+			for _, field := range []struct {
+				name         string
+				value        string
+				tokens, list []string
+				entry        string
+			}{
+				{"name", party.party.Name, name, e.name, e.Name},
+				{"address", party.party.Address, address, e.address, e.Address},
+			} {
+				score := tokenSimilarity(field.tokens, field.list)
+				if score < hold {
+					continue
+				}
+
+				result.Matches = append(result.Matches, ScreeningMatch{party.name, field.name, field.value, field.entry, score})
+				if s.RejectThreshold > 0 && score >= s.RejectThreshold {
+					result.Outcome = ScreeningReject
+				} else if result.Outcome == ScreeningClear {
+					result.Outcome = ScreeningHold
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Splits a name or address into lower case words of letters and digits, without accents
+func normalizeTokens(s string) []string {
+	return strings.FieldsFunc(strings.Map(foldRune, s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Accented latin letters, and the letters they fold to
+var foldedRunes = map[rune]rune{}
+
+func init() {
+	for folded, accented := range map[rune]string{
+		'a': "àáâãäåāăą", 'c': "çćĉċč", 'd': "ďđ", 'e': "èéêëēĕėęě", 'g': "ĝğġģ", 'h': "ĥħ",
+		'i': "ìíîïĩīĭįı", 'j': "ĵ", 'k': "ķ", 'l': "ĺļľŀł", 'n': "ñńņňŉ", 'o': "òóôõöøōŏő",
+		'r': "ŕŗř", 's': "śŝşšß", 't': "ţťŧ", 'u': "ùúûüũūŭůűų", 'w': "ŵ", 'y': "ýÿŷ", 'z': "źżž",
+	} {
+		for _, r := range accented {
+			foldedRunes[r] = folded
+		}
+	}
+}
+
+// Lower cases a rune and folds its accent away
+func foldRune(r rune) rune {
+	r = unicode.ToLower(r)
+	if folded, ok := foldedRunes[r]; ok {
+		return folded
+	}
+	return r
+}
+
+// The average similarity of each word of either list to the closest word of the other; 0 if either
+// is empty
+func tokenSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	closest := func(word string, words []string) float64 {
+		best := 0.0
+		for _, w := range words {
+			best = max(best, jaroWinkler(word, w))
+		}
+		return best
+	}
+
+	total := 0.0
+	for _, w := range a {
+		total += closest(w, b)
+	}
+	for _, w := range b {
+		total += closest(w, a)
+	}
+	return total / float64(len(a)+len(b))
+}
+
+// The Jaro-Winkler similarity of two strings, from 0 (nothing in common) to 1 (equal)
+// Common prefixes of up to 4 characters weigh in with the usual scaling factor of 0.1.
+func jaroWinkler(a, b string) float64 {
+	s, t := []rune(a), []rune(b)
+	if len(s) == 0 && len(t) == 0 {
+		return 1
+	}
+	if len(s) == 0 || len(t) == 0 {
+		return 0
+	}
+
+	// characters match if equal and not farther apart than this
+	window := max(max(len(s), len(t))/2-1, 0)
+	sMatched := make([]bool, len(s))
+	tMatched := make([]bool, len(t))
+
+	matches := 0
+	for i := range s {
+		for j := max(0, i-window); j < min(len(t), i+window+1); j++ {
+			if !tMatched[j] && s[i] == t[j] {
+				sMatched[i], tMatched[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+
+	// matched characters out of order, counted twice
+	transpositions, j := 0, 0
+	for i := range s {
+		if !sMatched[i] {
+			continue
+		}
+		for !tMatched[j] {
+			j++
+		}
+		if s[i] != t[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	m := float64(matches)
+	jaro := (m/float64(len(s)) + m/float64(len(t)) + (m-float64(transpositions/2))/m) / 3
+
+	prefix := 0
+	for prefix < min(4, len(s), len(t)) && s[prefix] == t[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// Returned when a payment is refused by screening, or would be held within a transaction
+type ScreeningError struct {
+	ID     string
+	Result ScreeningResult
+}
+
+func (e *ScreeningError) Error() string {
+	if e.Result.Outcome == ScreeningHold {
+		return fmt.Sprintf("Payment %v must be held for review, which can't be done within a transaction", e.ID)
+	}
+	return fmt.Sprintf("Payment %v was refused by screening", e.ID)
+}
+
+// Returned when a payment is held for review by screening, rather than written
+type HeldError struct {
+	Hold HeldPayment
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("Payment %v is held for review", e.Hold.Payment.ID)
+}
@@ -0,0 +1,145 @@
+package f3api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Tests the Jaro-Winkler similarity against well known values
+func TestJaroWinkler(t *testing.T) {
+	for _, c := range []struct {
+		a, b     string
+		expected float64
+	}{
+		{"martha", "marhta", 0.961},
+		{"dwayne", "duane", 0.84},
+		{"dixon", "dicksonx", 0.813},
+		{"abc", "abc", 1},
+		{"abc", "xyz", 0},
+		{"", "", 1},
+		{"a", "", 0},
+	} {
+		if score := jaroWinkler(c.a, c.b); math.Abs(score-c.expected) > 0.001 {
+			t.Fatalf("%s ~ %s: expected %.3f, got %.3f", c.a, c.b, c.expected, score)
+		}
+	}
+}
+
+// Tests matching names and addresses regardless of case, accents, punctuation and word order
+func TestListScreener(t *testing.T) {
+	list, err := ReadWatchList(strings.NewReader(`# name, address
+"Owens, Wilfred Jérémiah"
+Someone Else, "1 The Beneficiary, Localtown SE2"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", list.Len())
+	}
+
+	screener := NewListScreener(list)
+	result, err := screener.Screen(context.Background(), defaultPayment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Outcome != ScreeningHold || len(result.Matches) != 2 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	for i, field := range []string{"name", "address"} {
+		if m := result.Matches[i]; m.Party != "beneficiary_party" || m.Field != field || m.Score < 0.99 {
+			t.Fatalf("Unexpected match %+v", m)
+		}
+	}
+
+	screener.RejectThreshold = 0.99
+	if result, _ := screener.Screen(context.Background(), defaultPayment()); result.Outcome != ScreeningReject {
+		t.Fatalf("Expected the payment to be refused, got %+v", result)
+	}
+
+	// close enough, but not that close
+	p := defaultPayment()
+	p.Attributes.BeneficiaryParty.Name = "Wilfred Jeremiah Owen"
+	p.Attributes.BeneficiaryParty.Address = ""
+	if result, _ := screener.Screen(context.Background(), p); result.Outcome != ScreeningHold {
+		t.Fatalf("Expected a misspelt name to be held, got %+v", result)
+	}
+	p.Attributes.BeneficiaryParty.Name = "Winifred Oakes"
+	if result, _ := screener.Screen(context.Background(), p); result.Outcome != ScreeningClear {
+		t.Fatalf("Expected a different name to be clear, got %+v", result)
+	}
+
+	if _, err := ReadWatchList(strings.NewReader("a,b,c\n")); err == nil {
+		t.Fatal("Expected too many fields to be refused")
+	}
+}
+
+// Tests holding payments, and releasing or rejecting them through the API
+func TestScreenStore(t *testing.T) {
+	list := NewWatchList([]WatchListEntry{{Name: "Wilfred Jeremiah Owens"}})
+	store := ScreenStore(NewInMemStore(), NewListScreener(list))
+	api := NewGenericApi(store)
+
+	post := func(p Payment) *testResponseWriter {
+		body, _ := json.Marshal(p)
+		responseWriter := &testResponseWriter{}
+		api.PostPayment(responseWriter, createRestRequest("POST", "/payments", strings.NewReader(string(body)), nil))
+		return responseWriter
+	}
+
+	p := defaultPayment()
+	if responseWriter := post(p); responseWriter.status != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, responseWriter.status)
+	}
+	if _, err := store.GetPayment(p.ID); !errors.Is(err, ErrPaymentNotFound) {
+		t.Fatalf("Expected the held payment not to be stored, got %v", err)
+	}
+
+	rejected := p
+	rejected.ID = "rejected"
+	post(rejected)
+
+	responseWriter := &testResponseWriter{}
+	api.GetHeldPayments(responseWriter, createRestRequest("GET", "/holds", strings.NewReader(""), nil))
+	var held []HeldPayment
+	if err := json.Unmarshal(responseWriter.Read(), &held); err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 2 || held[0].Payment.ID != p.ID || held[0].Operation != "add" || held[0].Result.Matches[0].Entry != "Wilfred Jeremiah Owens" {
+		t.Fatalf("Unexpected held payments %+v", held)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.ReleaseHeldPayment(responseWriter, createRestRequest("POST", "/holds/"+p.ID+"/release", strings.NewReader(""), map[string]string{"id": p.ID}))
+	if _, err := store.GetPayment(p.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	responseWriter = &testResponseWriter{}
+	api.RejectHeldPayment(responseWriter, createRestRequest("POST", "/holds/rejected/reject", strings.NewReader(""), map[string]string{"id": "rejected"}))
+	if _, err := store.GetPayment("rejected"); !errors.Is(err, ErrPaymentNotFound) {
+		t.Fatalf("Expected the rejected payment not to be stored, got %v", err)
+	}
+
+	for _, id := range []string{p.ID, "rejected"} {
+		responseWriter = &testResponseWriter{}
+		api.RejectHeldPayment(responseWriter, createRestRequest("POST", "/holds/"+id+"/reject", strings.NewReader(""), map[string]string{"id": id}))
+		if responseWriter.status != http.StatusNotFound {
+			t.Fatalf("Expected %s not to be held any more, got status %d", id, responseWriter.status)
+		}
+	}
+
+	// transactions can't hold payments
+	var serr *ScreeningError
+	if err := ApplyBatch(store, []BatchOp{{BatchStore, p}}); !errors.As(err, &serr) {
+		t.Fatalf("Expected a screening error, got %v", err)
+	}
+	if held, _ := store.HeldPayments(context.Background()); len(held) != 0 {
+		t.Fatalf("Expected nothing held, got %+v", held)
+	}
+}
@@ -1,27 +1,256 @@
 package f3api
 
 import (
+	"context"
 	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Minimal example as seen in the go-json-rest documentation;
-// Sets up a basic API with the routes as specified in the Coding Exercise document
-func RunServer(impl RestApi) {
-	api := rest.NewApi()
-	api.Use(rest.DefaultDevStack...)
-	router, err := rest.MakeRouter(
+// Request body media types understood by the api
+var acceptedMediaTypes = []string{"application/json", jsonAPIMediaType, "text/csv", ndjsonMediaType}
+
+// Replacement for rest.ContentTypeCheckerMiddleware, which only allows JSON request bodies.
+// Returns a StatusUnsupportedMediaType (415) error if the Content-Type isn't one of MediaTypes,
+// or if its charset isn't UTF-8.
+type MediaTypeCheckerMiddleware struct {
+	MediaTypes []string
+}
+
+// Makes MediaTypeCheckerMiddleware implement the rest.Middleware interface
+func (mw *MediaTypeCheckerMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		mediatype, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		charset, ok := params["charset"]
+		if !ok {
+			charset = "UTF-8"
+		}
+
+		// per net/http doc, means that the length is known and non-null
+		if r.ContentLength > 0 && !(mw.accepts(mediatype) && strings.ToUpper(charset) == "UTF-8") {
+			rest.Error(w,
+				"Bad Content-Type or charset, expected one of "+strings.Join(mw.MediaTypes, ", "),
+				http.StatusUnsupportedMediaType,
+			)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (mw *MediaTypeCheckerMiddleware) accepts(mediatype string) bool {
+	for _, mt := range mw.MediaTypes {
+		if mt == mediatype {
+			return true
+		}
+	}
+	return false
+}
+
+// The rest.DefaultDevStack, with the content type checker swapped for a MediaTypeCheckerMiddleware,
+// and the Apache style access log swapped for a structured AccessLogMiddleware
+func devStack(config ServerConfig) []rest.Middleware {
+	var stack []rest.Middleware
+	for _, mw := range rest.DefaultDevStack {
+		switch mw.(type) {
+		case *rest.ContentTypeCheckerMiddleware:
+			mw = &MediaTypeCheckerMiddleware{MediaTypes: acceptedMediaTypes}
+		case *rest.AccessLogApacheMiddleware:
+			mw = &AccessLogMiddleware{Logger: config.Logger}
+		}
+		stack = append(stack, mw)
+	}
+	return stack
+}
+
+// Settings for the HTTP server; the zero value is ready to use
+type ServerConfig struct {
+	// TCP address to listen on, ":8080" if empty
+	Addr string
+
+	// Registry for the request metrics, also served at /metrics; DefaultMetrics if nil
+	Metrics *Metrics
+
+	// Provider of the request spans, see TracingMiddleware; the global otel provider if nil
+	TracerProvider trace.TracerProvider
+
+	// Destination of the request log, see AccessLogMiddleware; slog.Default() if nil
+	Logger *slog.Logger
+
+	// How long /readyz reports the server as shutting down before it stops accepting connections,
+	// giving load balancers time to stop sending requests its way
+	ShutdownDelay time.Duration
+
+	// How long to wait for requests in flight to finish when shutting down, 30 seconds if zero
+	ShutdownTimeout time.Duration
+}
+
+// The routes of the payments API
+func paymentRoutes(impl RestApi) []*rest.Route {
+	return []*rest.Route{
 		rest.Get("/payments", impl.GetAllPayments),
 		rest.Post("/payments", impl.PostPayment),
+		rest.Post("/payments/import", impl.ImportPayments),
+		rest.Post("/payments/bulk", impl.BulkPayments),
 		rest.Get("/payments/:id", impl.GetPayment),
 		rest.Put("/payments/:id", impl.PutPayment),
 		rest.Delete("/payments/:id", impl.DeletePayment),
-	)
+		rest.Get("/payments/:id/charges", impl.GetPaymentCharges),
+		rest.Get("/holds", impl.GetHeldPayments),
+		rest.Post("/holds/:id/release", impl.ReleaseHeldPayment),
+		rest.Post("/holds/:id/reject", impl.RejectHeldPayment),
+		rest.Get("/schedules", impl.GetAllSchedules),
+		rest.Post("/schedules", impl.PostSchedule),
+		rest.Get("/schedules/:id", impl.GetSchedule),
+		rest.Delete("/schedules/:id", impl.DeleteSchedule),
+		rest.Post("/fx/quote", impl.QuoteFX),
+		rest.Get("/charges/summary", impl.GetFeeSummaries),
+		rest.Get("/reports/summary", impl.GetReportSummary),
+		rest.Get("/duplicates", impl.GetFlaggedDuplicates),
+		rest.Post("/duplicates/:id/dismiss", impl.DismissFlaggedDuplicate),
+	}
+}
+
+// The payments API server, along with its operational endpoints:
+//
+//	/metrics  Prometheus metrics
+//	/healthz  liveness, always OK while the process serves requests
+//	/readyz   readiness, failing while shutting down or while the store is unusable
+//	/version  build information
+//	/openapi.json  OpenAPI document of the payments API, see OpenAPISpec
+type Server struct {
+	handler  http.Handler
+	srv      *http.Server
+	health   HealthChecker
+	config   ServerConfig
+	draining atomic.Bool
+}
+
+// Creates a server for the payments API of impl
+// Every API request is traced, see TracingMiddleware. Readiness is checked through impl, if it
+// implements HealthChecker (as GenericApi does).
+func NewServer(impl RestApi, config ServerConfig) (*Server, error) {
+	metrics := config.Metrics
+	if metrics == nil {
+		metrics = DefaultMetrics
+	}
+
+	api := rest.NewApi()
+	api.Use(&TracingMiddleware{TracerProvider: config.TracerProvider})
+	api.Use(devStack(config)...)
+	routes, err := InstrumentRoutes(metrics, paymentRoutes(impl)...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	router, err := rest.MakeRouter(routes...)
+	if err != nil {
+		return nil, err
 	}
 	api.SetApp(router)
-	log.Fatal(http.ListenAndServe(":8080", api.MakeHandler()))
+
+	s := Server{
+		config: config,
+	}
+	s.health, _ = impl.(HealthChecker)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+	mux.HandleFunc("/version", serveVersion)
+	mux.HandleFunc("/openapi.json", serveOpenAPI)
+	mux.Handle("/", api.MakeHandler())
+	s.handler = mux
+
+	addr := config.Addr
+	if addr == "" {
+		addr = ":8080"
+	}
+	s.srv = &http.Server{Addr: addr, Handler: mux}
+
+	return &s, nil
+}
+
+// Creates the HTTP handler of a Server, for embedding it in another server or in tests
+func MakeHandler(impl RestApi, config ServerConfig) (http.Handler, error) {
+	s, err := NewServer(impl, config)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Makes Server implement http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Listens on the configured address and serves requests until Shutdown is called
+// Returns http.ErrServerClosed after a shutdown, like http.Server.ListenAndServe.
+func (s *Server) ListenAndServe() error {
+	return s.srv.ListenAndServe()
+}
+
+// Shuts the server down gracefully: /readyz starts failing straight away, and after the configured
+// ShutdownDelay the server stops accepting connections and waits for requests in flight to finish
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+
+	select {
+	case <-time.After(s.config.ShutdownDelay):
+	case <-ctx.Done():
+	}
+
+	return s.srv.Shutdown(ctx)
+}
+
+// Minimal example as seen in the go-json-rest documentation;
+// Sets up a basic API with the routes as specified in the Coding Exercise document
+func RunServer(impl RestApi) {
+	RunServerConfig(impl, ServerConfig{})
+}
+
+// Like RunServer, with custom settings
+// Returns once the server has been shut down gracefully, after a SIGINT or SIGTERM.
+func RunServerConfig(impl RestApi, config ServerConfig) {
+	server, err := NewServer(impl, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		timeout := config.ShutdownTimeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownDelay+timeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
 }
@@ -1,9 +1,12 @@
 package f3api
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 )
 
 // Interface for stable storage
@@ -31,106 +34,564 @@ type ApiStore interface {
 	// Fetch a list of all payments from the stable storage
 	// NOTE: Does not paginate!
 	GetAllPayments() ([]Payment, error)
+
+	// Begin a transaction, staging writes until they are committed
+	Begin() (Tx, error)
 }
 
+var (
+	// Returned when adding a payment that already exists
+	ErrPaymentExists = errors.New("Cannot add an already existing resource")
+
+	// Returned (wrapped) when an operation requires a payment that does not exist
+	ErrPaymentNotFound = errors.New("resource does not exist")
+)
+
 // Simple in-memory stable storage implementation for testing and demonstration purposes
+// Payments are indexed by organisation, end to end reference, processing date and beneficiary
+// account besides their ID, see index.go.
+//
+// The payments are spread over shards by a hash of their ID, each with its own lock, so writers of
+// different payments rarely wait on each other. Listing takes a consistent snapshot of every shard
+// and copies it without holding any lock, see snapshot. Each shard keeps its payments ordered by ID
+// in a tree whose nodes are shared with snapshots, so taking one costs nothing and the writes which
+// follow only copy the nodes they change, see paymentTree.
 type InMemStore struct {
-	payments map[string]Payment
+	seed   maphash.Seed
+	shards []inMemShard
+}
+
+// A shard of an InMemStore, holding the payments whose IDs hash to it
+type inMemShard struct {
 	sync.RWMutex
+	payments paymentTree
+	indexes  paymentIndexes
+	// set while a snapshot may still be reading payments, whose nodes must then be copied before
+	// the next write changes them; only cleared under the write lock
+	shared atomic.Bool
 }
 
+// How many shards NewInMemStore creates
+const defaultShards = 32
+
 // Creates a new, blank in-memory ApiStore
 func NewInMemStore() *InMemStore {
+	return NewInMemStoreShards(defaultShards)
+}
+
+// Creates a new, blank in-memory ApiStore spread over the given number of shards (at least one)
+// A single shard serializes every write, like a store behind one lock.
+func NewInMemStoreShards(shards int) *InMemStore {
 	store := InMemStore{
-		payments: make(map[string]Payment),
+		seed:   maphash.MakeSeed(),
+		shards: make([]inMemShard, max(shards, 1)),
+	}
+	for i := range store.shards {
+		store.shards[i].indexes = newPaymentIndexes()
 	}
 	return &store
 }
 
+// The index of the shard holding a payment
+func (s *InMemStore) shardIndex(id string) int {
+	return int(maphash.String(s.seed, id) % uint64(len(s.shards)))
+}
+
+// The shard holding a payment
+func (s *InMemStore) shard(id string) *inMemShard {
+	return &s.shards[s.shardIndex(id)]
+}
+
 // Add a payment to the stable storage
 //
 // Precondition: The payment must not exist
 func (s *InMemStore) AddPayment(p Payment) error {
-	s.Lock()
-	defer s.Unlock()
+	return s.AddPaymentContext(context.Background(), p)
+}
 
-	if _, ok := s.payments[p.ID]; ok {
-		return errors.New("Cannot add an already existing resource")
+// Update an existing payment in the stable storage
+//
+// Precondition: The payment must already exist
+func (s *InMemStore) UpdatePayment(p Payment) error {
+	return s.UpdatePaymentContext(context.Background(), p)
+}
+
+// Creates or updates a payment in the stable storage, replacing if necessary/possible
+func (s *InMemStore) StorePayment(p Payment) error {
+	return s.StorePaymentContext(context.Background(), p)
+}
+
+// Delete a payment from the stable storage
+//
+// Precondition: The payment must already exist
+func (s *InMemStore) DeletePayment(id string) error {
+	return s.DeletePaymentContext(context.Background(), id)
+}
+
+// Fetch a specific payment from the stable storage
+//
+// Precondition: A payment with the resource ID must already exist
+func (s *InMemStore) GetPayment(id string) (Payment, error) {
+	return s.GetPaymentContext(context.Background(), id)
+}
+
+// Fetch a list of all payments from the stable storage
+func (s *InMemStore) GetAllPayments() ([]Payment, error) {
+	return s.GetAllPaymentsContext(context.Background())
+}
+
+// Begin a transaction on the in-memory store, see BeginContext
+func (s *InMemStore) Begin() (Tx, error) {
+	return s.BeginContext(context.Background())
+}
+
+// Reports the in-memory store as healthy, as long as it isn't locked up past the context's deadline
+func (s *InMemStore) CheckHealth(ctx context.Context) error {
+	if err := s.rLockAll(ctx); err != nil {
+		return err
 	}
+	s.rUnlockAll()
+	return nil
+}
 
-	s.payments[p.ID] = p
+// Acquires the write lock, unless the context is done before or while waiting for it
+// The lock itself can't be interrupted, so the context is checked again once it is held
+func (sh *inMemShard) lockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh.Lock()
+	if err := ctx.Err(); err != nil {
+		sh.Unlock()
+		return err
+	}
 	return nil
 }
 
-// Update an existing payment in the stable storage
+// Acquires the read lock, unless the context is done, see lockContext
+func (sh *inMemShard) rLockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh.RLock()
+	if err := ctx.Err(); err != nil {
+		sh.RUnlock()
+		return err
+	}
+	return nil
+}
+
+// Acquires the read locks of every shard, in order, unless the context is done first
+// Holding them all keeps out any write, batches included, for a consistent view of the store.
+func (s *InMemStore) rLockAll(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for i := range s.shards {
+		s.shards[i].RLock()
+	}
+	if err := ctx.Err(); err != nil {
+		s.rUnlockAll()
+		return err
+	}
+	return nil
+}
+
+// Releases the read locks acquired by rLockAll
+func (s *InMemStore) rUnlockAll() {
+	for i := range s.shards {
+		s.shards[i].RUnlock()
+	}
+}
+
+// Takes a consistent snapshot of the payments of every shard, for reading without holding any lock
+// The trees are marked as shared rather than copied, so the writes which follow copy the nodes they
+// change instead, see inMemShard.own.
+func (s *InMemStore) snapshot(ctx context.Context) ([]paymentTree, error) {
+	if err := s.rLockAll(ctx); err != nil {
+		return nil, err
+	}
+	defer s.rUnlockAll()
+
+	return s.snapshotLocked(), nil
+}
+
+// Takes a snapshot like snapshot, for a caller already holding every read lock
+func (s *InMemStore) snapshotLocked() []paymentTree {
+	snap := make([]paymentTree, len(s.shards))
+	for i := range s.shards {
+		s.shards[i].shared.Store(true)
+		snap[i] = s.shards[i].payments
+	}
+	return snap
+}
+
+// Copies the payments of a snapshot which match, or all of them if match is nil
+// Gives up, returning the context's error, if the context is done before all payments are copied
+func scanSnapshot(ctx context.Context, snap []paymentTree, match func(*Payment) bool) ([]Payment, error) {
+	var ps []Payment
+	if match == nil {
+		n := 0
+		for _, payments := range snap {
+			n += payments.size
+		}
+		ps = make([]Payment, 0, n)
+	}
+
+	n := 0
+	for _, payments := range snap {
+		it := payments.iter("")
+		for val, ok := it.next(); ok; val, ok = it.next() {
+			if n%ctxCheckInterval == 0 {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+			}
+			n++
+			if match == nil || match(val) {
+				ps = append(ps, *val)
+			}
+		}
+	}
+
+	return ps, nil
+}
+
+// Add a payment to the stable storage, unless the context is done first
+//
+// Precondition: The payment must not exist
+func (s *InMemStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	sh := s.shard(p.ID)
+	if err := sh.lockContext(ctx); err != nil {
+		return err
+	}
+	defer sh.Unlock()
+
+	if _, ok := sh.payments.get(p.ID); ok {
+		return ErrPaymentExists
+	}
+
+	sh.put(p)
+	return nil
+}
+
+// Update an existing payment in the stable storage, unless the context is done first
 //
 // Precondition: The payment must already exist
-func (s *InMemStore) UpdatePayment(p Payment) error {
-	s.Lock()
-	defer s.Unlock()
+func (s *InMemStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	sh := s.shard(p.ID)
+	if err := sh.lockContext(ctx); err != nil {
+		return err
+	}
+	defer sh.Unlock()
 
-	if _, ok := s.payments[p.ID]; !ok {
-		return errors.New("Cannot update a non-existing resource")
+	if _, ok := sh.payments.get(p.ID); !ok {
+		return fmt.Errorf("Cannot update resource %v: %w", p.ID, ErrPaymentNotFound)
 	}
 
-	s.payments[p.ID] = p
+	sh.put(p)
 	return nil
 }
 
-// Creates or updates a payment in the stable storage, replacing if necessary/possible
-func (s *InMemStore) StorePayment(p Payment) error {
-	s.Lock()
-	defer s.Unlock()
+// Creates or updates a payment in the stable storage, unless the context is done first
+func (s *InMemStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	sh := s.shard(p.ID)
+	if err := sh.lockContext(ctx); err != nil {
+		return err
+	}
+	defer sh.Unlock()
 
-	s.payments[p.ID] = p
+	sh.put(p)
 	return nil
 }
 
-// Delete a payment from the stable storage
+// Delete a payment from the stable storage, unless the context is done first
 //
 // Precondition: The payment must already exist
-func (s *InMemStore) DeletePayment(id string) error {
-	s.Lock()
-	defer s.Unlock()
+func (s *InMemStore) DeletePaymentContext(ctx context.Context, id string) error {
+	sh := s.shard(id)
+	if err := sh.lockContext(ctx); err != nil {
+		return err
+	}
+	defer sh.Unlock()
 
-	if _, ok := s.payments[id]; !ok {
-		return errors.New("Cannot delete a non-existing resource")
+	if _, ok := sh.payments.get(id); !ok {
+		return fmt.Errorf("Cannot delete resource %v: %w", id, ErrPaymentNotFound)
 	}
 
-	delete(s.payments, id)
+	sh.remove(id)
 	return nil
 }
 
-// Fetch a specific payment from the stable storage
+// Fetch a specific payment from the stable storage, unless the context is done first
 //
 // Precondition: A payment with the resource ID must already exist
-func (s *InMemStore) GetPayment(id string) (Payment, error) {
-	var (
-		p   Payment
-		err error
-		ok  bool
-	)
+func (s *InMemStore) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	p, err := s.stored(ctx, id)
+	if err != nil {
+		return Payment{}, err
+	}
+	if p == nil {
+		return Payment{}, fmt.Errorf("No resource with ID %v: %w", id, ErrPaymentNotFound)
+	}
 
-	s.RLock()
-	defer s.RUnlock()
+	return *p, nil
+}
 
-	if p, ok = s.payments[id]; !ok {
-		err = errors.New(fmt.Sprintf("No resource with ID %v", id))
+// Fetches the stored payment with the given ID, nil if there is none
+// The payment is shared with the shard and must not be changed.
+func (s *InMemStore) stored(ctx context.Context, id string) (*Payment, error) {
+	sh := s.shard(id)
+	if err := sh.rLockContext(ctx); err != nil {
+		return nil, err
 	}
+	defer sh.RUnlock()
 
-	return p, err
+	p, _ := sh.payments.get(id)
+	return p, nil
 }
 
+// How many payments are copied between checks of the context when listing
+const ctxCheckInterval = 1024
+
 // Fetch a list of all payments from the stable storage
-func (s *InMemStore) GetAllPayments() ([]Payment, error) {
+// The payments are copied from a snapshot, so writers aren't held up meanwhile. Gives up, returning
+// the context's error, if the context is done before all payments are copied.
+func (s *InMemStore) GetAllPaymentsContext(ctx context.Context) ([]Payment, error) {
+	snap, err := s.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scanSnapshot(ctx, snap, nil)
+}
+
+// Fetches up to limit payments with IDs greater than after, in order of their IDs
+// Merges the ordered trees of a snapshot of the shards, so only the payments of the page are copied.
+func (s *InMemStore) PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error) {
+	snap, err := s.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	its := make([]*treeIter, len(snap))
+	for i := range snap {
+		its[i] = snap[i].iter(after)
+	}
+
 	var ps []Payment
+	for len(ps) < limit {
+		first, firstID := -1, ""
+		for i, it := range its {
+			if id, ok := it.peek(); ok && (first < 0 || id < firstID) {
+				first, firstID = i, id
+			}
+		}
+		if first < 0 {
+			break
+		}
+		p, _ := its[first].next()
+		ps = append(ps, *p)
+	}
+	return ps, nil
+}
 
-	s.RLock()
-	defer s.RUnlock()
+// Fetch the payments matching a filter, without copying the others
+// Only the payments found through the indexes are checked if the filter allows it, see
+// paymentIndexes.candidates, and otherwise a snapshot is scanned like GetAllPaymentsContext does.
+func (s *InMemStore) FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error) {
+	var ps []Payment
+
+	if err := s.rLockAll(ctx); err != nil {
+		return nil, err
+	}
 
-	for _, val := range s.payments {
-		ps = append(ps, val)
+	for i := range s.shards {
+		sh := &s.shards[i]
+		ids, ok := sh.indexes.candidates(f.expr)
+		if !ok {
+			snap := s.snapshotLocked()
+			s.rUnlockAll()
+			return scanSnapshot(ctx, snap, f.Match)
+		}
+		for id := range ids {
+			if val, _ := sh.payments.get(id); f.Match(val) {
+				ps = append(ps, *val)
+			}
+		}
 	}
 
+	s.rUnlockAll()
 	return ps, nil
 }
+
+// Begin a transaction on the in-memory store
+//
+// Writes are staged in a copy-on-write overlay owned by the transaction, and only touch the store
+// when committing, at which point they are checked again and applied under the store's lock.
+// Every operation on the transaction fails with the context's error once the context is done.
+func (s *InMemStore) BeginContext(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tx := inMemTx{
+		ctx:    ctx,
+		store:  s,
+		staged: make(map[string]*Payment),
+		read:   make(map[string]*Payment),
+	}
+	return &tx, nil
+}
+
+// Reports whether a payment exists, for checking the preconditions of staged writes
+func (s *InMemStore) hasPayment(id string) bool {
+	sh := s.shard(id)
+	sh.RLock()
+	defer sh.RUnlock()
+
+	_, ok := sh.payments.get(id)
+	return ok
+}
+
+// Applies the operations of a committed transaction atomically
+// The write locks of the shards involved are all held at once, taken in order so that concurrent
+// batches can't deadlock.
+func (s *InMemStore) applyBatch(ctx context.Context, ops []BatchOp, read map[string]*Payment) error {
+	involved := make([]bool, len(s.shards))
+	for _, op := range ops {
+		involved[s.shardIndex(op.Payment.ID)] = true
+	}
+	for id := range read {
+		involved[s.shardIndex(id)] = true
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for i := range s.shards {
+		if involved[i] {
+			s.shards[i].Lock()
+			defer s.shards[i].Unlock()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	staged := make(map[string]*Payment)
+	exists := func(id string) bool {
+		_, ok := s.shard(id).payments.get(id)
+		return ok
+	}
+
+	// failed preconditions are reported first, as they fail the batch whatever was read
+	for i, op := range ops {
+		if err := stageBatchOp(staged, exists, op); err != nil {
+			return &BatchError{i, err}
+		}
+	}
+
+	// every write stores a new payment, so an unchanged payment is the very same one
+	for id, p := range read {
+		if current, _ := s.shard(id).payments.get(id); current != p {
+			return ErrTxConflict
+		}
+	}
+
+	for id, p := range staged {
+		if p == nil {
+			s.shard(id).remove(id)
+		} else {
+			s.shard(id).put(*p)
+		}
+	}
+
+	return nil
+}
+
+// Transaction on an InMemStore
+type inMemTx struct {
+	ctx    context.Context
+	store  *InMemStore
+	ops    []BatchOp
+	staged map[string]*Payment
+	// payments read from the store as they were first read, nil if they didn't exist; checked
+	// again on commit
+	read map[string]*Payment
+	done bool
+}
+
+func (tx *inMemTx) stage(op BatchOp) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := stageBatchOp(tx.staged, tx.store.hasPayment, op); err != nil {
+		return err
+	}
+
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+func (tx *inMemTx) AddPayment(p Payment) error {
+	return tx.stage(BatchOp{BatchAdd, p})
+}
+
+func (tx *inMemTx) UpdatePayment(p Payment) error {
+	return tx.stage(BatchOp{BatchUpdate, p})
+}
+
+func (tx *inMemTx) StorePayment(p Payment) error {
+	return tx.stage(BatchOp{BatchStore, p})
+}
+
+func (tx *inMemTx) DeletePayment(id string) error {
+	return tx.stage(BatchOp{BatchDelete, Payment{ID: id}})
+}
+
+func (tx *inMemTx) GetPayment(id string) (Payment, error) {
+	if tx.done {
+		return Payment{}, ErrTxDone
+	}
+
+	if p, ok := tx.staged[id]; ok {
+		if p == nil {
+			return Payment{}, fmt.Errorf("No resource with ID %v: %w", id, ErrPaymentNotFound)
+		}
+		return *p, nil
+	}
+
+	p, err := tx.store.stored(tx.ctx, id)
+	if err != nil {
+		return Payment{}, err
+	}
+	if _, ok := tx.read[id]; !ok {
+		tx.read[id] = p
+	}
+	if p == nil {
+		return Payment{}, fmt.Errorf("No resource with ID %v: %w", id, ErrPaymentNotFound)
+	}
+	return *p, nil
+}
+
+func (tx *inMemTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	return tx.store.applyBatch(tx.ctx, tx.ops, tx.read)
+}
+
+func (tx *inMemTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	return nil
+}
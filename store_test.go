@@ -0,0 +1,352 @@
+package f3api_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThrosturX/f3api"
+	"github.com/ThrosturX/f3api/storetest"
+)
+
+// Runs the ApiStore conformance suite against the in-memory store
+func TestInMemStore(t *testing.T) {
+	storetest.Run(t, func() f3api.ApiStore {
+		return f3api.NewInMemStore()
+	})
+}
+
+// Runs the conformance suite against an in-memory store of a single shard
+func TestInMemStoreSingleShard(t *testing.T) {
+	storetest.Run(t, func() f3api.ApiStore {
+		return f3api.NewInMemStoreShards(1)
+	})
+}
+
+// Tests that listing sees every batch either whole or not at all, even when it spans shards
+func TestInMemStoreSnapshot(t *testing.T) {
+	store := f3api.NewInMemStore()
+	ids := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for version := 0; ; version++ {
+			select {
+			case <-stop:
+				close(done)
+				return
+			default:
+			}
+			var ops []f3api.BatchOp
+			for _, id := range ids {
+				p := storetest.NewPayment(id)
+				p.Version = version
+				ops = append(ops, f3api.BatchOp{Kind: f3api.BatchStore, Payment: p})
+			}
+			if err := f3api.ApplyBatch(store, ops); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		ps, err := store.GetAllPayments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range ps {
+			if p.Version != ps[0].Version || len(ps) != len(ids) {
+				t.Fatalf("Listed a partial batch: %+v", ps)
+			}
+		}
+	}
+}
+
+// The store the benchmarks exercise
+type benchStore interface {
+	AddPayment(f3api.Payment) error
+	StorePayment(f3api.Payment) error
+	GetPayment(id string) (f3api.Payment, error)
+	GetAllPayments() ([]f3api.Payment, error)
+}
+
+// The in-memory store as it was before sharding, for comparison: one map under one lock, copied
+// under the read lock to be listed
+type baselineStore struct {
+	payments map[string]f3api.Payment
+	sync.RWMutex
+}
+
+func (s *baselineStore) AddPayment(p f3api.Payment) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.payments[p.ID]; ok {
+		return f3api.ErrPaymentExists
+	}
+	s.payments[p.ID] = p
+	return nil
+}
+
+func (s *baselineStore) StorePayment(p f3api.Payment) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.payments[p.ID] = p
+	return nil
+}
+
+func (s *baselineStore) GetPayment(id string) (f3api.Payment, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	p, ok := s.payments[id]
+	if !ok {
+		return p, f3api.ErrPaymentNotFound
+	}
+	return p, nil
+}
+
+func (s *baselineStore) GetAllPayments() ([]f3api.Payment, error) {
+	var ps []f3api.Payment
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, p := range s.payments {
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// Compares the throughput of the store as it was before sharding with a single shard, which
+// serializes every write like one lock over the whole store, and with the default sharding, under
+// concurrent reads, writes and listings
+func BenchmarkInMemStoreParallel(b *testing.B) {
+	const n = 100000
+	payments := make([]f3api.Payment, n)
+	for i := range payments {
+		payments[i] = storetest.NewPayment(fmt.Sprintf("payment-%06d", i))
+	}
+
+	stores := []struct {
+		name   string
+		create func() benchStore
+	}{
+		{"baseline", func() benchStore { return &baselineStore{payments: make(map[string]f3api.Payment)} }},
+		{"single", func() benchStore { return f3api.NewInMemStoreShards(1) }},
+		{"sharded", func() benchStore { return f3api.NewInMemStore() }},
+	}
+	workloads := []struct {
+		name string
+		// percentage of reads among the operations, the others being writes
+		reads int
+		// whether the store is listed over and over in the background
+		listing bool
+	}{
+		{"write", 0, false},
+		{"mixed", 90, false},
+		{"write+list", 0, true},
+	}
+
+	for _, w := range workloads {
+		for _, s := range stores {
+			b.Run(w.name+"/"+s.name, func(b *testing.B) {
+				store := s.create()
+				for _, p := range payments {
+					store.AddPayment(p)
+				}
+
+				if w.listing {
+					stop := make(chan struct{})
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						for {
+							select {
+							case <-stop:
+								return
+							default:
+								store.GetAllPayments()
+							}
+						}
+					}()
+					defer func() {
+						close(stop)
+						<-done
+					}()
+				}
+
+				var seed atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewPCG(seed.Add(1), 0))
+					for pb.Next() {
+						p := &payments[r.IntN(n)]
+						if r.IntN(100) < w.reads {
+							store.GetPayment(p.ID)
+						} else {
+							store.StorePayment(*p)
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// Tests paging through the payments of every shard in order of their IDs
+func TestInMemStorePages(t *testing.T) {
+	store := f3api.NewInMemStoreShards(7)
+	var ids []string
+	for i := range 100 {
+		id := fmt.Sprintf("payment-%03d", (i*37)%100)
+		store.AddPayment(storetest.NewPayment(id))
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var paged []string
+	after := ""
+	for {
+		page, err := f3api.PagePayments(t.Context(), store, after, 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, p := range page {
+			paged = append(paged, p.ID)
+		}
+		after = page[len(page)-1].ID
+	}
+	if !slices.Equal(paged, ids) {
+		t.Fatalf("Expected the pages to hold %v, got %v", ids, paged)
+	}
+
+	// pages are taken from a snapshot, which later writes leave alone
+	page, _ := f3api.PagePayments(t.Context(), store, "payment-049", 2)
+	store.DeletePayment("payment-050")
+	if len(page) != 2 || page[0].ID != "payment-050" || page[1].ID != "payment-051" {
+		t.Fatalf("Unexpected page %v", page)
+	}
+	if page, _ := f3api.PagePayments(t.Context(), store, "payment-049", 1); page[0].ID != "payment-051" {
+		t.Fatalf("Expected the deleted payment to be skipped, got %v", page)
+	}
+}
+
+// Tests that transactions don't commit writes based on payments changed since they were read
+func TestInMemStoreTxConflict(t *testing.T) {
+	store := f3api.NewInMemStore()
+	p := storetest.NewPayment("conflict")
+	store.AddPayment(p)
+
+	tx, _ := store.Begin()
+	read, err := tx.GetPayment(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := p
+	changed.Version = 1
+	store.UpdatePayment(changed)
+
+	read.Version = 2
+	tx.UpdatePayment(read)
+	if err := tx.Commit(); !errors.Is(err, f3api.ErrTxConflict) {
+		t.Fatalf("Expected ErrTxConflict, got %v", err)
+	}
+	if stored, _ := store.GetPayment(p.ID); stored.Version != 1 {
+		t.Fatalf("Expected the conflicting write to be refused, got version %d", stored.Version)
+	}
+
+	// payments found missing count too, and unchanged ones don't conflict
+	tx, _ = store.Begin()
+	tx.GetPayment(p.ID)
+	tx.GetPayment("missing")
+	store.AddPayment(storetest.NewPayment("missing"))
+	if err := tx.Commit(); !errors.Is(err, f3api.ErrTxConflict) {
+		t.Fatalf("Expected ErrTxConflict, got %v", err)
+	}
+	tx, _ = store.Begin()
+	tx.GetPayment(p.ID)
+	tx.DeletePayment(p.ID)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// failed preconditions are reported as such, rather than as conflicts
+	tx, _ = store.Begin()
+	tx.GetPayment("added")
+	tx.AddPayment(storetest.NewPayment("added"))
+	store.AddPayment(storetest.NewPayment("added"))
+	var berr *f3api.BatchError
+	if err := tx.Commit(); !errors.As(err, &berr) || !errors.Is(err, f3api.ErrPaymentExists) {
+		t.Fatalf("Expected ErrPaymentExists, got %v", err)
+	}
+}
+
+// Runs the conformance suite against the caching decorator
+func TestCacheStoreConformance(t *testing.T) {
+	storetest.Run(t, func() f3api.ApiStore {
+		store, _ := f3api.CacheStore(f3api.NewInMemStore(), f3api.CacheConfig{Size: 16})
+		return store
+	})
+}
+
+// Runs the conformance suite against the business day decorator, on the processing date of the
+// payments of the suite
+func TestBusinessDayStoreConformance(t *testing.T) {
+	storetest.Run(t, func() f3api.ApiStore {
+		calendar := &f3api.BusinessCalendar{}
+		return f3api.BusinessDayStoreAt(f3api.NewInMemStore(), calendar, time.Date(2017, time.January, 18, 9, 0, 0, 0, time.UTC))
+	})
+}
+
+// Runs the conformance suite against every other decorator, over an in-memory store
+func TestDecoratorConformance(t *testing.T) {
+	decorators := []struct {
+		name     string
+		decorate func(f3api.ApiStore) f3api.ApiStore
+	}{
+		{"Audit", func(s f3api.ApiStore) f3api.ApiStore { return f3api.AuditStore(s, &f3api.MemoryAuditSink{}) }},
+		{"Trace", f3api.TraceStore},
+		{"Instrument", func(s f3api.ApiStore) f3api.ApiStore {
+			store, err := f3api.InstrumentStore(s, f3api.NewMetrics())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		}},
+		// the payments of the suite only differ by ID, so they are all duplicates of each other
+		{"DetectDuplicates", func(s f3api.ApiStore) f3api.ApiStore {
+			return f3api.DetectDuplicates(s, f3api.DuplicateConfig{Default: f3api.DuplicatePolicy{Action: f3api.DuplicateFlag}})
+		}},
+		{"Screen", func(s f3api.ApiStore) f3api.ApiStore {
+			return f3api.ScreenStore(s, f3api.NewListScreener(f3api.NewWatchList(nil)))
+		}},
+		{"FX", func(s f3api.ApiStore) f3api.ApiStore { return f3api.FXStore(s, nil) }},
+		{"Charges", f3api.ChargesStore},
+	}
+
+	for _, d := range decorators {
+		t.Run(d.name, func(t *testing.T) {
+			storetest.Run(t, func() f3api.ApiStore {
+				return d.decorate(f3api.NewInMemStore())
+			})
+		})
+	}
+}
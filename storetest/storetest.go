@@ -0,0 +1,411 @@
+// Package storetest is a conformance test suite for f3api.ApiStore implementations.
+//
+// Every store, in-house or third party, should pass it from its own tests:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func() f3api.ApiStore {
+//			return NewMyStore()
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThrosturX/f3api"
+)
+
+// Creates the store under test. Must return a new, blank store on every call.
+type Factory func() f3api.ApiStore
+
+// Runs every ApiStore conformance check as a subtest of t
+func Run(t *testing.T, factory Factory) {
+	t.Run("AddExisting", func(t *testing.T) { testAddExisting(t, factory()) })
+	t.Run("UpdateMissing", func(t *testing.T) { testUpdateMissing(t, factory()) })
+	t.Run("Store", func(t *testing.T) { testStore(t, factory()) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory()) })
+	t.Run("GetAllPayments", func(t *testing.T) { testGetAllPayments(t, factory()) })
+	t.Run("ConcurrentWriters", func(t *testing.T) { testConcurrentWriters(t, factory()) })
+	t.Run("ConcurrentAdds", func(t *testing.T) { testConcurrentAdds(t, factory()) })
+	t.Run("RoundTrip", func(t *testing.T) { testRoundTrip(t, factory()) })
+	t.Run("Tx", func(t *testing.T) { runTx(t, factory) })
+	t.Run("Context", func(t *testing.T) { testContext(t, factory()) })
+}
+
+// Creates a payment with the given ID, with every field set to a non-zero value
+func NewPayment(id string) f3api.Payment {
+	return f3api.Payment{
+		Type:           "Payment",
+		ID:             id,
+		Version:        1,
+		OrganisationID: "743d5b63-8e6f-432e-a8fa-c5d8d2ee5fcb",
+		Attributes: f3api.PaymentAttributes{
+			Amount: 100.21,
+			BeneficiaryParty: f3api.TypedParty{
+				Party: f3api.Party{
+					MinimalParty: f3api.MinimalParty{
+						AccountNumber: "31926819",
+						BankID:        "403000",
+						BankIDCode:    "GBDSC",
+					},
+					AccountName:       "W Owens",
+					AccountNumberCode: "BBAN",
+					Address:           "1 The Beneficiary Localtown SE2",
+					Name:              "Wilfred Jeremiah Owens",
+				},
+				AccountType: 1,
+			},
+			ChargesInformation: f3api.ChargeInformation{
+				BearerCode: "SHAR",
+				SenderCharges: []f3api.SenderCharge{
+					{Amount: 5, Currency: "GBP"},
+					{Amount: 10, Currency: "USD"},
+				},
+				ReceiverChargesAmount:   1,
+				ReceiverChargesCurrency: "USD",
+			},
+			Currency: "GBP",
+			DebtorParty: f3api.Party{
+				MinimalParty: f3api.MinimalParty{
+					AccountNumber: "GB29XABC10161234567801",
+					BankID:        "203301",
+					BankIDCode:    "GBDSC",
+				},
+				AccountName:       "EJ Brown Black",
+				AccountNumberCode: "IBAN",
+				Address:           "10 Debtor Crescent Sourcetown NE1",
+				Name:              "Emelia Jane Brown",
+			},
+			EndToEndReference: "Wil piano Jan",
+			Fx: f3api.FX{
+				ContractReference: "FX123",
+				ExchangeRate:      2,
+				OriginalAmount:    200.42,
+				OriginalCurrency:  "USD",
+			},
+			NumericReference:     1002001,
+			PaymentID:            123456789012345678,
+			PaymentPurpose:       "Paying for goods/services",
+			PaymentScheme:        "FPS",
+			PaymentType:          "Credit",
+			ProcessingDate:       f3api.Date{Time: time.Date(2017, time.January, 18, 0, 0, 0, 0, time.UTC)},
+			Reference:            "Payment for Em's piano lessons",
+			SchemePaymentSubType: "InternetBanking",
+			SchemePaymentType:    "ImmediatePayment",
+			SponsorParty: f3api.MinimalParty{
+				AccountNumber: "56781234",
+				BankID:        "123123",
+				BankIDCode:    "GBDSC",
+			},
+		},
+	}
+}
+
+func testAddExisting(t *testing.T, store f3api.ApiStore) {
+	p := NewPayment("add-existing")
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := p
+	changed.Attributes.Reference = "changed"
+	if err := store.AddPayment(changed); !errors.Is(err, f3api.ErrPaymentExists) {
+		t.Fatalf("Expected ErrPaymentExists adding an existing payment, got %v", err)
+	}
+
+	found, err := store.GetPayment(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Attributes.Reference != p.Attributes.Reference {
+		t.Fatal("Failed add modified the existing payment")
+	}
+}
+
+func testUpdateMissing(t *testing.T, store f3api.ApiStore) {
+	p := NewPayment("update-missing")
+	if err := store.UpdatePayment(p); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Expected ErrPaymentNotFound updating a missing payment, got %v", err)
+	}
+	if _, err := store.GetPayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Failed update created the payment: %v", err)
+	}
+
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+	p.Version++
+	if err := store.UpdatePayment(p); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := store.GetPayment(p.ID); err != nil || found.Version != p.Version {
+		t.Fatalf("Update was not applied: %v", err)
+	}
+}
+
+func testStore(t *testing.T, store f3api.ApiStore) {
+	p := NewPayment("store")
+	if err := store.StorePayment(p); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Version++
+	if err := store.StorePayment(p); err != nil {
+		t.Fatal(err)
+	}
+
+	if found, err := store.GetPayment(p.ID); err != nil || found.Version != p.Version {
+		t.Fatalf("StorePayment did not replace the payment: %v", err)
+	}
+}
+
+func testDelete(t *testing.T, store f3api.ApiStore) {
+	p := NewPayment("delete")
+	if err := store.DeletePayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Expected ErrPaymentNotFound deleting a missing payment, got %v", err)
+	}
+
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeletePayment(p.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetPayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Expected ErrPaymentNotFound fetching a deleted payment, got %v", err)
+	}
+	if err := store.DeletePayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Expected ErrPaymentNotFound deleting a payment twice, got %v", err)
+	}
+
+	// a deleted payment may be added again
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testGetAllPayments(t *testing.T, store f3api.ApiStore) {
+	payments, err := store.GetAllPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 0 {
+		t.Fatalf("Expected a blank store, found %d payments", len(payments))
+	}
+
+	var expected []string
+	for i := 0; i < 100; i++ {
+		p := NewPayment(fmt.Sprintf("all-%03d", i))
+		if err := store.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, p.ID)
+	}
+	if err := store.DeletePayment(expected[0]); err != nil {
+		t.Fatal(err)
+	}
+	expected = expected[1:]
+
+	payments, err = store.GetAllPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found []string
+	for _, p := range payments {
+		found = append(found, p.ID)
+	}
+	sort.Strings(found)
+
+	if !reflect.DeepEqual(expected, found) {
+		t.Fatalf("GetAllPayments returned %d payments, expected each of the %d stored exactly once", len(found), len(expected))
+	}
+}
+
+func testConcurrentWriters(t *testing.T, store f3api.ApiStore) {
+	const (
+		writers  = 8
+		payments = 50
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < payments; i++ {
+				p := NewPayment(fmt.Sprintf("writer-%d-%d", w, i))
+				if err := store.AddPayment(p); err != nil {
+					errs <- err
+					return
+				}
+				p.Version++
+				if err := store.UpdatePayment(p); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := store.GetPayment(p.ID); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	all, err := store.GetAllPayments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != writers*payments {
+		t.Fatalf("Expected %d payments after concurrent writes, found %d", writers*payments, len(all))
+	}
+	for _, p := range all {
+		if p.Version != 2 {
+			t.Fatalf("Lost update on payment %s", p.ID)
+		}
+	}
+}
+
+func testConcurrentAdds(t *testing.T, store f3api.ApiStore) {
+	const writers = 16
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		added int
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := store.AddPayment(NewPayment("contended")); err == nil {
+				mu.Lock()
+				added++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if added != 1 {
+		t.Fatalf("Expected exactly one concurrent add of the same payment to succeed, %d did", added)
+	}
+}
+
+func testRoundTrip(t *testing.T, store f3api.ApiStore) {
+	p := NewPayment("round-trip")
+
+	// guards against new fields being added to the Payment type without being covered here
+	checkNonZero(t, reflect.ValueOf(p), "payment")
+
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.GetPayment(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compare dates by instant, since stores may not preserve the time.Location
+	if !found.Attributes.ProcessingDate.Equal(p.Attributes.ProcessingDate.Time) {
+		t.Fatalf("Mismatched processing dates %v and %v", p.Attributes.ProcessingDate, found.Attributes.ProcessingDate)
+	}
+	found.Attributes.ProcessingDate = p.Attributes.ProcessingDate
+
+	if !reflect.DeepEqual(p, found) {
+		t.Fatalf("Payment did not survive a round trip through the store:\n%+v\n%+v", p, found)
+	}
+}
+
+// Checks that stores which implement f3api.ContextStore give up once the context is done
+func testContext(t *testing.T, store f3api.ApiStore) {
+	cs, ok := store.(f3api.ContextStore)
+	if !ok {
+		t.Skip("Store does not implement f3api.ContextStore")
+	}
+
+	p := NewPayment("context")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := cs.AddPaymentContext(ctx, p); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled adding with a cancelled context, got %v", err)
+	}
+	if err := cs.StorePaymentContext(ctx, p); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled storing with a cancelled context, got %v", err)
+	}
+	if _, err := store.GetPayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Write with a cancelled context was applied: %v", err)
+	}
+
+	if err := store.AddPayment(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.UpdatePaymentContext(ctx, p); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled updating with a cancelled context, got %v", err)
+	}
+	if err := cs.DeletePaymentContext(ctx, p.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled deleting with a cancelled context, got %v", err)
+	}
+	if _, err := cs.GetPaymentContext(ctx, p.ID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled fetching with a cancelled context, got %v", err)
+	}
+	if _, err := cs.GetAllPaymentsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled listing with a cancelled context, got %v", err)
+	}
+
+	// a transaction gives up when its context is cancelled halfway through
+	txCtx, txCancel := context.WithCancel(context.Background())
+	tx, err := cs.BeginContext(txCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.StorePayment(NewPayment("context-tx")); err != nil {
+		t.Fatal(err)
+	}
+	txCancel()
+	if err := tx.Commit(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled committing with a cancelled context, got %v", err)
+	}
+	if _, err := store.GetPayment("context-tx"); !errors.Is(err, f3api.ErrPaymentNotFound) {
+		t.Fatalf("Transaction with a cancelled context was committed: %v", err)
+	}
+}
+
+// Fails the test if any leaf field of v holds a zero value
+func checkNonZero(t *testing.T, v reflect.Value, path string) {
+	switch {
+	case v.Type() == reflect.TypeOf(f3api.Date{}):
+		if v.Interface().(f3api.Date).IsZero() {
+			t.Fatalf("Test fixture leaves %s unset", path)
+		}
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			checkNonZero(t, v.Field(i), path+"."+v.Type().Field(i).Name)
+		}
+	case v.Kind() == reflect.Slice:
+		if v.Len() == 0 {
+			t.Fatalf("Test fixture leaves %s empty", path)
+		}
+		for i := 0; i < v.Len(); i++ {
+			checkNonZero(t, v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case v.IsZero():
+		t.Fatalf("Test fixture leaves %s unset", path)
+	}
+}
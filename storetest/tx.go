@@ -0,0 +1,138 @@
+package storetest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ThrosturX/f3api"
+)
+
+// Transaction conformance checks: isolation of staged writes, rollback and atomic commits
+func runTx(t *testing.T, factory Factory) {
+	t.Run("Isolation", func(t *testing.T) {
+		store := factory()
+		p := NewPayment("tx")
+
+		tx, err := store.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+
+		// the transaction sees its own write, the store doesn't until it is committed
+		if _, err := tx.GetPayment(p.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetPayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+			t.Fatalf("Uncommitted payment visible outside of the transaction: %v", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetPayment(p.ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		store := factory()
+		p := NewPayment("tx")
+		store.AddPayment(p)
+
+		tx, err := store.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.DeletePayment(p.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.GetPayment(p.ID); !errors.Is(err, f3api.ErrPaymentNotFound) {
+			t.Fatalf("Deleted payment still visible inside the transaction: %v", err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := store.GetPayment(p.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != f3api.ErrTxDone {
+			t.Fatalf("Expected ErrTxDone after rolling back, got %v", err)
+		}
+	})
+
+	t.Run("Preconditions", func(t *testing.T) {
+		store := factory()
+		p := NewPayment("tx")
+
+		tx, err := store.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+
+		if err := tx.UpdatePayment(p); !errors.Is(err, f3api.ErrPaymentNotFound) {
+			t.Fatalf("Expected ErrPaymentNotFound staging an update, got %v", err)
+		}
+		if err := tx.AddPayment(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AddPayment(p); !errors.Is(err, f3api.ErrPaymentExists) {
+			t.Fatalf("Expected ErrPaymentExists staging a second add, got %v", err)
+		}
+	})
+
+	t.Run("ConflictingCommit", func(t *testing.T) {
+		store := factory()
+		p1 := NewPayment("tx-first")
+		p2 := NewPayment("tx-second")
+
+		tx, err := store.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AddPayment(p2); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AddPayment(p1); err != nil {
+			t.Fatal(err)
+		}
+
+		// someone else adds the same payment before the transaction commits
+		if err := store.AddPayment(p1); err != nil {
+			t.Fatal(err)
+		}
+
+		err = tx.Commit()
+		var berr *f3api.BatchError
+		if !errors.As(err, &berr) || berr.Index != 1 || !errors.Is(err, f3api.ErrPaymentExists) {
+			t.Fatalf("Expected a conflict on the second operation, got %v", err)
+		}
+		if _, err := store.GetPayment(p2.ID); err == nil {
+			t.Fatal("Failed commit was partially applied")
+		}
+	})
+
+	t.Run("ApplyBatch", func(t *testing.T) {
+		store := factory()
+		p := NewPayment("tx")
+
+		err := f3api.ApplyBatch(store, []f3api.BatchOp{
+			{Kind: f3api.BatchAdd, Payment: p},
+			{Kind: f3api.BatchUpdate, Payment: p},
+			{Kind: f3api.BatchDelete, Payment: p},
+			{Kind: f3api.BatchDelete, Payment: p},
+		})
+		var berr *f3api.BatchError
+		if !errors.As(err, &berr) || berr.Index != 3 {
+			t.Fatalf("Expected the fourth operation to fail, got %v", err)
+		}
+
+		if payments, err := store.GetAllPayments(); err != nil || len(payments) != 0 {
+			t.Fatalf("Failed batch was partially applied: %v %v", payments, err)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package f3api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Instrumentation name of every tracer created by this package
+const tracerName = "github.com/ThrosturX/f3api"
+
+// Creates an OpenTelemetry tracer provider exporting spans as configured by exporter:
+//
+//	"" or "none"   spans are recorded (so trace IDs are propagated) but not exported
+//	"stdout"       spans are written to standard output as JSON, for reading
+//	"file:<path>"  spans are appended to the file at path in the OTLP/JSON encoding, one export
+//	               request per line, for an OpenTelemetry collector to pick up
+//
+// Spans are exported synchronously, so that nothing is lost when the process exits without
+// shutting down the provider. The returned function shuts the provider down, closing any file.
+func NewTracerProvider(exporter string) (*sdktrace.TracerProvider, func(context.Context) error, error) {
+	var (
+		exp   sdktrace.SpanExporter
+		close = func() error { return nil }
+	)
+
+	switch {
+	case exporter == "" || exporter == "none":
+		tp := sdktrace.NewTracerProvider()
+		return tp, tp.Shutdown, nil
+	case exporter == "stdout":
+		var err error
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, nil, err
+		}
+	case strings.HasPrefix(exporter, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(exporter, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exp, close = newOTLPJSONExporter(f), f.Close
+	default:
+		return nil, nil, fmt.Errorf("Unknown trace exporter %q", exporter)
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	shutdown := func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if cerr := close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	return tp, shutdown, nil
+}
+
+// Starts a span for every request, continuing the trace of the caller if the request carries a W3C
+// traceparent header. The span is passed on in the request context, so the spans of the handlers and
+// store calls become its children, and its traceparent is returned in the response headers.
+type TracingMiddleware struct {
+	// Provider of the request tracer; the global otel provider if nil
+	TracerProvider trace.TracerProvider
+	// Propagation format of the trace headers; W3C Trace Context if nil
+	Propagator propagation.TextMapPropagator
+}
+
+// Makes TracingMiddleware implement the rest.Middleware interface
+func (mw *TracingMiddleware) MiddlewareFunc(handler rest.HandlerFunc) rest.HandlerFunc {
+	provider := mw.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := mw.Propagator
+	if propagator == nil {
+		propagator = propagation.TraceContext{}
+	}
+	tracer := provider.Tracer(tracerName)
+
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		// named after the path for now, InstrumentRoutes renames it after the matched route
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		propagator.Inject(ctx, propagation.HeaderCarrier(w.Header()))
+		r.Request = r.Request.WithContext(ctx)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	}
+}
+
+// Starts a child span of the span in ctx, with the same tracer provider
+// Without a span in ctx, the returned span is a no-op.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// Ends a span, recording the error (if any) on it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ContextStore decorator tracing every store operation in a child span of the caller's span
+type tracedStore struct {
+	storeDecorator
+}
+
+// Wraps a store to trace every operation as a child span of the span in the context of the call.
+// The returned store implements both ApiStore and ContextStore.
+func TraceStore(store ApiStore) ApiStore {
+	return ApiStoreOf(&tracedStore{storeDecorator{ContextStoreOf(store)}})
+}
+
+// Starts the span of a store operation
+func (s *tracedStore) start(ctx context.Context, op string, id string) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindInternal)}
+	if id != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("payment.id", id)))
+	}
+	return startSpan(ctx, "ApiStore."+op, opts...)
+}
+
+func (s *tracedStore) AddPaymentContext(ctx context.Context, p Payment) error {
+	ctx, span := s.start(ctx, "AddPayment", p.ID)
+	err := s.store.AddPaymentContext(ctx, p)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) UpdatePaymentContext(ctx context.Context, p Payment) error {
+	ctx, span := s.start(ctx, "UpdatePayment", p.ID)
+	err := s.store.UpdatePaymentContext(ctx, p)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) StorePaymentContext(ctx context.Context, p Payment) error {
+	ctx, span := s.start(ctx, "StorePayment", p.ID)
+	err := s.store.StorePaymentContext(ctx, p)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) DeletePaymentContext(ctx context.Context, id string) error {
+	ctx, span := s.start(ctx, "DeletePayment", id)
+	err := s.store.DeletePaymentContext(ctx, id)
+	endSpan(span, err)
+	return err
+}
+
+func (s *tracedStore) GetPaymentContext(ctx context.Context, id string) (Payment, error) {
+	ctx, span := s.start(ctx, "GetPayment", id)
+	p, err := s.store.GetPaymentContext(ctx, id)
+	endSpan(span, err)
+	return p, err
+}
+
+func (s *tracedStore) GetAllPaymentsContext(ctx context.Context) ([]Payment, error) {
+	ctx, span := s.start(ctx, "GetAllPayments", "")
+	ps, err := s.store.GetAllPaymentsContext(ctx)
+	span.SetAttributes(attribute.Int("payment.count", len(ps)))
+	endSpan(span, err)
+	return ps, err
+}
+
+func (s *tracedStore) FindPaymentsContext(ctx context.Context, f *Filter) ([]Payment, error) {
+	ctx, span := s.start(ctx, "FindPayments", "")
+	span.SetAttributes(attribute.String("payment.filter", f.String()))
+	ps, err := FindPayments(ctx, s.store, f)
+	span.SetAttributes(attribute.Int("payment.count", len(ps)))
+	endSpan(span, err)
+	return ps, err
+}
+
+func (s *tracedStore) PagePaymentsContext(ctx context.Context, after string, limit int) ([]Payment, error) {
+	ctx, span := s.start(ctx, "PagePayments", "")
+	span.SetAttributes(attribute.String("payment.after", after), attribute.Int("payment.limit", limit))
+	ps, err := PagePayments(ctx, s.store, after, limit)
+	span.SetAttributes(attribute.Int("payment.count", len(ps)))
+	endSpan(span, err)
+	return ps, err
+}
+
+func (s *tracedStore) CheckHealth(ctx context.Context) error {
+	ctx, span := s.start(ctx, "CheckHealth", "")
+	err := CheckStoreHealth(ctx, s.store)
+	endSpan(span, err)
+	return err
+}
+
+// Traces the whole transaction, from BeginContext to Commit or Rollback, as a single span
+func (s *tracedStore) BeginContext(ctx context.Context) (Tx, error) {
+	ctx, span := s.start(ctx, "Tx", "")
+	tx, err := s.store.BeginContext(ctx)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracedTx{tx, span}, nil
+}
+
+// Transaction of a tracedStore, ending the transaction's span when committed or rolled back
+type tracedTx struct {
+	Tx
+	span trace.Span
+}
+
+func (tx *tracedTx) Commit() error {
+	err := tx.Tx.Commit()
+	tx.span.SetAttributes(attribute.String("tx.outcome", "commit"))
+	endSpan(tx.span, err)
+	return err
+}
+
+func (tx *tracedTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	tx.span.SetAttributes(attribute.String("tx.outcome", "rollback"))
+	endSpan(tx.span, err)
+	return err
+}
@@ -0,0 +1,144 @@
+package f3api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tests that a PUT request is traced from the server middleware down to the store,
+// continuing the trace of the caller
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	handler, err := MakeHandler(NewGenericApi(TraceStore(NewInMemStore())), ServerConfig{Metrics: NewMetrics(), TracerProvider: tp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	payment := defaultPayment()
+	body, err := json.Marshal(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	request, err := http.NewRequest("PUT", server.URL+"/payments/"+payment.ID, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if tp := resp.Header.Get("traceparent"); !strings.Contains(tp, traceID) {
+		t.Fatalf("Expected the response traceparent to continue trace %s, got %q", traceID, tp)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	root, ok := spans["PUT /payments/:id"]
+	if !ok {
+		t.Fatalf("Missing request span, got %v", spans)
+	}
+	if root.SpanContext().TraceID().String() != traceID {
+		t.Fatalf("Request span did not continue the caller's trace")
+	}
+
+	for _, name := range []string{"DecodePayment", "ApiStore.StorePayment"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("Missing span %s, got %v", name, spans)
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Fatalf("Span %s is not a child of the request span", name)
+		}
+	}
+}
+
+// Tests that the file exporter writes spans to the configured file
+func TestNewTracerProviderFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+
+	tp, shutdown, err := NewTracerProvider("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, parent := tp.Tracer(tracerName).Start(t.Context(), "parent")
+	_, span := tp.Tracer(tracerName).Start(ctx, "test-span", trace.WithAttributes(attribute.Int("count", 3)))
+	span.SetStatus(codes.Error, "failed")
+	span.End()
+	parent.End()
+	if err := shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected an export request per span, got %s", buf)
+	}
+
+	// the OTLP/JSON encoding of the first span, without its timestamps
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Scope struct{ Name string }
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &req); err != nil {
+		t.Fatal(err)
+	}
+	got := req.ResourceSpans[0].ScopeSpans[0]
+	s := got.Spans[0]
+	expected := map[string]interface{}{
+		"traceId":      parent.SpanContext().TraceID().String(),
+		"spanId":       span.SpanContext().SpanID().String(),
+		"parentSpanId": parent.SpanContext().SpanID().String(),
+		"flags":        float64(1),
+		"name":         "test-span",
+		"kind":         float64(1),
+		"attributes":   []interface{}{map[string]interface{}{"key": "count", "value": map[string]interface{}{"intValue": "3"}}},
+		"status":       map[string]interface{}{"code": float64(2), "message": "failed"},
+	}
+	if _, ok := s["startTimeUnixNano"].(string); !ok {
+		t.Fatalf("Expected the start time as a string, got %v", s["startTimeUnixNano"])
+	}
+	delete(s, "startTimeUnixNano")
+	delete(s, "endTimeUnixNano")
+	if got.Scope.Name != tracerName || !reflect.DeepEqual(s, expected) {
+		t.Fatalf("Unexpected span %s", lines[0])
+	}
+
+	if _, _, err := NewTracerProvider("carrier-pigeon"); err == nil {
+		t.Fatal("Expected an error for an unknown exporter")
+	}
+}
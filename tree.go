@@ -0,0 +1,204 @@
+package f3api
+
+import (
+	"hash/maphash"
+)
+
+// Payments of a shard of an InMemStore, ordered by ID
+//
+// The tree is a treap, balanced by priorities derived from a hash of the IDs. Its nodes are
+// immutable once shared: copying the tree (as snapshots do) shares every node, and writes to a tree
+// whose nodes may be shared copy the O(log n) nodes on the path they change instead, see own.
+// Nodes created since the tree was last shared are changed in place.
+type paymentTree struct {
+	root *treeNode
+	size int
+	// generation of the nodes the tree may change in place, see share
+	gen uint64
+}
+
+// A node of a paymentTree
+type treeNode struct {
+	id       string
+	payment  *Payment
+	priority uint64
+	left     *treeNode
+	right    *treeNode
+	gen      uint64
+}
+
+// Seed of the priorities of the nodes
+var treeSeed = maphash.MakeSeed()
+
+// Stops the tree from changing its current nodes in place, as a copy of it now shares them
+// The caller must hold the write lock of the tree.
+func (t *paymentTree) share() {
+	t.gen++
+}
+
+// Returns a node the tree may change in place: the node itself if it was created since the tree
+// was last shared, and otherwise a copy of it
+func (t *paymentTree) own(n *treeNode) *treeNode {
+	if n.gen == t.gen {
+		return n
+	}
+	c := *n
+	c.gen = t.gen
+	return &c
+}
+
+// Fetches a payment
+func (t *paymentTree) get(id string) (*Payment, bool) {
+	n := t.root
+	for n != nil {
+		switch {
+		case id < n.id:
+			n = n.left
+		case id > n.id:
+			n = n.right
+		default:
+			return n.payment, true
+		}
+	}
+	return nil, false
+}
+
+// Stores a payment, replacing any payment with the same ID, and returns the replaced one
+func (t *paymentTree) put(p Payment) (*Payment, bool) {
+	var old *Payment
+	t.root, old = t.insert(t.root, &p, maphash.String(treeSeed, p.ID))
+	if old == nil {
+		t.size++
+	}
+	return old, old != nil
+}
+
+// Inserts a payment into the subtree rooted at n, and returns the new root of the subtree along
+// with the replaced payment, if any
+func (t *paymentTree) insert(n *treeNode, p *Payment, priority uint64) (*treeNode, *Payment) {
+	if n == nil {
+		return &treeNode{id: p.ID, payment: p, priority: priority, gen: t.gen}, nil
+	}
+
+	var old *Payment
+	n = t.own(n)
+	switch {
+	case p.ID < n.id:
+		n.left, old = t.insert(n.left, p, priority)
+		if n.left.priority > n.priority {
+			// rotate right; the left child was just owned or created
+			l := n.left
+			n.left, l.right = l.right, n
+			n = l
+		}
+	case p.ID > n.id:
+		n.right, old = t.insert(n.right, p, priority)
+		if n.right.priority > n.priority {
+			r := n.right
+			n.right, r.left = r.left, n
+			n = r
+		}
+	default:
+		old, n.payment = n.payment, p
+	}
+	return n, old
+}
+
+// Deletes a payment, and returns it if it existed
+func (t *paymentTree) delete(id string) (*Payment, bool) {
+	var old *Payment
+	t.root, old = t.remove(t.root, id)
+	if old != nil {
+		t.size--
+	}
+	return old, old != nil
+}
+
+// Removes a payment from the subtree rooted at n, and returns the new root of the subtree along
+// with the removed payment, if any; nodes are only copied if the payment is found
+func (t *paymentTree) remove(n *treeNode, id string) (*treeNode, *Payment) {
+	if n == nil {
+		return nil, nil
+	}
+
+	switch {
+	case id < n.id:
+		left, old := t.remove(n.left, id)
+		if old == nil {
+			return n, nil
+		}
+		n = t.own(n)
+		n.left = left
+		return n, old
+	case id > n.id:
+		right, old := t.remove(n.right, id)
+		if old == nil {
+			return n, nil
+		}
+		n = t.own(n)
+		n.right = right
+		return n, old
+	}
+	return t.merge(n.left, n.right), n.payment
+}
+
+// Joins two subtrees, all of whose IDs in a are below those in b
+func (t *paymentTree) merge(a, b *treeNode) *treeNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.priority > b.priority:
+		a = t.own(a)
+		a.right = t.merge(a.right, b)
+		return a
+	}
+	b = t.own(b)
+	b.left = t.merge(a, b.left)
+	return b
+}
+
+// Iterates over the payments of a tree in order of their IDs
+// Iterating over a tree which is changed meanwhile is only safe on a copy taken before the last
+// call to share.
+type treeIter struct {
+	// the nodes left to visit before their right subtrees, innermost last
+	stack []*treeNode
+}
+
+// Starts iterating over the payments with IDs after the given one, or over every payment if it is
+// empty
+func (t *paymentTree) iter(after string) *treeIter {
+	it := treeIter{}
+	for n := t.root; n != nil; {
+		if after == "" || n.id > after {
+			it.stack = append(it.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return &it
+}
+
+// The next payment, if there is one
+func (it *treeIter) next() (*Payment, bool) {
+	if len(it.stack) == 0 {
+		return nil, false
+	}
+	n := it.stack[len(it.stack)-1]
+	it.stack = it.stack[:len(it.stack)-1]
+	for c := n.right; c != nil; c = c.left {
+		it.stack = append(it.stack, c)
+	}
+	return n.payment, true
+}
+
+// The ID of the next payment, without moving past it
+func (it *treeIter) peek() (string, bool) {
+	if len(it.stack) == 0 {
+		return "", false
+	}
+	return it.stack[len(it.stack)-1].id, true
+}
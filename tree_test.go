@@ -0,0 +1,110 @@
+package f3api
+
+import (
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// The IDs of a tree, in the order it iterates over them
+func treeIDs(t paymentTree, after string) []string {
+	var ids []string
+	it := t.iter(after)
+	for p, ok := it.next(); ok; p, ok = it.next() {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+// Tests that a tree behaves like a map, and keeps its payments in order
+func TestPaymentTree(t *testing.T) {
+	var tree paymentTree
+	m := make(map[string]int)
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 5000; i++ {
+		id := strconv.Itoa(rnd.Intn(1000))
+		if i%3 == 0 {
+			_, ok := tree.delete(id)
+			if _, exists := m[id]; ok != exists {
+				t.Fatalf("Deleting %s: got %v, expected %v", id, ok, exists)
+			}
+			delete(m, id)
+			continue
+		}
+
+		p := defaultPayment()
+		p.ID = id
+		p.Version = i
+		old, ok := tree.put(p)
+		if version, exists := m[id]; ok != exists || ok && old.Version != version {
+			t.Fatalf("Putting %s: got %v, expected %v", id, old, exists)
+		}
+		m[id] = i
+	}
+
+	if tree.size != len(m) {
+		t.Fatalf("Expected %d payments, got %d", len(m), tree.size)
+	}
+	for id, version := range m {
+		if p, ok := tree.get(id); !ok || p.Version != version {
+			t.Fatalf("Unexpected payment %s: %v", id, p)
+		}
+	}
+
+	var ids []string
+	for id := range m {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	if got := treeIDs(tree, ""); !slices.Equal(got, ids) {
+		t.Fatalf("Expected IDs %v, got %v", ids, got)
+	}
+	if got := treeIDs(tree, ids[10]); !slices.Equal(got, ids[11:]) {
+		t.Fatalf("Expected IDs %v, got %v", ids[11:], got)
+	}
+	if _, ok := tree.iter(ids[len(ids)-1]).next(); ok {
+		t.Fatal("Expected nothing after the last ID")
+	}
+}
+
+// Tests that copies of a shared tree don't see its later writes
+func TestPaymentTreeShare(t *testing.T) {
+	var tree paymentTree
+	for i := 0; i < 100; i++ {
+		p := defaultPayment()
+		p.ID = strconv.Itoa(i)
+		tree.put(p)
+	}
+
+	snap := tree
+	before := treeIDs(snap, "")
+	tree.share()
+
+	for i := 0; i < 100; i += 2 {
+		tree.delete(strconv.Itoa(i))
+	}
+	for i := 100; i < 150; i++ {
+		p := defaultPayment()
+		p.ID = strconv.Itoa(i)
+		tree.put(p)
+	}
+	p := defaultPayment()
+	p.ID = "1"
+	p.Version = 7
+	tree.put(p)
+
+	if snap.size != 100 || !slices.Equal(treeIDs(snap, ""), before) {
+		t.Fatalf("Expected the copy to keep its payments, got %v", treeIDs(snap, ""))
+	}
+	if p, _ := snap.get("1"); p.Version != 0 {
+		t.Fatalf("Expected the copy to keep version 0, got %d", p.Version)
+	}
+	if tree.size != 100 {
+		t.Fatalf("Expected 100 payments, got %d", tree.size)
+	}
+	if p, _ := tree.get("1"); p.Version != 7 {
+		t.Fatalf("Expected version 7, got %d", p.Version)
+	}
+}
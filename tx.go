@@ -0,0 +1,158 @@
+package f3api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// A transaction on an ApiStore, obtained from ApiStore.Begin
+//
+// Writes are staged in the transaction and checked against the store (plus earlier staged writes)
+// as they are made. Reads through the transaction see its own staged writes, nobody else does until
+// Commit applies all of them atomically. Stores may also refuse to commit with ErrTxConflict if a
+// payment read through the transaction was changed since. A Tx is not meant for concurrent use.
+type Tx interface {
+	// Stage adding a payment
+	// Precondition: The payment must not exist
+	AddPayment(Payment) error
+
+	// Stage updating an existing payment
+	// Precondition: The payment must already exist
+	UpdatePayment(Payment) error
+
+	// Stage creating or updating a payment
+	StorePayment(Payment) error
+
+	// Stage deleting a payment
+	// Precondition: A payment with the resource ID already exist
+	DeletePayment(id string) error
+
+	// Fetch a specific payment, as seen by the transaction
+	GetPayment(id string) (Payment, error)
+
+	// Apply all staged writes atomically
+	// If a precondition no longer holds, nothing is applied and a *BatchError is returned
+	Commit() error
+
+	// Discard all staged writes
+	Rollback() error
+}
+
+// Returned when using a transaction after it has been committed or rolled back
+var ErrTxDone = errors.New("Transaction has already been committed or rolled back")
+
+// Returned by Tx.Commit when a payment read through the transaction was changed before it committed
+var ErrTxConflict = errors.New("Payment read by the transaction was changed before it committed")
+
+// Kind of write operation in a batch
+type BatchOpKind int
+
+const (
+	// Add a payment, like ApiStore.AddPayment
+	BatchAdd BatchOpKind = iota
+	// Update a payment, like ApiStore.UpdatePayment
+	BatchUpdate
+	// Create or update a payment, like ApiStore.StorePayment
+	BatchStore
+	// Delete a payment, like ApiStore.DeletePayment; only the ID of the payment is used
+	BatchDelete
+)
+
+// A single write operation in a batch
+type BatchOp struct {
+	Kind    BatchOpKind
+	Payment Payment
+}
+
+// Returned by ApplyBatch and Tx.Commit when one of the operations failed
+type BatchError struct {
+	// Position of the failing operation in the batch
+	Index int
+	Err   error
+}
+
+// Formats the batch error with the position of the failing operation
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch operation %d: %v", e.Index, e.Err)
+}
+
+// Unwraps the error of the failing operation
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Applies a list of write operations atomically, through a transaction on the store
+// Either all of the operations succeed, or none of them are applied and a *BatchError is returned
+func ApplyBatch(store ApiStore, ops []BatchOp) error {
+	return ApplyBatchContext(context.Background(), ContextStoreOf(store), ops)
+}
+
+// Applies a list of write operations atomically, like ApplyBatch, within the given context
+func ApplyBatchContext(ctx context.Context, store ContextStore, ops []BatchOp) error {
+	tx, err := store.BeginContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i, op := range ops {
+		if err := stageOn(tx, op); err != nil {
+			tx.Rollback()
+			return &BatchError{i, err}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Stages a batch operation on a transaction
+func stageOn(tx Tx, op BatchOp) error {
+	switch op.Kind {
+	case BatchAdd:
+		return tx.AddPayment(op.Payment)
+	case BatchUpdate:
+		return tx.UpdatePayment(op.Payment)
+	case BatchStore:
+		return tx.StorePayment(op.Payment)
+	case BatchDelete:
+		return tx.DeletePayment(op.Payment.ID)
+	}
+	return fmt.Errorf("Unknown batch operation %d", op.Kind)
+}
+
+// Checks the precondition of a write operation, and records its outcome in staged (nil meaning deleted)
+// The exists function reports whether a payment exists outside of the staged writes.
+// Meant for ApiStore implementations that stage writes in memory.
+func stageBatchOp(staged map[string]*Payment, exists func(id string) bool, op BatchOp) error {
+	p := op.Payment
+
+	found, ok := staged[p.ID]
+	if ok {
+		ok = found != nil
+	} else {
+		ok = exists(p.ID)
+	}
+
+	switch op.Kind {
+	case BatchAdd:
+		if ok {
+			return ErrPaymentExists
+		}
+	case BatchUpdate:
+		if !ok {
+			return fmt.Errorf("Cannot update resource %v: %w", p.ID, ErrPaymentNotFound)
+		}
+	case BatchStore:
+	case BatchDelete:
+		if !ok {
+			return fmt.Errorf("Cannot delete resource %v: %w", p.ID, ErrPaymentNotFound)
+		}
+		staged[p.ID] = nil
+		return nil
+	default:
+		return fmt.Errorf("Unknown batch operation %d", op.Kind)
+	}
+
+	staged[p.ID] = &p
+	return nil
+}
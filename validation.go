@@ -0,0 +1,51 @@
+package f3api
+
+import (
+	"fmt"
+)
+
+// Describes why a payment resource was rejected, and which field was at fault
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+// Formats the validation error as "field: reason"
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// Checks that a payment resource is acceptable for storage.
+// Only structural checks are made here; the field semantics are still largely undocumented.
+func ValidatePayment(p Payment) error {
+	if p.ID == "" {
+		return ValidationError{"id", "must not be empty"}
+	}
+
+	if p.Type != "Payment" {
+		return ValidationError{"type", fmt.Sprintf("expected \"Payment\", got %q", p.Type)}
+	}
+
+	if !isCurrencyCode(p.Attributes.Currency) {
+		return ValidationError{"attributes.currency", fmt.Sprintf("%q is not an ISO 4217 currency code", p.Attributes.Currency)}
+	}
+
+	if p.Attributes.Amount < 0 {
+		return ValidationError{"attributes.amount", "must not be negative"}
+	}
+
+	return nil
+}
+
+// Reports whether s looks like an ISO 4217 currency code (three upper case letters)
+func isCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}